@@ -1,13 +1,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
 	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
@@ -30,12 +33,16 @@ const LOG_FILE_NAME = "data/bumble.log"
 
 // [BTREE]
 // Listens for SIGINT or SIGTERM and calls table.CloseDB().
-func setupCloseHandler(database *db.Database) {
-	c := make(chan os.Signal)
+// Stops the metrics server first, if one is running.
+func setupCloseHandler(database *db.Database, metricsServer *http.Server) {
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		fmt.Println("closehandler invoked")
+		if metricsServer != nil {
+			stopMetricsServer(metricsServer)
+		}
 		database.Close()
 		os.Exit(0)
 	}()
@@ -47,9 +54,24 @@ func startServer(repl *repl.REPL, tm *concurrency.TransactionManager, prompt str
 	// Handle a connection by running the repl on it.
 	handleConn := func(c net.Conn) {
 		clientId := uuid.New()
+		atomic.AddInt64(&activeConnections, 1)
+		defer atomic.AddInt64(&activeConnections, -1)
 		defer c.Close()
 		if tm != nil {
-			defer tm.Commit(clientId)
+			// Abort any subtransactions the client left open, then commit its own transaction.
+			defer func() {
+				for {
+					childId, found := tm.GetOpenNested(clientId)
+					if !found {
+						break
+					}
+					if err := tm.AbortNested(childId); err != nil {
+						log.Printf("aborting nested transaction for %v: %v", clientId, err)
+						break
+					}
+				}
+				tm.Commit(clientId)
+			}()
 		}
 		repl.Run(c, clientId, prompt)
 	}
@@ -77,18 +99,32 @@ func main() {
 	// Set up flags.
 	var promptFlag = flag.Bool("c", true, "use prompt?")
 	var projectFlag = flag.String("project", "", "choose project: [go,pager,db,query,concurrency,recovery] (required)")
+	var typedFlag = flag.Bool("typed", false, "store numeric list values as integers (go project)")
 
 	// [BTREE]
 	var dbFlag = flag.String("db", "data/", "DB folder")
+	var breakLockFlag = flag.Bool("break-stale-lock", false, "remove the DB folder's lock if the process holding it is gone")
 
 	// [CONCURRENCY]
 	var portFlag = flag.Int("p", DEFAULT_PORT, "port number")
+	var metricsPortFlag = flag.Int("metrics-port", 0, "serve JSON metrics at /metrics on this port (0 disables)")
+	var verifyRecoveryFlag = flag.Bool("verify-recovery", false, "check that recovery leaves no transactions or locks behind (recovery project)")
 
 	flag.Parse()
 
 	// [BTREE]
-	// Open the db.
+	// Open the db, first removing a lock left behind by a crash if asked to.
+	if *breakLockFlag {
+		if err := db.BreakStaleLock(*dbFlag); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 	database, err := db.Open(*dbFlag)
+	if errors.Is(err, db.ErrDatabaseLocked) {
+		fmt.Printf("%v; if that process is gone, rerun with -break-stale-lock\n", err)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -103,7 +139,6 @@ func main() {
 	// [BTREE]
 	// Setup close conditions.
 	defer database.Close()
-	setupCloseHandler(database)
 
 	// Set up REPL resources.
 	prompt := config.GetPrompt(*promptFlag)
@@ -120,7 +155,11 @@ func main() {
 	switch *projectFlag {
 	case "go":
 		l := list.NewList()
-		repls = append(repls, list.ListRepl(l))
+		if *typedFlag {
+			repls = append(repls, list.TypedListRepl(l))
+		} else {
+			repls = append(repls, list.ListRepl(l))
+		}
 
 	// [PAGER]
 	case "pager":
@@ -161,7 +200,11 @@ func main() {
 		}
 		repls = append(repls, recovery.RecoveryREPL(database, tm, rm))
 		// Recover in this case!
-		rm.Recover()
+		rm.SetDebug(*verifyRecoveryFlag)
+		if err = rm.Recover(); err != nil && *verifyRecoveryFlag {
+			fmt.Println(err)
+			return
+		}
 
 	default:
 		fmt.Println("must specify -project [go,pager,db,query,concurrency,recovery]")
@@ -175,6 +218,17 @@ func main() {
 		return
 	}
 
+	// Start the metrics server if requested.
+	var metricsServer *http.Server
+	if *metricsPortFlag != 0 {
+		metricsServer = startMetricsServer(database, tm, *metricsPortFlag)
+		defer stopMetricsServer(metricsServer)
+	}
+
+	// [BTREE]
+	// Setup close conditions.
+	setupCloseHandler(database, metricsServer)
+
 	// Start server if server (concurrency or recovery), else run REPL here.
 	if server {
 		// 	[CONCURRENCY]
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+)
+
+// Number of open client connections; accessed atomically.
+var activeConnections int64
+
+// Per-table statistics reported at /metrics, from the table's pager.
+type tableMetrics struct {
+	NumPages   int64 `json:"num_pages"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Evictions  int64 `json:"evictions"`
+	Flushes    int64 `json:"flushes"`
+	Prefetches int64 `json:"prefetches"`
+}
+
+// Statistics reported at /metrics.
+type serverMetrics struct {
+	Connections     int64                   `json:"connections"`
+	Transactions    int                     `json:"transactions"`
+	Deadlocks       int64                   `json:"deadlocks"`
+	RecentDeadlocks int                     `json:"recent_deadlocks"` // Within concurrency.RECENT_DEADLOCK_WINDOW.
+	Tables          map[string]tableMetrics `json:"tables"`
+}
+
+// Collect the current server statistics. tm may be nil.
+func collectMetrics(database *db.Database, tm *concurrency.TransactionManager) serverMetrics {
+	m := serverMetrics{
+		Connections: atomic.LoadInt64(&activeConnections),
+		Tables:      make(map[string]tableMetrics),
+	}
+	if tm != nil {
+		m.Transactions = tm.NumTransactions()
+		m.Deadlocks = tm.NumDeadlocks()
+		m.RecentDeadlocks = tm.NumRecentDeadlocks()
+	}
+	// GetTables is a snapshot, so clients may create tables meanwhile.
+	for name, table := range database.GetTables() {
+		stats := table.GetPager().Stats()
+		m.Tables[name] = tableMetrics{
+			NumPages:   table.GetPager().GetNumPages(),
+			Hits:       stats.Hits,
+			Misses:     stats.Misses,
+			Evictions:  stats.Evictions,
+			Flushes:    stats.Flushes,
+			Prefetches: stats.Prefetches,
+		}
+	}
+	return m
+}
+
+// Start serving metrics as JSON at /metrics on the given port.
+func startMetricsServer(database *db.Database, tm *concurrency.TransactionManager, port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collectMetrics(database, tm))
+	})
+	srv := &http.Server{Addr: fmt.Sprintf(":%v", port), Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Print(err)
+		}
+	}()
+	fmt.Printf("metrics server started listening on localhost:%v\n", port)
+	return srv
+}
+
+// Stop the metrics server, waiting briefly for in-flight requests.
+func stopMetricsServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
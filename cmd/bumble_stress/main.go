@@ -11,9 +11,7 @@ import (
 	"syscall"
 	"time"
 
-	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
-	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 
 	uuid "github.com/google/uuid"
 )
@@ -23,7 +21,7 @@ var MAX_DELAY int64 = 10
 
 // Listens for SIGINT or SIGTERM and calls table.CloseDB().
 func setupCloseHandler(database *db.Database) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -135,13 +133,13 @@ func main() {
 			fmt.Println("error getting table t")
 			return
 		}
-		switch *indexFlag {
-		case "btree":
-			index := index.(*btree.BTreeIndex)
-			btree.IsBTree(index)
-		case "hash":
-			index := index.(*hash.HashIndex)
-			hash.IsHash(index)
+		indexType := db.BTreeIndexType
+		if *indexFlag == "hash" {
+			indexType = db.HashIndexType
+		}
+		if err = db.VerifyIndex(index, indexType); err != nil {
+			fmt.Printf("error verifying table t: %v\n", err)
+			return
 		}
 	}
 }
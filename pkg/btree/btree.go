@@ -2,38 +2,227 @@ package btree
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"sync"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
+// SplitPolicy determines where a full node is split.
+type SplitPolicy int
+
+const (
+	MEDIAN_SPLIT       SplitPolicy = 0 // Split full nodes down the middle.
+	RIGHT_BIASED_SPLIT SplitPolicy = 1 // Keep the left node full when appending.
+)
+
 // Tables are an abstraction over the entries stored in our database.
 type BTreeIndex struct {
-	pager  *pager.Pager // The page handler to read from files.
-	rootPN int64        // The root page number.
+	pager       *pager.Pager        // The page handler to read from files.
+	rootPN      int64               // The root page number.
+	splitPolicy SplitPolicy         // Where full nodes are split.
+	deleteMode  utils.DeleteMode    // How Delete removes entries.
+	numValues   int64               // Number of values in each entry.
+	vacuum      utils.VacuumTracker // When Delete compacts the table.
+	multi       bool                // Whether keys may repeat.
+	batchMtx    sync.Mutex          // Applies write batches one at a time.
 }
 
 // OpenTable returns a table associated with the given database filename.
 func OpenTable(filename string) (table *BTreeIndex, err error) {
+	return OpenTableWithPolicy(filename, MEDIAN_SPLIT)
+}
+
+// OpenTableWithPolicy returns a table associated with the given database filename
+// that splits full nodes according to the given policy.
+// The policy is not persisted; reopening the table picks a policy afresh.
+func OpenTableWithPolicy(filename string, policy SplitPolicy) (table *BTreeIndex, err error) {
+	return openTable(filename, policy, 0)
+}
+
+// OpenTableWithValues returns a table associated with the given database filename
+// whose entries each store numValues values. The number of values is persisted;
+// opening an existing table with a different number is an error.
+func OpenTableWithValues(filename string, numValues int64) (table *BTreeIndex, err error) {
+	if err = utils.CheckNumValues(numValues); err != nil {
+		return nil, err
+	}
+	return openTable(filename, MEDIAN_SPLIT, numValues)
+}
+
+// OpenTableMulti returns a table associated with the given database filename in which
+// a key may hold several entries, kept adjacent and ordered by value ascending; only an
+// entry with the same key and value is a duplicate. Entries can't be updated in place.
+// The mode is not persisted; reopen such a table with OpenTableMulti.
+func OpenTableMulti(filename string) (table *BTreeIndex, err error) {
+	table, err = openTable(filename, MEDIAN_SPLIT, 0)
+	if err != nil {
+		return nil, err
+	}
+	table.multi = true
+	return table, nil
+}
+
+// openTable opens the table at filename, creating it with numValues values per entry
+// if it is new. A numValues of 0 accepts whatever an existing table stores, and
+// creates single-value tables.
+func openTable(filename string, policy SplitPolicy, numValues int64) (table *BTreeIndex, err error) {
 	// Create a pager for the table
 	pager := pager.NewPager()
 	err = pager.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	return newTable(pager, policy, numValues)
+}
+
+// NewMemoryTable returns an empty table whose entries each store numValues values, kept
+// in the buffer pool without a backing file. It holds at most pager.MAXPAGES pages;
+// inserts that need more fail. Closing it discards its entries, and it has no name.
+func NewMemoryTable(policy SplitPolicy, numValues int64) (table *BTreeIndex, err error) {
+	if err = utils.CheckNumValues(numValues); err != nil {
+		return nil, err
+	}
+	return newTable(pager.NewPager(), policy, numValues)
+}
+
+// BulkLoad creates a table at the given filename, which must not exist yet, holding the
+// given entries, which must be sorted by key without duplicates. Rather than inserting
+// them one at a time, it packs the entries into leaves, then builds the internal levels
+// bottom-up, so that every node is at least half full and most are nearly full.
+// Entries store as many values as the first; no entries gives an empty single-value table.
+func BulkLoad(filename string, entries []utils.Entry) (table *BTreeIndex, err error) {
+	if _, err := os.Stat(filename); err == nil {
+		return nil, errors.New("bulk load target already exists")
+	}
+	numValues := int64(1)
+	if len(entries) > 0 {
+		numValues = int64(len(entries[0].Values()))
+	}
+	if err = utils.CheckNumValues(numValues); err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if err = utils.CheckValues(entry.Values(), numValues); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			continue
+		}
+		if prev := entries[i-1].GetKey(); entry.GetKey() == prev {
+			return nil, fmt.Errorf("cannot bulk load duplicate key %v", prev)
+		} else if entry.GetKey() < prev {
+			return nil, fmt.Errorf("cannot bulk load unsorted keys: %v follows %v", entry.GetKey(), prev)
+		}
+	}
+	table, err = openTable(filename, MEDIAN_SPLIT, numValues)
+	if err != nil {
+		return nil, err
+	}
+	if err = table.bulkLoad(entries); err != nil {
+		table.pager.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+	return table, nil
+}
+
+// bulkLoad fills the new, empty table with the given sorted entries.
+func (table *BTreeIndex) bulkLoad(entries []utils.Entry) error {
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	defer rootPage.Put()
+	maxEntries := EntriesPerLeafNode(table.numValues)
+	if int64(len(entries)) <= maxEntries {
+		// Everything fits in the root leaf.
+		fillLeaf(pageToLeafNode(rootPage), entries)
+		return nil
+	}
+	// Fill the leaves left to right, linking each to the one before. Keep the first key of
+	// each node, which separates it from the node before in the level above.
+	pns, keys := make([]int64, 0), make([]int64, 0)
+	var prev *LeafNode
+	for _, size := range evenSizes(int64(len(entries)), maxEntries) {
+		leaf, err := createLeafNode(table.pager, table.numValues)
+		if err != nil {
+			if prev != nil {
+				prev.page.Put()
+			}
+			return err
+		}
+		fillLeaf(leaf, entries[:size])
+		if prev != nil {
+			prev.setRightSibling(leaf.page.GetPageNum())
+			leaf.setLeftSibling(prev.page.GetPageNum())
+			prev.page.Put()
+		}
+		prev = leaf
+		pns = append(pns, leaf.page.GetPageNum())
+		keys = append(keys, entries[0].GetKey())
+		entries = entries[size:]
+	}
+	prev.page.Put()
+	// Build internal levels until a single node, the root, can hold every child.
+	for int64(len(pns)) > KEYS_PER_INTERNAL_NODE+1 {
+		levelPNs, levelKeys := make([]int64, 0), make([]int64, 0)
+		for _, size := range evenSizes(int64(len(pns)), KEYS_PER_INTERNAL_NODE+1) {
+			node, err := createInternalNode(table.pager)
+			if err != nil {
+				return err
+			}
+			node.fillChildren(pns[:size], keys[:size])
+			node.page.Put()
+			levelPNs = append(levelPNs, node.page.GetPageNum())
+			levelKeys = append(levelKeys, keys[0])
+			pns, keys = pns[size:], keys[size:]
+		}
+		pns, keys = levelPNs, levelKeys
+	}
+	initPage(rootPage, INTERNAL_NODE)
+	pageToInternalNode(rootPage).fillChildren(pns, keys)
+	return nil
+}
+
+// newTable wraps an index around the given pager, initializing the pager if it is new.
+func newTable(pager *pager.Pager, policy SplitPolicy, numValues int64) (table *BTreeIndex, err error) {
+	table = &BTreeIndex{pager: pager, rootPN: ROOT_PN, splitPolicy: policy}
 	// Initialize the pager if it's new.
 	if pager.GetNumPages() == 0 {
+		if numValues == 0 {
+			numValues = 1
+		}
 		rootPage, err := pager.GetPage(ROOT_PN)
 		if err != nil {
 			return nil, err
 		}
 		defer rootPage.Put()
-		initPage(rootPage, LEAF_NODE)
+		initLeafPage(rootPage, numValues)
 		rootNode := pageToLeafNode(rootPage)
-		rootNode.setRightSibling(-1)
+		rootNode.setRightSibling(NO_SIBLING_PN)
+		rootNode.setLeftSibling(NO_SIBLING_PN)
+		table.numValues = numValues
+		return table, nil
+	}
+	// Else, every leaf records the number of values; read it off the leftmost one.
+	leftmostNode, err := table.descend(func(node *InternalNode) int64 {
+		return 0
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &BTreeIndex{pager: pager, rootPN: ROOT_PN}, nil
+	table.numValues = leftmostNode.numValues
+	releaseLeaf(leftmostNode)
+	if numValues != 0 && numValues != table.numValues {
+		pager.Close()
+		return nil, fmt.Errorf("table stores %v values per entry, not %v", table.numValues, numValues)
+	}
+	return table, nil
 }
 
 // Get this index's filename.
@@ -46,14 +235,167 @@ func (table *BTreeIndex) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get this index's split policy.
+func (table *BTreeIndex) GetSplitPolicy() SplitPolicy {
+	return table.splitPolicy
+}
+
+// Get the number of values in each of this index's entries.
+func (table *BTreeIndex) GetNumValues() int64 {
+	return table.numValues
+}
+
+// Get this index's delete mode.
+func (table *BTreeIndex) GetDeleteMode() utils.DeleteMode {
+	return table.deleteMode
+}
+
+// Set how Delete removes entries; see utils.DeleteMode. Not persisted.
+// Should not be called while other operations are running on the table.
+func (table *BTreeIndex) SetDeleteMode(mode utils.DeleteMode) {
+	table.deleteMode = mode
+}
+
+// Compact physically removes entries deleted in place, one leaf at a time.
+// Cursors parked on a leaf while it is compacted may skip entries.
+// Returns the number of entries removed.
+func (table *BTreeIndex) Compact() (int64, error) {
+	leftmostNode, err := table.descend(func(node *InternalNode) int64 {
+		return 0
+	})
+	if err != nil {
+		return 0, err
+	}
+	curPN := leftmostNode.page.GetPageNum()
+	releaseLeaf(leftmostNode)
+	removed := int64(0)
+	for {
+		page, err := table.pager.GetPage(curPN)
+		if err != nil {
+			return removed, err
+		}
+		page.WLock()
+		leaf := pageToLeafNode(page)
+		removed += leaf.compact()
+		hasNext := leaf.hasRightSibling()
+		curPN = leaf.rightSiblingPN
+		page.WUnlock()
+		page.Put()
+		if !hasNext {
+			return removed, nil
+		}
+	}
+}
+
+// Fragmentation returns the fraction of occupied entry slots that hold entries deleted
+// in place, which Compact would reclaim. Returns 0 for an empty table.
+func (table *BTreeIndex) Fragmentation() float64 {
+	occupied, dead := int64(0), int64(0)
+	err := table.forEachLeaf(func(leaf *LeafNode) {
+		occupied += leaf.numKeys
+		for i := int64(0); i < leaf.numKeys; i++ {
+			if leaf.isTombstone(i) {
+				dead++
+			}
+		}
+	})
+	if err != nil || occupied == 0 {
+		return 0
+	}
+	return float64(dead) / float64(occupied)
+}
+
+// forEachLeaf calls fn on every leaf, from left to right, following the sibling pointers.
+// Like a cursor, it read-latches the next leaf before letting go of the last.
+func (table *BTreeIndex) forEachLeaf(fn func(*LeafNode)) error {
+	leaf, err := table.descend(func(node *InternalNode) int64 {
+		return 0
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		fn(leaf)
+		if !leaf.hasRightSibling() {
+			releaseLeaf(leaf)
+			return nil
+		}
+		nextPage, err := table.pager.GetPage(leaf.rightSiblingPN)
+		if err != nil {
+			releaseLeaf(leaf)
+			return err
+		}
+		nextPage.RLock()
+		releaseLeaf(leaf)
+		leaf = pageToLeafNode(nextPage)
+	}
+}
+
+// AutoVacuum makes Delete compact the table once its Fragmentation reaches threshold,
+// checking every utils.AUTO_VACUUM_INTERVAL deletes in place; 0 turns it off. Not persisted.
+// Compaction waits for scans bracketed by BeginScan and EndScan, including Select.
+// It never changes which entries the table holds, so transactions are unaffected.
+func (table *BTreeIndex) AutoVacuum(threshold float64) {
+	table.vacuum.SetThreshold(threshold)
+}
+
+// BeginScan holds off auto-vacuum until the matching EndScan; cursor users should bracket
+// their scans with them.
+func (table *BTreeIndex) BeginScan() {
+	table.vacuum.BeginScan()
+}
+
+// EndScan ends a scan, running any auto-vacuum that fell due during it.
+func (table *BTreeIndex) EndScan() {
+	if table.vacuum.EndScan() {
+		table.vacuumIfFragmented()
+	}
+}
+
+// BeginBatch waits for any write batch being applied to the table, then claims it until EndBatch.
+func (table *BTreeIndex) BeginBatch() {
+	table.batchMtx.Lock()
+}
+
+// EndBatch lets the next write batch be applied.
+func (table *BTreeIndex) EndBatch() {
+	table.batchMtx.Unlock()
+}
+
+// vacuumIfFragmented compacts the table if it is fragmented past the auto-vacuum threshold.
+func (table *BTreeIndex) vacuumIfFragmented() {
+	defer table.vacuum.EndCheck()
+	if table.Fragmentation() >= table.vacuum.GetThreshold() {
+		table.Compact()
+	}
+}
+
 // Close flushes all changes to disk.
 func (table *BTreeIndex) Close() (err error) {
 	err = table.pager.Close()
 	return err
 }
 
-// Finds the given key.
+// PinResident pins every node in the buffer pool until UnpinResident, so lookups never
+// read from disk. Fails if the table has more pages than there are buffer frames.
+func (table *BTreeIndex) PinResident() error {
+	return table.pager.PinResident()
+}
+
+// UnpinResident releases the pins taken by PinResident.
+func (table *BTreeIndex) UnpinResident() {
+	table.pager.UnpinResident()
+}
+
+// Finds the given key. If the key holds several entries, returns the first.
 func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
+	if table.multi {
+		entries, err := table.findAll(key)
+		if err != nil {
+			return nil, err
+		}
+		return entries[0], nil
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -62,19 +404,67 @@ func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
+	initRootNode(rootNode, table.splitPolicy, table.deleteMode, table.multi)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
-	value, found := rootNode.get(key)
+	entry, found := rootNode.get(key)
 	if found {
-		return BTreeEntry{key: key, value: value}, nil
+		return entry, nil
 	}
 	return nil, errors.New("entry could not be found")
 }
 
+// GetAll returns the first value of every entry with the given key, in ascending order.
+func (table *BTreeIndex) GetAll(key int64) ([]int64, error) {
+	entries, err := table.findAll(key)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]int64, len(entries))
+	for i, entry := range entries {
+		values[i] = entry.GetValue()
+	}
+	return values, nil
+}
+
+// findAll returns every entry with the given key, scanning from the first.
+func (table *BTreeIndex) findAll(key int64) ([]utils.Entry, error) {
+	c, err := table.TableFind(key)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]utils.Entry, 0)
+	for !c.IsEnd() {
+		entry, err := c.GetEntry()
+		if err != nil {
+			return nil, err
+		}
+		if entry.GetKey() != key {
+			break
+		}
+		entries = append(entries, entry)
+		if c.StepForward() {
+			break
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("entry could not be found")
+	}
+	return entries, nil
+}
+
 // Inserts an entry to the table.
 func (table *BTreeIndex) Insert(key int64, value int64) error {
+	return table.InsertValues(key, []int64{value})
+}
+
+// InsertValues inserts an entry with the given values to the table.
+// Any values past the end of the slice are stored as 0.
+func (table *BTreeIndex) InsertValues(key int64, values []int64) error {
+	if err := utils.CheckValues(values, table.numValues); err != nil {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -83,11 +473,11 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
+	initRootNode(rootNode, table.splitPolicy, table.deleteMode, table.multi)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
-	result := rootNode.insert(key, value, false)
+	result := rootNode.insert(key, values, false)
 	// Check if we need to split the root node.
 	// Remember to preserve the invariant that the root node occupies page 0.
 	if result.isSplit {
@@ -102,15 +492,24 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 		// Depending on whether the root is a leaf or an internal node...
 		if rootNode.getNodeType() == LEAF_NODE {
 			// Create a new leaf node.
-			newNode, err := createLeafNode(table.pager)
+			leafyRoot := pageToLeafNode(rootNode.getPage())
+			newNode, err := createLeafNode(table.pager, leafyRoot.numValues)
 			if err != nil {
 				return errors.New("failed to split root node")
 			}
 			defer newNode.page.Put()
 			// Copy the attributes from the root node.
-			leafyRoot := pageToLeafNode(rootNode.getPage())
 			newNode.copy(leafyRoot)
 			newNodePN = newNode.page.GetPageNum()
+			// The split's right node took the root's page as its left sibling.
+			rightPage, err := table.pager.GetPage(result.rightPN)
+			if err != nil {
+				return errors.New("failed to split root node")
+			}
+			rightPage.WLock()
+			pageToLeafNode(rightPage).setLeftSibling(newNodePN)
+			rightPage.WUnlock()
+			rightPage.Put()
 		} else {
 			// Create a new internal node.
 			newNode, err := createInternalNode(table.pager)
@@ -137,6 +536,17 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 
 // Update modifies an existing entry.
 func (table *BTreeIndex) Update(key int64, value int64) error {
+	return table.UpdateValues(key, []int64{value})
+}
+
+// UpdateValues overwrites the first len(values) values of an existing entry.
+func (table *BTreeIndex) UpdateValues(key int64, values []int64) error {
+	if table.multi {
+		return errors.New("cannot update entries whose keys may repeat")
+	}
+	if err := utils.CheckValues(values, table.numValues); err != nil {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -145,16 +555,42 @@ func (table *BTreeIndex) Update(key int64, value int64) error {
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
+	initRootNode(rootNode, table.splitPolicy, table.deleteMode, table.multi)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Update the entry.
-	result := rootNode.insert(key, value, true)
+	result := rootNode.insert(key, values, true)
 	return result.err
 }
 
-// Delete removes a key from the table.
+// Delete removes a key from the table, along with every entry it holds.
+// Returns an error if the key is not in the table.
 func (table *BTreeIndex) Delete(key int64) error {
+	// Once the tree is unlocked, see if it is time to auto-vacuum.
+	defer func() {
+		if table.deleteMode == utils.TOMBSTONE_DELETE && table.vacuum.NoteDelete() {
+			table.vacuumIfFragmented()
+		}
+	}()
+	if !table.multi {
+		return table.deleteEntry(key, 0)
+	}
+	// Delete the key's entries one at a time, since they may span several leaves.
+	entries, err := table.findAll(key)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = table.deleteEntry(key, entry.GetValue()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEntry removes the entry with the given key and, in tables whose keys may repeat,
+// the given value.
+func (table *BTreeIndex) deleteEntry(key int64, value int64) error {
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -163,17 +599,69 @@ func (table *BTreeIndex) Delete(key int64) error {
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
+	initRootNode(rootNode, table.splitPolicy, table.deleteMode, table.multi)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
-	// Delete the key.
-	rootNode.delete(key)
+	// Delete the key; if the root is left with one child, that child becomes the root.
+	underflow, err := rootNode.delete(key, value)
+	if underflow {
+		// [CONCURRENCY] Unlock the super node.
+		defer SUPER_NODE.unlock()
+		return table.collapseRoot()
+	}
+	return err
+}
+
+// collapseRoot copies the root's only child into the root's page, removing a level from the tree.
+// The child's page is left empty, since the pager can't reuse it.
+func (table *BTreeIndex) collapseRoot() error {
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	defer rootPage.Put()
+	rootPage.WLock()
+	defer rootPage.WUnlock()
+	rootNode, ok := pageToNode(rootPage).(*InternalNode)
+	if !ok || rootNode.numKeys > 0 {
+		return nil
+	}
+	childPage, err := table.pager.GetPage(rootNode.getPNAt(0))
+	if err != nil {
+		return err
+	}
+	defer childPage.Put()
+	childPage.WLock()
+	defer childPage.WUnlock()
+	rootPage.Update(*childPage.GetData(), 0, pager.PAGESIZE)
+	childHeader := pageToNodeHeader(childPage)
+	if childHeader.nodeType == LEAF_NODE {
+		pageToLeafNode(childPage).updateNumKeys(0)
+	} else {
+		pageToInternalNode(childPage).updateNumKeys(0)
+	}
 	return nil
 }
 
+// GetHeight returns the number of levels in the tree; a tree whose root is a leaf has height 1.
+func (table *BTreeIndex) GetHeight() (int64, error) {
+	height := int64(1)
+	leftmostNode, err := table.descend(func(node *InternalNode) int64 {
+		height++
+		return 0
+	})
+	if err != nil {
+		return 0, err
+	}
+	releaseLeaf(leftmostNode)
+	return height, nil
+}
+
 // Select returns a slice of all entries in the table.
 func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 	// Use a cursor to traverse the table from start to end
+	table.BeginScan()
+	defer table.EndScan()
 	entries := make([]utils.Entry, 0)
 	cursor, err := table.TableStart()
 	if err != nil {
@@ -198,6 +686,80 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 	return entries, nil
 }
 
+// Count returns the number of entries in the table, walking the leaves once.
+func (table *BTreeIndex) Count() (int64, error) {
+	count := int64(0)
+	err := table.forEachLeaf(func(leaf *LeafNode) {
+		for i := int64(0); i < leaf.numKeys; i++ {
+			if !leaf.isTombstone(i) {
+				count++
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// SumValues returns the sum of the first value of every entry in the table, walking the
+// leaves once. Returns an error if the sum overflows. An empty table sums to 0.
+func (table *BTreeIndex) SumValues() (int64, error) {
+	sum := int64(0)
+	overflow := false
+	err := table.forEachLeaf(func(leaf *LeafNode) {
+		for i := int64(0); i < leaf.numKeys; i++ {
+			if leaf.isTombstone(i) {
+				continue
+			}
+			value := leaf.getValueAt(i)
+			if (value > 0 && sum > math.MaxInt64-value) || (value < 0 && sum < math.MinInt64-value) {
+				overflow = true
+			}
+			sum += value
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if overflow {
+		return 0, errors.New("sum of values overflows int64")
+	}
+	return sum, nil
+}
+
+// MinKey returns the smallest key in the table, or an error if the table is empty.
+func (table *BTreeIndex) MinKey() (int64, error) {
+	cursor, err := table.TableStart()
+	if err != nil {
+		return 0, err
+	}
+	if cursor.IsEnd() {
+		return 0, errors.New("table is empty")
+	}
+	entry, err := cursor.GetEntry()
+	if err != nil {
+		return 0, err
+	}
+	return entry.GetKey(), nil
+}
+
+// MaxKey returns the largest key in the table, or an error if the table is empty.
+func (table *BTreeIndex) MaxKey() (int64, error) {
+	cursor, err := table.TableEnd()
+	if err != nil {
+		return 0, err
+	}
+	if cursor.IsEnd() {
+		return 0, errors.New("table is empty")
+	}
+	entry, err := cursor.GetEntry()
+	if err != nil {
+		return 0, err
+	}
+	return entry.GetKey(), nil
+}
+
 // Print will pretty-print all nodes in the table.
 func (table *BTreeIndex) Print(w io.Writer) {
 	rootPage, err := table.pager.GetPage(table.rootPN)
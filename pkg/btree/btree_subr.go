@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // We'll always maintain the invariant that the root's pagenum is 0.
@@ -13,6 +14,9 @@ import (
 // we open the database.
 var ROOT_PN int64 = 0
 
+// Leaves without a left or right sibling store NOPAGE as that sibling's pagenum.
+var NO_SIBLING_PN int64 = pager.NOPAGE
+
 // Node header constants.
 var NODETYPE_OFFSET int64 = 0
 var NODETYPE_SIZE int64 = 1
@@ -23,8 +27,10 @@ var NODE_HEADER_SIZE int64 = NODETYPE_SIZE + NUM_KEYS_SIZE
 // Leaf node header constants.
 var RIGHT_SIBLING_PN_OFFSET int64 = NODE_HEADER_SIZE
 var RIGHT_SIBLING_PN_SIZE int64 = binary.MaxVarintLen64
-var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE
-var ENTRIES_PER_LEAF_NODE int64 = ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / ENTRYSIZE) - 1
+var LEFT_SIBLING_PN_OFFSET int64 = RIGHT_SIBLING_PN_OFFSET + RIGHT_SIBLING_PN_SIZE
+var LEFT_SIBLING_PN_SIZE int64 = binary.MaxVarintLen64
+var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE + LEFT_SIBLING_PN_SIZE
+var ENTRIES_PER_LEAF_NODE int64 = EntriesPerLeafNode(1) // In single-value tables.
 
 // Internal node header constants.
 var KEY_SIZE int64 = binary.MaxVarintLen64
@@ -37,7 +43,7 @@ var KEYS_SIZE int64 = KEY_SIZE * (KEYS_PER_INTERNAL_NODE + 1)
 var PNS_OFFSET int64 = KEYS_OFFSET + KEYS_SIZE
 
 // [CONCURRENCY]
-var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}}, nil}
+var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}}, nil, MEDIAN_SPLIT, utils.PHYSICAL_DELETE, false}
 
 // NodeType identifies if a node is a leaf node or internal node.
 type NodeType bool
@@ -56,21 +62,35 @@ type NodeHeader struct {
 
 // Leaf Node definition
 type LeafNode struct {
-	NodeHeader           // Include header information
-	rightSiblingPN int64 // Page number of the right sibling node
-	parent         Node  // Pointer to the parent node for unlocking.
+	NodeHeader                      // Include header information
+	rightSiblingPN int64            // Page number of the right sibling node
+	leftSiblingPN  int64            // Page number of the left sibling node
+	numValues      int64            // Number of values in each entry
+	parent         Node             // Pointer to the parent node for unlocking.
+	splitPolicy    SplitPolicy      // Split policy inherited from the tree.
+	deleteMode     utils.DeleteMode // Delete mode inherited from the tree.
+	multi          bool             // Whether keys may repeat, inherited from the tree.
 }
 
 // Internal Node definition
 type InternalNode struct {
-	NodeHeader      // Include header information
-	parent     Node // Pointer to the parent node for unlocking.
+	NodeHeader                   // Include header information
+	parent      Node             // Pointer to the parent node for unlocking.
+	splitPolicy SplitPolicy      // Split policy inherited from the tree.
+	deleteMode  utils.DeleteMode // Delete mode inherited from the tree.
+	multi       bool             // Whether keys may repeat, inherited from the tree.
 }
 
 /////////////////////////////////////////////////////////////////////////////
 //////////////////////// Generic Helper Functions ///////////////////////////
 /////////////////////////////////////////////////////////////////////////////
 
+// EntriesPerLeafNode returns how many entries fit in a leaf of a table
+// storing numValues values per entry.
+func EntriesPerLeafNode(numValues int64) int64 {
+	return ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / entrySize(numValues)) - 1
+}
+
 // initPage resets the page then sets the nodeType variable.
 func initPage(page *pager.Page, nodeType NodeType) {
 	page.SetDirty(true)
@@ -80,6 +100,13 @@ func initPage(page *pager.Page, nodeType NodeType) {
 	}
 }
 
+// initLeafPage resets the page as a leaf whose entries hold numValues values each.
+// Leaves record this in their nodeType byte, which is 1 for single-value leaves.
+func initLeafPage(page *pager.Page, numValues int64) {
+	initPage(page, LEAF_NODE)
+	(*page.GetData())[int(NODETYPE_OFFSET)] = byte(numValues)
+}
+
 // pageToNode returns the node corresponding to the given page.
 func pageToNode(page *pager.Page) Node {
 	nodeHeader := pageToNodeHeader(page)
@@ -107,9 +134,18 @@ func pageToNodeHeader(page *pager.Page) NodeHeader {
 	}
 }
 
-// entryPos computes the position of an entry within a page given a headersize.
-func entryPos(headersize int64, entrynum int64) int64 {
-	return headersize + entrynum*ENTRYSIZE
+// evenSizes splits n items into as few groups of at most capacity items as possible,
+// and returns the size of each group; the sizes differ by at most one.
+func evenSizes(n int64, capacity int64) []int64 {
+	numGroups := (n + capacity - 1) / capacity
+	sizes := make([]int64, numGroups)
+	for i := range sizes {
+		sizes[i] = n / numGroups
+		if int64(i) < n%numGroups {
+			sizes[i]++
+		}
+	}
+	return sizes
 }
 
 // keyPos returns the offset in the page to the internal node's ith key.
@@ -132,23 +168,34 @@ func pageToLeafNode(page *pager.Page) *LeafNode {
 	rightSiblingPN, _ := binary.Varint(
 		(*page.GetData())[RIGHT_SIBLING_PN_OFFSET : RIGHT_SIBLING_PN_OFFSET+RIGHT_SIBLING_PN_SIZE],
 	)
+	leftSiblingPN, _ := binary.Varint(
+		(*page.GetData())[LEFT_SIBLING_PN_OFFSET : LEFT_SIBLING_PN_OFFSET+LEFT_SIBLING_PN_SIZE],
+	)
 	return &LeafNode{
 		nodeHeader,
 		rightSiblingPN,
+		leftSiblingPN,
+		int64((*page.GetData())[NODETYPE_OFFSET]),
 		nil,
+		MEDIAN_SPLIT,
+		utils.PHYSICAL_DELETE,
+		false,
 	}
 }
 
-// createLeafNode creates and returns a new leaf node.
+// createLeafNode creates and returns a new leaf node with numValues values per entry.
 // Nodes created with this function must be `Put()` accordingly after use.
-func createLeafNode(pager *pager.Pager) (*LeafNode, error) {
+func createLeafNode(pager *pager.Pager, numValues int64) (*LeafNode, error) {
 	newPN := pager.GetFreePN()
 	newPage, err := pager.GetPage(newPN)
 	if err != nil {
 		return &LeafNode{}, err
 	}
-	initPage(newPage, LEAF_NODE)
-	return pageToLeafNode(newPage), nil
+	initLeafPage(newPage, numValues)
+	newNode := pageToLeafNode(newPage)
+	newNode.setRightSibling(NO_SIBLING_PN)
+	newNode.setLeftSibling(NO_SIBLING_PN)
+	return newNode, nil
 }
 
 // getPage returns a pointer to the leaf node's page.
@@ -166,6 +213,7 @@ func (node *LeafNode) copy(toCopy *LeafNode) {
 	copy(*node.page.GetData(), *toCopy.page.GetData())
 	node.updateNumKeys(toCopy.numKeys)
 	node.setRightSibling(toCopy.rightSiblingPN)
+	node.setLeftSibling(toCopy.leftSiblingPN)
 }
 
 // isRoot returns true if the current node is the root node.
@@ -173,6 +221,11 @@ func (node *LeafNode) isRoot() bool {
 	return node.page.GetPageNum() == ROOT_PN
 }
 
+// hasRightSibling returns true if the leaf node points to a right sibling.
+func (node *LeafNode) hasRightSibling() bool {
+	return node.rightSiblingPN != NO_SIBLING_PN
+}
+
 // setRightSibling sets the right sibling pagenumber attribute of the leaf node
 // and updates the leaf node's page accordingly. returns the old right sibling.
 func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
@@ -190,26 +243,126 @@ func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
 	return oldSiblingPN
 }
 
+// hasLeftSibling returns true if the leaf node points to a left sibling.
+func (node *LeafNode) hasLeftSibling() bool {
+	return node.leftSiblingPN != NO_SIBLING_PN
+}
+
+// setLeftSibling sets the left sibling pagenumber attribute of the leaf node
+// and updates the leaf node's page accordingly. returns the old left sibling.
+func (node *LeafNode) setLeftSibling(siblingPN int64) int64 {
+	oldSiblingPN := node.leftSiblingPN
+	node.leftSiblingPN = siblingPN
+	siblingData := make([]byte, LEFT_SIBLING_PN_SIZE)
+	binary.PutVarint(siblingData, node.leftSiblingPN)
+	node.page.Update(
+		siblingData,
+		LEFT_SIBLING_PN_OFFSET,
+		LEFT_SIBLING_PN_SIZE,
+	)
+	return oldSiblingPN
+}
+
+// entrySize returns the size of each entry in the leaf node.
+func (node *LeafNode) entrySize() int64 {
+	return entrySize(node.numValues)
+}
+
+// maxEntries returns how many entries the leaf node holds before it must split.
+func (node *LeafNode) maxEntries() int64 {
+	return EntriesPerLeafNode(node.numValues)
+}
+
+// minEntries returns how many entries the leaf node holds before it must be rebalanced.
+// The root has no siblings to rebalance with, so it may hold any number.
+func (node *LeafNode) minEntries() int64 {
+	if node.isRoot() {
+		return 0
+	}
+	return node.maxEntries() / 2
+}
+
 // entryPos returns the page offset to the entry at the given index.
 func (node *LeafNode) entryPos(index int64) int64 {
-	return entryPos(LEAF_NODE_HEADER_SIZE, index)
+	return LEAF_NODE_HEADER_SIZE + index*node.entrySize()
 }
 
 // modifyEntry updates the data stored in the entry at the given index.
+// Values the entry doesn't have are stored as 0.
 func (node *LeafNode) modifyEntry(index int64, entry BTreeEntry) {
-	newdata := entry.Marshal()
+	newdata := make([]byte, node.entrySize())
+	copy(newdata, entry.Marshal())
 	startPos := node.entryPos(index)
-	node.page.Update(newdata, startPos, ENTRYSIZE)
+	node.page.Update(newdata, startPos, node.entrySize())
 }
 
 // getEntry returns the entry stored in the entry at the given index.
 func (node *LeafNode) getEntry(index int64) BTreeEntry {
 	startPos := node.entryPos(index)
 	// Deserialize the entry.
-	entry := unmarshalEntry((*node.page.GetData())[startPos : startPos+ENTRYSIZE])
+	entry := unmarshalEntry((*node.page.GetData())[startPos : startPos+node.entrySize()])
 	return entry
 }
 
+// tombstonePos returns the page offset to the byte marking the entry at the given index as deleted.
+func (node *LeafNode) tombstonePos(index int64) int64 {
+	return node.entryPos(index) + node.entrySize() - 1
+}
+
+// isTombstone returns true if the entry at the given index has been deleted in place.
+func (node *LeafNode) isTombstone(index int64) bool {
+	return (*node.page.GetData())[node.tombstonePos(index)]&TOMBSTONE_BIT != 0
+}
+
+// setTombstone marks the entry at the given index as deleted in place.
+func (node *LeafNode) setTombstone(index int64) {
+	pos := node.tombstonePos(index)
+	node.page.Update([]byte{(*node.page.GetData())[pos] | TOMBSTONE_BIT}, pos, 1)
+}
+
+// moveEntry copies the entry at index from to index to, keeping any tombstone mark.
+func (node *LeafNode) moveEntry(to int64, from int64) {
+	startPos := node.entryPos(from)
+	data := make([]byte, node.entrySize())
+	copy(data, (*node.page.GetData())[startPos:startPos+node.entrySize()])
+	node.page.Update(data, node.entryPos(to), node.entrySize())
+}
+
+// fillLeaf writes the given entries into the empty leaf node, in order.
+func fillLeaf(node *LeafNode, entries []utils.Entry) {
+	for i, entry := range entries {
+		node.modifyEntry(int64(i), newEntry(entry.GetKey(), entry.Values()))
+	}
+	node.updateNumKeys(int64(len(entries)))
+}
+
+// copyEntryFrom copies the entry at index from of another leaf to index to, keeping any tombstone mark.
+func (node *LeafNode) copyEntryFrom(to int64, other *LeafNode, from int64) {
+	startPos := other.entryPos(from)
+	data := make([]byte, other.entrySize())
+	copy(data, (*other.page.GetData())[startPos:startPos+other.entrySize()])
+	node.page.Update(data, node.entryPos(to), node.entrySize())
+}
+
+// compact physically removes the entries deleted in place; returns how many were removed.
+func (node *LeafNode) compact() int64 {
+	live := int64(0)
+	for i := int64(0); i < node.numKeys; i++ {
+		if node.isTombstone(i) {
+			continue
+		}
+		if live != i {
+			node.moveEntry(live, i)
+		}
+		live++
+	}
+	removed := node.numKeys - live
+	if removed > 0 {
+		node.updateNumKeys(live)
+	}
+	return removed
+}
+
 // getKeyAt returns the key stored at the given index of the leaf node.
 func (node *LeafNode) getKeyAt(index int64) int64 {
 	return node.getEntry(index).GetKey()
@@ -234,6 +387,14 @@ func (node *LeafNode) updateValueAt(index int64, value int64) {
 	node.modifyEntry(index, entry)
 }
 
+// updateValuesAt overwrites the first len(values) values at the given index of the leaf node.
+func (node *LeafNode) updateValuesAt(index int64, values []int64) {
+	entry := node.getEntry(index)
+	newValues := entry.Values()
+	copy(newValues, values)
+	node.modifyEntry(index, newEntry(entry.GetKey(), newValues))
+}
+
 // updateNumKeys updates the numKeys field in the node struct and the page.
 func (node *LeafNode) updateNumKeys(nKeys int64) {
 	node.numKeys = nKeys
@@ -250,7 +411,7 @@ func (node *LeafNode) updateNumKeys(nKeys int64) {
 // pageToInternalNode returns the internal node corresponding to the given page.
 func pageToInternalNode(page *pager.Page) *InternalNode {
 	nodeHeader := pageToNodeHeader(page)
-	return &InternalNode{nodeHeader, nil}
+	return &InternalNode{nodeHeader, nil, MEDIAN_SPLIT, utils.PHYSICAL_DELETE, false}
 }
 
 // createInternalNode creates and returns a new internal node.
@@ -286,6 +447,27 @@ func (node *InternalNode) isRoot() bool {
 	return node.page.GetPageNum() == ROOT_PN
 }
 
+// minKeys returns how many keys the internal node holds before it must be rebalanced.
+// The root only needs to keep two children.
+func (node *InternalNode) minKeys() int64 {
+	if node.isRoot() {
+		return 1
+	}
+	return KEYS_PER_INTERNAL_NODE / 2
+}
+
+// fillChildren points the empty internal node at the given children, separating each from
+// the one before by its first key.
+func (node *InternalNode) fillChildren(pns []int64, firstKeys []int64) {
+	for i, pn := range pns {
+		node.updatePNAt(int64(i), pn)
+		if i > 0 {
+			node.updateKeyAt(int64(i-1), firstKeys[i])
+		}
+	}
+	node.updateNumKeys(int64(len(pns) - 1))
+}
+
 // getKeyAt returns the key stored at the given index of the internal node.
 func (node *InternalNode) getKeyAt(index int64) int64 {
 	startPos := keyPos(index)
@@ -356,12 +538,18 @@ func (node *InternalNode) updateNumKeys(nKeys int64) {
 ////////////////////////// Lock  Helper Functions ///////////////////////////
 /////////////////////////////////////////////////////////////////////////////
 
-func initRootNode(root Node) {
+func initRootNode(root Node, policy SplitPolicy, mode utils.DeleteMode, multi bool) {
 	switch castedRootNode := root.(type) {
 	case *InternalNode:
 		castedRootNode.parent = SUPER_NODE
+		castedRootNode.splitPolicy = policy
+		castedRootNode.deleteMode = mode
+		castedRootNode.multi = multi
 	case *LeafNode:
 		castedRootNode.parent = SUPER_NODE
+		castedRootNode.splitPolicy = policy
+		castedRootNode.deleteMode = mode
+		castedRootNode.multi = multi
 	}
 }
 
@@ -400,8 +588,14 @@ func (node *InternalNode) initChild(child Node) {
 	switch castedChild := child.(type) {
 	case *InternalNode:
 		castedChild.parent = node
+		castedChild.splitPolicy = node.splitPolicy
+		castedChild.deleteMode = node.deleteMode
+		castedChild.multi = node.multi
 	case *LeafNode:
 		castedChild.parent = node
+		castedChild.splitPolicy = node.splitPolicy
+		castedChild.deleteMode = node.deleteMode
+		castedChild.multi = node.multi
 	}
 }
 
@@ -439,7 +633,7 @@ func (node *InternalNode) unlock() {
 // only checks if force == false
 func (node *LeafNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == ENTRIES_PER_LEAF_NODE {
+	if !force && node.numKeys == node.maxEntries() {
 		return nil
 	}
 	// Unlock the parents recursively, and remove parent pointers.
@@ -2,175 +2,418 @@ package btree
 
 import (
 	"errors"
+	"math"
 
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // Cursors are an abstration to represent locations in a table.
+// A cursor holds no pins or latches between calls; it re-reads its leaf node each time,
+// under a read latch, so each entry it returns is read whole. If a concurrent write moved
+// the cursor's entry, say by splitting its leaf, the cursor finds it again from the root.
+// Scans are not snapshots: they return entries in order, each at most once, and every entry
+// present for the whole scan, but may or may not see entries written while they run.
+// Entries deleted in place are skipped; one deleted after the cursor reached it is still returned.
 type BTreeCursor struct {
-	table   *BTreeIndex // The table that this cursor point to.
-	cellnum int64       // The cell number within a leaf node.
-	isEnd   bool        // Indicates that this cursor points beyond the table/at the end of the table.
-	curNode *LeafNode   // Current node.
+	table      *BTreeIndex // The table that this cursor point to.
+	cellnum    int64       // The cell number within a leaf node.
+	isEnd      bool        // Indicates that this cursor points beyond the table/at the end of the table.
+	curPN      int64       // Page number of the current leaf node.
+	bounded    bool        // Whether the cursor ends before endKey rather than at the end of the table.
+	endKey     int64       // The first key past the end of a bounded cursor.
+	positioned bool        // Whether the cursor points at an entry, recorded in entry.
+	entry      BTreeEntry  // The entry the cursor pointed at when it reached it.
 }
 
-// TableStart returns a cursor pointing to the first entry of the table.
-func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
-	cursor := BTreeCursor{table: table, cellnum: 0}
-	// Get the root page.
+// descend walks from the root down to a leaf, read-latching one level at a time.
+// pick chooses which child to follow at each internal node.
+// The returned leaf is pinned and read-locked; release it with releaseLeaf.
+func (table *BTreeIndex) descend(pick func(*InternalNode) int64) (*LeafNode, error) {
 	curPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
 		return nil, err
 	}
-	defer curPage.Put()
-	// Locks the root (WLOCK)
-	curPage.WLock()
+	curPage.RLock()
 	curHeader := pageToNodeHeader(curPage)
-	// Traverse the leftmost children until we reach a leaf node.
 	for curHeader.nodeType != LEAF_NODE {
-		// * holding lock on curPage upon entry
 		curNode := pageToInternalNode(curPage)
-		leftmostPN := curNode.getPNAt(0)
-		curPage, err = table.pager.GetPage(leftmostPN)
+		childPage, err := table.pager.GetPage(curNode.getPNAt(pick(curNode)))
 		if err != nil {
-			// unlock self
-			curNode.unlock()
+			curPage.RUnlock()
+			curPage.Put()
 			return nil, err
 		}
-		defer curPage.Put()
-		// lock child
-		curPage.WLock()
-		// unlock parent
-		curNode.unlock()
-
+		// Latch the child before letting go of the parent.
+		childPage.RLock()
+		curPage.RUnlock()
+		curPage.Put()
+		curPage = childPage
 		curHeader = pageToNodeHeader(curPage)
 	}
+	return pageToLeafNode(curPage), nil
+}
+
+// descendToEntry descends to the leaf whose range holds the entry with the given key and,
+// in tables whose keys may repeat, the given value.
+// The returned leaf is pinned and read-locked; release it with releaseLeaf.
+func (table *BTreeIndex) descendToEntry(key int64, value int64) (*LeafNode, error) {
+	var pickErr error
+	leaf, err := table.descend(func(node *InternalNode) int64 {
+		if !table.multi {
+			return node.search(key)
+		}
+		childIdx, err := node.searchEntry(key, value)
+		if err != nil {
+			pickErr = err
+		}
+		return childIdx
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pickErr != nil {
+		releaseLeaf(leaf)
+		return nil, pickErr
+	}
+	leaf.multi = table.multi
+	return leaf, nil
+}
+
+// releaseLeaf unlocks and unpins a leaf returned by descend or getLeaf.
+func releaseLeaf(node *LeafNode) {
+	node.page.RUnlock()
+	node.page.Put()
+}
+
+// TableStart returns a cursor pointing to the first entry of the table.
+func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
+	leftmostNode, err := table.descend(func(node *InternalNode) int64 {
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
 	// Set the cursor to point to the first entry in the leftmost leaf node.
-	leftmostNode := pageToLeafNode(curPage)
-	cursor.isEnd = (leftmostNode.numKeys == 0)
-	cursor.curNode = leftmostNode
+	cursor := BTreeCursor{table: table, cellnum: 0, curPN: leftmostNode.page.GetPageNum()}
+	skip := leftmostNode.numKeys == 0 || leftmostNode.isTombstone(0)
+	if !skip {
+		cursor.remember(leftmostNode)
+	}
+	releaseLeaf(leftmostNode)
+	if skip {
+		// Skip over any empty leaves and deleted entries.
+		cursor.cellnum = -1
+		cursor.StepForward()
+	}
 	return &cursor, nil
 }
 
 // TableEnd returns a cursor pointing to the last entry in the db.
-// If the db is empty, returns a cursor to the new insertion position.
+// If the db is empty, returns a cursor to the new insertion position, at the end.
 func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 	/* SOLUTION {{{ */
-	cursor := BTreeCursor{table: table, cellnum: 0}
-	// Get the root page.
-	curPage, err := table.pager.GetPage(table.rootPN)
+	rightmostNode, err := table.descend(func(node *InternalNode) int64 {
+		return node.numKeys
+	})
 	if err != nil {
 		return &BTreeCursor{}, err
 	}
-	defer curPage.Put()
-	curHeader := pageToNodeHeader(curPage)
-	// Traverse the rightmost children until we reach a leaf node.
-	for curHeader.nodeType != LEAF_NODE {
-		curNode := pageToInternalNode(curPage)
-		rightmostPN := curNode.getPNAt(curHeader.numKeys)
-		curPage, err = table.pager.GetPage(rightmostPN)
-		if err != nil {
-			return &BTreeCursor{}, err
-		}
-		defer curPage.Put()
-		curHeader = pageToNodeHeader(curPage)
-	}
 	// Set the cursor to point to the last entry in the rightmost leaf node.
-	rightmostNode := pageToLeafNode(curPage)
-	cursor.isEnd = false
+	cursor := BTreeCursor{table: table, curPN: rightmostNode.page.GetPageNum()}
 	cursor.cellnum = rightmostNode.numKeys - 1
-	cursor.curNode = rightmostNode
+	skip := rightmostNode.numKeys == 0 || rightmostNode.isTombstone(cursor.cellnum)
+	if !skip {
+		cursor.remember(rightmostNode)
+	}
+	releaseLeaf(rightmostNode)
+	if skip {
+		// Skip back over any empty leaves and deleted entries; with no entries left,
+		// stay past the end of the rightmost leaf.
+		cursor.cellnum++
+		cursor.isEnd = cursor.StepBackward()
+	}
 	return &cursor, nil
 	/* SOLUTION }}} */
 }
 
-// TableFind returns a cursor pointing to the given key.
+// TableFind returns a cursor pointing to the given key, or the first of its entries.
 // If the key is not found, returns a cursor to the new insertion position.
-// Hint: use keyToNodeEntry
 func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
 	/* SOLUTION {{{ */
-	cursor := BTreeCursor{table: table}
-	// Get the root page.
-	rootPage, err := table.pager.GetPage(table.rootPN)
+	// Head for the key's first entry, which sorts before any other with that key.
+	leaf, err := table.descendToEntry(key, math.MinInt64)
 	if err != nil {
 		return &BTreeCursor{}, err
 	}
-	rootPage.WLock()
-	defer rootPage.Put()
-	rootNode := pageToNode(rootPage)
-	// Find the leaf node and cellnum that this key belongs to.
-	leaf, cellnum, err := rootNode.keyToNodeEntry(key)
-	if err != nil {
-		return &BTreeCursor{}, err
+	// Find the cellnum that this key belongs to.
+	cursor := BTreeCursor{table: table, curPN: leaf.page.GetPageNum()}
+	cursor.cellnum = leaf.search(key)
+	skip := cursor.cellnum >= leaf.numKeys || leaf.isTombstone(cursor.cellnum)
+	if !skip {
+		cursor.remember(leaf)
+	}
+	releaseLeaf(leaf)
+	if skip {
+		// The next larger key, if any, lives further along or in a right sibling.
+		cursor.cellnum--
+		cursor.StepForward()
 	}
-	// Initialize cursor.
-	cursor.cellnum = cellnum
-	cursor.isEnd = (cellnum == leaf.numKeys)
-	cursor.curNode = leaf
 	return &cursor, nil
 	/* SOLUTION }}} */
 }
 
-// TableFindRange returns a slice of Entries with keys between the startKey and endKey.
-func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.Entry, error) {
-	ret := make([]utils.Entry, 0)
+// TableRangeCursor returns a cursor over the entries with keys in the half-open range
+// [startKey, endKey): an entry with key endKey is excluded, unlike in TableFindRange,
+// which includes both bounds. The cursor reports the end once it reaches endKey, without
+// reading any further.
+func (table *BTreeIndex) TableRangeCursor(startKey int64, endKey int64) (utils.Cursor, error) {
 	c, err := table.TableFind(startKey)
 	if err != nil {
-		return nil, err
+		return c, err
+	}
+	cursor, ok := c.(*BTreeCursor)
+	if !ok {
+		return c, errors.New("expected btree cursor")
+	}
+	cursor.bounded = true
+	cursor.endKey = endKey
+	if cursor.isEnd {
+		return cursor, nil
 	}
-	// Check if we are at the end
-	checkEntry, err := c.GetEntry()
+	// The first entry may already be past the end.
+	curNode, err := cursor.getLeaf()
 	if err != nil {
-		return nil, err
+		return cursor, err
 	}
-	for !c.IsEnd() && endKey > checkEntry.GetKey() {
-		ret = append(ret, checkEntry)
-		if !c.StepForward() {
+	cursor.isEnd = cursor.pastEnd(curNode)
+	releaseLeaf(curNode)
+	return cursor, nil
+}
+
+// TableFindRange returns a slice of Entries with keys in [startKey, endKey].
+func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.Entry, error) {
+	return table.TableFindRangeEx(startKey, endKey, true, true)
+}
+
+// TableFindRangeEx returns a slice of Entries with keys between startKey and endKey,
+// including each bound only if asked to.
+func (table *BTreeIndex) TableFindRangeEx(startKey int64, endKey int64, includeStart bool, includeEnd bool) ([]utils.Entry, error) {
+	ret := make([]utils.Entry, 0)
+	// Narrow exclusive bounds to the nearest included keys.
+	if !includeStart {
+		if startKey == math.MaxInt64 {
 			return ret, nil
 		}
-		checkEntry, err = c.GetEntry()
-		if err != nil {
+		startKey++
+	}
+	if !includeEnd {
+		if endKey == math.MinInt64 {
 			return ret, nil
 		}
+		endKey--
+	}
+	if startKey > endKey {
+		return ret, nil
+	}
+	// The range cursor excludes its end key, unless there is no key past it.
+	var c utils.Cursor
+	var err error
+	if endKey == math.MaxInt64 {
+		c, err = table.TableFind(startKey)
+	} else {
+		c, err = table.TableRangeCursor(startKey, endKey+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for !c.IsEnd() {
+		checkEntry, err := c.GetEntry()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, checkEntry)
+		if c.StepForward() {
+			break
+		}
 	}
 	return ret, nil
 }
 
-// stepForward moves the cursor ahead by one entry. Returns true at the end of the BTree.
+// pastEnd returns true if a bounded cursor points at or beyond its end key in the given node.
+func (cursor *BTreeCursor) pastEnd(node *LeafNode) bool {
+	return cursor.bounded && cursor.cellnum < node.numKeys && node.getKeyAt(cursor.cellnum) >= cursor.endKey
+}
+
+// getLeaf pins and read-locks the cursor's current leaf node; release it with releaseLeaf.
+func (cursor *BTreeCursor) getLeaf() (*LeafNode, error) {
+	page, err := cursor.table.pager.GetPage(cursor.curPN)
+	if err != nil {
+		return nil, err
+	}
+	page.RLock()
+	return pageToLeafNode(page), nil
+}
+
+// remember records the entry the cursor points at in the given node, if any,
+// so that the cursor can find it again if a concurrent write moves it.
+func (cursor *BTreeCursor) remember(node *LeafNode) {
+	cursor.positioned = cursor.cellnum >= 0 && cursor.cellnum < node.numKeys
+	if cursor.positioned {
+		cursor.entry = node.getEntry(cursor.cellnum)
+	}
+}
+
+// pointsAt returns true if the cursor points at its recorded entry in the given node.
+func (cursor *BTreeCursor) pointsAt(node *LeafNode) bool {
+	if cursor.cellnum < 0 || cursor.cellnum >= node.numKeys || node.getKeyAt(cursor.cellnum) != cursor.entry.GetKey() {
+		return false
+	}
+	return !cursor.table.multi || node.getValueAt(cursor.cellnum) == cursor.entry.GetValue()
+}
+
+// relocate pins and read-locks the cursor's current leaf node, like getLeaf. If a concurrent
+// write has moved the cursor's entry, it first finds the entry again from the root; if the
+// entry is gone, the cursor is left where it would be, on the entry after it.
+func (cursor *BTreeCursor) relocate() (*LeafNode, error) {
+	curNode, err := cursor.getLeaf()
+	if err != nil {
+		return nil, err
+	}
+	if !cursor.positioned || cursor.pointsAt(curNode) {
+		return curNode, nil
+	}
+	releaseLeaf(curNode)
+	key, value := cursor.entry.GetKey(), cursor.entry.GetValue()
+	curNode, err = cursor.table.descendToEntry(key, value)
+	if err != nil {
+		return nil, err
+	}
+	cursor.curPN = curNode.page.GetPageNum()
+	cursor.cellnum = curNode.position(key, value)
+	return curNode, nil
+}
+
+// skipTombstones moves the cursor past any deleted entries in the given node.
+func (cursor *BTreeCursor) skipTombstones(node *LeafNode) {
+	for cursor.cellnum < node.numKeys && node.isTombstone(cursor.cellnum) {
+		cursor.cellnum++
+	}
+}
+
+// StepForward moves the cursor ahead by one entry. Returns true at the end of the BTree.
 func (cursor *BTreeCursor) StepForward() (atEnd bool) {
-	// If the cursor is at the end of the node, go to the next node.
-	cursor.curNode.page.RLock()
-	if cursor.cellnum+1 >= cursor.curNode.numKeys {
-		// Get the next node's page number.
-		nextPN := cursor.curNode.rightSiblingPN
-		if nextPN < 0 {
-			cursor.curNode.page.RUnlock()
+	if cursor.isEnd {
+		return true
+	}
+	curNode, err := cursor.relocate()
+	if err != nil {
+		cursor.isEnd = true
+		return true
+	}
+	// If the cursor's entry is gone, it already points at the next one.
+	if !cursor.positioned || cursor.pointsAt(curNode) {
+		cursor.cellnum++
+	}
+	// Skip deleted entries; if the cursor is past the end of the node, go to the next non-empty node.
+	cursor.skipTombstones(curNode)
+	for cursor.cellnum >= curNode.numKeys {
+		if !curNode.hasRightSibling() {
+			releaseLeaf(curNode)
+			cursor.isEnd = true
+			cursor.positioned = false
 			return true
 		}
-		// Convert the page into a node.
+		nextPN := curNode.rightSiblingPN
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
 		if err != nil {
-			cursor.curNode.page.RUnlock()
+			releaseLeaf(curNode)
+			cursor.isEnd = true
+			cursor.positioned = false
 			return true
 		}
-		defer nextPage.Put()
-		nextNode := pageToLeafNode(nextPage)
-		nextNode.page.RLock()
-		cursor.curNode.page.RUnlock()
-		// Reinitialize the cursor.
+		// Latch the sibling before letting go of the current node.
+		nextPage.RLock()
+		releaseLeaf(curNode)
+		curNode = pageToLeafNode(nextPage)
+		cursor.curPN = nextPN
 		cursor.cellnum = 0
-		cursor.curNode = nextNode
-		// If the next node is empty, step to the next node.
-		if cursor.cellnum == nextNode.numKeys {
-			return cursor.StepForward()
+		cursor.skipTombstones(curNode)
+	}
+	// Stop a bounded cursor once it passes its end key.
+	cursor.isEnd = cursor.pastEnd(curNode)
+	cursor.remember(curNode)
+	releaseLeaf(curNode)
+	return cursor.isEnd
+}
+
+// StepBackward moves the cursor back by one entry. Returns true at the start of the BTree,
+// leaving the cursor where it was. A cursor at the end steps back onto the last entry.
+func (cursor *BTreeCursor) StepBackward() (atStart bool) {
+	curNode, err := cursor.relocate()
+	if err != nil {
+		return true
+	}
+	cellnum := cursor.cellnum
+	if cellnum > curNode.numKeys {
+		cellnum = curNode.numKeys
+	}
+	cellnum--
+	// Skip deleted entries; if the cursor is before the start of the node, go to the previous non-empty node.
+	for {
+		for cellnum >= 0 && curNode.isTombstone(cellnum) {
+			cellnum--
 		}
-		return false
+		if cellnum >= 0 {
+			break
+		}
+		if !curNode.hasLeftSibling() {
+			releaseLeaf(curNode)
+			return true
+		}
+		curNode, err = cursor.leftSibling(curNode)
+		if err != nil {
+			return true
+		}
+		cellnum = curNode.numKeys - 1
 	}
-	// Else, just move the cursor forward.
-	cursor.cellnum++
+	cursor.curPN = curNode.page.GetPageNum()
+	cursor.cellnum = cellnum
+	cursor.isEnd = false
+	cursor.remember(curNode)
+	releaseLeaf(curNode)
 	return false
 }
 
+// leftSibling latches and returns the given leaf's left sibling, releasing the leaf.
+// The leaf is released first, since latching leftwards while holding it could deadlock
+// with StepForward; if the sibling split in between, walks right to the leaf just before it.
+func (cursor *BTreeCursor) leftSibling(node *LeafNode) (*LeafNode, error) {
+	targetPN := node.page.GetPageNum()
+	leftPN := node.leftSiblingPN
+	releaseLeaf(node)
+	page, err := cursor.table.pager.GetPage(leftPN)
+	if err != nil {
+		return nil, err
+	}
+	page.RLock()
+	left := pageToLeafNode(page)
+	for left.rightSiblingPN != targetPN {
+		if !left.hasRightSibling() {
+			releaseLeaf(left)
+			return nil, errors.New("leftSibling: sibling pointers are inconsistent")
+		}
+		nextPage, err := cursor.table.pager.GetPage(left.rightSiblingPN)
+		if err != nil {
+			releaseLeaf(left)
+			return nil, err
+		}
+		nextPage.RLock()
+		releaseLeaf(left)
+		left = pageToLeafNode(nextPage)
+	}
+	return left, nil
+}
+
 // IsEnd returns true if at end.
 func (cursor *BTreeCursor) IsEnd() bool {
 	return cursor.isEnd
@@ -182,6 +425,18 @@ func (cursor *BTreeCursor) GetEntry() (utils.Entry, error) {
 	if cursor.isEnd {
 		return BTreeEntry{}, errors.New("getEntry: entry is non-existent")
 	}
-	entry := cursor.curNode.getEntry(cursor.cellnum)
+	curNode, err := cursor.relocate()
+	if err != nil {
+		return BTreeEntry{}, err
+	}
+	defer releaseLeaf(curNode)
+	if cursor.positioned && !cursor.pointsAt(curNode) {
+		// The entry was deleted after the cursor reached it; return it as it was.
+		return cursor.entry, nil
+	}
+	if cursor.cellnum >= curNode.numKeys {
+		return BTreeEntry{}, errors.New("getEntry: entry is non-existent")
+	}
+	entry := curNode.getEntry(cursor.cellnum)
 	return entry, nil
 }
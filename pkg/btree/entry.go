@@ -4,13 +4,28 @@ import (
 	"encoding/binary"
 )
 
-// Global size for Entries.
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2
+// Global size for Entries in single-value tables.
+var ENTRYSIZE int64 = entrySize(1)
+
+// Entries deleted in place are marked by setting the high bit of the last byte of their cell,
+// which a marshalled varint never uses.
+const TOMBSTONE_BIT byte = 0x80
 
 // Entry is a struct of one unit of information in our table.
 type BTreeEntry struct {
 	key   int64
 	value int64
+	extra []int64 // Values past the first, in tables storing more than one.
+}
+
+// entrySize returns the size of an entry with the given number of values.
+func entrySize(numValues int64) int64 {
+	return binary.MaxVarintLen64 * (1 + numValues)
+}
+
+// newEntry returns an entry with the given key and values; values must not be empty.
+func newEntry(key int64, values []int64) BTreeEntry {
+	return BTreeEntry{key: key, value: values[0], extra: values[1:]}
 }
 
 // Get key.
@@ -23,6 +38,11 @@ func (entry BTreeEntry) GetValue() int64 {
 	return entry.value
 }
 
+// Get all values.
+func (entry BTreeEntry) Values() []int64 {
+	return append([]int64{entry.value}, entry.extra...)
+}
+
 // Set key.
 func (entry *BTreeEntry) SetKey(key int64) {
 	entry.key = key
@@ -40,17 +60,29 @@ func (entry BTreeEntry) Marshal() []byte {
 	bin := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(bin, entry.GetKey())
 	newdata = bin
-	// Marshall the value field.
-	bin = make([]byte, binary.MaxVarintLen64)
-	binary.PutVarint(bin, entry.GetValue())
-	newdata = append(newdata, bin...)
+	// Marshall the value fields.
+	for _, value := range entry.Values() {
+		bin = make([]byte, binary.MaxVarintLen64)
+		binary.PutVarint(bin, value)
+		newdata = append(newdata, bin...)
+	}
 	// Return the combined byte array.
 	return newdata
 }
 
-// unmarshalEntry deserializes a byte array into an entry.
+// unmarshalEntry deserializes a byte array into an entry, ignoring any tombstone mark.
+// The number of values is taken from the length of the array.
 func unmarshalEntry(data []byte) (entry BTreeEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return BTreeEntry{key: k, value: v}
+	last := len(data) - 1
+	if data[last]&TOMBSTONE_BIT != 0 {
+		data = append([]byte{}, data...)
+		data[last] &^= TOMBSTONE_BIT
+	}
+	size := binary.MaxVarintLen64
+	k, _ := binary.Varint(data[:size])
+	values := make([]int64, len(data)/size-1)
+	for i := range values {
+		values[i], _ = binary.Varint(data[(i+1)*size : (i+2)*size])
+	}
+	return newEntry(k, values)
 }
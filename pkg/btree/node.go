@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // Split is a supporting data structure to propagate keys up our B+ tree.
@@ -23,9 +24,9 @@ type Split struct {
 type Node interface {
 	// Interface for main node functions.
 	search(int64) int64
-	insert(int64, int64, bool) Split
-	delete(int64)
-	get(int64) (int64, bool)
+	insert(int64, []int64, bool) Split
+	delete(int64, int64) (bool, error)
+	get(int64) (BTreeEntry, bool)
 
 	// Interface for helper functions.
 	keyToNodeEntry(int64) (*LeafNode, int64, error)
@@ -40,6 +41,8 @@ type Node interface {
 
 // search returns the first index where key >= given key.
 // If no key satisfies this condition, returns numKeys.
+// In tables whose keys may repeat, equal keys are kept ordered by value ascending (see
+// searchEntry), so this is the first entry of the run and scans don't depend on insertion order.
 func (node *LeafNode) search(key int64) int64 {
 	/* SOLUTION {{{ */
 	// Binary search for the key.
@@ -53,19 +56,59 @@ func (node *LeafNode) search(key int64) int64 {
 	/* SOLUTION }}} */
 }
 
+// searchEntry returns the first index where the entry is at or after the given key and value,
+// ordering equal keys by value ascending. If no entry is, returns numKeys.
+func (node *LeafNode) searchEntry(key int64, value int64) int64 {
+	minIndex := sort.Search(
+		int(node.numKeys),
+		func(idx int) bool {
+			entry := node.getEntry(int64(idx))
+			return entry.GetKey() > key || (entry.GetKey() == key && entry.GetValue() >= value)
+		},
+	)
+	return int64(minIndex)
+}
+
+// position returns the index of the entry with the given key and value, or where it belongs.
+// Values only matter in tables whose keys may repeat.
+func (node *LeafNode) position(key int64, value int64) int64 {
+	if node.multi {
+		return node.searchEntry(key, value)
+	}
+	return node.search(key)
+}
+
+// matches returns true if the entry at the given index has the given key and, in tables
+// whose keys may repeat, the given value.
+func (node *LeafNode) matches(index int64, key int64, value int64) bool {
+	if index >= node.numKeys || node.getKeyAt(index) != key {
+		return false
+	}
+	return !node.multi || node.getValueAt(index) == value
+}
+
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-// if update is true, allow overwriting existing keys. else, error.
-func (node *LeafNode) insert(key int64, value int64, update bool) Split {
+// if update is true, allow overwriting the first len(values) values of existing keys. else, error.
+// In tables whose keys may repeat, only an entry with the same key and value is a duplicate.
+func (node *LeafNode) insert(key int64, values []int64, update bool) Split {
 	/* SOLUTION {{{ */
 	node.unlockParent(false)
 	defer node.unlock()
 	// Get insert position.
-	insertPos := node.search(key)
+	insertPos := node.position(key, values[0])
 	// Check if this is a duplicate entry.
-	if insertPos < node.numKeys && node.getKeyAt(insertPos) == key {
+	if node.matches(insertPos, key, values[0]) {
 		defer node.unlockParent(true)
+		if node.isTombstone(insertPos) {
+			// Reuse the cell of a key deleted in place.
+			if update {
+				return Split{err: errors.New("cannot update non-existent entry")}
+			}
+			node.modifyEntry(insertPos, newEntry(key, values))
+			return Split{}
+		}
 		if update {
-			node.updateValueAt(insertPos, value)
+			node.updateValuesAt(insertPos, values)
 			return Split{}
 		} else {
 			return Split{err: errors.New("cannot insert duplicate key")}
@@ -78,15 +121,18 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 	}
 	// Shift entries to the right if needed.
 	for i := node.numKeys - 1; i >= insertPos; i-- {
-		node.updateKeyAt(i+1, node.getKeyAt(i))
-		node.updateValueAt(i+1, node.getValueAt(i))
+		node.moveEntry(i+1, i)
 	}
 	node.updateNumKeys(node.numKeys + 1)
 	// Modify the Entry at this position.
-	node.modifyEntry(insertPos, BTreeEntry{key: key, value: value})
-	// Check if we need to split the node.
-	if node.numKeys > ENTRIES_PER_LEAF_NODE {
-		return node.split()
+	node.modifyEntry(insertPos, newEntry(key, values))
+	// Check if we need to split the node, reclaiming space from deleted entries first.
+	if node.numKeys > node.maxEntries() {
+		if node.compact() > 0 && node.numKeys <= node.maxEntries() {
+			node.unlockParent(true)
+			return Split{}
+		}
+		return node.split(node.position(key, values[0]))
 	}
 	node.unlockParent(true)
 	return Split{}
@@ -94,40 +140,72 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *LeafNode) delete(key int64) {
-	// Find entry.
-	node.unlockParent(true)
+// In tables whose keys may repeat, removes the entry with the given key and value.
+// Returns true if the node is left underfull; its parents are then still locked
+// so that the parent can rebalance it. Returns an error if there is no such entry.
+func (node *LeafNode) delete(key int64, value int64) (underflow bool, err error) {
+	// If we can't underflow, unlock the parents.
+	if node.deleteMode == utils.TOMBSTONE_DELETE || node.numKeys > node.minEntries() {
+		node.unlockParent(true)
+	}
 	defer node.unlock()
-	deletePos := node.search(key)
-	if deletePos >= node.numKeys || node.getKeyAt(deletePos) != key {
+	// Find entry.
+	deletePos := node.position(key, value)
+	if !node.matches(deletePos, key, value) || node.isTombstone(deletePos) {
 		// Thank you Mario! But our key is in another castle!
-		return
+		node.unlockParent(true)
+		return false, errors.New("cannot delete non-existent entry")
+	}
+	// Leave the other entries where they are; compaction happens later.
+	if node.deleteMode == utils.TOMBSTONE_DELETE {
+		node.setTombstone(deletePos)
+		return false, nil
 	}
 	// Shift entries to the left.
 	for i := deletePos; i < node.numKeys-1; i++ {
-		node.updateKeyAt(i, node.getKeyAt(i+1))
-		node.updateValueAt(i, node.getValueAt(i+1))
+		node.moveEntry(i, i+1)
 	}
 	node.updateNumKeys(node.numKeys - 1)
+	if node.numKeys >= node.minEntries() {
+		node.unlockParent(true)
+		return false, nil
+	}
+	return true, nil
 }
 
 // split is a helper function to split a leaf node, then propagate the split upwards.
-func (node *LeafNode) split() Split {
+// insertPos is the position of the entry that overfilled the node.
+func (node *LeafNode) split(insertPos int64) Split {
 	/* SOLUTION {{{ */
 	// Create a new leaf node to split our keys.
-	newNode, err := createLeafNode(node.page.GetPager())
+	newNode, err := createLeafNode(node.page.GetPager(), node.numValues)
 	if err != nil {
 		return Split{err: err}
 	}
 	defer newNode.getPage().Put()
-	// Set the right sibling for our two nodes.
+	// Set the siblings for our two nodes, and splice the new node into the old right sibling.
 	prevSiblingPN := node.setRightSibling(newNode.page.GetPageNum())
 	newNode.setRightSibling(prevSiblingPN)
+	newNode.setLeftSibling(node.page.GetPageNum())
+	if prevSiblingPN != NO_SIBLING_PN {
+		// Latching rightwards while holding this node, as cursors do, can't deadlock.
+		siblingPage, err := node.page.GetPager().GetPage(prevSiblingPN)
+		if err != nil {
+			return Split{err: err}
+		}
+		siblingPage.WLock()
+		pageToLeafNode(siblingPage).setLeftSibling(newNode.page.GetPageNum())
+		siblingPage.WUnlock()
+		siblingPage.Put()
+	}
 	// Transfer entries to the new node (plus the new entry) accordingly.
 	midpoint := node.numKeys / 2
+	if node.splitPolicy == RIGHT_BIASED_SPLIT && insertPos == node.numKeys-1 {
+		// Appending; leave this node full and move only the new entry.
+		midpoint = node.numKeys - 1
+	}
 	for i := midpoint; i < node.numKeys; i++ {
-		newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
-		newNode.updateValueAt(newNode.numKeys, node.getValueAt(i))
+		newNode.modifyEntry(newNode.numKeys, node.getEntry(i))
 		newNode.updateNumKeys(newNode.numKeys + 1)
 	}
 	node.updateNumKeys(midpoint)
@@ -140,19 +218,18 @@ func (node *LeafNode) split() Split {
 	/* SOLUTION }}} */
 }
 
-// get returns the value associated with a given key from the leaf node.
-func (node *LeafNode) get(key int64) (value int64, found bool) {
+// get returns the entry associated with a given key from the leaf node.
+func (node *LeafNode) get(key int64) (entry BTreeEntry, found bool) {
 	// Unlock parents, eventually unlock this node.
 	node.unlockParent(true)
 	defer node.unlock()
 	// Find index.
 	index := node.search(key)
-	if index >= node.numKeys || node.getKeyAt(index) != key {
+	if index >= node.numKeys || node.getKeyAt(index) != key || node.isTombstone(index) {
 		// Thank you Mario! But our key is in another castle!
-		return 0, false
+		return BTreeEntry{}, false
 	}
-	entry := node.getEntry(index)
-	return entry.GetValue(), true
+	return node.getEntry(index), true
 }
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
@@ -175,10 +252,18 @@ func (node *LeafNode) printNode(w io.Writer, firstPrefix string, prefix string)
 	// Print entries.
 	for Entrynum := int64(0); Entrynum < node.numKeys; Entrynum++ {
 		entry := node.getEntry(Entrynum)
-		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)\n",
-			prefix, entry.GetKey(), entry.GetValue()))
+		var deleted string
+		if node.isTombstone(Entrynum) {
+			deleted = " (deleted)"
+		}
+		var value interface{} = entry.GetValue()
+		if node.numValues > 1 {
+			value = entry.Values()
+		}
+		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)%v\n",
+			prefix, entry.GetKey(), value, deleted))
 	}
-	if node.rightSiblingPN > 0 {
+	if node.hasRightSibling() {
 		io.WriteString(w, fmt.Sprintf("%v |--+\n", prefix))
 		io.WriteString(w, fmt.Sprintf("%v    | right sibling @ [%v]\n",
 			prefix, node.rightSiblingPN))
@@ -205,12 +290,83 @@ func (node *InternalNode) search(key int64) int64 {
 	/* SOLUTION }}} */
 }
 
+// searchEntry returns the index of the child whose range holds the entry with the given key
+// and value, ordering equal keys by value ascending. A run of equal keys may span several
+// children, separated by keys equal to it; these are told apart by their first entries.
+func (node *InternalNode) searchEntry(key int64, value int64) (int64, error) {
+	childIdx := node.search(key)
+	for childIdx > 0 && node.getKeyAt(childIdx-1) == key {
+		first, ok, err := node.firstEntryAt(childIdx)
+		if err != nil {
+			return 0, err
+		}
+		if ok && (first.GetKey() < key || (first.GetKey() == key && first.GetValue() <= value)) {
+			break
+		}
+		childIdx--
+	}
+	return childIdx, nil
+}
+
+// childFor returns the index of the child whose range holds the entry with the given key and value.
+// Values only matter in tables whose keys may repeat.
+func (node *InternalNode) childFor(key int64, value int64) (int64, error) {
+	if node.multi {
+		return node.searchEntry(key, value)
+	}
+	return node.search(key), nil
+}
+
+// firstEntryAt returns the first entry at or after the start of the ith child's subtree,
+// read-latching one node at a time. ok is false if there is none.
+func (node *InternalNode) firstEntryAt(index int64) (entry BTreeEntry, ok bool, err error) {
+	page, err := node.page.GetPager().GetPage(node.getPNAt(index))
+	if err != nil {
+		return BTreeEntry{}, false, err
+	}
+	page.RLock()
+	for {
+		var nextPN int64
+		if pageToNodeHeader(page).nodeType == LEAF_NODE {
+			// Leaves emptied by merges have no first entry; try the next one.
+			leaf := pageToLeafNode(page)
+			if leaf.numKeys > 0 {
+				entry = leaf.getEntry(0)
+				releaseLeaf(leaf)
+				return entry, true, nil
+			}
+			if !leaf.hasRightSibling() {
+				releaseLeaf(leaf)
+				return BTreeEntry{}, false, nil
+			}
+			nextPN = leaf.rightSiblingPN
+		} else {
+			nextPN = pageToInternalNode(page).getPNAt(0)
+		}
+		nextPage, err := node.page.GetPager().GetPage(nextPN)
+		if err != nil {
+			page.RUnlock()
+			page.Put()
+			return BTreeEntry{}, false, err
+		}
+		nextPage.RLock()
+		page.RUnlock()
+		page.Put()
+		page = nextPage
+	}
+}
+
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-func (node *InternalNode) insert(key int64, value int64, update bool) Split {
+func (node *InternalNode) insert(key int64, values []int64, update bool) Split {
 	/* SOLUTION {{{ */
 	// Insert the entry into the appropriate child node.
 	node.unlockParent(false)
-	childIdx := node.search(key)
+	childIdx, err := node.childFor(key, values[0])
+	if err != nil {
+		node.unlockParent(true)
+		node.unlock()
+		return Split{err: err}
+	}
 	child, err := node.getAndLockChildAt(childIdx)
 	if err != nil {
 		return Split{err: err}
@@ -218,10 +374,10 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 	node.initChild(child)
 	defer child.getPage().Put()
 	// Insert value into the child.
-	result := child.insert(key, value, update)
+	result := child.insert(key, values, update)
 	// Insert a new key into our node if necessary.
 	if result.isSplit {
-		split := node.insertSplit(result)
+		split := node.insertSplit(result, childIdx)
 		defer node.unlock()
 		if !split.isSplit {
 			node.unlockParent(true)
@@ -232,11 +388,13 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 	/* SOLUTION }}} */
 }
 
-// insertSplit inserts a split result into an internal node.
+// insertSplit inserts a split result from the child at childIdx into an internal node.
 // If this insertion results in another split, the split is cascaded upwards.
-func (node *InternalNode) insertSplit(split Split) Split {
+func (node *InternalNode) insertSplit(split Split, childIdx int64) Split {
 	/* SOLUTION {{{ */
-	insertPos := node.search(split.key)
+	// The new key goes right after the split child; searching for it could land past
+	// equal keys in tables whose keys may repeat.
+	insertPos := childIdx
 	// Shift keys to the right.
 	for i := node.numKeys - 1; i >= insertPos; i-- {
 		node.updateKeyAt(i+1, node.getKeyAt(i))
@@ -251,29 +409,192 @@ func (node *InternalNode) insertSplit(split Split) Split {
 	node.updateNumKeys(node.numKeys + 1)
 	// Check if we need to split.
 	if node.numKeys > KEYS_PER_INTERNAL_NODE {
-		return node.split()
+		return node.split(insertPos)
 	}
 	return Split{}
 	/* SOLUTION }}} */
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *InternalNode) delete(key int64) {
+// In tables whose keys may repeat, removes the entry with the given key and value.
+// Returns true if the node is left underfull; its parents are then still locked
+// so that the parent can rebalance it. Returns an error if there is no such entry.
+func (node *InternalNode) delete(key int64, value int64) (underflow bool, err error) {
+	// If we can't underflow, unlock the parents.
+	if node.deleteMode == utils.TOMBSTONE_DELETE || node.numKeys > node.minKeys() {
+		node.unlockParent(true)
+	}
 	// Get child.
-	node.unlockParent(true)
-	childIdx := node.search(key)
+	childIdx, err := node.childFor(key, value)
+	if err != nil {
+		node.unlockParent(true)
+		node.unlock()
+		return false, err
+	}
 	child, err := node.getAndLockChildAt(childIdx)
 	if err != nil {
-		return
+		node.unlockParent(true)
+		node.unlock()
+		return false, err
 	}
 	node.initChild(child)
 	defer child.getPage().Put()
-	// Delete from child.
-	child.delete(key)
+	// Delete from child; unless it underflowed, it has unlocked this node.
+	if underflow, err = child.delete(key, value); !underflow {
+		return false, err
+	}
+	defer node.unlock()
+	if err = node.rebalanceChild(childIdx); err != nil || node.numKeys >= node.minKeys() {
+		node.unlockParent(true)
+		return false, err
+	}
+	return true, nil
+}
+
+// rebalanceChild fixes the underfull child at the given index by borrowing entries from
+// a neighbouring child or, if they fit in one node, merging the two.
+func (node *InternalNode) rebalanceChild(childIdx int64) error {
+	// Pair the child with its left neighbour, or its right one if it has none.
+	leftIdx := childIdx - 1
+	if childIdx == 0 {
+		leftIdx = 0
+	}
+	// Lock left to right, like cursors and splits.
+	left, err := node.getAndLockChildAt(leftIdx)
+	if err != nil {
+		return err
+	}
+	defer left.getPage().Put()
+	defer left.getPage().WUnlock()
+	right, err := node.getAndLockChildAt(leftIdx + 1)
+	if err != nil {
+		return err
+	}
+	defer right.getPage().Put()
+	defer right.getPage().WUnlock()
+	switch left := left.(type) {
+	case *LeafNode:
+		return node.rebalanceLeaves(leftIdx, left, right.(*LeafNode))
+	case *InternalNode:
+		node.rebalanceInternals(leftIdx, left, right.(*InternalNode))
+	}
+	return nil
+}
+
+// rebalanceLeaves merges or evens out the leaves on either side of the key at leftIdx.
+func (node *InternalNode) rebalanceLeaves(leftIdx int64, left *LeafNode, right *LeafNode) error {
+	if left.numKeys+right.numKeys <= left.maxEntries() {
+		// Move every entry to the left leaf and unlink the right one.
+		for i := int64(0); i < right.numKeys; i++ {
+			left.copyEntryFrom(left.numKeys+i, right, i)
+		}
+		left.updateNumKeys(left.numKeys + right.numKeys)
+		left.setRightSibling(right.rightSiblingPN)
+		nextPN := right.rightSiblingPN
+		if nextPN != NO_SIBLING_PN {
+			nextPage, err := node.page.GetPager().GetPage(nextPN)
+			if err != nil {
+				return err
+			}
+			nextPage.WLock()
+			pageToLeafNode(nextPage).setLeftSibling(left.page.GetPageNum())
+			nextPage.WUnlock()
+			nextPage.Put()
+		}
+		// The pager can't reuse the page; leave it empty, but still pointing right,
+		// so that cursors left on it step onwards.
+		right.updateNumKeys(0)
+		node.removeKeyAt(leftIdx)
+		return nil
+	}
+	if left.numKeys < right.numKeys {
+		// Move entries from the front of the right leaf to the end of the left.
+		n := (right.numKeys - left.numKeys) / 2
+		for i := int64(0); i < n; i++ {
+			left.copyEntryFrom(left.numKeys+i, right, i)
+		}
+		for i := n; i < right.numKeys; i++ {
+			right.moveEntry(i-n, i)
+		}
+		left.updateNumKeys(left.numKeys + n)
+		right.updateNumKeys(right.numKeys - n)
+	} else {
+		// Move entries from the end of the left leaf to the front of the right.
+		n := (left.numKeys - right.numKeys) / 2
+		for i := right.numKeys - 1; i >= 0; i-- {
+			right.moveEntry(i+n, i)
+		}
+		for i := int64(0); i < n; i++ {
+			right.copyEntryFrom(i, left, left.numKeys-n+i)
+		}
+		right.updateNumKeys(right.numKeys + n)
+		left.updateNumKeys(left.numKeys - n)
+	}
+	node.updateKeyAt(leftIdx, right.getKeyAt(0))
+	return nil
+}
+
+// rebalanceInternals merges or evens out the internal nodes on either side of the key at leftIdx.
+func (node *InternalNode) rebalanceInternals(leftIdx int64, left *InternalNode, right *InternalNode) {
+	separator := node.getKeyAt(leftIdx)
+	if left.numKeys+right.numKeys+1 <= KEYS_PER_INTERNAL_NODE {
+		// Pull the separator down between the two nodes' keys and drop the right node.
+		left.updateKeyAt(left.numKeys, separator)
+		for i := int64(0); i < right.numKeys; i++ {
+			left.updateKeyAt(left.numKeys+1+i, right.getKeyAt(i))
+		}
+		for i := int64(0); i <= right.numKeys; i++ {
+			left.updatePNAt(left.numKeys+1+i, right.getPNAt(i))
+		}
+		left.updateNumKeys(left.numKeys + 1 + right.numKeys)
+		right.updateNumKeys(0)
+		node.removeKeyAt(leftIdx)
+		return
+	}
+	// Rotate children through the separator until the two nodes are even.
+	for left.numKeys+1 < right.numKeys {
+		left.updateKeyAt(left.numKeys, separator)
+		left.updatePNAt(left.numKeys+1, right.getPNAt(0))
+		left.updateNumKeys(left.numKeys + 1)
+		separator = right.getKeyAt(0)
+		for i := int64(0); i < right.numKeys-1; i++ {
+			right.updateKeyAt(i, right.getKeyAt(i+1))
+		}
+		for i := int64(0); i < right.numKeys; i++ {
+			right.updatePNAt(i, right.getPNAt(i+1))
+		}
+		right.updateNumKeys(right.numKeys - 1)
+	}
+	for right.numKeys+1 < left.numKeys {
+		for i := right.numKeys - 1; i >= 0; i-- {
+			right.updateKeyAt(i+1, right.getKeyAt(i))
+		}
+		for i := right.numKeys; i >= 0; i-- {
+			right.updatePNAt(i+1, right.getPNAt(i))
+		}
+		right.updateKeyAt(0, separator)
+		right.updatePNAt(0, left.getPNAt(left.numKeys))
+		right.updateNumKeys(right.numKeys + 1)
+		separator = left.getKeyAt(left.numKeys - 1)
+		left.updateNumKeys(left.numKeys - 1)
+	}
+	node.updateKeyAt(leftIdx, separator)
+}
+
+// removeKeyAt removes the key at the given index and the child to its right.
+func (node *InternalNode) removeKeyAt(index int64) {
+	for i := index; i < node.numKeys-1; i++ {
+		node.updateKeyAt(i, node.getKeyAt(i+1))
+	}
+	for i := index + 1; i < node.numKeys; i++ {
+		node.updatePNAt(i, node.getPNAt(i+1))
+	}
+	node.updateNumKeys(node.numKeys - 1)
 }
 
 // split is a helper function that splits an internal node, then propagates the split upwards.
-func (node *InternalNode) split() Split {
+// insertPos is the position of the key that overfilled the node.
+func (node *InternalNode) split(insertPos int64) Split {
 	/* SOLUTION {{{ */
 	// Create a new internal node to split our keys.
 	newNode, err := createInternalNode(node.page.GetPager())
@@ -283,6 +604,10 @@ func (node *InternalNode) split() Split {
 	defer newNode.getPage().Put()
 	// Compute the midpoint based on the number of children to move.
 	midpoint := (node.numKeys - 1) / 2
+	if node.splitPolicy == RIGHT_BIASED_SPLIT && insertPos == node.numKeys-1 {
+		// Appending; move only the last two children.
+		midpoint = node.numKeys - 1
+	}
 	// Transfer the keys to the new node.
 	for i := midpoint; i <= node.numKeys; i++ {
 		newNode.updatePNAt(newNode.numKeys, node.getPNAt(i))
@@ -303,15 +628,15 @@ func (node *InternalNode) split() Split {
 	/* SOLUTION }}} */
 }
 
-// get returns the value associated with a given key from the leaf node.
-func (node *InternalNode) get(key int64) (value int64, found bool) {
+// get returns the entry associated with a given key from the leaf node.
+func (node *InternalNode) get(key int64) (entry BTreeEntry, found bool) {
 	// [CONCURRENCY] Unlock parents.
 	node.unlockParent(true)
 	// Find the child.
 	childIdx := node.search(key)
 	child, err := node.getAndLockChildAt(childIdx)
 	if err != nil {
-		return 0, false
+		return BTreeEntry{}, false
 	}
 	node.initChild(child)
 	defer child.getPage().Put()
@@ -2,6 +2,8 @@ package btree
 
 import (
 	"errors"
+	"fmt"
+	"math"
 )
 
 func IsBTree(index *BTreeIndex) (l int64, r int64, isbtree bool, err error) {
@@ -10,6 +12,7 @@ func IsBTree(index *BTreeIndex) (l int64, r int64, isbtree bool, err error) {
 	if err != nil {
 		return 0, 0, false, err
 	}
+	defer rootPage.Put()
 	n := pageToNode(rootPage)
 	return isBTree(n)
 }
@@ -28,6 +31,7 @@ func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
 			}
 			// Check if child is BTree
 			cl, cr, cisbtree, err := isBTree(c)
+			c.getPage().Put()
 			if err != nil {
 				return -1, -1, false, err
 			} else if !cisbtree {
@@ -69,3 +73,135 @@ func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
 		return -1, -1, false, errors.New("should not have gotten here")
 	}
 }
+
+// IsBTreeStrict checks the tree's structure, returning an error naming the first broken
+// invariant, or nil if there is none. Keys must ascend within every node and fall within
+// the bounds set by the keys above them; no node may hold more than it has room for;
+// every leaf must be at the same depth; and the sibling pointers must link the leaves in
+// key order. In tables whose keys may repeat, equal keys may also separate children whose
+// entries share them, and entries must ascend by key, then value, across the leaves.
+// The table must not be modified while it is checked.
+func IsBTreeStrict(index *BTreeIndex) error {
+	rootPage, err := index.pager.GetPage(index.rootPN)
+	if err != nil {
+		return err
+	}
+	defer rootPage.Put()
+	checker := btreeChecker{
+		numValues: index.numValues,
+		multi:     index.multi,
+		leafDepth: -1,
+		prevLeaf:  NO_SIBLING_PN,
+		nextLeaf:  NO_SIBLING_PN,
+		visited:   make(map[int64]bool),
+	}
+	if err = checker.check(pageToNode(rootPage), 1, math.MinInt64, math.MaxInt64, false); err != nil {
+		return err
+	}
+	if checker.nextLeaf != NO_SIBLING_PN {
+		return fmt.Errorf("last leaf on page %v points right to page %v", checker.prevLeaf, checker.nextLeaf)
+	}
+	return nil
+}
+
+// btreeChecker carries what IsBTreeStrict has seen so far through its walk of the tree.
+type btreeChecker struct {
+	numValues int64          // Number of values in each entry.
+	multi     bool           // Whether keys may repeat.
+	lastEntry *BTreeEntry    // Last entry visited, in tables whose keys may repeat.
+	leafDepth int64          // Depth of the leaves, or -1 before the first.
+	prevLeaf  int64          // Page number of the last leaf visited.
+	nextLeaf  int64          // Right sibling of the last leaf visited.
+	visited   map[int64]bool // Page numbers visited, to catch cycles.
+}
+
+// check checks the subtree rooted at the given node, at the given depth, whose keys must
+// be at least lo and, if hasHi, less than hi (or at most hi, in tables whose keys may repeat).
+// Leaves must be visited in key order.
+func (checker *btreeChecker) check(n Node, depth int64, lo int64, hi int64, hasHi bool) error {
+	pn := n.getPage().GetPageNum()
+	if checker.visited[pn] {
+		return fmt.Errorf("page %v is reachable twice", pn)
+	}
+	checker.visited[pn] = true
+	inBounds := func(key int64) bool {
+		return key >= lo && (!hasHi || key < hi || (checker.multi && key == hi))
+	}
+	// Separators may repeat in tables whose keys may repeat.
+	outOfOrder := func(key int64, prev int64) bool {
+		return key < prev || (key == prev && !checker.multi)
+	}
+	switch node := n.(type) {
+	case *InternalNode:
+		if node.numKeys < 1 || node.numKeys > KEYS_PER_INTERNAL_NODE {
+			return fmt.Errorf("internal node on page %v holds %v keys, outside [1, %v]", pn, node.numKeys, KEYS_PER_INTERNAL_NODE)
+		}
+		for i := int64(0); i < node.numKeys; i++ {
+			key := node.getKeyAt(i)
+			if i > 0 && outOfOrder(key, node.getKeyAt(i-1)) {
+				return fmt.Errorf("internal node on page %v has key %v after %v", pn, key, node.getKeyAt(i-1))
+			}
+			if !inBounds(key) {
+				return fmt.Errorf("internal node on page %v has key %v outside its bounds", pn, key)
+			}
+		}
+		for i := int64(0); i <= node.numKeys; i++ {
+			childLo, childHi, childHasHi := lo, hi, hasHi
+			if i > 0 {
+				childLo = node.getKeyAt(i - 1)
+			}
+			if i < node.numKeys {
+				childHi, childHasHi = node.getKeyAt(i), true
+			}
+			child, err := node.getChildAt(i)
+			if err != nil {
+				return err
+			}
+			err = checker.check(child, depth+1, childLo, childHi, childHasHi)
+			child.getPage().Put()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *LeafNode:
+		if node.numValues != checker.numValues {
+			return fmt.Errorf("leaf on page %v stores %v values per entry, not %v", pn, node.numValues, checker.numValues)
+		}
+		if node.numKeys < 0 || node.numKeys > node.maxEntries() {
+			return fmt.Errorf("leaf on page %v holds %v entries, outside [0, %v]", pn, node.numKeys, node.maxEntries())
+		}
+		for i := int64(0); i < node.numKeys; i++ {
+			key := node.getKeyAt(i)
+			if i > 0 && outOfOrder(key, node.getKeyAt(i-1)) {
+				return fmt.Errorf("leaf on page %v has key %v after %v", pn, key, node.getKeyAt(i-1))
+			}
+			if checker.multi {
+				entry := node.getEntry(i)
+				if last := checker.lastEntry; last != nil && key == last.GetKey() && entry.GetValue() <= last.GetValue() {
+					return fmt.Errorf("leaf on page %v has entry (%v, %v) after (%v, %v)", pn, key, entry.GetValue(), key, last.GetValue())
+				}
+				checker.lastEntry = &entry
+			}
+			if !inBounds(key) {
+				return fmt.Errorf("leaf on page %v has key %v outside its bounds", pn, key)
+			}
+		}
+		if checker.leafDepth == -1 {
+			checker.leafDepth = depth
+		} else if depth != checker.leafDepth {
+			return fmt.Errorf("leaf on page %v is at depth %v, not %v like the leaves before it", pn, depth, checker.leafDepth)
+		}
+		// The previous leaf must point right here, and this one left there.
+		if checker.prevLeaf != NO_SIBLING_PN && checker.nextLeaf != pn {
+			return fmt.Errorf("leaf on page %v points right to page %v, not %v", checker.prevLeaf, checker.nextLeaf, pn)
+		}
+		if node.leftSiblingPN != checker.prevLeaf {
+			return fmt.Errorf("leaf on page %v points left to page %v, not %v", pn, node.leftSiblingPN, checker.prevLeaf)
+		}
+		checker.prevLeaf, checker.nextLeaf = pn, node.rightSiblingPN
+		return nil
+	default:
+		return errors.New("should not have gotten here")
+	}
+}
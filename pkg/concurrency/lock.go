@@ -33,15 +33,28 @@ func (r *Resource) GetResourceKey() int64 {
 type LockManager struct {
 	lmMtx sync.Mutex
 	locks map[Resource]*sync.RWMutex
+	held  map[Resource]int // Number of holders of each locked resource.
 }
 
 // Construct a new lock manager.
 func NewLockManager() *LockManager {
 	return &LockManager{
 		locks: make(map[Resource]*sync.RWMutex),
+		held:  make(map[Resource]int),
 	}
 }
 
+// Get the resources that are currently locked.
+func (lm *LockManager) GetHeldResources() []Resource {
+	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
+	resources := make([]Resource, 0, len(lm.held))
+	for r := range lm.held {
+		resources = append(resources, r)
+	}
+	return resources
+}
+
 // Lock a resource.
 func (lm *LockManager) Lock(r Resource, lType LockType) error {
 	// Safely acquire the lock itself, initializing it if needed.
@@ -59,17 +72,47 @@ func (lm *LockManager) Lock(r Resource, lType LockType) error {
 	case W_LOCK:
 		lock.Lock()
 	}
+	lm.lmMtx.Lock()
+	lm.held[r]++
+	lm.lmMtx.Unlock()
 	return nil
 }
 
+// Lock a resource only if that doesn't have to wait; reports whether it was locked.
+func (lm *LockManager) TryLock(r Resource, lType LockType) bool {
+	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
+	lock, found := lm.locks[r]
+	if !found {
+		lm.locks[r] = &sync.RWMutex{}
+		lock = lm.locks[r]
+	}
+	locked := false
+	switch lType {
+	case R_LOCK:
+		locked = lock.TryRLock()
+	case W_LOCK:
+		locked = lock.TryLock()
+	}
+	if locked {
+		lm.held[r]++
+	}
+	return locked
+}
+
 // Unlock a resource.
 func (lm *LockManager) Unlock(r Resource, lType LockType) error {
 	// Safely acquire the lock itself.
 	lm.lmMtx.Lock()
 	lock, found := lm.locks[r]
 	if !found {
+		lm.lmMtx.Unlock()
 		return errors.New("tried to unlock nonexistent resource")
 	}
+	lm.held[r]--
+	if lm.held[r] <= 0 {
+		delete(lm.held, r)
+	}
 	lm.lmMtx.Unlock()
 	// Unlock accordingly.
 	switch lType {
@@ -3,16 +3,87 @@ package concurrency
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	uuid "github.com/google/uuid"
 )
 
+// Deadlocks detected less than this long ago count as recent; see NumRecentDeadlocks.
+var RECENT_DEADLOCK_WINDOW = time.Minute
+
+// Returned by Commit when an optimistic transaction read data that has since changed.
+var ErrValidationFailed = errors.New("optimistic validation failed")
+
+// A transaction either locks resources up front or validates them at commit.
+type TransactionMode int
+
+const (
+	PESSIMISTIC_MODE TransactionMode = 0 // Strict two-phase locking.
+	OPTIMISTIC_MODE  TransactionMode = 1 // Record versions, validate at commit.
+)
+
+// [OPTIMISTIC] The kinds of write an optimistic transaction holds back until it commits.
+type writeKind int
+
+const (
+	insertWrite writeKind = 0
+	updateWrite writeKind = 1
+	deleteWrite writeKind = 2
+)
+
+// [OPTIMISTIC] A write an optimistic transaction holds back until it validates.
+type bufferedWrite struct {
+	table db.Index
+	kind  writeKind
+	key   int64
+	value int64
+}
+
+// Applies the write to its table.
+func (write bufferedWrite) apply() error {
+	switch write.kind {
+	case insertWrite:
+		return write.table.Insert(write.key, write.value)
+	case updateWrite:
+		return write.table.Update(write.key, write.value)
+	default:
+		return write.table.Delete(write.key)
+	}
+}
+
+// Returns the write that undoes this one, read from the table before this one is applied.
+func (write bufferedWrite) inverse() (bufferedWrite, error) {
+	if write.kind == insertWrite {
+		return bufferedWrite{table: write.table, kind: deleteWrite, key: write.key}, nil
+	}
+	entry, err := write.table.Find(write.key)
+	if err != nil {
+		return bufferedWrite{}, err
+	}
+	kind := insertWrite
+	if write.kind == updateWrite {
+		kind = updateWrite
+	}
+	return bufferedWrite{table: write.table, kind: kind, key: write.key, value: entry.GetValue()}, nil
+}
+
+// Returns the resource the write changes.
+func (write bufferedWrite) resource() Resource {
+	return Resource{tableName: write.table.GetName(), resourceKey: write.key}
+}
+
 // Each client can have a transaction running. Each transaction has a list of locked resources.
 type Transaction struct {
 	clientId  uuid.UUID
 	resources map[Resource]LockType
 	lock      sync.RWMutex
+	mode      TransactionMode
+	versions  map[Resource]int64 // [OPTIMISTIC] Version of each resource when first accessed.
+	writes    []bufferedWrite    // [OPTIMISTIC] Writes to apply once the transaction validates.
+	parent    *Transaction       // [NESTED] Enclosing transaction, or nil at the top level.
+	child     *Transaction       // [NESTED] Open subtransaction, if any.
 }
 
 // Grab a write lock on the tx
@@ -40,22 +111,77 @@ func (t *Transaction) GetClientID() (clientId uuid.UUID) {
 	return t.clientId
 }
 
+// Get the transaction's mode.
+func (t *Transaction) GetMode() TransactionMode {
+	return t.mode
+}
+
 // Get the transaction's resources.
 func (t *Transaction) GetResources() (resources map[Resource]LockType) {
 	return t.resources
 }
 
+// Get the enclosing transaction; nil if this is a top-level transaction.
+func (t *Transaction) GetParent() *Transaction {
+	return t.parent
+}
+
+// [OPTIMISTIC] Returns the value the transaction's own writes leave at the key, whether
+// they leave one at all, and whether they touch the key. t should be locked on entry.
+func (t *Transaction) pendingValue(table db.Index, key int64) (value int64, present bool, touched bool) {
+	for _, write := range t.writes {
+		if write.key != key || write.table.GetName() != table.GetName() {
+			continue
+		}
+		value, present, touched = write.value, write.kind != deleteWrite, true
+	}
+	return value, present, touched
+}
+
+// [NESTED] Returns the lock an enclosing transaction holds on the resource, if any.
+func (t *Transaction) ancestorLock(r Resource) (lType LockType, found bool) {
+	for p := t.parent; p != nil; p = p.parent {
+		p.RLock()
+		lType, found = p.resources[r]
+		p.RUnlock()
+		if found {
+			return lType, true
+		}
+	}
+	return lType, false
+}
+
+// [NESTED] Checks if the given transaction encloses this one.
+func (t *Transaction) isDescendantOf(other *Transaction) bool {
+	for p := t.parent; p != nil; p = p.parent {
+		if p == other {
+			return true
+		}
+	}
+	return false
+}
+
 // Transaction Manager manages all of the transactions on a server.
 type TransactionManager struct {
 	lm           *LockManager
 	tmMtx        sync.RWMutex
 	pGraph       *Graph
 	transactions map[uuid.UUID]*Transaction
+	numDeadlocks int64       // Number of lock requests refused due to deadlock; accessed atomically.
+	deadlocks    []time.Time // When each recent deadlock was detected, oldest first.
+	deadlocksMtx sync.Mutex
+	versions     map[Resource]int64 // [OPTIMISTIC] Number of committed writes to each resource.
+	versionsMtx  sync.Mutex
 }
 
 // Get a pointer to a new transaction manager.
 func NewTransactionManager(lm *LockManager) *TransactionManager {
-	return &TransactionManager{lm: lm, pGraph: NewGraph(), transactions: make(map[uuid.UUID]*Transaction)}
+	return &TransactionManager{
+		lm:           lm,
+		pGraph:       NewGraph(),
+		transactions: make(map[uuid.UUID]*Transaction),
+		versions:     make(map[Resource]int64),
+	}
 }
 
 // Get the transactions.
@@ -63,9 +189,54 @@ func (tm *TransactionManager) GetLockManager() (lm *LockManager) {
 	return tm.lm
 }
 
-// Get the transactions.
+// Get a snapshot of the running transactions, safe to range over while transactions begin and end.
 func (tm *TransactionManager) GetTransactions() (txs map[uuid.UUID]*Transaction) {
-	return tm.transactions
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	txs = make(map[uuid.UUID]*Transaction, len(tm.transactions))
+	for id, t := range tm.transactions {
+		txs[id] = t
+	}
+	return txs
+}
+
+// Get the number of running transactions.
+func (tm *TransactionManager) NumTransactions() int {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	return len(tm.transactions)
+}
+
+// Get the number of deadlocks detected so far.
+func (tm *TransactionManager) NumDeadlocks() int64 {
+	return atomic.LoadInt64(&tm.numDeadlocks)
+}
+
+// Get the number of deadlocks detected within the last RECENT_DEADLOCK_WINDOW.
+func (tm *TransactionManager) NumRecentDeadlocks() int {
+	tm.deadlocksMtx.Lock()
+	defer tm.deadlocksMtx.Unlock()
+	tm.forgetOldDeadlocks(time.Now())
+	return len(tm.deadlocks)
+}
+
+// Count a deadlock detected now.
+func (tm *TransactionManager) noteDeadlock() {
+	atomic.AddInt64(&tm.numDeadlocks, 1)
+	now := time.Now()
+	tm.deadlocksMtx.Lock()
+	defer tm.deadlocksMtx.Unlock()
+	tm.forgetOldDeadlocks(now)
+	tm.deadlocks = append(tm.deadlocks, now)
+}
+
+// Drop the deadlocks that are no longer recent. deadlocksMtx should be locked on entry.
+func (tm *TransactionManager) forgetOldDeadlocks(now time.Time) {
+	i := 0
+	for i < len(tm.deadlocks) && now.Sub(tm.deadlocks[i]) >= RECENT_DEADLOCK_WINDOW {
+		i++
+	}
+	tm.deadlocks = tm.deadlocks[i:]
 }
 
 // Get a particular transaction.
@@ -78,16 +249,44 @@ func (tm *TransactionManager) GetTransaction(clientId uuid.UUID) (tx *Transactio
 
 // Begin a transaction for the given client; error if already began.
 func (tm *TransactionManager) Begin(clientId uuid.UUID) (err error) {
+	return tm.BeginWithMode(clientId, PESSIMISTIC_MODE)
+}
+
+// Begin a transaction in the given mode for the given client; error if already began.
+func (tm *TransactionManager) BeginWithMode(clientId uuid.UUID, mode TransactionMode) (err error) {
 	tm.tmMtx.Lock()
 	defer tm.tmMtx.Unlock()
 	_, found := tm.transactions[clientId]
 	if found {
 		return errors.New("transaction already began")
 	}
-	tm.transactions[clientId] = &Transaction{clientId: clientId, resources: make(map[Resource]LockType)}
+	tm.transactions[clientId] = newTransaction(clientId, mode)
 	return nil
 }
 
+// Begin a transaction for the given client unless one is already running.
+// Returns the client's transaction, and whether it was just begun.
+func (tm *TransactionManager) BeginOrGet(clientId uuid.UUID) (tx *Transaction, began bool, err error) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	if tx, found := tm.transactions[clientId]; found {
+		return tx, false, nil
+	}
+	tx = newTransaction(clientId, PESSIMISTIC_MODE)
+	tm.transactions[clientId] = tx
+	return tx, true, nil
+}
+
+// newTransaction constructs a top-level transaction that holds no resources.
+func newTransaction(clientId uuid.UUID, mode TransactionMode) *Transaction {
+	return &Transaction{
+		clientId:  clientId,
+		resources: make(map[Resource]LockType),
+		mode:      mode,
+		versions:  make(map[Resource]int64),
+	}
+}
+
 // Locks the given resource. Will return an error if deadlock is created.
 func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceKey int64, lType LockType) (err error) {
 	/* SOLUTION {{{ */
@@ -99,7 +298,20 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 		return errors.New("transaction not found")
 	}
 	resource := Resource{tableName: table.GetName(), resourceKey: resourceKey}
-	// Check if we already have rights to the resource
+	// Optimistic transactions don't lock; they remember what they saw.
+	if t.mode == OPTIMISTIC_MODE {
+		tm.tmMtx.RUnlock()
+		tm.recordAccess(t, resource, lType)
+		return nil
+	}
+	// Check if we already have rights to the resource, either directly or through a parent.
+	if heldType, ok := t.ancestorLock(resource); ok {
+		tm.tmMtx.RUnlock()
+		if heldType == W_LOCK || heldType == lType {
+			return nil
+		}
+		return errors.New("cannot upgrade a lock held by a parent transaction")
+	}
 	t.RLock()
 	if curLockType, ok := t.resources[resource]; ok {
 		tm.tmMtx.RUnlock()
@@ -113,7 +325,7 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 	t.RUnlock()
 	// Create a precedence graph, see if we create a cycle by locking this resource.
 	for _, tt := range tm.discoverTransactions(resource, lType) {
-		if t == tt {
+		if t == tt || t.isDescendantOf(tt) {
 			continue
 		}
 		tm.pGraph.AddEdge(t, tt)
@@ -121,6 +333,7 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 	}
 	// If a deadlock, unlock and error.
 	if tm.pGraph.DetectCycle() {
+		tm.noteDeadlock()
 		tm.tmMtx.RUnlock()
 		return errors.New("deadlock detected")
 	}
@@ -148,6 +361,15 @@ func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourc
 	// Iterate through our locks to find the right one and remove it.
 	t.WLock()
 	defer t.WUnlock()
+	if t.mode == OPTIMISTIC_MODE {
+		// Keep the recorded version so the access is still validated at commit.
+		if storedType, ok := t.resources[resource]; !ok {
+			return errors.New("resource not locked")
+		} else if storedType != lType {
+			return errors.New("incorrect unlock type")
+		}
+		return nil
+	}
 	removed := false
 	for r, storedType := range t.resources {
 		if r == resource {
@@ -181,9 +403,21 @@ func (tm *TransactionManager) Commit(clientId uuid.UUID) (err error) {
 	if !found {
 		return errors.New("no transactions running")
 	}
-	// Unlock all resources.
+	if t.parent != nil {
+		return errors.New("use CommitNested to commit a nested transaction")
+	}
+	if t.child != nil {
+		return errors.New("cannot commit while a nested transaction is open")
+	}
+	if t.mode == OPTIMISTIC_MODE {
+		// The transaction ends either way.
+		delete(tm.transactions, clientId)
+		return tm.validateAndCommit(t)
+	}
+	// Unlock all resources, once optimistic readers can tell they were written.
 	t.RLock()
 	defer t.RUnlock()
+	tm.bumpVersions(t.resources)
 	for r, lType := range t.resources {
 		err := tm.lm.Unlock(r, lType)
 		if err != nil {
@@ -195,10 +429,161 @@ func (tm *TransactionManager) Commit(clientId uuid.UUID) (err error) {
 	return nil
 }
 
+// Aborts the given client's transaction, first aborting any open nested transactions,
+// innermost first, and releases every lock they held. Buffered optimistic writes are
+// dropped; writes a pessimistic transaction already made are not undone.
+func (tm *TransactionManager) Abort(clientId uuid.UUID) (err error) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	t, found := tm.transactions[clientId]
+	if !found {
+		return errors.New("no transactions running")
+	}
+	if t.parent != nil {
+		return errors.New("use AbortNested to abort a nested transaction")
+	}
+	innermost := t
+	for innermost.child != nil {
+		innermost = innermost.child
+	}
+	for tx := innermost; tx != nil; tx = tx.parent {
+		if err = tm.release(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release the locks the given transaction acquired itself and remove it from the running
+// transactions list. tmMtx should be locked on entry.
+func (tm *TransactionManager) release(t *Transaction) (err error) {
+	t.WLock()
+	defer t.WUnlock()
+	// Writes already made are kept, so they count against optimistic readers too.
+	tm.bumpVersions(t.resources)
+	for r, lType := range t.resources {
+		if err = tm.lm.Unlock(r, lType); err != nil {
+			return err
+		}
+		delete(t.resources, r)
+	}
+	if t.parent != nil {
+		t.parent.child = nil
+	}
+	delete(tm.transactions, t.clientId)
+	return nil
+}
+
+// [NESTED] Begin a subtransaction of the given client's transaction and return its id.
+// The child treats every lock its ancestors hold as already held, and tracks the locks
+// it acquires itself. A transaction may have at most one open child at a time.
+func (tm *TransactionManager) BeginNested(parentClientId uuid.UUID) (childId uuid.UUID, err error) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	parent, found := tm.transactions[parentClientId]
+	if !found {
+		return uuid.Nil, errors.New("transaction not found")
+	}
+	if parent.mode == OPTIMISTIC_MODE {
+		return uuid.Nil, errors.New("optimistic transactions cannot be nested")
+	}
+	if parent.child != nil {
+		return uuid.Nil, errors.New("transaction already has an open nested transaction")
+	}
+	childId = uuid.New()
+	child := &Transaction{
+		clientId:  childId,
+		resources: make(map[Resource]LockType),
+		mode:      parent.mode,
+		versions:  make(map[Resource]int64),
+		parent:    parent,
+	}
+	parent.child = child
+	tm.transactions[childId] = child
+	return childId, nil
+}
+
+// [NESTED] Commits the given subtransaction, handing the locks it acquired to its parent.
+func (tm *TransactionManager) CommitNested(childId uuid.UUID) (err error) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	child, err := tm.getNested(childId)
+	if err != nil {
+		return err
+	}
+	// The parent now holds the child's locks until it ends itself.
+	child.RLock()
+	child.parent.WLock()
+	for r, lType := range child.resources {
+		child.parent.resources[r] = lType
+	}
+	child.parent.WUnlock()
+	child.RUnlock()
+	child.parent.child = nil
+	delete(tm.transactions, childId)
+	return nil
+}
+
+// [NESTED] Aborts the given subtransaction, releasing only the locks it acquired itself.
+func (tm *TransactionManager) AbortNested(childId uuid.UUID) (err error) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	child, err := tm.getNested(childId)
+	if err != nil {
+		return err
+	}
+	child.WLock()
+	defer child.WUnlock()
+	tm.bumpVersions(child.resources)
+	for r, lType := range child.resources {
+		if err = tm.lm.Unlock(r, lType); err != nil {
+			return err
+		}
+		delete(child.resources, r)
+	}
+	child.parent.child = nil
+	delete(tm.transactions, childId)
+	return nil
+}
+
+// [NESTED] Get the id of the innermost open subtransaction of the given client's transaction.
+func (tm *TransactionManager) GetOpenNested(clientId uuid.UUID) (childId uuid.UUID, found bool) {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	t, found := tm.transactions[clientId]
+	if !found || t.child == nil {
+		return uuid.Nil, false
+	}
+	for t.child != nil {
+		t = t.child
+	}
+	return t.clientId, true
+}
+
+// [NESTED] Get an open subtransaction that has no open subtransaction of its own.
+// tmMtx should be locked on entry.
+func (tm *TransactionManager) getNested(childId uuid.UUID) (*Transaction, error) {
+	child, found := tm.transactions[childId]
+	if !found {
+		return nil, errors.New("transaction not found")
+	}
+	if child.parent == nil {
+		return nil, errors.New("not a nested transaction")
+	}
+	if child.child != nil {
+		return nil, errors.New("nested transaction has an open nested transaction")
+	}
+	return child, nil
+}
+
 // Returns a slice of all transactions that conflict w/ the given resource and locktype.
 func (tm *TransactionManager) discoverTransactions(r Resource, lType LockType) (txs []*Transaction) {
 	txs = make([]*Transaction, 0)
 	for _, t := range tm.transactions {
+		// Optimistic transactions hold no locks to wait on.
+		if t.mode == OPTIMISTIC_MODE {
+			continue
+		}
 		t.RLock()
 		for storedResource, storedType := range t.resources {
 			if storedResource == r && (storedType == W_LOCK || lType == W_LOCK) {
@@ -210,3 +595,128 @@ func (tm *TransactionManager) discoverTransactions(r Resource, lType LockType) (
 	}
 	return txs
 }
+
+// [OPTIMISTIC] Record the version of a resource the first time a transaction accesses it.
+func (tm *TransactionManager) recordAccess(t *Transaction, r Resource, lType LockType) {
+	tm.versionsMtx.Lock()
+	version := tm.versions[r]
+	tm.versionsMtx.Unlock()
+	t.WLock()
+	defer t.WUnlock()
+	if _, seen := t.versions[r]; !seen {
+		t.versions[r] = version
+	}
+	if curLockType, ok := t.resources[r]; !ok || curLockType == R_LOCK {
+		t.resources[r] = lType
+	}
+}
+
+// [OPTIMISTIC] Checks a write against what the client's optimistic transaction can see,
+// then holds it back until the transaction commits. Reports false, doing nothing, if the
+// client's transaction isn't optimistic.
+func (tm *TransactionManager) bufferWrite(clientId uuid.UUID, write bufferedWrite) (buffered bool, err error) {
+	t, found := tm.GetTransaction(clientId)
+	if !found || t.mode != OPTIMISTIC_MODE {
+		return false, nil
+	}
+	t.WLock()
+	defer t.WUnlock()
+	_, present, touched := t.pendingValue(write.table, write.key)
+	if !touched {
+		entry, _ := write.table.Find(write.key)
+		present = entry != nil
+	}
+	if write.kind == insertWrite && present {
+		return true, errors.New("key already in table")
+	}
+	if write.kind != insertWrite && !present {
+		return true, errors.New("key not found")
+	}
+	t.writes = append(t.writes, write)
+	return true, nil
+}
+
+// [OPTIMISTIC] Returns the value the client's optimistic transaction has written at the key,
+// whether it left one at all, and whether it wrote to the key.
+func (tm *TransactionManager) pendingFind(clientId uuid.UUID, table db.Index, key int64) (value int64, present bool, touched bool) {
+	t, found := tm.GetTransaction(clientId)
+	if !found || t.mode != OPTIMISTIC_MODE {
+		return 0, false, false
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return t.pendingValue(table, key)
+}
+
+// [OPTIMISTIC] Count a committed write to every resource held with a write lock, so
+// optimistic transactions that read one before the write fail validation.
+func (tm *TransactionManager) bumpVersions(resources map[Resource]LockType) {
+	tm.versionsMtx.Lock()
+	defer tm.versionsMtx.Unlock()
+	for r, lType := range resources {
+		if lType == W_LOCK {
+			tm.versions[r]++
+		}
+	}
+}
+
+// [OPTIMISTIC] Check that nothing the transaction accessed was changed by a transaction
+// that committed since, and that no pessimistic transaction holds a lock on anything it
+// writes; if so, apply its writes, then publish them by bumping their versions. If
+// validation or any write fails, the tables are left as they were before the commit.
+func (tm *TransactionManager) validateAndCommit(t *Transaction) error {
+	t.RLock()
+	defer t.RUnlock()
+	// Hold the write locks for the write set while applying it. Waiting on them could
+	// deadlock with their holders, so a held lock fails validation instead.
+	locked := make(map[Resource]LockType)
+	defer func() {
+		for r := range locked {
+			tm.lm.Unlock(r, W_LOCK)
+		}
+	}()
+	writeSet := make([]Resource, 0, len(t.writes))
+	for _, write := range t.writes {
+		writeSet = append(writeSet, write.resource())
+	}
+	for r, lType := range t.resources {
+		if lType == W_LOCK {
+			writeSet = append(writeSet, r)
+		}
+	}
+	for _, r := range writeSet {
+		if _, ok := locked[r]; ok {
+			continue
+		}
+		if !tm.lm.TryLock(r, W_LOCK) {
+			return ErrValidationFailed
+		}
+		locked[r] = W_LOCK
+	}
+	tm.versionsMtx.Lock()
+	for r, seen := range t.versions {
+		if tm.versions[r] != seen {
+			tm.versionsMtx.Unlock()
+			return ErrValidationFailed
+		}
+	}
+	tm.versionsMtx.Unlock()
+	// Commits hold tmMtx, so no other transaction commits between validating and applying.
+	// Apply every write, undoing those already applied if one fails.
+	undo := make([]bufferedWrite, 0, len(t.writes))
+	for _, write := range t.writes {
+		inverse, err := write.inverse()
+		if err == nil {
+			err = write.apply()
+		}
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i].apply()
+			}
+			return err
+		}
+		undo = append(undo, inverse)
+	}
+	tm.bumpVersions(locked)
+	return nil
+}
@@ -40,13 +40,16 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	}, "Joins two tables. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
 	r.AddCommand("transaction", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleTransaction(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Handle transactions. usage: transaction <begin|commit>")
+	}, "Handle transactions. usage: transaction <begin [optimistic]|commit>")
 	r.AddCommand("lock", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleLock(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Grabs a write lock on a resource. usage: lock <table> <key>")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	// Shorthands for the most common commands; their targets are registered above.
+	r.AddAlias("b", "transaction begin")
+	r.AddAlias("c", "transaction commit")
 	return r
 }
 
@@ -54,9 +57,12 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 func HandleTransaction(d *db.Database, tm *TransactionManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: create <type> table <table>
+	// Usage: transaction <begin [optimistic]|commit>
+	if numFields == 3 && fields[1] == "begin" && fields[2] == "optimistic" {
+		return tm.BeginWithMode(clientId, OPTIMISTIC_MODE)
+	}
 	if numFields != 2 || (fields[1] != "begin" && fields[1] != "commit") {
-		return errors.New("usage: transaction <begin|commit>")
+		return errors.New("usage: transaction <begin [optimistic]|commit>")
 	}
 	switch fields[1] {
 	case "begin":
@@ -93,6 +99,16 @@ func HandleFind(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 	if err = tm.Lock(clientId, table, int64(key), R_LOCK); err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
+	// Optimistic transactions see their own writes before they commit.
+	if value, present, touched := tm.pendingFind(clientId, table, int64(key)); touched {
+		if !present {
+			return errors.New("find error: key not found")
+		}
+		return repl.WriteRow(w, repl.Row{
+			Text:   fmt.Sprintf("found entry: (%v, %v)", key, value),
+			Fields: map[string]interface{}{"key": int64(key), "value": value},
+		})
+	}
 	if err = db.HandleFind(d, payload, w); err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
@@ -104,7 +120,7 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 	fields := strings.Fields(payload)
 	numFields := len(fields)
 	// Usage: insert <key> <value> into <table>
-	var key int
+	var key, value int
 	var table db.Index
 	if numFields != 5 || fields[3] != "into" {
 		return fmt.Errorf("usage: insert <key> <value> into <table>")
@@ -112,6 +128,9 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 	if key, err = strconv.Atoi(fields[1]); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
+	if value, err = strconv.Atoi(fields[2]); err != nil {
+		return fmt.Errorf("insert error: %v", err)
+	}
 	if table, err = d.GetTable(fields[4]); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
@@ -119,6 +138,13 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
+	// Optimistic transactions hold their writes back until they commit.
+	if buffered, err := tm.bufferWrite(clientId, bufferedWrite{table: table, kind: insertWrite, key: int64(key), value: int64(value)}); buffered {
+		if err != nil {
+			return fmt.Errorf("insert error: %v", err)
+		}
+		return nil
+	}
 	if err = db.HandleInsert(d, payload); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
@@ -130,7 +156,7 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 	fields := strings.Fields(payload)
 	numFields := len(fields)
 	// Usage: update <table> <key> <value>
-	var key int
+	var key, value int
 	var table db.Index
 	if numFields != 4 {
 		return fmt.Errorf("usage: update <table> <key> <value>")
@@ -138,6 +164,9 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 	if key, err = strconv.Atoi(fields[2]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
+	if value, err = strconv.Atoi(fields[3]); err != nil {
+		return fmt.Errorf("update error: %v", err)
+	}
 	if table, err = d.GetTable(fields[1]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
@@ -145,6 +174,12 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
+	if buffered, err := tm.bufferWrite(clientId, bufferedWrite{table: table, kind: updateWrite, key: int64(key), value: int64(value)}); buffered {
+		if err != nil {
+			return fmt.Errorf("update error: %v", err)
+		}
+		return nil
+	}
 	if err = db.HandleUpdate(d, payload); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
@@ -171,6 +206,12 @@ func HandleDelete(d *db.Database, tm *TransactionManager, payload string, client
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
 		return fmt.Errorf("delete error: %v", err)
 	}
+	if buffered, err := tm.bufferWrite(clientId, bufferedWrite{table: table, kind: deleteWrite, key: int64(key)}); buffered {
+		if err != nil {
+			return fmt.Errorf("delete error: %v", err)
+		}
+		return nil
+	}
 	if err = db.HandleDelete(d, payload); err != nil {
 		return fmt.Errorf("delete error: %v", err)
 	}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A named tunable that can be read and changed with .show and .set.
+type setting struct {
+	help string                   // What the setting controls.
+	get  func() string            // Formats the current value.
+	set  func(value string) error // Parses, validates and stores a new value.
+}
+
+// Registered settings, by name.
+var settings = make(map[string]*setting)
+
+// Guards the registry of settings; each setting's value is read and written atomically.
+var settingsMtx sync.Mutex
+
+// register adds a setting, replacing any previous one with the same name.
+func register(name string, s *setting) {
+	settingsMtx.Lock()
+	defer settingsMtx.Unlock()
+	settings[name] = s
+}
+
+// An int tunable, safe to read while .set changes it.
+type IntSetting struct {
+	value int64 // Accessed atomically.
+}
+
+// Get the current value.
+func (s *IntSetting) Get() int {
+	return int(atomic.LoadInt64(&s.value))
+}
+
+// Set the value, without the range check .set applies.
+func (s *IntSetting) Set(value int) {
+	atomic.StoreInt64(&s.value, int64(value))
+}
+
+// NewIntSetting exposes an int tunable, starting at value, which may be set to values in [min, max].
+// Subsystems create their tunables once, as package variables, and read them with Get.
+func NewIntSetting(name string, value int, min int, max int, help string) *IntSetting {
+	s := &IntSetting{value: int64(value)}
+	register(name, &setting{
+		help: help,
+		get:  func() string { return strconv.Itoa(s.Get()) },
+		set: func(str string) error {
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+			if v < min || v > max {
+				return fmt.Errorf("%s must be between %v and %v", name, min, max)
+			}
+			s.Set(v)
+			return nil
+		},
+	})
+	return s
+}
+
+// An int64 tunable, safe to read while .set changes it.
+type Int64Setting struct {
+	value int64 // Accessed atomically.
+}
+
+// Get the current value.
+func (s *Int64Setting) Get() int64 {
+	return atomic.LoadInt64(&s.value)
+}
+
+// Set the value, without the range check .set applies.
+func (s *Int64Setting) Set(value int64) {
+	atomic.StoreInt64(&s.value, value)
+}
+
+// NewInt64Setting exposes an int64 tunable, starting at value, which may be set to values in [min, max].
+func NewInt64Setting(name string, value int64, min int64, max int64, help string) *Int64Setting {
+	s := &Int64Setting{value: value}
+	register(name, &setting{
+		help: help,
+		get:  func() string { return strconv.FormatInt(s.Get(), 10) },
+		set: func(str string) error {
+			v, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+			if v < min || v > max {
+				return fmt.Errorf("%s must be between %v and %v", name, min, max)
+			}
+			s.Set(v)
+			return nil
+		},
+	})
+	return s
+}
+
+// A duration tunable, safe to read while .set changes it.
+type DurationSetting struct {
+	value int64 // Nanoseconds; accessed atomically.
+}
+
+// Get the current value.
+func (s *DurationSetting) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.value))
+}
+
+// Set the value, without the range check .set applies.
+func (s *DurationSetting) Set(value time.Duration) {
+	atomic.StoreInt64(&s.value, int64(value))
+}
+
+// NewDurationSetting exposes a duration tunable, starting at value, which may be set to
+// values in [min, max]. Values are written like "250ms" or "2s".
+func NewDurationSetting(name string, value time.Duration, min time.Duration, max time.Duration, help string) *DurationSetting {
+	s := &DurationSetting{value: int64(value)}
+	register(name, &setting{
+		help: help,
+		get:  func() string { return s.Get().String() },
+		set: func(str string) error {
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return fmt.Errorf("%s must be a duration, like 250ms", name)
+			}
+			if v < min || v > max {
+				return fmt.Errorf("%s must be between %v and %v", name, min, max)
+			}
+			s.Set(v)
+			return nil
+		},
+	})
+	return s
+}
+
+// SetSetting parses and stores a new value for the named setting.
+func SetSetting(name string, value string) error {
+	settingsMtx.Lock()
+	defer settingsMtx.Unlock()
+	s, found := settings[name]
+	if !found {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	return s.set(value)
+}
+
+// ShowSetting returns the current value of the named setting.
+func ShowSetting(name string) (string, error) {
+	settingsMtx.Lock()
+	defer settingsMtx.Unlock()
+	s, found := settings[name]
+	if !found {
+		return "", fmt.Errorf("unknown setting %s", name)
+	}
+	return s.get(), nil
+}
+
+// SettingNames returns the names of all registered settings, in order.
+func SettingNames() []string {
+	settingsMtx.Lock()
+	defer settingsMtx.Unlock()
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SettingHelp returns what the named setting controls.
+func SettingHelp(name string) string {
+	settingsMtx.Lock()
+	defer settingsMtx.Unlock()
+	if s, found := settings[name]; found {
+		return s.help
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"fmt"
+)
+
+// The kinds of operation a write batch can hold.
+type batchOpType int
+
+const (
+	BATCH_INSERT batchOpType = 0
+	BATCH_UPDATE batchOpType = 1
+	BATCH_DELETE batchOpType = 2
+)
+
+// batchOp is a single mutation queued in a write batch.
+type batchOp struct {
+	opType batchOpType
+	key    int64
+	value  int64
+	values []int64 // Every value to restore, when undoing a change to an entry that has several.
+}
+
+// WriteBatch accumulates mutations to be applied to an index all at once.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// batchGuard is implemented by indexes that apply write batches one at a time.
+type batchGuard interface {
+	BeginBatch()
+	EndBatch()
+}
+
+// valuesUpdater is implemented by indexes that store several values per entry.
+type valuesUpdater interface {
+	UpdateValues(int64, []int64) error
+}
+
+// NewWriteBatch returns an empty write batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{ops: make([]batchOp, 0)}
+}
+
+// Insert queues an insertion.
+func (b *WriteBatch) Insert(key int64, value int64) {
+	b.ops = append(b.ops, batchOp{opType: BATCH_INSERT, key: key, value: value})
+}
+
+// Update queues an update.
+func (b *WriteBatch) Update(key int64, value int64) {
+	b.ops = append(b.ops, batchOp{opType: BATCH_UPDATE, key: key, value: value})
+}
+
+// Delete queues a deletion.
+func (b *WriteBatch) Delete(key int64) {
+	b.ops = append(b.ops, batchOp{opType: BATCH_DELETE, key: key})
+}
+
+// Len returns the number of queued operations.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// ApplyBatch applies every operation in the batch to the index, or none of them.
+// If an operation fails, the operations applied before it are undone in reverse order
+// using the values they replaced, and the original error is returned.
+//
+// Batches on the same btree or hash index are applied one at a time, so a batch never sees
+// another batch's partial writes. That is the only isolation a batch has: plain Insert,
+// Update and Delete calls may interleave with it and see its partial writes, and a rollback
+// overwrites any change they made meanwhile to a key the batch had touched.
+func ApplyBatch(index Index, b *WriteBatch) error {
+	if guard, ok := index.(batchGuard); ok {
+		guard.BeginBatch()
+		defer guard.EndBatch()
+	}
+	// Apply each operation, remembering how to undo it.
+	undos := make([]batchOp, 0, len(b.ops))
+	for i, op := range b.ops {
+		undo, err := applyBatchOp(index, op)
+		if err != nil {
+			if rbErr := rollbackBatch(index, undos); rbErr != nil {
+				return fmt.Errorf("batch operation %v failed: %w; rollback error: %v", i, err, rbErr)
+			}
+			return fmt.Errorf("batch operation %v failed: %w", i, err)
+		}
+		undos = append(undos, undo)
+	}
+	return nil
+}
+
+// applyBatchOp applies a single operation and returns the operation that reverses it.
+// The reverse of an update or delete restores every value the entry held.
+func applyBatchOp(index Index, op batchOp) (undo batchOp, err error) {
+	switch op.opType {
+	case BATCH_INSERT:
+		if multi, ok := index.(valuesInserter); ok && op.values != nil {
+			err = multi.InsertValues(op.key, op.values)
+		} else {
+			err = index.Insert(op.key, op.value)
+		}
+		if err != nil {
+			return batchOp{}, err
+		}
+		return batchOp{opType: BATCH_DELETE, key: op.key}, nil
+	case BATCH_UPDATE:
+		prev, err := index.Find(op.key)
+		if err != nil {
+			return batchOp{}, err
+		}
+		if multi, ok := index.(valuesUpdater); ok && op.values != nil {
+			err = multi.UpdateValues(op.key, op.values)
+		} else {
+			err = index.Update(op.key, op.value)
+		}
+		if err != nil {
+			return batchOp{}, err
+		}
+		return batchOp{opType: BATCH_UPDATE, key: op.key, value: prev.GetValue(), values: prev.Values()}, nil
+	case BATCH_DELETE:
+		prev, err := index.Find(op.key)
+		if err != nil {
+			return batchOp{}, err
+		}
+		if err = index.Delete(op.key); err != nil {
+			return batchOp{}, err
+		}
+		return batchOp{opType: BATCH_INSERT, key: op.key, value: prev.GetValue(), values: prev.Values()}, nil
+	default:
+		return batchOp{}, fmt.Errorf("unknown batch operation type %v", op.opType)
+	}
+}
+
+// rollbackBatch applies the given undo operations in reverse order.
+func rollbackBatch(index Index, undos []batchOp) error {
+	for i := len(undos) - 1; i >= 0; i-- {
+		if _, err := applyBatchOp(index, undos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 
 	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
@@ -16,8 +17,9 @@ import (
 
 // Database interface.
 type Database struct {
-	basepath string
-	tables   map[string]Index
+	basepath  string
+	tables    map[string]Index
+	tablesMtx sync.RWMutex // Guards tables, which clients and the metrics server share.
 }
 
 // Index interface.
@@ -33,8 +35,22 @@ type Index interface {
 	Print(io.Writer)
 	PrintPN(int, io.Writer)
 	TableStart() (utils.Cursor, error)
+	TableFind(int64) (utils.Cursor, error)
+	TableFindRange(int64, int64) ([]utils.Entry, error)
+	PinResident() error
+	UnpinResident()
 }
 
+// scanGuard is implemented by indexes that must not be compacted while they are scanned.
+type scanGuard interface {
+	BeginScan()
+	EndScan()
+}
+
+// ErrTableNotFound is returned, possibly wrapped, whenever a table that doesn't exist is
+// looked up, so callers can check for it with errors.Is.
+var ErrTableNotFound = errors.New("table not found")
+
 // An index can either be a B+Tree or a Hash Table.
 type IndexType int64
 
@@ -43,7 +59,8 @@ const (
 	HashIndexType  IndexType = 1
 )
 
-// Opens a database given a data folder.
+// Opens a database given a data folder, locking the folder until Close.
+// Returns ErrDatabaseLocked if the folder is already open.
 func Open(folder string) (*Database, error) {
 	// Ensure folder is of the form */
 	if !strings.HasSuffix(folder, "/") {
@@ -54,6 +71,10 @@ func Open(folder string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Make sure no one else has the folder open.
+	if err = lock(folder); err != nil {
+		return nil, err
+	}
 	// Return an empty database.
 	return &Database{
 		basepath: folder,
@@ -61,14 +82,19 @@ func Open(folder string) (*Database, error) {
 	}, nil
 }
 
-// Close each table in the database, then close the database.
+// Close each table in the database, then close the database, releasing its folder.
 func (db *Database) Close() (err error) {
+	db.tablesMtx.Lock()
+	defer db.tablesMtx.Unlock()
 	for _, table := range db.tables {
 		curErr := table.Close()
 		if err == nil {
 			err = curErr
 		}
 	}
+	if curErr := unlock(db.basepath); err == nil {
+		err = curErr
+	}
 	return err
 }
 
@@ -92,6 +118,8 @@ func (db *Database) createTable(name string, indexType IndexType) (index Index,
 		return nil, errors.New("table name must be alphanumeric")
 	}
 	// Create the file, if not exists.
+	db.tablesMtx.Lock()
+	defer db.tablesMtx.Unlock()
 	path := filepath.Join(db.basepath, name)
 	if _, err := os.Stat(path); err == nil {
 		return nil, errors.New("table already exists")
@@ -118,13 +146,22 @@ func (db *Database) createTable(name string, indexType IndexType) (index Index,
 // Get a table by its name, either from existing tables, or by creating a new one.
 func (db *Database) GetTable(name string) (index Index, err error) {
 	// Check existing set of tables.
+	db.tablesMtx.RLock()
+	idx, ok := db.tables[name]
+	db.tablesMtx.RUnlock()
+	if ok {
+		return idx, nil
+	}
+	// Look again once no one else can open it.
+	db.tablesMtx.Lock()
+	defer db.tablesMtx.Unlock()
 	if idx, ok := db.tables[name]; ok {
 		return idx, nil
 	}
 	// Check if file exists; if not, error.
 	path := filepath.Join(db.basepath, name)
 	if _, err := os.Stat(path); err != nil {
-		return nil, errors.New("table not found")
+		return nil, ErrTableNotFound
 	}
 	// Else, open from disk.
 	// NOTE: This is janky; assumes that if a .meta file exists, then it is a hash index,
@@ -144,12 +181,162 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	return index, nil
 }
 
-// Get a database's tables.
+// RepairHashTable rebuilds the named hash table from the entries in its bucket pages,
+// ignoring its directory, then swaps the rebuilt table in under the same name.
+// Returns the number of entries in the rebuilt table.
+func (db *Database) RepairHashTable(name string) (int64, error) {
+	index, err := db.GetTable(name)
+	if err != nil {
+		return 0, err
+	}
+	hashIndex, ok := index.(*hash.HashIndex)
+	if !ok {
+		return 0, errors.New("only hash tables can be repaired")
+	}
+	path := filepath.Join(db.basepath, name)
+	repairPath := path + ".repair"
+	repaired, err := hash.Rebuild(hashIndex, repairPath)
+	if err != nil {
+		return 0, err
+	}
+	var numEntries int64
+	Scan(repaired, func(entry utils.Entry) error {
+		numEntries++
+		return nil
+	})
+	// Close both tables, then move the rebuilt one and its directory into place.
+	metaName := hash.MetaFileName(hashIndex.GetPager())
+	repairedMetaName := hash.MetaFileName(repaired.GetPager())
+	db.tablesMtx.Lock()
+	defer db.tablesMtx.Unlock()
+	delete(db.tables, name)
+	if err = repaired.Close(); err != nil {
+		return 0, err
+	}
+	if err = hashIndex.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(repairPath, path); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(repairedMetaName, metaName); err != nil {
+		return 0, err
+	}
+	if db.tables[name], err = hash.OpenTable(path); err != nil {
+		delete(db.tables, name)
+		return 0, err
+	}
+	return numEntries, nil
+}
+
+// Get a snapshot of a database's tables, safe to range over while tables are created.
 func (db *Database) GetTables() map[string]Index {
-	return db.tables
+	db.tablesMtx.RLock()
+	defer db.tablesMtx.RUnlock()
+	tables := make(map[string]Index, len(db.tables))
+	for name, table := range db.tables {
+		tables[name] = table
+	}
+	return tables
 }
 
 // Returns the basepath of the database.
 func (db *Database) GetBasePath() string {
 	return db.basepath
-}
\ No newline at end of file
+}
+
+// VerifyIndex checks that the index is of the given type and that its structure is valid.
+func VerifyIndex(index Index, indexType IndexType) error {
+	switch indexType {
+	case BTreeIndexType:
+		btreeIndex, ok := index.(*btree.BTreeIndex)
+		if !ok {
+			return errors.New("expected btree index")
+		}
+		if _, _, isBTree, err := btree.IsBTree(btreeIndex); err != nil {
+			return err
+		} else if !isBTree {
+			return errors.New("index is not a valid btree")
+		}
+	case HashIndexType:
+		hashIndex, ok := index.(*hash.HashIndex)
+		if !ok {
+			return errors.New("expected hash index")
+		}
+		if isHash, err := hash.IsHash(hashIndex); err != nil {
+			return err
+		} else if !isHash {
+			return errors.New("index is not a valid hash table")
+		}
+	default:
+		return errors.New("unknown index type")
+	}
+	return nil
+}
+
+// Scan calls fn on every entry in the index, one at a time, without collecting them.
+// Scanning stops at the first error returned by fn.
+func Scan(index Index, fn func(entry utils.Entry) error) error {
+	// Hold off auto-vacuum, which could move entries out from under the cursor.
+	if guard, ok := index.(scanGuard); ok {
+		guard.BeginScan()
+		defer guard.EndScan()
+	}
+	cursor, err := index.TableStart()
+	if err != nil {
+		return err
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return err
+			}
+			if err = fn(entry); err != nil {
+				return err
+			}
+		}
+		if cursor.StepForward() {
+			return nil
+		}
+	}
+}
+
+// StreamEntries writes every entry from cursor onwards to w, as formatted by format,
+// batchSize entries to a write, so a large result costs few writes to a connection.
+// The final batch may be smaller. Stops at the first write error, such as a client
+// disconnecting, and returns it.
+func StreamEntries(cursor utils.Cursor, w io.Writer, batchSize int, format func(utils.Entry) string) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var batch strings.Builder
+	batched := 0
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		_, err := io.WriteString(w, batch.String())
+		batch.Reset()
+		batched = 0
+		return err
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return err
+			}
+			batch.WriteString(format(entry))
+			batched++
+			if batched == batchSize {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor.StepForward() {
+			return flush()
+		}
+	}
+}
@@ -7,10 +7,15 @@ import (
 	"strconv"
 	"strings"
 
+	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
 	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
+// Number of entries select writes at once.
+var SELECT_BATCH_SIZE = config.NewIntSetting("select_batch_size", 256, 1, 1<<16,
+	"number of entries select writes at once")
+
 // Creates a DB Repl for the given index.
 func DatabaseRepl(db *Database) *repl.REPL {
 	r := repl.NewRepl()
@@ -20,15 +25,23 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(db, payload, replConfig.GetWriter())
 	}, "Find an element. usage: find <key> from <table>")
-	r.AddCommand("insert", func(payload string, replConfig *repl.REPLConfig) error { return HandleInsert(db, payload) }, "Insert an element. usage: insert <key> <value> into <table>")
+	r.AddCommand("insert", func(payload string, replConfig *repl.REPLConfig) error {
+		if isInsertSelect(payload) {
+			return handleInsertSelectPayload(db, payload, replConfig.GetWriter())
+		}
+		return HandleInsert(db, payload)
+	}, "Insert an element, or copy a table. usage: insert <key> <value> into <table> | insert [ignore] into <table> select from <table>")
 	r.AddCommand("update", func(payload string, replConfig *repl.REPLConfig) error { return HandleUpdate(db, payload) }, "Update en element. usage: update <table> <key> <value>")
 	r.AddCommand("delete", func(payload string, replConfig *repl.REPLConfig) error { return HandleDelete(db, payload) }, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(db, payload, replConfig.GetWriter())
-	}, "Select elements from a table. usage: select from <table>")
+	}, "Select elements from a table. usage: select from <table> | select <table> where value between <lo> <hi>")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(db, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.AddCommand("repair", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleRepair(db, payload, replConfig.GetWriter())
+	}, "Rebuild a hash table from its buckets. usage: repair <table>")
 	return r
 }
 
@@ -68,19 +81,20 @@ func HandleFind(d *Database, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("usage: find <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	tableName := fields[3]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	entry, err := table.Find(int64(key))
 	if err != nil || entry == nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
-	io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n",
-		entry.GetKey(), entry.GetValue()))
+	row := entryRow(entry)
+	row.Text = "found entry: " + row.Text
+	repl.WriteRow(w, row)
 	return nil
 }
 
@@ -94,15 +108,15 @@ func HandleInsert(d *Database, payload string) (err error) {
 		return fmt.Errorf("usage: insert <key> <value> into <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if value, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	tableName := fields[4]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	val, _ := table.Find(int64(key))
 	if val != nil {
@@ -110,11 +124,84 @@ func HandleInsert(d *Database, payload string) (err error) {
 	}
 	err = table.Insert(int64(key), int64(value))
 	if err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	return nil
 }
 
+// isInsertSelect returns true if the payload is of the form insert [ignore] into ... select.
+func isInsertSelect(payload string) bool {
+	fields := strings.Fields(payload)
+	return len(fields) > 1 && (fields[1] == "into" || fields[1] == "ignore")
+}
+
+// handleInsertSelectPayload parses an insert ... select command and reports the number of entries copied.
+func handleInsertSelectPayload(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	// Usage: insert [ignore] into <dest> select from <src>
+	skipDuplicates := len(fields) > 1 && fields[1] == "ignore"
+	if skipDuplicates {
+		fields = fields[1:]
+	}
+	if len(fields) != 6 || fields[1] != "into" || fields[3] != "select" || fields[4] != "from" {
+		return fmt.Errorf("usage: insert [ignore] into <table> select from <table>")
+	}
+	copied, err := HandleInsertSelect(d, fields[2], fields[5], skipDuplicates)
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, fmt.Sprintf("%v entries copied from %s into %s.\n", copied, fields[5], fields[2]))
+	return nil
+}
+
+// HandleInsertSelect streams every entry of srcTable into destTable, returning the number copied.
+// Keys already in destTable are skipped if skipDuplicates is set, and are an error otherwise;
+// entries copied before the error are kept.
+func HandleInsertSelect(d *Database, destTable string, srcTable string, skipDuplicates bool) (int, error) {
+	if destTable == srcTable {
+		return 0, errors.New("insert error: cannot copy a table into itself")
+	}
+	src, err := d.GetTable(srcTable)
+	if err != nil {
+		return 0, fmt.Errorf("insert error: %w", err)
+	}
+	dest, err := d.GetTable(destTable)
+	if err != nil {
+		return 0, fmt.Errorf("insert error: %w", err)
+	}
+	// Carry over every value if the destination can hold more than one.
+	multi, isMulti := dest.(valuesInserter)
+	copied := 0
+	err = Scan(src, func(entry utils.Entry) error {
+		val, _ := dest.Find(entry.GetKey())
+		if val != nil {
+			if skipDuplicates {
+				return nil
+			}
+			return fmt.Errorf("key %v already in table %s", entry.GetKey(), destTable)
+		}
+		if isMulti {
+			err = multi.InsertValues(entry.GetKey(), entry.Values())
+		} else {
+			err = dest.Insert(entry.GetKey(), entry.GetValue())
+		}
+		if err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		return copied, fmt.Errorf("insert error: %w", err)
+	}
+	return copied, nil
+}
+
+// valuesInserter is implemented by indexes that store several values per entry.
+type valuesInserter interface {
+	InsertValues(int64, []int64) error
+}
+
 // Handle update.
 func HandleUpdate(d *Database, payload string) (err error) {
 	fields := strings.Fields(payload)
@@ -125,19 +212,19 @@ func HandleUpdate(d *Database, payload string) (err error) {
 		return fmt.Errorf("usage: update <table> <key> <value>")
 	}
 	if key, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	if value, err = strconv.Atoi(fields[3]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	tableName := fields[1]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	err = table.Update(int64(key), int64(value))
 	if err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	return nil
 }
@@ -152,16 +239,16 @@ func HandleDelete(d *Database, payload string) (err error) {
 		return fmt.Errorf("usage: delete <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	tableName := fields[3]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	err = table.Delete(int64(key))
 	if err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	return nil
 }
@@ -170,21 +257,64 @@ func HandleDelete(d *Database, payload string) (err error) {
 func HandleSelect(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
+	// Usage: select <table> where value between <lo> <hi>
+	if numFields == 7 && fields[2] == "where" && fields[3] == "value" && fields[4] == "between" {
+		var lo, hi int
+		if lo, err = strconv.Atoi(fields[5]); err != nil {
+			return fmt.Errorf("select error: %w", err)
+		}
+		if hi, err = strconv.Atoi(fields[6]); err != nil {
+			return fmt.Errorf("select error: %w", err)
+		}
+		entries, err := HandleSelectWhereValue(d, fields[1], int64(lo), int64(hi))
+		if err != nil {
+			return err
+		}
+		printResults(entries, w)
+		return nil
+	}
 	// Usage: select from <table>
 	if numFields != 3 || fields[1] != "from" {
-		return fmt.Errorf("usage: select from <table>")
+		return fmt.Errorf("usage: select from <table> | select <table> where value between <lo> <hi>")
 	}
 	tableName := fields[2]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("select error: %v", err)
+		return fmt.Errorf("select error: %w", err)
 	}
-	var results []utils.Entry
-	if results, err = table.Select(); err != nil {
-		return err
+	// Stream entries out in batches rather than materializing the whole table.
+	if guard, ok := table.(scanGuard); ok {
+		guard.BeginScan()
+		defer guard.EndScan()
 	}
-	printResults(results, w)
-	return nil
+	cursor, err := table.TableStart()
+	if err != nil {
+		return fmt.Errorf("select error: %w", err)
+	}
+	format := repl.GetFormat(w)
+	return StreamEntries(cursor, w, SELECT_BATCH_SIZE.Get(), func(entry utils.Entry) string {
+		return repl.FormatRow(format, entryRow(entry))
+	})
+}
+
+// HandleSelectWhereValue returns the entries of the table whose values lie in [lo, hi].
+// Neither index type is ordered by value, so this reads every entry in the table.
+func HandleSelectWhereValue(d *Database, tableName string, lo int64, hi int64) ([]utils.Entry, error) {
+	table, err := d.GetTable(tableName)
+	if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	entries := make([]utils.Entry, 0)
+	err = Scan(table, func(entry utils.Entry) error {
+		if entry.GetValue() >= lo && entry.GetValue() <= hi {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return entries, nil
 }
 
 // Handle pretty printing.
@@ -196,18 +326,18 @@ func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 		tableName := fields[2]
 		table, err := d.GetTable(tableName)
 		if err != nil {
-			return fmt.Errorf("pretty error: %v", err)
+			return fmt.Errorf("pretty error: %w", err)
 		}
 		table.Print(w)
 	} else if numFields == 4 && fields[2] == "from" {
 		var pn int
 		if pn, err = strconv.Atoi(fields[1]); err != nil {
-			return fmt.Errorf("pretty error: %v", err)
+			return fmt.Errorf("pretty error: %w", err)
 		}
 		tableName := fields[3]
 		table, err := d.GetTable(tableName)
 		if err != nil {
-			return fmt.Errorf("pretty error: %v", err)
+			return fmt.Errorf("pretty error: %w", err)
 		}
 		table.PrintPN(pn, w)
 	} else {
@@ -216,10 +346,38 @@ func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
+// Handle repair.
+func HandleRepair(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: repair <table>
+	if numFields != 2 {
+		return fmt.Errorf("usage: repair <table>")
+	}
+	numEntries, err := d.RepairHashTable(fields[1])
+	if err != nil {
+		return fmt.Errorf("repair error: %w", err)
+	}
+	io.WriteString(w, fmt.Sprintf("table %s repaired with %v entries.\n", fields[1], numEntries))
+	return nil
+}
+
 // printResults prints all given entries in a standard format.
 func printResults(entries []utils.Entry, w io.Writer) {
 	for _, entry := range entries {
-		io.WriteString(w, fmt.Sprintf("(%v, %v)\n",
-			entry.GetKey(), entry.GetValue()))
+		printEntry(entry, w)
 	}
-}
\ No newline at end of file
+}
+
+// printEntry prints a single entry in the output format of w.
+func printEntry(entry utils.Entry, w io.Writer) error {
+	return repl.WriteRow(w, entryRow(entry))
+}
+
+// entryRow renders a single entry as a result row.
+func entryRow(entry utils.Entry) repl.Row {
+	return repl.Row{
+		Text:   fmt.Sprintf("(%v, %v)", entry.GetKey(), entry.GetValue()),
+		Fields: map[string]interface{}{"key": entry.GetKey(), "value": entry.GetValue()},
+	}
+}
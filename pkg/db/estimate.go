@@ -0,0 +1,76 @@
+package db
+
+import (
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// EstimateInsertCost estimates how many new pages inserting n fresh keys into the index
+// will allocate, and whether they will fit. Only indexes without a backing file are
+// bounded, by the MAXPAGES frames in their buffer pool.
+// The estimate uses the index's current fill factor once it holds more than a page's worth
+// of entries, and otherwise the fill factor its split behaviour typically produces.
+func EstimateInsertCost(idx Index, n int64) (pages int64, willFit bool) {
+	p := idx.GetPager()
+	numPages := p.GetNumPages()
+	if n <= 0 {
+		return 0, true
+	}
+	// Count existing entries to measure the current fill factor.
+	var numEntries int64
+	Scan(idx, func(entry utils.Entry) error {
+		numEntries++
+		return nil
+	})
+	var capacity, perPage, fanout float64
+	switch index := idx.(type) {
+	case *btree.BTreeIndex:
+		capacity = float64(btree.EntriesPerLeafNode(index.GetNumValues()))
+		perPage = capacity / 2
+		fanout = float64(btree.KEYS_PER_INTERNAL_NODE) / 2
+		if index.GetSplitPolicy() == btree.RIGHT_BIASED_SPLIT {
+			perPage = capacity
+			fanout = float64(btree.KEYS_PER_INTERNAL_NODE)
+		}
+	case *hash.HashIndex:
+		// Extendible hashing with well-mixed keys leaves buckets about ln(2) full.
+		capacity = float64(hash.BucketSize(index.GetNumValues()))
+		perPage = capacity * 0.69
+	default:
+		return 0, false
+	}
+	total := float64(numEntries + n)
+	if float64(numEntries) > capacity {
+		// Grow at the fill factor the index already has, internal nodes included.
+		perPage = float64(numEntries) / float64(numPages)
+		pages = ceilDiv(total, perPage) - numPages
+	} else if total <= capacity {
+		// Everything fits in the first page.
+		pages = 0
+	} else {
+		// Count the leaves and the internal nodes above them, less the existing pages.
+		level := ceilDiv(total, perPage)
+		pages = level
+		for fanout > 0 && level > 1 {
+			level = ceilDiv(float64(level), fanout)
+			pages += level
+		}
+		pages -= numPages
+	}
+	if pages < 0 {
+		pages = 0
+	}
+	willFit = p.HasFile() || numPages+pages <= pager.MAXPAGES
+	return pages, willFit
+}
+
+// ceilDiv returns a / b rounded up.
+func ceilDiv(a float64, b float64) int64 {
+	q := int64(a / b)
+	if float64(q)*b < a {
+		q++
+	}
+	return q
+}
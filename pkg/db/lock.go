@@ -0,0 +1,104 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Name of the lockfile Open creates in a database folder. It holds the pid of the
+// process that opened the folder, and is removed by Close.
+const LOCK_FILE_NAME = "LOCK"
+
+// ErrDatabaseLocked is returned, possibly wrapped, by Open if the folder is already open.
+// If the process holding the lock exited without closing the database, the lock is stale;
+// ReadLock detects this and BreakStaleLock removes it.
+var ErrDatabaseLocked = errors.New("database folder is already open")
+
+// errMalformedLock is returned, wrapped, by ReadLock if the lockfile holds no pid, as when
+// the process that created it crashed before writing one.
+var errMalformedLock = errors.New("malformed lockfile")
+
+// lock takes the lock on the given folder for this process.
+func lock(folder string) error {
+	file, err := os.OpenFile(filepath.Join(folder, LOCK_FILE_NAME), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		if pid, _, err := ReadLock(folder); err == nil {
+			return fmt.Errorf("%w: locked by process %v", ErrDatabaseLocked, pid)
+		}
+		return ErrDatabaseLocked
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// Don't leave behind a lockfile without a pid, which would lock out every later Open.
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// unlock releases the lock on the given folder.
+func unlock(folder string) error {
+	err := os.Remove(filepath.Join(folder, LOCK_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ReadLock returns the pid of the process holding the lock on the given folder, and
+// whether that process is still running. If it isn't, the lock is stale.
+// Returns an error satisfying os.IsNotExist if the folder isn't locked.
+// A stale lock may look live if its pid has since been reused by another process.
+func ReadLock(folder string) (pid int, running bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, LOCK_FILE_NAME))
+	if err != nil {
+		return 0, false, err
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %v", errMalformedLock, err)
+	}
+	return pid, processRunning(pid), nil
+}
+
+// BreakStaleLock removes the lock on the given folder if the process holding it is no
+// longer running, and returns ErrDatabaseLocked if it still is. A lockfile with no pid in it
+// is stale too. Unlocked folders are left alone.
+func BreakStaleLock(folder string) error {
+	pid, running, err := ReadLock(folder)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if errors.Is(err, errMalformedLock) {
+		return unlock(folder)
+	}
+	if err != nil {
+		return err
+	}
+	if running {
+		return fmt.Errorf("%w: locked by running process %v", ErrDatabaseLocked, pid)
+	}
+	return unlock(folder)
+}
+
+// processRunning returns true if a process with the given pid exists.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 checks for the process without disturbing it.
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
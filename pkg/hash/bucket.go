@@ -1,6 +1,7 @@
 package hash
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,19 +12,20 @@ import (
 
 // HashBucket.
 type HashBucket struct {
-	depth   int64
-	numKeys int64
-	page    *pager.Page
+	depth     int64
+	numKeys   int64
+	numValues int64 // Number of values in each entry.
+	page      *pager.Page
 }
 
-// Construct a new HashBucket.
-func NewHashBucket(pager *pager.Pager, depth int64) (*HashBucket, error) {
+// Construct a new HashBucket whose entries hold numValues values each.
+func NewHashBucket(pager *pager.Pager, depth int64, numValues int64) (*HashBucket, error) {
 	newPN := pager.GetFreePN()
 	newPage, err := pager.GetPage(newPN)
 	if err != nil {
 		return nil, err
 	}
-	bucket := &HashBucket{depth: depth, numKeys: 0, page: newPage}
+	bucket := &HashBucket{depth: depth, numKeys: 0, numValues: numValues, page: newPage}
 	bucket.updateDepth(depth)
 	return bucket, nil
 }
@@ -33,6 +35,11 @@ func (bucket *HashBucket) GetDepth() int64 {
 	return bucket.depth
 }
 
+// Get how many entries this bucket holds before it must split.
+func (bucket *HashBucket) capacity() int64 {
+	return BucketSize(bucket.numValues)
+}
+
 // Get a bucket's page.
 func (bucket *HashBucket) GetPage() *pager.Page {
 	return bucket.page
@@ -41,73 +48,106 @@ func (bucket *HashBucket) GetPage() *pager.Page {
 // Finds the entry with the given key.
 func (bucket *HashBucket) Find(key int64) (utils.Entry, bool) {
 	/* SOLUTION {{{ */
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			return bucket.getCell(i), true
-		}
+	if i := bucket.indexOf(key); i != -1 {
+		return bucket.getCell(i), true
 	}
 	return nil, false
 	/* SOLUTION }}} */
 }
 
-// Inserts the given key-value pair, splits if necessary.
+// Inserts the given key-value pair, splits if necessary. Errors if the key is already present.
 func (bucket *HashBucket) Insert(key int64, value int64) (bool, error) {
+	return bucket.InsertValues(key, []int64{value})
+}
+
+// Inserts an entry with the given key and values, splits if necessary.
+// Errors if the key is already present.
+func (bucket *HashBucket) InsertValues(key int64, values []int64) (bool, error) {
 	/* SOLUTION {{{ */
-	bucket.modifyCell(bucket.numKeys, HashEntry{key, value})
-	bucket.updateNumKeys(bucket.numKeys + 1)
-	return bucket.numKeys >= BUCKETSIZE, nil
+	if bucket.indexOf(key) != -1 {
+		return false, errors.New("cannot insert duplicate key")
+	}
+	return bucket.appendEntry(key, values), nil
 	/* SOLUTION }}} */
 }
 
+// appendEntry inserts an entry without checking whether its key is already present,
+// returning whether the bucket must now split.
+func (bucket *HashBucket) appendEntry(key int64, values []int64) bool {
+	bucket.modifyCell(bucket.numKeys, newEntry(key, values))
+	bucket.updateNumKeys(bucket.numKeys + 1)
+	// Reclaim space from deleted entries before resorting to a split.
+	if bucket.numKeys >= bucket.capacity() {
+		bucket.compact()
+	}
+	return bucket.numKeys >= bucket.capacity()
+}
+
 // Update the given key-value pair, should never split.
 func (bucket *HashBucket) Update(key int64, value int64) error {
+	return bucket.UpdateValues(key, []int64{value})
+}
+
+// Overwrite the first len(values) values of the entry with the given key, should never split.
+func (bucket *HashBucket) UpdateValues(key int64, values []int64) error {
 	/* SOLUTION {{{ */
 	// Get the index to update.
-	index := int64(-1)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			index = i
-			break
-		}
-	}
+	index := bucket.indexOf(key)
 	if index == -1 {
 		return errors.New("key not found, update aborted")
 	}
-	// Update the value.
-	bucket.updateValueAt(index, value)
+	// Update the values.
+	bucket.updateValuesAt(index, values)
 	return nil
 	/* SOLUTION }}} */
 }
 
-// Delete the given key-value pair, does not coalesce.
+// Delete the given key-value pair; the table coalesces buckets, see HashTable.Coalesce.
 func (bucket *HashBucket) Delete(key int64) error {
 	/* SOLUTION {{{ */
 	// Get the index to delete.
-	index := int64(-1)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			index = i
-			break
-		}
-	}
+	index := bucket.indexOf(key)
 	if index == -1 {
 		return errors.New("key not found, delete aborted")
 	}
 	// Move all other keys left by one.
-	for i := index; i < bucket.numKeys; i++ {
-		bucket.modifyCell(i, bucket.getCell(i+1))
+	for i := index; i < bucket.numKeys-1; i++ {
+		bucket.moveCell(i, i+1)
 	}
 	bucket.updateNumKeys(bucket.numKeys - 1)
 	return nil
 	/* SOLUTION }}} */
 }
 
+// Tombstone marks the given key-value pair as deleted without moving any other entries.
+// The space is reclaimed once the bucket fills up, or by Compact.
+func (bucket *HashBucket) Tombstone(key int64) error {
+	index := bucket.indexOf(key)
+	if index == -1 {
+		return errors.New("key not found, delete aborted")
+	}
+	bucket.setTombstone(index)
+	return nil
+}
+
+// indexOf returns the index of the live entry with the given key, or -1 if there is none.
+func (bucket *HashBucket) indexOf(key int64) int64 {
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if bucket.getKeyAt(i) == key && !bucket.isTombstone(i) {
+			return i
+		}
+	}
+	return -1
+}
+
 // Select all entries in this bucket.
 func (bucket *HashBucket) Select() ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
 	ret := make([]utils.Entry, 0)
 	for i := int64(0); i < bucket.numKeys; i++ {
-		ret = append(ret, bucket.getCell(i))
+		if !bucket.isTombstone(i) {
+			ret = append(ret, bucket.getCell(i))
+		}
 	}
 	return ret, nil
 	/* SOLUTION }}} */
@@ -118,11 +158,39 @@ func (bucket *HashBucket) Print(w io.Writer) {
 	io.WriteString(w, fmt.Sprintf("bucket depth: %d\n", bucket.depth))
 	io.WriteString(w, "entries:")
 	for i := int64(0); i < bucket.numKeys; i++ {
-		bucket.getCell(i).Print(w)
+		if !bucket.isTombstone(i) {
+			bucket.getCell(i).Print(w)
+		}
 	}
 	io.WriteString(w, "\n")
 }
 
+// bucketJSON is the form PrintJSON writes a bucket in.
+type bucketJSON struct {
+	PN       int64        `json:"pn"`
+	Depth    int64        `json:"depth"`
+	Entries  [][]int64    `json:"entries"`            // Each entry's key, then its values.
+	Overflow []bucketJSON `json:"overflow,omitempty"` // The bucket's overflow pages, in a table.
+}
+
+// toJSON returns the bucket in the form PrintJSON writes it in.
+func (bucket *HashBucket) toJSON() bucketJSON {
+	entries := make([][]int64, 0)
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if !bucket.isTombstone(i) {
+			entry := bucket.getCell(i)
+			entries = append(entries, append([]int64{entry.GetKey()}, entry.Values()...))
+		}
+	}
+	return bucketJSON{PN: bucket.page.GetPageNum(), Depth: bucket.depth, Entries: entries}
+}
+
+// PrintJSON writes the bucket as a JSON object with its page number, depth, and entries,
+// each an array of its key followed by its values.
+func (bucket *HashBucket) PrintJSON(w io.Writer) {
+	json.NewEncoder(w).Encode(bucket.toJSON())
+}
+
 // [CONCURRENCY] Grab a write lock on the hash table index
 func (bucket *HashBucket) WLock() {
 	bucket.page.WLock()
@@ -2,62 +2,125 @@ package hash
 
 import (
 	"errors"
+	"sort"
 
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // HashCursor points to a spot in the hash table.
+// A cursor holds no pins between calls; it re-reads its bucket each time.
+// Buckets are visited in page order, so each bucket is visited exactly once, unless buckets
+// coalesce while the cursor is open; see HashTable.Coalesce.
+// Entries deleted in place are skipped; one deleted after the cursor reached it is still returned.
 type HashCursor struct {
-	table     *HashIndex
-	cellnum   int64
-	isEnd     bool
-	curBucket *HashBucket
+	table   *HashIndex
+	cellnum int64
+	isEnd   bool
+	curPN   int64 // Page number of the current bucket.
 }
 
 // TableStart returns a cursor to the first entry in the hash table.
 func (table *HashIndex) TableStart() (utils.Cursor, error) {
-	cursor := HashCursor{table: table, cellnum: 0}
+	cursor := HashCursor{table: table, cellnum: 0, curPN: ROOT_PN}
+	bucket, err := cursor.getBucket()
+	if err != nil {
+		return nil, err
+	}
+	cursor.skipTombstones(bucket)
+	releaseBucket(bucket)
+	return &cursor, nil
+}
 
-	curPage, err := table.pager.GetPage(ROOT_PN)
+// TableFind returns a cursor to the entry with the given key, or at the end of the table if
+// there is none. Stepping forward goes on through the rest of the table in page order, so the
+// entries after it are in no particular key order.
+func (table *HashIndex) TableFind(key int64) (utils.Cursor, error) {
+	hashTable := table.table
+	hashTable.RLock()
+	bucket, err := hashTable.lockKeyBucket(hashTable.hashFn(key, hashTable.depth), key, READ_LOCK)
+	hashTable.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-	defer curPage.Put()
-	cursor.curBucket = pageToBucket(curPage)
-	cursor.isEnd = (cursor.curBucket.numKeys == 0)
+	defer releaseBucket(bucket)
+	cursor := HashCursor{table: table, cellnum: bucket.indexOf(key), curPN: bucket.page.GetPageNum()}
+	if cursor.cellnum == -1 {
+		cursor.cellnum = 0
+		cursor.curPN = table.pager.GetNumPages() - 1
+		cursor.isEnd = true
+	}
 	return &cursor, nil
 }
 
+// TableFindRange returns the entries with keys in [startKey, endKey], sorted by key, as
+// the btree's does. Hashing keeps no order, so it scans the whole table.
+func (table *HashIndex) TableFindRange(startKey int64, endKey int64) ([]utils.Entry, error) {
+	ret, err := table.SelectFilter(func(entry utils.Entry) bool {
+		return startKey <= entry.GetKey() && entry.GetKey() <= endKey
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetKey() < ret[j].GetKey()
+	})
+	return ret, nil
+}
+
+// skipTombstones moves the cursor past any deleted entries, marking the end of the bucket if reached.
+func (cursor *HashCursor) skipTombstones(bucket *HashBucket) {
+	for cursor.cellnum < bucket.numKeys && bucket.isTombstone(cursor.cellnum) {
+		cursor.cellnum++
+	}
+	cursor.isEnd = (cursor.cellnum >= bucket.numKeys)
+}
+
+// getBucket pins and read-locks the cursor's current bucket; release it with releaseBucket.
+func (cursor *HashCursor) getBucket() (*HashBucket, error) {
+	// The bucket's page may have been given up by a coalesce.
+	if cursor.curPN >= cursor.table.pager.GetNumPages() {
+		return nil, errors.New("bucket no longer exists")
+	}
+	return cursor.table.table.GetAndLockBucketByPN(cursor.curPN, READ_LOCK)
+}
+
+// releaseBucket unlocks and unpins a bucket returned by getBucket.
+func releaseBucket(bucket *HashBucket) {
+	bucket.RUnlock()
+	bucket.page.Put()
+}
+
 // StepForward moves the cursor ahead by one entry.
 func (cursor *HashCursor) StepForward() bool {
 	// If the cursor is at the end of the bucket, try visiting the next bucket.
 	if cursor.isEnd {
 		// Get the next page number.
-		nextPN := cursor.curBucket.page.GetPageNum() + 1
-		if nextPN >= cursor.curBucket.page.GetPager().GetNumPages() {
+		nextPN := cursor.curPN + 1
+		if nextPN >= cursor.table.pager.GetNumPages() {
 			return true
 		}
-		// Convert the page to a bucket.
-		nextPage, err := cursor.table.pager.GetPage(nextPN)
+		// Reinitialize the cursor.
+		cursor.curPN = nextPN
+		cursor.cellnum = 0
+		nextBucket, err := cursor.getBucket()
 		if err != nil {
 			return true
 		}
-		defer nextPage.Put()
-		nextBucket := pageToBucket(nextPage)
-		// Reinitialize the cursor.
-		cursor.cellnum = 0
-		cursor.isEnd = (cursor.cellnum == nextBucket.numKeys)
-		cursor.curBucket = nextBucket
+		cursor.skipTombstones(nextBucket)
+		releaseBucket(nextBucket)
 		if cursor.isEnd {
 			return cursor.StepForward()
 		}
 		return false
 	}
 	// Else, just move the cursor forward.
-	cursor.cellnum++
-	if cursor.cellnum >= cursor.curBucket.numKeys {
-		cursor.isEnd = true
+	bucket, err := cursor.getBucket()
+	if err != nil {
+		return true
 	}
+	cursor.cellnum++
+	cursor.skipTombstones(bucket)
+	releaseBucket(bucket)
 	return false
 }
 
@@ -71,6 +134,14 @@ func (cursor *HashCursor) GetEntry() (utils.Entry, error) {
 	if cursor.isEnd {
 		return HashEntry{}, errors.New("getEntry: entry is non-existent")
 	}
-	entry := cursor.curBucket.getCell(cursor.cellnum)
+	bucket, err := cursor.getBucket()
+	if err != nil {
+		return HashEntry{}, err
+	}
+	defer releaseBucket(bucket)
+	if cursor.cellnum >= bucket.numKeys {
+		return HashEntry{}, errors.New("getEntry: entry is non-existent")
+	}
+	entry := bucket.getCell(cursor.cellnum)
 	return entry, nil
 }
@@ -10,6 +10,12 @@ import (
 type HashEntry struct {
 	key   int64
 	value int64
+	extra []int64 // Values past the first, in tables storing more than one.
+}
+
+// newEntry returns an entry with the given key and values; values must not be empty.
+func newEntry(key int64, values []int64) HashEntry {
+	return HashEntry{key: key, value: values[0], extra: values[1:]}
 }
 
 // Get key.
@@ -22,6 +28,11 @@ func (entry HashEntry) GetValue() int64 {
 	return entry.value
 }
 
+// Get all values.
+func (entry HashEntry) Values() []int64 {
+	return append([]int64{entry.value}, entry.extra...)
+}
+
 // Set key.
 func (entry *HashEntry) SetKey(key int64) {
 	entry.key = key
@@ -39,23 +50,39 @@ func (entry HashEntry) Marshal() []byte {
 	bin := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(bin, entry.GetKey())
 	newdata = bin
-	// Marshall the value field.
-	bin = make([]byte, binary.MaxVarintLen64)
-	binary.PutVarint(bin, entry.GetValue())
-	newdata = append(newdata, bin...)
+	// Marshall the value fields.
+	for _, value := range entry.Values() {
+		bin = make([]byte, binary.MaxVarintLen64)
+		binary.PutVarint(bin, value)
+		newdata = append(newdata, bin...)
+	}
 	// Return the combined byte array.
 	return newdata
 }
 
-// unmarshalEntry deserializes a byte array into an entry.
+// unmarshalEntry deserializes a byte array into an entry, ignoring any tombstone mark.
+// The number of values is taken from the length of the array.
 func unmarshalEntry(data []byte) (entry HashEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return HashEntry{key: k, value: v}
+	last := len(data) - 1
+	if data[last]&TOMBSTONE_BIT != 0 {
+		data = append([]byte{}, data...)
+		data[last] &^= TOMBSTONE_BIT
+	}
+	size := binary.MaxVarintLen64
+	k, _ := binary.Varint(data[:size])
+	values := make([]int64, len(data)/size-1)
+	for i := range values {
+		values[i], _ = binary.Varint(data[(i+1)*size : (i+2)*size])
+	}
+	return newEntry(k, values)
 }
 
 // Print this entry.
 func (entry HashEntry) Print(w io.Writer) {
+	if len(entry.extra) > 0 {
+		io.WriteString(w, fmt.Sprintf("(%d, %v), ", entry.GetKey(), entry.Values()))
+		return
+	}
 	io.WriteString(w, fmt.Sprintf("(%d, %d), ",
 		entry.GetKey(), entry.GetValue()))
 }
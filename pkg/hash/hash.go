@@ -1,7 +1,11 @@
 package hash
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sync"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
@@ -9,12 +13,38 @@ import (
 
 // HashIndex is an index that uses a HashTable as its datastructure. Implements db.Index.
 type HashIndex struct {
-	table *HashTable
-	pager *pager.Pager
+	table    *HashTable
+	pager    *pager.Pager
+	vacuum   utils.VacuumTracker // When Delete compacts the table.
+	batchMtx sync.Mutex          // Applies write batches one at a time.
 }
 
 // Opens the pager with the given table name.
 func OpenTable(filename string) (*HashIndex, error) {
+	return openTable(filename, 0, 0)
+}
+
+// Opens the pager with the given table name, creating a table whose global depth never
+// exceeds maxDepth if it is new; see NewHashTableBounded. The bound is persisted; an
+// existing table keeps its own.
+func OpenTableBounded(filename string, maxDepth int64) (*HashIndex, error) {
+	return openTable(filename, 0, maxDepth)
+}
+
+// Opens the pager with the given table name, creating a table whose entries each store
+// numValues values if it is new. The number of values is persisted; opening an existing
+// table with a different number is an error.
+func OpenTableWithValues(filename string, numValues int64) (*HashIndex, error) {
+	if err := utils.CheckNumValues(numValues); err != nil {
+		return nil, err
+	}
+	return openTable(filename, numValues, 0)
+}
+
+// Opens the pager with the given table name. A numValues of 0 accepts whatever an
+// existing table stores, and creates single-value tables. A maxDepth of 0 creates
+// unbounded tables.
+func openTable(filename string, numValues int64, maxDepth int64) (*HashIndex, error) {
 	// Create a pager for the table.
 	pager := pager.NewPager()
 	err := pager.Open(filename)
@@ -24,16 +54,56 @@ func OpenTable(filename string) (*HashIndex, error) {
 	// Return index.
 	var table *HashTable
 	if pager.GetNumPages() == 0 {
-		table, err = NewHashTable(pager)
+		if numValues == 0 {
+			numValues = 1
+		}
+		if maxDepth > 0 {
+			table, err = NewHashTableBounded(pager, numValues, maxDepth)
+		} else {
+			table, err = NewHashTable(pager, numValues)
+		}
 	} else {
 		table, err = ReadHashTable(pager)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if numValues != 0 && numValues != table.numValues {
+		pager.Close()
+		return nil, fmt.Errorf("table stores %v values per entry, not %v", table.numValues, numValues)
+	}
 	return &HashIndex{table: table, pager: pager}, nil
 }
 
+// Rebuild reads every entry straight from the bucket pages, ignoring the directory,
+// and inserts them into a new hash table at the given filename, which must not exist yet.
+// Every entry is copied, even one whose key another entry shares.
+// This recovers a table whose directory no longer points at the right buckets.
+func Rebuild(index *HashIndex, filename string) (*HashIndex, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return nil, errors.New("rebuild target already exists")
+	}
+	// Block writers while reading every bucket page.
+	index.table.WLock()
+	entries, err := index.table.SelectConcurrent()
+	index.table.WUnlock()
+	if err != nil {
+		return nil, err
+	}
+	newIndex, err := openTable(filename, index.table.numValues, index.table.maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err = newIndex.table.insertValues(entry.GetKey(), entry.Values(), true); err != nil {
+			newIndex.GetPager().Close()
+			os.Remove(filename)
+			return nil, err
+		}
+	}
+	return newIndex, nil
+}
+
 // Get name.
 func (table *HashIndex) GetName() string {
 	return table.pager.GetFileName()
@@ -44,6 +114,11 @@ func (table *HashIndex) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get the number of values in each entry.
+func (index *HashIndex) GetNumValues() int64 {
+	return index.table.numValues
+}
+
 // Get table.
 func (index *HashIndex) GetTable() *HashTable {
 	return index.table
@@ -54,31 +129,151 @@ func (index *HashIndex) Close() error {
 	return WriteHashTable(index.pager, index.table)
 }
 
+// Pins every bucket in the buffer pool until UnpinResident; see pager.PinResident.
+func (index *HashIndex) PinResident() error {
+	return index.pager.PinResident()
+}
+
+// Releases the pins taken by PinResident.
+func (index *HashIndex) UnpinResident() {
+	index.pager.UnpinResident()
+}
+
+// Set how Delete removes entries; see utils.DeleteMode. Not persisted.
+func (index *HashIndex) SetDeleteMode(mode utils.DeleteMode) {
+	index.table.SetDeleteMode(mode)
+}
+
+// Physically remove entries deleted in place; see HashTable.Compact.
+func (index *HashIndex) Compact() (int64, error) {
+	return index.table.Compact()
+}
+
+// Fraction of occupied entry slots holding entries deleted in place; see HashTable.Fragmentation.
+func (index *HashIndex) Fragmentation() float64 {
+	return index.table.Fragmentation()
+}
+
+// AutoVacuum makes Delete compact the table once its Fragmentation reaches threshold,
+// checking every utils.AUTO_VACUUM_INTERVAL deletes in place; 0 turns it off. Not persisted.
+// Compaction waits for scans bracketed by BeginScan and EndScan, including the Selects.
+// It never changes which entries the table holds, so transactions are unaffected.
+func (index *HashIndex) AutoVacuum(threshold float64) {
+	index.vacuum.SetThreshold(threshold)
+}
+
+// BeginScan holds off auto-vacuum until the matching EndScan; cursor users should bracket
+// their scans with them.
+func (index *HashIndex) BeginScan() {
+	index.vacuum.BeginScan()
+}
+
+// EndScan ends a scan, running any auto-vacuum that fell due during it.
+func (index *HashIndex) EndScan() {
+	if index.vacuum.EndScan() {
+		index.vacuumIfFragmented()
+	}
+}
+
+// BeginBatch waits for any write batch being applied to the index, then claims it until EndBatch.
+func (index *HashIndex) BeginBatch() {
+	index.batchMtx.Lock()
+}
+
+// EndBatch lets the next write batch be applied.
+func (index *HashIndex) EndBatch() {
+	index.batchMtx.Unlock()
+}
+
+// vacuumIfFragmented compacts the table if it is fragmented past the auto-vacuum threshold.
+func (index *HashIndex) vacuumIfFragmented() {
+	defer index.vacuum.EndCheck()
+	if index.table.Fragmentation() >= index.vacuum.GetThreshold() {
+		index.table.Compact()
+	}
+}
+
 // Find element by key.
 func (index *HashIndex) Find(key int64) (utils.Entry, error) {
 	return index.table.Find(key)
 }
 
-// Insert given element.
+// Insert given element; errors if the key is already present, as in the btree.
 func (index *HashIndex) Insert(key int64, value int64) error {
 	return index.table.Insert(key, value)
 }
 
+// Insert given element even if the key is already present; see HashTable.InsertDuplicate.
+func (index *HashIndex) InsertDuplicate(key int64, value int64) error {
+	return index.table.InsertDuplicate(key, value)
+}
+
+// Insert an element with the given values; any values past the end of the slice are stored as 0.
+// Errors if the key is already present.
+func (index *HashIndex) InsertValues(key int64, values []int64) error {
+	if err := utils.CheckValues(values, index.table.numValues); err != nil {
+		return err
+	}
+	return index.table.InsertValues(key, values)
+}
+
 // Update given element.
 func (index *HashIndex) Update(key int64, value int64) error {
 	return index.table.Update(key, value)
 }
 
+// Overwrite the first len(values) values of the given element.
+func (index *HashIndex) UpdateValues(key int64, values []int64) error {
+	if err := utils.CheckValues(values, index.table.numValues); err != nil {
+		return err
+	}
+	return index.table.UpdateValues(key, values)
+}
+
 // Delete given element.
 func (index *HashIndex) Delete(key int64) error {
-	return index.table.Delete(key)
+	err := index.table.Delete(key)
+	if index.table.GetDeleteMode() == utils.TOMBSTONE_DELETE && index.vacuum.NoteDelete() {
+		index.vacuumIfFragmented()
+	}
+	return err
 }
 
 // Select all elements.
 func (index *HashIndex) Select() ([]utils.Entry, error) {
+	index.BeginScan()
+	defer index.EndScan()
 	return index.table.Select()
 }
 
+// Select all elements with the given number of workers; see HashTable.SelectParallel.
+func (index *HashIndex) SelectParallel(workers int) ([]utils.Entry, error) {
+	index.BeginScan()
+	defer index.EndScan()
+	return index.table.SelectParallel(workers)
+}
+
+// Select the elements satisfying pred; see HashTable.SelectFilter.
+func (index *HashIndex) SelectFilter(pred func(utils.Entry) bool) ([]utils.Entry, error) {
+	index.BeginScan()
+	defer index.EndScan()
+	return index.table.SelectFilter(pred)
+}
+
+// Select all elements, sorted by key; see HashTable.SelectOrdered.
+func (index *HashIndex) SelectOrdered() ([]utils.Entry, error) {
+	index.BeginScan()
+	defer index.EndScan()
+	return index.table.SelectOrdered()
+}
+
+// Select all elements without blocking writers to other buckets; see HashTable.SelectConcurrent.
+func (index *HashIndex) SelectConcurrent() ([]utils.Entry, error) {
+	index.BeginScan()
+	defer index.EndScan()
+	return index.table.SelectConcurrent()
+}
+
 // Print all elements.
 func (index *HashIndex) Print(w io.Writer) {
 	index.table.Print(w)
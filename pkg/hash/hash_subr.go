@@ -2,6 +2,7 @@ package hash
 
 import (
 	"encoding/binary"
+	"sort"
 
 	xxhash "github.com/cespare/xxhash"
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
@@ -17,8 +18,13 @@ var DEPTH_SIZE int64 = binary.MaxVarintLen64
 var NUM_KEYS_OFFSET int64 = DEPTH_OFFSET + DEPTH_SIZE
 var NUM_KEYS_SIZE int64 = binary.MaxVarintLen64
 var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2                    // int64 key, int64 value
-var BUCKETSIZE int64 = (PAGESIZE - BUCKET_HEADER_SIZE) / ENTRYSIZE // num entries
+var ENTRYSIZE int64 = entrySize(1)   // int64 key, int64 value
+var BUCKETSIZE int64 = BucketSize(1) // num entries in single-value tables
+var COALESCE_DIVISOR int64 = 4       // Buddies merge once both are under 1/COALESCE_DIVISOR full
+
+// Entries deleted in place are marked by setting the high bit of the last byte of their cell,
+// which a marshalled varint never uses.
+const TOMBSTONE_BIT byte = 0x80
 
 // Lock Types
 type BucketLockType int
@@ -29,51 +35,169 @@ const (
 	READ_LOCK  BucketLockType = 2
 )
 
-// getHash returns the hash of a key, given a hashing function.
-func getHash(hasher func(b []byte) uint64, key int64, size int64) uint {
+// getHash returns the magnitude of the hash of a key, given a hashing function.
+// The magnitude is taken as unsigned, so every key, including ones hashing to the
+// most negative int64, gets a non-negative hash.
+func getHash(hasher func(b []byte) uint64, key int64) uint64 {
 	buf := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(buf, key)
-	hash := int64(hasher(buf))
-	if hash < 0 {
-		hash *= -1
+	hash := hasher(buf)
+	if int64(hash) < 0 {
+		hash = -hash
 	}
-	return uint(hash % size)
+	return hash
 }
 
 // XxHasher returns the xxHash hash of the given key, bounded by size.
 func XxHasher(key int64, size int64) uint {
-	return getHash(xxhash.Sum64, key, size)
+	return uint(getHash(xxhash.Sum64, key) % uint64(size))
 }
 
 // MurmurHasher returns the MurmurHash3 hash of the given key, bounded by size.
 func MurmurHasher(key int64, size int64) uint {
-	return getHash(murmur3.Sum64, key, size)
+	return uint(getHash(murmur3.Sum64, key) % uint64(size))
 }
 
-// Hasher returns the hash of a key, modded by 2^depth.
+// Hasher returns the hash of a key, masked to its low depth bits.
+// The result is always a valid index into a directory of 2^depth buckets, for any key.
 func Hasher(key int64, depth int64) int64 {
-	return int64(XxHasher(key, powInt(2, depth)))
+	return int64(getHash(xxhash.Sum64, key) & (uint64(1)<<uint(depth) - 1))
+}
+
+// Get the size of an entry with the given number of values.
+func entrySize(numValues int64) int64 {
+	return binary.MaxVarintLen64 * (1 + numValues)
+}
+
+// BucketSize returns how many entries a bucket holds before it must split,
+// in a table storing numValues values per entry.
+func BucketSize(numValues int64) int64 {
+	return (PAGESIZE - BUCKET_HEADER_SIZE) / entrySize(numValues)
+}
+
+// Get the size of each cell in this bucket.
+func (bucket *HashBucket) cellSize() int64 {
+	return entrySize(bucket.numValues)
 }
 
 // Get the byte-position of the cell with the given index.
-func cellPos(index int64) int64 {
-	return BUCKET_HEADER_SIZE + index*ENTRYSIZE
+func (bucket *HashBucket) cellPos(index int64) int64 {
+	return BUCKET_HEADER_SIZE + index*bucket.cellSize()
 }
 
-// Write the given entry into the given index.
+// Write the given entry into the given index. Values the entry doesn't have are stored as 0.
 func (bucket *HashBucket) modifyCell(index int64, entry HashEntry) {
-	newdata := entry.Marshal()
-	startPos := cellPos(index)
-	bucket.page.Update(newdata, startPos, ENTRYSIZE)
+	newdata := make([]byte, bucket.cellSize())
+	copy(newdata, entry.Marshal())
+	startPos := bucket.cellPos(index)
+	bucket.page.Update(newdata, startPos, bucket.cellSize())
 }
 
 // Get the entry at the given index.
 func (bucket *HashBucket) getCell(index int64) HashEntry {
-	startPos := cellPos(index)
-	entry := unmarshalEntry((*bucket.page.GetData())[startPos : startPos+ENTRYSIZE])
+	startPos := bucket.cellPos(index)
+	entry := unmarshalEntry((*bucket.page.GetData())[startPos : startPos+bucket.cellSize()])
 	return entry
 }
 
+// Get the byte-position of the byte marking the cell with the given index as deleted.
+func (bucket *HashBucket) tombstonePos(index int64) int64 {
+	return bucket.cellPos(index) + bucket.cellSize() - 1
+}
+
+// Check if the entry at the given index has been deleted in place.
+func (bucket *HashBucket) isTombstone(index int64) bool {
+	return (*bucket.page.GetData())[bucket.tombstonePos(index)]&TOMBSTONE_BIT != 0
+}
+
+// Mark the entry at the given index as deleted in place.
+func (bucket *HashBucket) setTombstone(index int64) {
+	pos := bucket.tombstonePos(index)
+	bucket.page.Update([]byte{(*bucket.page.GetData())[pos] | TOMBSTONE_BIT}, pos, 1)
+}
+
+// Copy the cell at index from to index to, keeping any tombstone mark.
+func (bucket *HashBucket) moveCell(to int64, from int64) {
+	startPos := bucket.cellPos(from)
+	data := make([]byte, bucket.cellSize())
+	copy(data, (*bucket.page.GetData())[startPos:startPos+bucket.cellSize()])
+	bucket.page.Update(data, bucket.cellPos(to), bucket.cellSize())
+}
+
+// Physically remove the entries deleted in place; returns how many were removed.
+func (bucket *HashBucket) compact() int64 {
+	live := int64(0)
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if bucket.isTombstone(i) {
+			continue
+		}
+		if live != i {
+			bucket.moveCell(live, i)
+		}
+		live++
+	}
+	removed := bucket.numKeys - live
+	if removed > 0 {
+		bucket.updateNumKeys(live)
+	}
+	return removed
+}
+
+// underfull returns whether the bucket's live entries are few enough for it to coalesce.
+func (bucket *HashBucket) underfull() bool {
+	live := int64(0)
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if !bucket.isTombstone(i) {
+			live++
+		}
+	}
+	return live*COALESCE_DIVISOR < bucket.capacity()
+}
+
+// hasRoom returns whether an entry fits without splitting, compacting the bucket if it is full.
+func (bucket *HashBucket) hasRoom() bool {
+	if bucket.numKeys >= bucket.capacity() {
+		bucket.compact()
+	}
+	return bucket.numKeys < bucket.capacity()
+}
+
+// singleKey returns the key shared by every live entry in the bucket, if there is one.
+func (bucket *HashBucket) singleKey() (key int64, ok bool) {
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if bucket.isTombstone(i) {
+			continue
+		}
+		if ok && bucket.getKeyAt(i) != key {
+			return 0, false
+		}
+		key, ok = bucket.getKeyAt(i), true
+	}
+	return key, ok
+}
+
+// splitsApart reports whether splitting the bucket one level deeper would leave live
+// entries in both halves.
+func (table *HashTable) splitsApart(bucket *HashBucket) bool {
+	newHash := int64(-1)
+	moved, stayed := false, false
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if bucket.isTombstone(i) {
+			continue
+		}
+		hash := table.hashFn(bucket.getKeyAt(i), bucket.depth+1)
+		if newHash == -1 {
+			newHash = hash%powInt(2, bucket.depth) + powInt(2, bucket.depth)
+		}
+		if hash == newHash {
+			moved = true
+		} else {
+			stayed = true
+		}
+	}
+	return moved && stayed
+}
+
 // Get the key at the given index.
 func (bucket *HashBucket) getKeyAt(index int64) int64 {
 	return bucket.getCell(index).GetKey()
@@ -98,6 +222,14 @@ func (bucket *HashBucket) updateValueAt(index int64, value int64) {
 	bucket.modifyCell(index, entry)
 }
 
+// Overwrite the first len(values) values at the given index.
+func (bucket *HashBucket) updateValuesAt(index int64, values []int64) {
+	entry := bucket.getCell(index)
+	newValues := entry.Values()
+	copy(newValues, values)
+	bucket.modifyCell(index, newEntry(entry.GetKey(), newValues))
+}
+
 // Update this bucket's depth.
 func (bucket *HashBucket) updateDepth(depth int64) {
 	bucket.depth = depth
@@ -114,8 +246,8 @@ func (bucket *HashBucket) updateNumKeys(nKeys int64) {
 	bucket.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
 }
 
-// Convert a page into a bucket.
-func pageToBucket(page *pager.Page) *HashBucket {
+// Convert a page into a bucket whose entries hold numValues values each.
+func pageToBucket(page *pager.Page, numValues int64) *HashBucket {
 	depth, _ := binary.Varint(
 		(*page.GetData())[DEPTH_OFFSET : DEPTH_OFFSET+DEPTH_SIZE],
 	)
@@ -123,9 +255,10 @@ func pageToBucket(page *pager.Page) *HashBucket {
 		(*page.GetData())[NUM_KEYS_OFFSET : NUM_KEYS_OFFSET+NUM_KEYS_SIZE],
 	)
 	return &HashBucket{
-		depth:   depth,
-		numKeys: numKeys,
-		page:    page,
+		depth:     depth,
+		numKeys:   numKeys,
+		numValues: numValues,
+		page:      page,
 	}
 }
 
@@ -135,7 +268,7 @@ func (table *HashTable) GetBucketByPN(pn int64) (*HashBucket, error) {
 	if err != nil {
 		return nil, err
 	}
-	return pageToBucket(page), nil
+	return pageToBucket(page, table.numValues), nil
 }
 
 // Returns the bucket in the hash table using its page number, and increments the bucket ref count.
@@ -150,7 +283,7 @@ func (table *HashTable) GetAndLockBucketByPN(pn int64, lock BucketLockType) (*Ha
 	if lock == WRITE_LOCK {
 		page.WLock()
 	}
-	return pageToBucket(page), nil
+	return pageToBucket(page, table.numValues), nil
 }
 
 // Returns the bucket in the hash table, and increments the bucket ref count.
@@ -173,10 +306,15 @@ func (table *HashTable) GetAndLockBucket(hash int64, lock BucketLockType) (*Hash
 	return bucket, nil
 }
 
+// MetaFileName returns the name of the file holding the directory of the table stored by the given pager.
+func MetaFileName(bucketPager *pager.Pager) string {
+	return bucketPager.GetFileName() + ".meta"
+}
+
 // Read hash table in from memory.
 func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	indexPager := pager.NewPager()
-	err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+	err := indexPager.Open(MetaFileName(bucketPager))
 	if err != nil {
 		return nil, err
 	}
@@ -188,34 +326,67 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	// Read the gobal depth
 	depth, _ := binary.Varint((*page.GetData())[:DEPTH_SIZE])
 	bytesRead := DEPTH_SIZE
-	// Read the bucket index
+	// Read the rest one number at a time; directories written before a field existed end
+	// before it, and read as 0 there.
 	pnSize := int64(binary.MaxVarintLen64)
-	numHashes := powInt(2, depth)
-	buckets := make([]int64, numHashes)
-	for i := int64(0); i < numHashes; i++ {
+	readInt := func() int64 {
+		if page == nil {
+			return 0
+		}
 		if bytesRead+pnSize > PAGESIZE {
 			page.Put()
+			page = nil
 			metaPN++
-			page, err = indexPager.GetPage(metaPN)
-			if err != nil {
-				return nil, err
+			if metaPN >= indexPager.GetNumPages() {
+				return 0
+			}
+			if page, err = indexPager.GetPage(metaPN); err != nil {
+				return 0
 			}
 			bytesRead = 0
 		}
-		pn, _ := binary.Varint((*page.GetData())[bytesRead : bytesRead+pnSize])
+		n, _ := binary.Varint((*page.GetData())[bytesRead : bytesRead+pnSize])
 		bytesRead += pnSize
-		buckets[i] = pn
+		return n
+	}
+	// Read the bucket index, followed by the number of values per entry, the maximum depth,
+	// and the overflow chains.
+	numHashes := powInt(2, depth)
+	buckets := make([]int64, numHashes)
+	for i := range buckets {
+		buckets[i] = readInt()
+	}
+	numValues := readInt()
+	maxDepth := readInt()
+	overflow := make(map[int64][]int64)
+	for numChains := readInt(); numChains > 0; numChains-- {
+		pn := readInt()
+		chain := make([]int64, readInt())
+		for i := range chain {
+			chain[i] = readInt()
+		}
+		overflow[pn] = chain
+	}
+	if page != nil {
+		page.Put()
 	}
-	page.Put()
 	indexPager.Close()
-	return &HashTable{depth: depth, buckets: buckets, pager: bucketPager}, nil
+	if err != nil {
+		return nil, err
+	}
+	// Tables written before entries could hold more than one value have a 0 here.
+	if numValues == 0 {
+		numValues = 1
+	}
+	return &HashTable{depth: depth, buckets: buckets, pager: bucketPager, numValues: numValues, hashFn: Hasher,
+		maxDepth: maxDepth, overflow: overflow}, nil
 }
 
 // Write hash table out to memory.
 func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 	if bucketPager.HasFile() {
 		indexPager := pager.NewPager()
-		err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+		err := indexPager.Open(MetaFileName(bucketPager))
 		if err != nil {
 			return err
 		}
@@ -230,10 +401,20 @@ func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 		binary.PutVarint(depthData, table.depth)
 		page.Update(depthData, DEPTH_OFFSET, DEPTH_SIZE)
 		bytesWritten := DEPTH_SIZE
-		// Write bucket index to meta file
+		// Write bucket index to meta file, followed by the number of values per entry,
+		// the maximum depth, and the overflow chains
 		pnSize := int64(binary.MaxVarintLen64)
 		pnData := make([]byte, pnSize)
-		for _, pn := range table.buckets {
+		toWrite := append(append([]int64{}, table.buckets...), table.numValues, table.maxDepth, int64(len(table.overflow)))
+		chained := make([]int64, 0, len(table.overflow))
+		for pn := range table.overflow {
+			chained = append(chained, pn)
+		}
+		sort.Slice(chained, func(i, j int) bool { return chained[i] < chained[j] })
+		for _, pn := range chained {
+			toWrite = append(append(toWrite, pn, int64(len(table.overflow[pn]))), table.overflow[pn]...)
+		}
+		for _, pn := range toWrite {
 			if bytesWritten+pnSize > PAGESIZE {
 				page.Put()
 				metaPN = indexPager.GetFreePN()
@@ -1,37 +1,62 @@
 package hash
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"sync"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+
+	errgroup "golang.org/x/sync/errgroup"
 )
 
 // HashTable definitions.
 type HashTable struct {
-	depth   int64
-	buckets []int64 // Array of bucket page numbers
-	pager   *pager.Pager
-	rwlock  sync.RWMutex // Lock on the hash table index
+	depth      int64
+	buckets    []int64 // Array of bucket page numbers
+	pager      *pager.Pager
+	rwlock     sync.RWMutex                       // Lock on the hash table index
+	deleteMode utils.DeleteMode                   // How Delete removes entries.
+	numValues  int64                              // Number of values in each entry.
+	hashFn     func(key int64, depth int64) int64 // Hashes keys; Hasher unless set.
+	maxDepth   int64                              // Deepest the table grows; 0 is unbounded.
+	overflow   map[int64][]int64                  // Overflow pages chained to each bucket, by bucket page.
 }
 
-// Returns a new HashTable.
-func NewHashTable(pager *pager.Pager) (*HashTable, error) {
+// Returns a new HashTable whose entries each store numValues values.
+func NewHashTable(pager *pager.Pager, numValues int64) (*HashTable, error) {
 	depth := int64(2)
 	buckets := make([]int64, powInt(2, depth))
 	for i := range buckets {
-		bucket, err := NewHashBucket(pager, depth)
+		bucket, err := NewHashBucket(pager, depth, numValues)
 		if err != nil {
 			return nil, err
 		}
 		buckets[i] = bucket.page.GetPageNum()
 		bucket.page.Put()
 	}
-	return &HashTable{depth: depth, buckets: buckets, pager: pager}, nil
+	return &HashTable{depth: depth, buckets: buckets, pager: pager, numValues: numValues, hashFn: Hasher,
+		overflow: make(map[int64][]int64)}, nil
+}
+
+// Returns a new HashTable, like NewHashTable, whose global depth never exceeds maxDepth.
+// Rather than split a bucket that deep, entries that don't fit in it go to overflow pages
+// chained to it.
+func NewHashTableBounded(pager *pager.Pager, numValues int64, maxDepth int64) (*HashTable, error) {
+	if maxDepth < 2 {
+		return nil, fmt.Errorf("maximum depth must be at least the starting depth of 2, not %v", maxDepth)
+	}
+	table, err := NewHashTable(pager, numValues)
+	if err != nil {
+		return nil, err
+	}
+	table.maxDepth = maxDepth
+	return table, nil
 }
 
 // [CONCURRENCY] Grab a write lock on the hash table index
@@ -59,6 +84,11 @@ func (table *HashTable) GetDepth() int64 {
 	return table.depth
 }
 
+// Get the deepest the table grows, or 0 if it is unbounded.
+func (table *HashTable) GetMaxDepth() int64 {
+	return table.maxDepth
+}
+
 // Get bucket page numbers.
 func (table *HashTable) GetBuckets() []int64 {
 	return table.buckets
@@ -69,17 +99,50 @@ func (table *HashTable) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get the number of values in each entry.
+func (table *HashTable) GetNumValues() int64 {
+	return table.numValues
+}
+
+// Get the function keys are hashed with.
+func (table *HashTable) GetHashFn() func(key int64, depth int64) int64 {
+	return table.hashFn
+}
+
+// Set the function keys are hashed with, which, like Hasher, must return a key's hash
+// masked to its low depth bits. An insert that overfills a bucket fails unless the function
+// tells its entries apart one level deeper, or the table is bounded and chains them instead.
+// Entries already in the table are not moved, so set it while the table is empty,
+// and again after reopening it. Not persisted.
+func (table *HashTable) SetHashFn(hashFn func(key int64, depth int64) int64) {
+	table.WLock()
+	defer table.WUnlock()
+	table.hashFn = hashFn
+}
+
+// Get delete mode.
+func (table *HashTable) GetDeleteMode() utils.DeleteMode {
+	return table.deleteMode
+}
+
+// Set how Delete removes entries. Not persisted.
+func (table *HashTable) SetDeleteMode(mode utils.DeleteMode) {
+	table.WLock()
+	defer table.WUnlock()
+	table.deleteMode = mode
+}
+
 // Finds the entry with the given key.
 func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	table.RLock()
 	// Hash the key.
-	hash := Hasher(key, table.depth)
-	if hash < 0 || int(hash) >= len(table.buckets) {
+	hash := table.hashFn(key, table.depth)
+	if int(hash) >= len(table.buckets) {
 		table.RUnlock()
 		return nil, errors.New("not found")
 	}
 	// Get the corresponding bucket.
-	bucket, err := table.GetAndLockBucket(hash, READ_LOCK)
+	bucket, err := table.lockKeyBucket(hash, key, READ_LOCK)
 	if err != nil {
 		table.RUnlock()
 		return nil, err
@@ -98,6 +161,101 @@ func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	return entry, nil
 }
 
+// Get the page numbers of the bucket on the given page: its own, then its overflow pages.
+func (table *HashTable) GetChain(pn int64) []int64 {
+	table.RLock()
+	defer table.RUnlock()
+	return table.chain(pn)
+}
+
+// chain returns the pages of the bucket on the given page: its own, then its overflow pages.
+func (table *HashTable) chain(pn int64) []int64 {
+	return append([]int64{pn}, table.overflow[pn]...)
+}
+
+// chained returns whether the bucket is as deep as the table may grow, so entries that
+// don't fit in it go to overflow pages instead of splitting it.
+func (table *HashTable) chained(bucket *HashBucket) bool {
+	return table.maxDepth > 0 && bucket.depth >= table.maxDepth
+}
+
+// lockKeyBucket gets and locks the page holding the given key in the bucket at the given hash,
+// searching its overflow pages after its own. If no page holds the key, returns the last one.
+// Expects the table to be locked.
+func (table *HashTable) lockKeyBucket(hash int64, key int64, lock BucketLockType) (*HashBucket, error) {
+	chain := table.chain(table.buckets[hash])
+	for i, pn := range chain {
+		bucket, err := table.GetAndLockBucketByPN(pn, lock)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(chain)-1 || bucket.indexOf(key) != -1 {
+			return bucket, nil
+		}
+		if lock == WRITE_LOCK {
+			bucket.WUnlock()
+		} else {
+			bucket.RUnlock()
+		}
+		bucket.page.Put()
+	}
+	return nil, errors.New("bucket has no pages")
+}
+
+// insertChained inserts an entry into the first page of the bucket's chain with room,
+// chaining a new overflow page if none has any. Expects the table and bucket to be write-locked.
+func (table *HashTable) insertChained(bucket *HashBucket, key int64, values []int64) error {
+	if bucket.hasRoom() {
+		bucket.appendEntry(key, values)
+		return nil
+	}
+	pn := bucket.page.GetPageNum()
+	for _, overflowPN := range table.overflow[pn] {
+		overflow, err := table.GetAndLockBucketByPN(overflowPN, WRITE_LOCK)
+		if err != nil {
+			return err
+		}
+		room := overflow.hasRoom()
+		if room {
+			overflow.appendEntry(key, values)
+		}
+		overflow.WUnlock()
+		overflow.page.Put()
+		if room {
+			return nil
+		}
+	}
+	overflow, err := NewHashBucket(table.pager, bucket.depth, table.numValues)
+	if err != nil {
+		return err
+	}
+	defer overflow.page.Put()
+	table.overflow[pn] = append(table.overflow[pn], overflow.page.GetPageNum())
+	overflow.appendEntry(key, values)
+	return nil
+}
+
+// checkUnique errors if the bucket, or any overflow page chained to it, holds the given key.
+// Expects the table and bucket to be write-locked.
+func (table *HashTable) checkUnique(bucket *HashBucket, key int64) error {
+	if bucket.indexOf(key) != -1 {
+		return errors.New("cannot insert duplicate key")
+	}
+	for _, pn := range table.overflow[bucket.page.GetPageNum()] {
+		overflow, err := table.GetAndLockBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return err
+		}
+		found := overflow.indexOf(key) != -1
+		overflow.RUnlock()
+		overflow.page.Put()
+		if found {
+			return errors.New("cannot insert duplicate key")
+		}
+	}
+	return nil
+}
+
 // ExtendTable increases the global depth of the table by 1.
 func (table *HashTable) ExtendTable() {
 	table.depth = table.depth + 1
@@ -107,6 +265,18 @@ func (table *HashTable) ExtendTable() {
 // Split the given bucket into two, extending the table if necessary.
 func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	/* SOLUTION {{{ */
+	// Entries that share a key hash alike at every depth, so splitting can never separate
+	// them; drop the entry just inserted, always the last, rather than split forever.
+	// A bounded table splits them down to its maximum depth instead, then chains them.
+	if key, ok := bucket.singleKey(); ok && table.maxDepth == 0 {
+		bucket.updateNumKeys(bucket.numKeys - 1)
+		return fmt.Errorf("cannot insert more than %v entries with key %v", bucket.capacity()-1, key)
+	}
+	// Likewise if the hash function doesn't tell the entries apart one level deeper.
+	if table.maxDepth == 0 && !table.splitsApart(bucket) {
+		bucket.updateNumKeys(bucket.numKeys - 1)
+		return fmt.Errorf("cannot insert more than %v entries the hash function doesn't tell apart", bucket.capacity()-1)
+	}
 	// Figure out where the new pointer should live.
 	oldHash := (hash % powInt(2, bucket.depth))
 	newHash := oldHash + powInt(2, bucket.depth)
@@ -116,21 +286,23 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	}
 	// Next, make a new bucket.
 	bucket.updateDepth(bucket.depth + 1)
-	newBucket, err := NewHashBucket(table.pager, bucket.depth)
+	newBucket, err := NewHashBucket(table.pager, bucket.depth, table.numValues)
 	if err != nil {
 		return err
 	}
 	defer newBucket.page.Put()
 
 	// Move entries over to it.
-	tmpEntries := make([]HashEntry, bucket.numKeys)
+	tmpEntries := make([]HashEntry, 0, bucket.numKeys)
 	for i := int64(0); i < bucket.numKeys; i++ {
-		tmpEntries[i] = bucket.getCell(i)
+		if !bucket.isTombstone(i) {
+			tmpEntries = append(tmpEntries, bucket.getCell(i))
+		}
 	}
 	oldNKeys := int64(0)
 	newNKeys := int64(0)
 	for _, entry := range tmpEntries {
-		if Hasher(entry.GetKey(), bucket.depth) == newHash {
+		if table.hashFn(entry.GetKey(), bucket.depth) == newHash {
 			newBucket.modifyCell(newNKeys, entry)
 			newNKeys++
 		} else {
@@ -148,43 +320,130 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 		i += powInt(2, power)
 	}
 	// Check if recursive splitting is required
-	if oldNKeys >= BUCKETSIZE {
+	if oldNKeys >= bucket.capacity() && !table.chained(bucket) {
 		return table.Split(bucket, oldHash)
 	}
-	if newNKeys >= BUCKETSIZE {
+	if newNKeys >= newBucket.capacity() && !table.chained(newBucket) {
 		return table.Split(newBucket, newHash)
 	}
 	return nil
 	/* SOLUTION }}} */
 }
 
+// Insert the given key-value pair. Errors if the key is already in the table, as the
+// btree does; see InsertDuplicate.
 func (table *HashTable) Insert(key int64, value int64) error {
+	return table.InsertValues(key, []int64{value})
+}
+
+// Insert an entry with the given values; any values past the end of the slice are stored as 0.
+// Errors if the key is already in the table.
+func (table *HashTable) InsertValues(key int64, values []int64) error {
+	return table.insertValues(key, values, false)
+}
+
+// InsertDuplicate inserts the given key-value pair even if the key is already in the table,
+// as temporary tables keyed on a column whose values repeat need. Entries sharing a key
+// hash alike, so only a bounded table holds more of them than fit in a bucket, chaining
+// them on overflow pages; see NewHashTableBounded. Find and Update see only one of them.
+func (table *HashTable) InsertDuplicate(key int64, value int64) error {
+	return table.insertValues(key, []int64{value}, true)
+}
+
+// insertValues inserts an entry, first checking that its key isn't in the table unless
+// allowDuplicates is set.
+func (table *HashTable) insertValues(key int64, values []int64, allowDuplicates bool) error {
 	/* SOLUTION {{{ */
 	table.WLock()
 	defer table.WUnlock()
-	hash := Hasher(key, table.depth)
+	hash := table.hashFn(key, table.depth)
 	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
 	if err != nil {
 		return err
 	}
 	defer bucket.page.Put()
 	defer bucket.WUnlock()
-	split, err := bucket.Insert(key, value)
-	if err != nil {
-		return err
+	if !allowDuplicates {
+		if err = table.checkUnique(bucket, key); err != nil {
+			return err
+		}
+	}
+	if table.chained(bucket) {
+		return table.insertChained(bucket, key, values)
 	}
-	if !split {
+	if !bucket.appendEntry(key, values) {
 		return nil
 	}
 	return table.Split(bucket, hash)
 	/* SOLUTION }}} */
 }
 
+// InsertBatch inserts the given entries under a single write lock, bucket by bucket, as
+// InsertValues would one at a time. Not atomic: on error, some entries may be inserted.
+func (table *HashTable) InsertBatch(entries []utils.Entry) error {
+	table.WLock()
+	defer table.WUnlock()
+	for len(entries) > 0 {
+		// Group the entries by bucket; splits only move the slots of the bucket split.
+		groups := make(map[int64][]utils.Entry)
+		order := make([]int64, 0)
+		for _, entry := range entries {
+			pn := table.buckets[table.hashFn(entry.GetKey(), table.depth)]
+			if _, ok := groups[pn]; !ok {
+				order = append(order, pn)
+			}
+			groups[pn] = append(groups[pn], entry)
+		}
+		// Entries left over when their bucket splits are hashed again next round.
+		next := make([]utils.Entry, 0)
+		for _, pn := range order {
+			rest, err := table.insertGroup(pn, groups[pn])
+			if err != nil {
+				return err
+			}
+			next = append(next, rest...)
+		}
+		entries = next
+	}
+	return nil
+}
+
+// insertGroup inserts entries into the bucket on the given page until it fills and splits,
+// returning the entries not yet inserted. Expects the table to be write-locked.
+func (table *HashTable) insertGroup(pn int64, entries []utils.Entry) ([]utils.Entry, error) {
+	bucket, err := table.GetAndLockBucketByPN(pn, WRITE_LOCK)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.page.Put()
+	defer bucket.WUnlock()
+	for i, entry := range entries {
+		if err = table.checkUnique(bucket, entry.GetKey()); err != nil {
+			return nil, err
+		}
+		if table.chained(bucket) {
+			if err = table.insertChained(bucket, entry.GetKey(), entry.Values()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if bucket.appendEntry(entry.GetKey(), entry.Values()) {
+			return entries[i+1:], table.Split(bucket, table.hashFn(entry.GetKey(), table.depth))
+		}
+	}
+	return nil, nil
+}
+
 // Update the given key-value pair.
 func (table *HashTable) Update(key int64, value int64) error {
+	return table.UpdateValues(key, []int64{value})
+}
+
+// Overwrite the first len(values) values of the entry with the given key.
+func (table *HashTable) UpdateValues(key int64, values []int64) error {
 	table.RLock()
-	hash := Hasher(key, table.depth)
-	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
+	hash := table.hashFn(key, table.depth)
+	bucket, err := table.lockKeyBucket(hash, key, WRITE_LOCK)
 	if err != nil {
 		table.RUnlock()
 		return err
@@ -192,24 +451,206 @@ func (table *HashTable) Update(key int64, value int64) error {
 	defer bucket.page.Put()
 	table.RUnlock()
 	defer bucket.WUnlock()
-	err2 := bucket.Update(key, value)
+	err2 := bucket.UpdateValues(key, values)
 	return err2
 }
 
-// Delete the given key-value pair, does not coalesce.
+// Delete the given key-value pair. Unless deleting in place, a bucket left nearly empty
+// is coalesced with its buddy; see Coalesce.
 func (table *HashTable) Delete(key int64) error {
 	table.RLock()
-	hash := Hasher(key, table.depth)
-	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
+	mode := table.deleteMode
+	hash := table.hashFn(key, table.depth)
+	bucket, err := table.lockKeyBucket(hash, key, WRITE_LOCK)
 	if err != nil {
 		table.RUnlock()
 		return err
 	}
-	defer bucket.page.Put()
 	table.RUnlock()
-	defer bucket.WUnlock()
-	err2 := bucket.Delete(key)
-	return err2
+	if mode == utils.TOMBSTONE_DELETE {
+		defer bucket.page.Put()
+		defer bucket.WUnlock()
+		return bucket.Tombstone(key)
+	}
+	err = bucket.Delete(key)
+	underfull := bucket.underfull()
+	bucket.WUnlock()
+	bucket.page.Put()
+	if err != nil || !underfull {
+		return err
+	}
+	return table.coalesceFrom(key)
+}
+
+// coalesceFrom coalesces the bucket holding the given key until it stops merging.
+func (table *HashTable) coalesceFrom(key int64) error {
+	table.WLock()
+	defer table.WUnlock()
+	for {
+		numPages := table.pager.GetNumPages()
+		hash := table.hashFn(key, table.depth)
+		bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
+		if err != nil {
+			return err
+		}
+		err = table.Coalesce(bucket, hash)
+		bucket.WUnlock()
+		bucket.page.Put()
+		// Every merge gives up a page.
+		if err != nil || table.pager.GetNumPages() == numPages {
+			return err
+		}
+	}
+}
+
+// Coalesce merges the given bucket with its buddy, the bucket whose hash differs from it
+// only in the top bit of their local depth, if the two have the same local depth and both
+// are under 1/COALESCE_DIVISOR full. The merged bucket is a level shallower, and the table
+// shrinks while every bucket is shallower than it. The last two buckets never merge.
+// The page given up is filled with the last bucket, so the pager shrinks by one page.
+// Expects the table and the bucket to be write-locked; the caller still releases the bucket.
+func (table *HashTable) Coalesce(bucket *HashBucket, hash int64) error {
+	if bucket.depth <= 1 || !bucket.underfull() {
+		return nil
+	}
+	// Find the buddy.
+	half := powInt(2, bucket.depth-1)
+	buddyHash := (hash % powInt(2, bucket.depth)) ^ half
+	buddy, err := table.GetAndLockBucket(buddyHash, WRITE_LOCK)
+	if err != nil {
+		return err
+	}
+	defer buddy.page.Put()
+	defer buddy.WUnlock()
+	if buddy.depth != bucket.depth || !buddy.underfull() {
+		return nil
+	}
+	// Overflow pages aren't counted, so buckets with any stay as they are.
+	if len(table.overflow[bucket.page.GetPageNum()]) > 0 || len(table.overflow[buddy.page.GetPageNum()]) > 0 {
+		return nil
+	}
+	// Keep the lower page, and move the other's entries into it.
+	survivor, victim := bucket, buddy
+	if victim.page.GetPageNum() < survivor.page.GetPageNum() {
+		survivor, victim = victim, survivor
+	}
+	survivor.compact()
+	nKeys := survivor.numKeys
+	for i := int64(0); i < victim.numKeys; i++ {
+		if !victim.isTombstone(i) {
+			survivor.modifyCell(nKeys, victim.getCell(i))
+			nKeys++
+		}
+	}
+	survivor.updateNumKeys(nKeys)
+	survivor.updateDepth(survivor.depth - 1)
+	// Point both buckets' slots at the survivor.
+	for i := hash % half; i < int64(len(table.buckets)); i += half {
+		table.buckets[i] = survivor.page.GetPageNum()
+	}
+	// The halves of the table are the same once no bucket is as deep as it.
+	for table.depth > 1 && table.halvesMatch() {
+		table.ShrinkTable()
+	}
+	return table.freePage(victim.page)
+}
+
+// halvesMatch returns whether both halves of the table point at the same buckets.
+func (table *HashTable) halvesMatch() bool {
+	half := len(table.buckets) / 2
+	for i := 0; i < half; i++ {
+		if table.buckets[i] != table.buckets[i+half] {
+			return false
+		}
+	}
+	return true
+}
+
+// ShrinkTable decreases the global depth of the table by 1.
+// Expects both halves of the table to point at the same buckets.
+func (table *HashTable) ShrinkTable() {
+	table.depth = table.depth - 1
+	table.buckets = table.buckets[:len(table.buckets)/2]
+}
+
+// freePage gives up the page of a bucket merged away. The last bucket moves into it, so
+// every page still holds a bucket, and the pager drops its last page.
+// Expects the table and the page to be write-locked.
+func (table *HashTable) freePage(page *pager.Page) error {
+	last := table.pager.GetNumPages() - 1
+	if pn := page.GetPageNum(); pn != last {
+		lastBucket, err := table.GetAndLockBucketByPN(last, WRITE_LOCK)
+		if err != nil {
+			return err
+		}
+		page.Update(*lastBucket.page.GetData(), 0, PAGESIZE)
+		for i := range table.buckets {
+			if table.buckets[i] == last {
+				table.buckets[i] = pn
+			}
+		}
+		if chain, ok := table.overflow[last]; ok {
+			table.overflow[pn] = chain
+			delete(table.overflow, last)
+		}
+		for _, chain := range table.overflow {
+			for i := range chain {
+				if chain[i] == last {
+					chain[i] = pn
+				}
+			}
+		}
+		lastBucket.WUnlock()
+		lastBucket.page.Put()
+	}
+	return table.pager.Truncate(last)
+}
+
+// Compact physically removes entries deleted in place, one bucket at a time, holding the
+// table's write lock so no split or coalesce moves pages during the walk.
+// Cursors parked on a bucket while it is compacted may skip entries.
+// Returns the number of entries removed.
+func (table *HashTable) Compact() (int64, error) {
+	table.WLock()
+	defer table.WUnlock()
+	removed := int64(0)
+	for i := int64(0); i < table.pager.GetNumPages(); i++ {
+		bucket, err := table.GetAndLockBucketByPN(i, WRITE_LOCK)
+		if err != nil {
+			return removed, err
+		}
+		removed += bucket.compact()
+		bucket.WUnlock()
+		bucket.page.Put()
+	}
+	return removed, nil
+}
+
+// Fragmentation returns the fraction of occupied entry slots that hold entries deleted
+// in place, which Compact would reclaim. Returns 0 for an empty table.
+// Holds the table's read lock, so no split or coalesce moves pages during the count.
+func (table *HashTable) Fragmentation() float64 {
+	table.RLock()
+	defer table.RUnlock()
+	occupied, dead := int64(0), int64(0)
+	for i := int64(0); i < table.pager.GetNumPages(); i++ {
+		bucket, err := table.GetAndLockBucketByPN(i, READ_LOCK)
+		if err != nil {
+			break
+		}
+		occupied += bucket.numKeys
+		for j := int64(0); j < bucket.numKeys; j++ {
+			if bucket.isTombstone(j) {
+				dead++
+			}
+		}
+		bucket.RUnlock()
+		bucket.page.Put()
+	}
+	if occupied == 0 {
+		return 0
+	}
+	return float64(dead) / float64(occupied)
 }
 
 // Select all entries in this table.
@@ -237,6 +678,117 @@ func (table *HashTable) Select() ([]utils.Entry, error) {
 	/* SOLUTION }}} */
 }
 
+// SelectParallel returns all entries in this table, like Select, reading the buckets with
+// the given number of workers. Each worker read-locks one bucket at a time.
+func (table *HashTable) SelectParallel(workers int) ([]utils.Entry, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	table.RLock()
+	defer table.RUnlock()
+	// Buckets appear once per slot pointing at them; read each once, with its overflow pages.
+	pns := make([]int64, 0)
+	seen := make(map[int64]bool)
+	for _, pn := range table.buckets {
+		if !seen[pn] {
+			seen[pn] = true
+			pns = append(pns, table.chain(pn)...)
+		}
+	}
+	results := make([][]utils.Entry, workers)
+	var group errgroup.Group
+	for w := 0; w < workers; w++ {
+		w := w
+		group.Go(func() error {
+			ret := make([]utils.Entry, 0)
+			for i := w; i < len(pns); i += workers {
+				bucket, err := table.GetAndLockBucketByPN(pns[i], READ_LOCK)
+				if err != nil {
+					return err
+				}
+				entries, err := bucket.Select()
+				bucket.RUnlock()
+				bucket.GetPage().Put()
+				if err != nil {
+					return err
+				}
+				ret = append(ret, entries...)
+			}
+			results[w] = ret
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	ret := make([]utils.Entry, 0)
+	for _, entries := range results {
+		ret = append(ret, entries...)
+	}
+	return ret, nil
+}
+
+// SelectFilter returns the entries in this table satisfying pred, checking each bucket's
+// entries as it is read, so only matches are kept.
+func (table *HashTable) SelectFilter(pred func(utils.Entry) bool) ([]utils.Entry, error) {
+	table.RLock()
+	defer table.RUnlock()
+	ret := make([]utils.Entry, 0)
+	for i := int64(0); i < table.pager.GetNumPages(); i++ {
+		bucket, err := table.GetAndLockBucketByPN(i, READ_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := bucket.Select()
+		bucket.RUnlock()
+		bucket.GetPage().Put()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if pred(entry) {
+				ret = append(ret, entry)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// SelectOrdered returns all entries in this table sorted by key, so the same data always
+// comes back in the same order whatever the table's split history. Costs a sort over Select.
+func (table *HashTable) SelectOrdered() ([]utils.Entry, error) {
+	ret, err := table.Select()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetKey() < ret[j].GetKey()
+	})
+	return ret, nil
+}
+
+// SelectConcurrent returns all entries in this table, locking one bucket at a time.
+// Unlike Select, writers to other buckets are not blocked during the scan, so the result
+// is not a consistent snapshot: entries written concurrently may or may not be included,
+// and entries moved by a concurrent split may be missed or returned twice.
+func (table *HashTable) SelectConcurrent() ([]utils.Entry, error) {
+	ret := make([]utils.Entry, 0)
+	for i := int64(0); i < table.pager.GetNumPages(); i++ {
+		bucket, err := table.GetAndLockBucketByPN(i, READ_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := bucket.Select()
+		bucket.RUnlock()
+		bucket.GetPage().Put()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entries...)
+	}
+	return ret, nil
+}
+
 // Print out each bucket.
 func (table *HashTable) Print(w io.Writer) {
 	table.RLock()
@@ -252,10 +804,54 @@ func (table *HashTable) Print(w io.Writer) {
 		bucket.Print(w)
 		bucket.RUnlock()
 		bucket.page.Put()
+		for _, pn := range table.overflow[table.buckets[i]] {
+			io.WriteString(w, fmt.Sprintf("overflow page %d\n", pn))
+			overflow, err := table.GetAndLockBucketByPN(pn, READ_LOCK)
+			if err != nil {
+				continue
+			}
+			overflow.Print(w)
+			overflow.RUnlock()
+			overflow.page.Put()
+		}
 	}
 	io.WriteString(w, "====\n")
 }
 
+// PrintJSON writes the table as a JSON object with its global depth and its buckets, each
+// once, in the order the directory first points at them; see HashBucket.PrintJSON. The
+// overflow pages of a bucket are listed under it.
+func (table *HashTable) PrintJSON(w io.Writer) {
+	table.RLock()
+	defer table.RUnlock()
+	buckets := make([]bucketJSON, 0)
+	seen := make(map[int64]bool)
+	for _, pn := range table.buckets {
+		if seen[pn] {
+			continue
+		}
+		seen[pn] = true
+		chain := make([]bucketJSON, 0)
+		for _, chainPN := range table.chain(pn) {
+			bucket, err := table.GetAndLockBucketByPN(chainPN, READ_LOCK)
+			if err != nil {
+				break
+			}
+			chain = append(chain, bucket.toJSON())
+			bucket.RUnlock()
+			bucket.page.Put()
+		}
+		if len(chain) > 0 {
+			chain[0].Overflow = chain[1:]
+			buckets = append(buckets, chain[0])
+		}
+	}
+	json.NewEncoder(w).Encode(struct {
+		GlobalDepth int64        `json:"globalDepth"`
+		Buckets     []bucketJSON `json:"buckets"`
+	}{table.depth, buckets})
+}
+
 // Print out a specific bucket.
 func (table *HashTable) PrintPN(pn int, w io.Writer) {
 	table.RLock()
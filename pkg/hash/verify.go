@@ -1,28 +1,72 @@
 package hash
 
+import (
+	"errors"
+	"fmt"
+)
+
 func IsHash(index *HashIndex) (bool, error) {
 	table := index.GetTable()
 	buckets := table.GetBuckets()
 	for _, pn := range buckets {
-		// Get bucket
-		bucket, err := table.GetAndLockBucketByPN(pn, NO_LOCK)
-		d := bucket.GetDepth()
-		if err != nil {
-			return false, err
-		}
-		// Get all entries
-		entries, err := bucket.Select()
-		if err != nil {
-			return false, err
-		}
-		// Check that all entries should hash to this bucket.
-		for _, e := range entries {
-			key := e.GetKey()
-			hash := Hasher(key, d)
-			if pn != table.buckets[hash] {
-				return false, nil
+		// Entries in the bucket's overflow pages belong to it too.
+		for _, chainPN := range table.chain(pn) {
+			// Get bucket
+			bucket, err := table.GetAndLockBucketByPN(chainPN, NO_LOCK)
+			if err != nil {
+				return false, err
+			}
+			d := bucket.GetDepth()
+			// Get all entries
+			entries, err := bucket.Select()
+			bucket.GetPage().Put()
+			if err != nil {
+				return false, err
+			}
+			// Check that all entries should hash to this bucket.
+			for _, e := range entries {
+				key := e.GetKey()
+				hash := table.hashFn(key, d)
+				if pn != table.buckets[hash] {
+					return false, nil
+				}
 			}
 		}
 	}
 	return true, nil
 }
+
+// IsHashStrict checks the table's structure as well as where its entries are, returning an
+// error naming the first broken invariant, or nil if there is none. The directory must have
+// 2^depth slots; every bucket must hold between 0 and a bucket's worth of entries and be no
+// deeper than the table; and every entry must hash to the bucket holding it.
+func IsHashStrict(index *HashIndex) error {
+	table := index.GetTable()
+	if int64(len(table.buckets)) != powInt(2, table.depth) {
+		return fmt.Errorf("directory has %v slots, not 2^%v", len(table.buckets), table.depth)
+	}
+	for _, primary := range table.buckets {
+		for _, pn := range table.chain(primary) {
+			bucket, err := table.GetAndLockBucketByPN(pn, NO_LOCK)
+			if err != nil {
+				return err
+			}
+			numKeys, depth, capacity := bucket.numKeys, bucket.depth, bucket.capacity()
+			bucket.GetPage().Put()
+			if numKeys < 0 || numKeys > capacity {
+				return fmt.Errorf("bucket on page %v holds %v entries, outside [0, %v]", pn, numKeys, capacity)
+			}
+			if depth > table.depth {
+				return fmt.Errorf("bucket on page %v has local depth %v, deeper than global depth %v", pn, depth, table.depth)
+			}
+		}
+	}
+	ok, err := IsHash(index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("an entry does not hash to the bucket holding it")
+	}
+	return nil
+}
@@ -1,9 +1,8 @@
 package list
 
 import (
-	"errors"
 	"fmt"
-	"strings"
+	"strconv"
 
 	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
 )
@@ -12,14 +11,20 @@ import (
 type List struct {
 	head *Link
 	tail *Link
+	size int // Number of links in the list.
 }
 
 // Create a new list.
 func NewList() *List {
-	nlist := List{nil, nil}
+	nlist := List{nil, nil, 0}
 	return &nlist
 }
 
+// Get the number of links in the list.
+func (list *List) Len() int {
+	return list.size
+}
+
 // Get a pointer to the head of the list.
 func (list *List) PeekHead() *Link {
 	return list.head
@@ -40,6 +45,7 @@ func (list *List) PushHead(value interface{}) *Link {
 	if list.tail == nil {
 		list.tail = newlink
 	}
+	list.size++
 	return newlink
 }
 
@@ -53,29 +59,102 @@ func (list *List) PushTail(value interface{}) *Link {
 	if list.head == nil {
 		list.head = newlink
 	}
+	list.size++
 	return newlink
 }
 
+// Remove the first element of the list. Returns its value, or nil if the list is empty.
+func (list *List) PopHead() interface{} {
+	return list.pop(list.head)
+}
+
+// Remove the last element of the list. Returns its value, or nil if the list is empty.
+func (list *List) PopTail() interface{} {
+	return list.pop(list.tail)
+}
+
+// pop removes link, if any, and returns its value.
+func (list *List) pop(link *Link) interface{} {
+	if link == nil {
+		return nil
+	}
+	link.PopSelf()
+	return link.value
+}
+
 // Find an element in a list given a boolean function, f, that evaluates to true on the desired element.
 func (list *List) Find(f func(*Link) bool) *Link {
-	newlist := &List{list.head, list.tail}
-	for newlist.head != nil {
-		if f(newlist.head) {
-			return newlist.head
+	for curr := list.head; curr != nil; curr = curr.next {
+		if f(curr) {
+			return curr
 		}
-		newlist.head = newlist.head.next
 	}
 	return nil
 }
 
 // Apply a function to every element in the list. f should alter Link in place.
 func (list *List) Map(f func(*Link)) {
-	newlist := &List{list.head, list.tail}
-	for newlist.head != nil {
-		f(newlist.head)
-		newlist.head = newlist.head.next
+	list.MapWhile(func(link *Link) bool {
+		f(link)
+		return true
+	})
+}
+
+// Apply a function to each element in the list in order, stopping after the first one
+// that f returns false on. f may remove the link it is given.
+func (list *List) MapWhile(f func(*Link) bool) {
+	for curr := list.head; curr != nil; {
+		// Grab the next link before curr can be unlinked.
+		next := curr.next
+		if !f(curr) {
+			return
+		}
+		curr = next
+	}
+}
+
+// Find the last element in a list that f evaluates to true on, traversing from tail to head.
+func (list *List) FindReverse(f func(*Link) bool) *Link {
+	for curr := list.tail; curr != nil; curr = curr.prev {
+		if f(curr) {
+			return curr
+		}
+	}
+	return nil
+}
+
+// Apply a function to every element in the list, from tail to head. f may remove links it
+// has already been given, but removing the link it is currently given is undefined.
+func (list *List) MapReverse(f func(*Link)) {
+	for curr := list.tail; curr != nil; curr = curr.prev {
+		f(curr)
+	}
+}
+
+// Remove every element that f evaluates to true on. Returns the number of removed elements.
+func (list *List) RemoveWhere(f func(*Link) bool) int {
+	removed := 0
+	for curr := list.head; curr != nil; {
+		// Grab the next link before curr is unlinked.
+		next := curr.next
+		if f(curr) {
+			curr.PopSelf()
+			removed++
+		}
+		curr = next
+	}
+	return removed
+}
+
+// Create a new list of the values of the elements that f evaluates to true on.
+func (list *List) Filter(f func(*Link) bool) *List {
+	filtered := NewList()
+	for curr := list.head; curr != nil; curr = curr.next {
+		if f(curr) {
+			filtered.PushTail(curr.value)
+		}
 	}
-	list = newlist
+	return filtered
 }
 
 // Link struct.
@@ -111,9 +190,42 @@ func (link *Link) GetNext() *Link {
 	return link.next
 }
 
-// Remove this link from its list.
+// Add an element right before this link. Returns the added link, or nil if this link was removed.
+func (link *Link) InsertBefore(value interface{}) *Link {
+	if link.list == nil {
+		return nil
+	}
+	if link.prev == nil {
+		return link.list.PushHead(value)
+	}
+	newlink := &Link{link.list, link.prev, link, value}
+	link.prev.next = newlink
+	link.prev = newlink
+	link.list.size++
+	return newlink
+}
+
+// Add an element right after this link. Returns the added link, or nil if this link was removed.
+func (link *Link) InsertAfter(value interface{}) *Link {
+	if link.list == nil {
+		return nil
+	}
+	if link.next == nil {
+		return link.list.PushTail(value)
+	}
+	newlink := &Link{link.list, link, link.next, value}
+	link.next.prev = newlink
+	link.next = newlink
+	link.list.size++
+	return newlink
+}
+
+// Remove this link from its list, detaching it entirely; does nothing if it was already removed.
 // Suppose list [2,3,4]
 func (link *Link) PopSelf() {
+	if link.list == nil {
+		return
+	}
 	// so it's the first one
 	if link.prev == nil && link.next == nil {
 		link.list.head = nil
@@ -125,67 +237,97 @@ func (link *Link) PopSelf() {
 		link.prev.next = nil
 		link.list.tail = link.prev
 	} else {
-		prevlink := link.prev
-		prevlink.next = link.next
 		link.prev.next = link.next
-		link.next.prev = prevlink
-		link.list = nil
-		link.next = nil
-		link.prev = nil
+		link.next.prev = link.prev
 	}
+	link.list.size--
+	link.list = nil
+	link.next = nil
+	link.prev = nil
 }
 
 // List REPL.
 // use dispatcher
 func ListRepl(list *List) *repl.REPL {
-	newrepl := repl.NewRepl()
-	newrepl.AddCommand("list_print", func(str string, repl *repl.REPLConfig) error {
-		if len(strings.Split(str, " ")) == 2 {
-			list.Map(func(linkput *Link) { fmt.Println(linkput.value) })
-			return nil
-		} else {
-			return errors.New("the format is not well-informed")
+	return listRepl(list, false)
+}
+
+// Typed list REPL; numeric values are stored and compared as int64.
+func TypedListRepl(list *List) *repl.REPL {
+	return listRepl(list, true)
+}
+
+// parseValue converts a token into the value stored in the list.
+// In typed mode, tokens that parse as integers are stored as int64; everything else stays a string.
+func parseValue(token string, typed bool) interface{} {
+	if typed {
+		if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return n
 		}
-	}, "Input: List of anything. Prints out all of the elements in the list in order")
-	newrepl.AddCommand("list_push_head", func(str string, repl *repl.REPLConfig) error {
-		if len(strings.Split(str, " ")) == 2 {
-			list.PushHead(strings.Split(str, " ")[1])
-			return nil
-		} else {
-			return errors.New("the format is not well-informed")
+	}
+	return token
+}
+
+// listArg returns the single argument of a list command, which may be quoted.
+func listArg(str string) (string, error) {
+	fields, err := repl.Tokenize(str)
+	if err != nil {
+		return "", err
+	}
+	return fields[len(fields)-1], nil
+}
+
+func listRepl(list *List, typed bool) *repl.REPL {
+	newrepl := repl.NewRepl()
+	newrepl.AddCommandN("list_print", 0, 0, func(str string, replConfig *repl.REPLConfig) error {
+		list.Map(func(linkput *Link) { replConfig.Println(linkput.value) })
+		return nil
+	}, "Input: List of anything. Prints out all of the elements in the list in order. usage: list_print")
+	newrepl.AddCommandN("list_push_head", 1, 1, func(str string, replConfig *repl.REPLConfig) error {
+		arg, err := listArg(str)
+		if err != nil {
+			return err
 		}
-	}, "Inserts the given element to the List as a string")
-	newrepl.AddCommand("list_push_tail", func(str string, repl *repl.REPLConfig) error {
-		if len(strings.Split(str, " ")) == 2 {
-			list.PushTail(strings.Split(str, " ")[1])
-			return nil
-		} else {
-			return errors.New("the format is not well-informed")
+		list.PushHead(parseValue(arg, typed))
+		return nil
+	}, "Inserts the given element to the List. usage: list_push_head <value>")
+	newrepl.AddCommandN("list_push_tail", 1, 1, func(str string, replConfig *repl.REPLConfig) error {
+		arg, err := listArg(str)
+		if err != nil {
+			return err
 		}
+		list.PushTail(parseValue(arg, typed))
+		return nil
 	},
-		"Inserts the given element to the end of the List as a string")
-	newrepl.AddCommand("list_remove", func(str string, repl *repl.REPLConfig) error {
-		if len(strings.Split(str, " ")) == 2 {
-			list.Find(func(linkfind *Link) bool { return linkfind.value == strings.Split(str, " ")[2] }).PopSelf()
-			return nil
-		} else {
-			return errors.New("the format is not well-informed")
+		"Inserts the given element to the end of the List. usage: list_push_tail <value>")
+	newrepl.AddCommandN("list_remove", 1, 1, func(str string, replConfig *repl.REPLConfig) error {
+		arg, err := listArg(str)
+		if err != nil {
+			return err
+		}
+		target := parseValue(arg, typed)
+		link := list.Find(func(linkfind *Link) bool { return linkfind.value == target })
+		if link == nil {
+			return fmt.Errorf("element %v not found", arg)
 		}
+		link.PopSelf()
+		return nil
 	},
-		"Removes the given element from the list")
-	newrepl.AddCommand("list_contains", func(str string, repl *repl.REPLConfig) error {
-		if len(strings.Split(str, " ")) == 2 {
-			if list.Find(func(linkfind *Link) bool { return linkfind.value == strings.Split(str, " ")[2] }) != nil {
-				fmt.Print("found!")
-			} else {
-				fmt.Print("not found")
-			}
-			return nil
+		"Removes the given element from the list. usage: list_remove <value>")
+	newrepl.AddCommandN("list_contains", 1, 1, func(str string, replConfig *repl.REPLConfig) error {
+		arg, err := listArg(str)
+		if err != nil {
+			return err
+		}
+		target := parseValue(arg, typed)
+		if list.Find(func(linkfind *Link) bool { return linkfind.value == target }) != nil {
+			replConfig.Println("found!")
 		} else {
-			return errors.New("the format is not well-informed")
+			replConfig.Println("not found")
 		}
+		return nil
 	},
-		"Check whether the element is in the list or not")
+		"Check whether the element is in the list or not. usage: list_contains <value>")
 	return newrepl
 }
 
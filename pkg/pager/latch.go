@@ -0,0 +1,98 @@
+package pager
+
+import (
+	"sync"
+)
+
+// A fairLatch is a readers-writers lock that grants requests in arrival order.
+// Readers that arrive after a waiting writer queue behind it, so a stream of readers
+// can't hold a writer off indefinitely. The zero value is an unlocked latch.
+type fairLatch struct {
+	mtx     sync.Mutex     // Guards the fields below.
+	readers int            // Number of readers holding the latch.
+	writer  bool           // Whether a writer holds the latch.
+	queue   []*latchWaiter // Waiting requests, oldest first.
+}
+
+// A request waiting for the latch.
+type latchWaiter struct {
+	write bool          // Whether this is a writer.
+	ready chan struct{} // Closed once the latch is granted.
+}
+
+// Acquire the latch for reading.
+func (latch *fairLatch) RLock() {
+	latch.acquire(false)
+}
+
+// Acquire the latch for writing.
+func (latch *fairLatch) Lock() {
+	latch.acquire(true)
+}
+
+// Release a read hold on the latch.
+func (latch *fairLatch) RUnlock() {
+	latch.mtx.Lock()
+	defer latch.mtx.Unlock()
+	if latch.readers <= 0 {
+		panic("fairLatch: RUnlock of unlocked latch")
+	}
+	latch.readers--
+	latch.grant()
+}
+
+// Release a write hold on the latch.
+func (latch *fairLatch) Unlock() {
+	latch.mtx.Lock()
+	defer latch.mtx.Unlock()
+	if !latch.writer {
+		panic("fairLatch: Unlock of unlocked latch")
+	}
+	latch.writer = false
+	latch.grant()
+}
+
+// acquire takes the latch right away if nobody is waiting and it's compatible,
+// and otherwise joins the back of the queue.
+func (latch *fairLatch) acquire(write bool) {
+	latch.mtx.Lock()
+	if len(latch.queue) == 0 && latch.compatible(write) {
+		latch.take(write)
+		latch.mtx.Unlock()
+		return
+	}
+	waiter := &latchWaiter{write: write, ready: make(chan struct{})}
+	latch.queue = append(latch.queue, waiter)
+	latch.mtx.Unlock()
+	<-waiter.ready
+}
+
+// compatible checks if a request could hold the latch alongside the current holders.
+// mtx should be locked on entry.
+func (latch *fairLatch) compatible(write bool) bool {
+	if write {
+		return !latch.writer && latch.readers == 0
+	}
+	return !latch.writer
+}
+
+// take records a new holder. mtx should be locked on entry.
+func (latch *fairLatch) take(write bool) {
+	if write {
+		latch.writer = true
+	} else {
+		latch.readers++
+	}
+}
+
+// grant wakes waiters from the front of the queue for as long as they're compatible;
+// a run of readers is admitted together. mtx should be locked on entry.
+func (latch *fairLatch) grant() {
+	for len(latch.queue) > 0 && latch.compatible(latch.queue[0].write) {
+		waiter := latch.queue[0]
+		latch.queue[0] = nil
+		latch.queue = latch.queue[1:]
+		latch.take(waiter.write)
+		close(waiter.ready)
+	}
+}
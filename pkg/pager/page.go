@@ -11,13 +11,15 @@ const NOPAGE = -1
 
 // A page is a unit that is read from and written to disk.
 type Page struct {
-	pager      *Pager       // Pointer to the pager that this page belongs to.
-	pagenum    int64        // Position of the page in the file.
-	pinCount   int64        // The number of active references to this page.
-	dirty      bool         // Flag on whether data has to be written back.
-	rwlock     sync.RWMutex // Readers-writers lock on the page itself
-	updateLock sync.Mutex   // Mutex for updating data in a page
-	data       *[]byte      // Serialized data.
+	pager      *Pager     // Pointer to the pager that this page belongs to.
+	pagenum    int64      // Position of the page in the file.
+	pinCount   int64      // The number of active references to this page.
+	dirty      bool       // Flag on whether data has to be written back.
+	loadSeq    int64      // When the page was brought into its frame, for FIFO eviction.
+	refBit     bool       // Whether the page was used since the clock hand last passed it.
+	rwlock     fairLatch  // Readers-writers lock on the page itself; grants in arrival order.
+	updateLock sync.Mutex // Mutex for updating data in a page
+	data       *[]byte    // Serialized data.
 }
 
 // Get the pager.
@@ -56,7 +58,10 @@ func (page *Page) Put() {
 	pager.ptMtx.Lock()
 	ret := atomic.AddInt64(&page.pinCount, -1)
 	// Check if we can unpin this page; if so, move from pinned to unpinned list.
-	if ret == 0 {
+	if ret == 0 && page.pagenum == NOPAGE {
+		// The page was truncated away while pinned; its frame is free now.
+		pager.freeList.PushTail(page)
+	} else if ret == 0 {
 		link := pager.pageTable[page.pagenum]
 		link.PopSelf()
 		newLink := pager.unpinnedList.PushTail(page)
@@ -6,8 +6,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
 	list "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/list"
@@ -23,6 +25,7 @@ const MAXPAGES = config.NumPages
 
 // Pagers manage pages of data read from a file.
 type Pager struct {
+	stats        PagerStats           // Buffer pool counters; first, so 64-bit atomics stay aligned.
 	file         *os.File             // File descriptor.
 	maxPageNum   int64                // The number of pages used by this database.
 	ptMtx        sync.Mutex           // Page table mutex.
@@ -30,15 +33,62 @@ type Pager struct {
 	unpinnedList *list.List           // Unpinned page list.
 	pinnedList   *list.List           // Pinned page list.
 	pageTable    map[int64]*list.Link // Page table.
+	coalesce     bool                 // Whether FlushAllPages combines writes of adjacent pages.
+	onEvict      func(pagenum int64)  // Called before an evicted frame is reused, if set.
+	resident     []*Page              // Pages pinned by PinResident, or nil.
+	policy       EvictionPolicy       // Which unpinned page is evicted to make room.
+	frames       []*Page              // Every buffer frame, in the order the clock hand visits them.
+	clockHand    int                  // The next frame the clock hand visits.
+	numLoads     int64                // The number of pages brought into frames so far.
 }
 
-// Construct a new Pager.
+// EvictionPolicy determines which unpinned page is evicted when the buffer pool is full.
+type EvictionPolicy int
+
+const (
+	LRU_EVICTION   EvictionPolicy = 0 // Evict the page unpinned longest ago.
+	FIFO_EVICTION  EvictionPolicy = 1 // Evict the page brought in longest ago, however recently used.
+	CLOCK_EVICTION EvictionPolicy = 2 // Sweep the frames in order, sparing pages used since the last sweep.
+)
+
+// Which list a buffer frame is on.
+const (
+	FREE_FRAME     = "free"
+	PINNED_FRAME   = "pinned"
+	UNPINNED_FRAME = "unpinned"
+)
+
+// FrameInfo is a snapshot of a buffer frame.
+type FrameInfo struct {
+	List     string // FREE_FRAME, PINNED_FRAME or UNPINNED_FRAME.
+	PageNum  int64  // The page held, or NOPAGE if free.
+	PinCount int64  // The number of active references to the page.
+	Dirty    bool   // Whether the page has to be written back.
+}
+
+// PagerStats counts buffer pool activity since the pager was created or its stats reset.
+type PagerStats struct {
+	Hits       int64 // GetPage calls served from the page table.
+	Misses     int64 // GetPage calls that had to read the page in, or allocate it past the end of the file.
+	Evictions  int64 // Unpinned pages evicted to make room for another.
+	Flushes    int64 // Dirty pages written back to disk.
+	Prefetches int64 // Pages read in ahead of use by Prefetch.
+}
+
+// Construct a new Pager that evicts the least recently used page.
 func NewPager() (pager *Pager) {
-	pager = &Pager{}
+	return NewPagerWithPolicy(LRU_EVICTION)
+}
+
+// NewPagerWithPolicy constructs a new Pager that evicts pages according to the given policy.
+func NewPagerWithPolicy(policy EvictionPolicy) (pager *Pager) {
+	pager = &Pager{policy: policy}
 	pager.pageTable = make(map[int64]*list.Link)
 	pager.freeList = list.NewList()
 	pager.unpinnedList = list.NewList()
 	pager.pinnedList = list.NewList()
+	pager.coalesce = true
+	pager.frames = make([]*Page, 0, MAXPAGES)
 	frames := directio.AlignedBlock(int(PAGESIZE * MAXPAGES))
 	for i := 0; i < MAXPAGES; i++ {
 		frame := frames[i*int(PAGESIZE) : (i+1)*int(PAGESIZE)]
@@ -50,10 +100,16 @@ func NewPager() (pager *Pager) {
 			data:     &frame,
 		}
 		pager.freeList.PushTail(&page)
+		pager.frames = append(pager.frames, &page)
 	}
 	return pager
 }
 
+// GetEvictionPolicy returns the pager's eviction policy.
+func (pager *Pager) GetEvictionPolicy() EvictionPolicy {
+	return pager.policy
+}
+
 // HasFile checks if the pager is backed by disk.
 func (pager *Pager) HasFile() (hasFile bool) {
 	return pager.file != nil
@@ -64,6 +120,169 @@ func (pager *Pager) GetFileName() string {
 	return filepath.Base(pager.file.Name())
 }
 
+// SetCoalesceFlushes sets whether FlushAllPages combines runs of adjacent dirty pages
+// into a single write. On by default.
+func (pager *Pager) SetCoalesceFlushes(coalesce bool) {
+	pager.coalesce = coalesce
+}
+
+// SetEvictionCallback sets a function called with the page number of each page evicted
+// from the buffer pool, right before its frame is reused for a different page, so that
+// state cached by page number can be invalidated. Pass nil to remove it.
+// The callback runs with the page table locked, so it must not call back into the pager.
+func (pager *Pager) SetEvictionCallback(onEvict func(pagenum int64)) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	pager.onEvict = onEvict
+}
+
+// PinResident pins every page of the file in the buffer pool until UnpinResident, so that
+// none of them can be evicted. Fails without pinning anything if the file has more pages
+// than there are frames; pages allocated afterwards are not pinned.
+func (pager *Pager) PinResident() error {
+	pager.ptMtx.Lock()
+	if pager.resident != nil {
+		pager.ptMtx.Unlock()
+		return errors.New("pages are already pinned resident")
+	}
+	numPages := pager.maxPageNum
+	if numPages > MAXPAGES {
+		pager.ptMtx.Unlock()
+		return fmt.Errorf("cannot pin %v pages in %v buffer frames", numPages, MAXPAGES)
+	}
+	resident := make([]*Page, 0, numPages)
+	pager.resident = resident
+	pager.ptMtx.Unlock()
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := pager.GetPage(pn)
+		if err != nil {
+			for _, page := range resident {
+				page.Put()
+			}
+			pager.ptMtx.Lock()
+			pager.resident = nil
+			pager.ptMtx.Unlock()
+			return err
+		}
+		resident = append(resident, page)
+	}
+	pager.ptMtx.Lock()
+	pager.resident = resident
+	pager.ptMtx.Unlock()
+	return nil
+}
+
+// UnpinResident releases the pins taken by PinResident, if any.
+func (pager *Pager) UnpinResident() {
+	pager.ptMtx.Lock()
+	resident := pager.resident
+	pager.resident = nil
+	pager.ptMtx.Unlock()
+	for _, page := range resident {
+		page.Put()
+	}
+}
+
+// Frames returns a snapshot of every buffer frame, taken with the page table locked:
+// first the pinned list, then the unpinned list from least recently used, then the free list.
+func (pager *Pager) Frames() []FrameInfo {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	frames := make([]FrameInfo, 0, MAXPAGES)
+	snapshot := func(listName string) func(*list.Link) {
+		return func(link *list.Link) {
+			page := link.GetKey().(*Page)
+			frames = append(frames, FrameInfo{
+				List:     listName,
+				PageNum:  page.pagenum,
+				PinCount: atomic.LoadInt64(&page.pinCount),
+				Dirty:    page.IsDirty(),
+			})
+		}
+	}
+	pager.pinnedList.Map(snapshot(PINNED_FRAME))
+	pager.unpinnedList.Map(snapshot(UNPINNED_FRAME))
+	pager.freeList.Map(snapshot(FREE_FRAME))
+	return frames
+}
+
+// DropUnpinned flushes every unpinned page and frees its frame, leaving the buffer pool
+// cold. Refuses if any page is pinned, or if there is no file to read the pages back from.
+// Returns the number of pages dropped.
+func (pager *Pager) DropUnpinned() (int, error) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if !pager.HasFile() {
+		return 0, errors.New("cannot drop pages without a backing file")
+	}
+	if pinned := pager.pinnedList.Len(); pinned > 0 {
+		return 0, fmt.Errorf("cannot drop pages while %v are pinned", pinned)
+	}
+	dropped := 0
+	for value := pager.unpinnedList.PopHead(); value != nil; value = pager.unpinnedList.PopHead() {
+		page := value.(*Page)
+		pager.FlushPage(page)
+		delete(pager.pageTable, page.pagenum)
+		page.pagenum = NOPAGE
+		pager.freeList.PushTail(page)
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Truncate drops every page numbered numPages or above, without writing them back, and
+// shrinks the file to match. A dropped page that is still pinned keeps its frame, contents
+// intact, until its last pin is released.
+func (pager *Pager) Truncate(numPages int64) error {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if numPages < 0 || numPages > pager.maxPageNum {
+		return fmt.Errorf("cannot truncate %v pages to %v", pager.maxPageNum, numPages)
+	}
+	for pagenum := numPages; pagenum < pager.maxPageNum; pagenum++ {
+		link, ok := pager.pageTable[pagenum]
+		if !ok {
+			continue
+		}
+		delete(pager.pageTable, pagenum)
+		page := link.GetKey().(*Page)
+		unpinned := link.GetList() == pager.unpinnedList
+		link.PopSelf()
+		page.pagenum = NOPAGE
+		page.dirty = false
+		if unpinned {
+			pager.freeList.PushTail(page)
+		}
+	}
+	if pager.HasFile() {
+		if err := pager.file.Truncate(numPages * PAGESIZE); err != nil {
+			return err
+		}
+	}
+	pager.maxPageNum = numPages
+	return nil
+}
+
+// Stats returns the pager's buffer pool counters. Each is read atomically, but not all at once.
+func (pager *Pager) Stats() PagerStats {
+	return PagerStats{
+		Hits:       atomic.LoadInt64(&pager.stats.Hits),
+		Misses:     atomic.LoadInt64(&pager.stats.Misses),
+		Evictions:  atomic.LoadInt64(&pager.stats.Evictions),
+		Flushes:    atomic.LoadInt64(&pager.stats.Flushes),
+		Prefetches: atomic.LoadInt64(&pager.stats.Prefetches),
+	}
+}
+
+// ResetStats sets the pager's buffer pool counters back to zero.
+func (pager *Pager) ResetStats() {
+	atomic.StoreInt64(&pager.stats.Hits, 0)
+	atomic.StoreInt64(&pager.stats.Misses, 0)
+	atomic.StoreInt64(&pager.stats.Evictions, 0)
+	atomic.StoreInt64(&pager.stats.Flushes, 0)
+	atomic.StoreInt64(&pager.stats.Prefetches, 0)
+}
+
 // GetNumPages returns the number of pages.
 func (pager *Pager) GetNumPages() (numPages int64) {
 	return pager.maxPageNum
@@ -104,13 +323,17 @@ func (pager *Pager) Open(filename string) (err error) {
 }
 
 // Close signals our pager to flush all dirty pages to disk.
+// Pages pinned by PinResident are released first.
 func (pager *Pager) Close() (err error) {
+	pager.UnpinResident()
 	// Prevent new data from being paged in.
 	pager.ptMtx.Lock()
 	// Check if all refcounts are 0.
+	var pinErr error
 	curLink := pager.pinnedList.PeekHead()
 	if curLink != nil {
 		fmt.Println("ERROR: pages are still pinned on close")
+		pinErr = errors.New("pages are still pinned on close")
 	}
 	// Cleanup.
 	pager.FlushAllPages()
@@ -118,6 +341,9 @@ func (pager *Pager) Close() (err error) {
 		err = pager.file.Close()
 	}
 	pager.ptMtx.Unlock()
+	if err == nil {
+		err = pinErr
+	}
 	return err
 }
 
@@ -140,13 +366,18 @@ func (pager *Pager) NewPage(pagenum int64) (newPage *Page, err error) {
 		// Check the free list first
 		freeLink.PopSelf()
 		newPage = freeLink.GetKey().(*Page)
-	} else if unpinLink := pager.unpinnedList.PeekHead(); pager.HasFile() && unpinLink != nil {
+	} else if pager.HasFile() && pager.unpinnedList.Len() > 0 {
 		// If no page was found, evict a page from the unpinned list.
 		// But skip this if our pager isn't backed by disk.
+		unpinLink := pager.victim()
 		unpinLink.PopSelf()
 		newPage = unpinLink.GetKey().(*Page)
 		pager.FlushPage(newPage)
 		delete(pager.pageTable, newPage.pagenum)
+		atomic.AddInt64(&pager.stats.Evictions, 1)
+		if pager.onEvict != nil {
+			pager.onEvict(newPage.pagenum)
+		}
 	} else {
 		// If still no page is found, error.
 		return nil, errors.New("no available pages")
@@ -154,14 +385,54 @@ func (pager *Pager) NewPage(pagenum int64) (newPage *Page, err error) {
 	newPage.pagenum = pagenum
 	newPage.dirty = false
 	newPage.pinCount = 1
+	pager.numLoads++
+	newPage.loadSeq = pager.numLoads
+	newPage.refBit = true
 	return newPage, nil
 	/* SOLUTION }}} */
 }
 
+// victim picks the unpinned page to evict according to the eviction policy.
+// the ptMtx should be locked on entry, and the unpinned list must not be empty.
+func (pager *Pager) victim() *list.Link {
+	switch pager.policy {
+	case FIFO_EVICTION:
+		oldest := pager.unpinnedList.PeekHead()
+		pager.unpinnedList.Map(func(link *list.Link) {
+			if link.GetKey().(*Page).loadSeq < oldest.GetKey().(*Page).loadSeq {
+				oldest = link
+			}
+		})
+		return oldest
+	case CLOCK_EVICTION:
+		// Clear the reference bits of unpinned pages as the hand passes them, and evict the
+		// first one found clear; within two sweeps, one is.
+		for {
+			page := pager.frames[pager.clockHand]
+			pager.clockHand = (pager.clockHand + 1) % len(pager.frames)
+			link, ok := pager.pageTable[page.pagenum]
+			if !ok || link.GetKey() != page || link.GetList() != pager.unpinnedList {
+				continue
+			}
+			if page.refBit {
+				page.refBit = false
+				continue
+			}
+			return link
+		}
+	default:
+		// Put appends pages to the unpinned list as they are unpinned.
+		return pager.unpinnedList.PeekHead()
+	}
+}
+
 // GetPage returns the page corresponding to the given pagenum.
 func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	/* SOLUTION {{{ */
 	// Input checking.
+	if pagenum == NOPAGE {
+		return nil, errors.New("cannot get NOPAGE")
+	}
 	if pagenum < 0 {
 		return nil, errors.New("invalid pagenum")
 	}
@@ -179,8 +450,11 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 			pager.pageTable[pagenum] = newLink
 		}
 		page.Get()
+		page.refBit = true
+		atomic.AddInt64(&pager.stats.Hits, 1)
 		return page, nil
 	}
+	atomic.AddInt64(&pager.stats.Misses, 1)
 	// Else, create a buffer to hold the new page in.
 	page, err = pager.NewPage(pagenum)
 	if err != nil {
@@ -207,15 +481,54 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	/* SOLUTION }}} */
 }
 
+// Prefetch reads up to count pages, starting at startPN, into the buffer pool ahead of use,
+// leaving them unpinned. Pages already in the pool are skipped, as are pages past the end of
+// the file. Prefetching only fills free frames, so it never evicts a page; it stops early
+// once the pool has none left.
+func (pager *Pager) Prefetch(startPN int64, count int64) error {
+	if startPN < 0 || count < 0 {
+		return fmt.Errorf("cannot prefetch %v pages from page %v", count, startPN)
+	}
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if !pager.HasFile() {
+		return nil
+	}
+	for pagenum := startPN; pagenum < startPN+count && pagenum < pager.maxPageNum; pagenum++ {
+		if _, ok := pager.pageTable[pagenum]; ok {
+			continue
+		}
+		if pager.freeList.Len() == 0 {
+			return nil
+		}
+		page, err := pager.NewPage(pagenum)
+		if err != nil {
+			return err
+		}
+		if err = pager.ReadPageFromDisk(page, pagenum); err != nil {
+			pager.freeList.PushTail(page)
+			return err
+		}
+		// Nothing has used the page yet.
+		page.pinCount = 0
+		page.refBit = false
+		pager.pageTable[pagenum] = pager.unpinnedList.PushTail(page)
+		atomic.AddInt64(&pager.stats.Prefetches, 1)
+	}
+	return nil
+}
+
 // Flush a particular page to disk.
 func (pager *Pager) FlushPage(page *Page) {
 	/* SOLUTION {{{ */
-	if pager.HasFile() && page.IsDirty() {
+	// Frames that don't hold a page have nothing to write back.
+	if pager.HasFile() && page.IsDirty() && page.pagenum != NOPAGE {
 		pager.file.WriteAt(
 			*page.data,
 			page.pagenum*PAGESIZE,
 		)
 		page.SetDirty(false)
+		atomic.AddInt64(&pager.stats.Flushes, 1)
 	}
 	/* SOLUTION }}} */
 }
@@ -223,15 +536,61 @@ func (pager *Pager) FlushPage(page *Page) {
 // Flushes all dirty pages.
 func (pager *Pager) FlushAllPages() {
 	/* SOLUTION {{{ */
-	writer := func(link *list.Link) {
+	if !pager.coalesce {
+		writer := func(link *list.Link) {
+			page := link.GetKey().(*Page)
+			pager.FlushPage(page)
+		}
+		pager.pinnedList.Map(writer)
+		pager.unpinnedList.Map(writer)
+		return
+	}
+	if !pager.HasFile() {
+		return
+	}
+	// Collect the dirty pages in page order.
+	dirty := make([]*Page, 0)
+	collector := func(link *list.Link) {
 		page := link.GetKey().(*Page)
-		pager.FlushPage(page)
+		if page.IsDirty() && page.pagenum != NOPAGE {
+			dirty = append(dirty, page)
+		}
+	}
+	pager.pinnedList.Map(collector)
+	pager.unpinnedList.Map(collector)
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].pagenum < dirty[j].pagenum
+	})
+	// Write each run of consecutive page numbers at once.
+	for start := 0; start < len(dirty); {
+		end := start + 1
+		for end < len(dirty) && dirty[end].pagenum == dirty[end-1].pagenum+1 {
+			end++
+		}
+		pager.flushRun(dirty[start:end])
+		start = end
 	}
-	pager.pinnedList.Map(writer)
-	pager.unpinnedList.Map(writer)
 	/* SOLUTION }}} */
 }
 
+// flushRun writes pages with consecutive page numbers to disk in a single write.
+func (pager *Pager) flushRun(run []*Page) {
+	if len(run) == 1 {
+		pager.FlushPage(run[0])
+		return
+	}
+	// Direct I/O needs an aligned buffer.
+	buf := directio.AlignedBlock(int(PAGESIZE) * len(run))
+	for i, page := range run {
+		copy(buf[int64(i)*PAGESIZE:], *page.data)
+	}
+	pager.file.WriteAt(buf, run[0].pagenum*PAGESIZE)
+	for _, page := range run {
+		page.SetDirty(false)
+	}
+	atomic.AddInt64(&pager.stats.Flushes, int64(len(run)))
+}
+
 // [RECOVERY] Block all updates.
 func (pager *Pager) LockAllUpdates() {
 	pager.ptMtx.Lock()
@@ -48,6 +48,9 @@ func PagerRepl() (*repl.REPL, error) {
 	r.AddCommand("pager_flushall", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePagerFlushAll(p, payload, replConfig.GetWriter())
 	}, "Flush all pages. usage: pager_flushall")
+	r.AddCommand("pager_bufferpool", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleBufferPool(p, payload, replConfig.GetWriter())
+	}, "Show the buffer pool, or drop every unpinned page. usage: pager_bufferpool [reset]")
 	return r, nil
 }
 
@@ -258,4 +261,27 @@ func HandlePagerFlushAll(p *Pager, payload string, w io.Writer) (err error) {
 	// Flush all.
 	p.FlushAllPages()
 	return nil
-}
\ No newline at end of file
+}
+
+// Function to show the buffer pool, or empty it of unpinned pages.
+func HandleBufferPool(p *Pager, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: pager_bufferpool [reset]
+	if numFields == 2 && fields[1] == "reset" {
+		dropped, err := p.DropUnpinned()
+		if err != nil {
+			return err
+		}
+		io.WriteString(w, fmt.Sprintf("dropped %v pages\n", dropped))
+		return nil
+	}
+	if numFields != 1 {
+		return fmt.Errorf("usage: pager_bufferpool [reset]")
+	}
+	for _, frame := range p.Frames() {
+		io.WriteString(w, fmt.Sprintf("%v (pagenum: %v, pincount: %v, dirty: %v)\n",
+			frame.List, frame.PageNum, frame.PinCount, frame.Dirty))
+	}
+	return nil
+}
@@ -5,6 +5,9 @@ import (
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 )
 
+// BloomFilter is a set of keys that may answer false positives but never false negatives.
+// Each key sets two bits, chosen by independent hashes; after inserting n keys into a filter
+// of m bits, the false-positive rate is about (1 - e^(-2n/m))^2.
 type BloomFilter struct {
 	size int64
 	bits *bitset.BitSet
@@ -35,4 +38,3 @@ func (filter *BloomFilter) Contains(key int64) (contains bool) {
 		filter.bits.Test(hash.MurmurHasher(key, filter.size)))
 	/* SOLUTION }}} */
 }
-
@@ -2,8 +2,11 @@ package query
 
 import (
 	"context"
+	"errors"
 	"os"
+	"sync/atomic"
 
+	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
@@ -11,165 +14,440 @@ import (
 	errgroup "golang.org/x/sync/errgroup"
 )
 
-var DEFAULT_FILTER_SIZE int64 = 1024
+// Bits in the bloom filter built over each right bucket while probing.
+var DEFAULT_FILTER_SIZE = config.NewInt64Setting("bloom_filter_size", 1024, 1, 1<<24,
+	"bits in each bloom filter a join builds to probe a bucket")
 
-// Entry pair struct - output of a join.
+// Buffer size of the results channel returned by Join, read when each join starts.
+// Larger buffers let probing run further ahead of a slow reader at the cost of memory.
+var JOIN_CHANNEL_BUFFER = config.NewIntSetting("join_channel_buffer", 1024, 0, 1<<20,
+	"buffer size of the results channel returned by a join")
+
+// Number of bucket pairs a join holds at once. Each pins its pages, one at a time, only
+// while their entries are copied out, so a slow reader never holds pins; the copy is kept
+// until its results are sent, so a slow reader holds up at most this many copies.
+var JOIN_MAX_PINNED_BUCKETS = config.NewIntSetting("join_max_pinned_buckets", 8, 1, config.NumPages,
+	"number of bucket pairs a join holds at once")
+
+// Number of bucket pairs copied out by running joins and not yet fully probed; accessed atomically.
+var bucketPairsInFlight int64
+
+// BucketPairsInFlight returns how many bucket pairs running joins hold copies of right now.
+func BucketPairsInFlight() int64 {
+	return atomic.LoadInt64(&bucketPairsInFlight)
+}
+
+// Joins of tables with at most this many entries each run as nested-loop joins in memory,
+// without temporary hash tables. The default is the most entries a bucket holds, so each
+// table would fit in a single bucket anyway; 0 always uses temporary hash tables.
+var NESTED_LOOP_JOIN_MAX_ENTRIES = config.NewInt64Setting("nested_loop_join_max_entries", hash.BUCKETSIZE-1, 0, 1<<16,
+	"most entries in each table of a join run in memory")
+
+// Deepest the temporary hash tables a join builds grow; see hash.NewHashTableBounded.
+// Entries sharing a join value never split apart, so once they fill a bucket this deep
+// they go to overflow pages chained to it, however many there are.
+var JOIN_MAX_DEPTH = config.NewInt64Setting("join_max_depth", 16, 2, 20,
+	"deepest the temporary hash tables a join builds grow before chaining overflow pages")
+
+// Which unmatched entries a join emits, besides its matching pairs.
+type JoinType int
+
+const (
+	INNER       JoinType = iota // Only matching pairs.
+	LEFT_OUTER                  // Also left entries without a match.
+	RIGHT_OUTER                 // Also right entries without a match.
+	FULL_OUTER                  // Also unmatched entries from either side.
+)
+
+// JoinConfig customizes a join; start from DefaultJoinConfig.
+type JoinConfig struct {
+	Type          JoinType // Which unmatched entries to emit.
+	ChannelBuffer int      // Buffer size of the results channel.
+}
+
+// DefaultJoinConfig returns the configuration of an inner join that uses the join tunables.
+func DefaultJoinConfig() JoinConfig {
+	return JoinConfig{Type: INNER, ChannelBuffer: JOIN_CHANNEL_BUFFER.Get()}
+}
+
+// validate checks that a join can run as configured.
+func (joinConfig JoinConfig) validate() error {
+	if joinConfig.ChannelBuffer < 0 {
+		return errors.New("join channel buffer cannot be negative")
+	}
+	return nil
+}
+
+// Entry pair struct - output of a join. In an outer join, the side an unmatched
+// entry has no match on is nil.
 type EntryPair struct {
 	l utils.Entry
 	r utils.Entry
 }
 
+// Get the entry from the left table, or nil if none matched the right entry.
+func (p EntryPair) GetLeft() utils.Entry {
+	return p.l
+}
+
+// Get the entry from the right table, or nil if none matched the left entry.
+func (p EntryPair) GetRight() utils.Entry {
+	return p.r
+}
+
 // Int pair struct - to keep track of seen bucket pairs.
 type pair struct {
 	l int64
 	r int64
 }
 
+// removeTempIndex closes a temporary hash index, if open, then deletes its files.
+// The index must be closed first so its file handles are released.
+func removeTempIndex(tempIndex *hash.HashIndex, dbName string) {
+	if tempIndex != nil {
+		tempIndex.Close()
+	}
+	os.Remove(dbName)
+	os.Remove(dbName + ".meta")
+}
+
+// openJoinIndex opens a new temporary hash index for a join, bounded by JOIN_MAX_DEPTH, so
+// it holds any number of entries sharing a key when they are added with InsertDuplicate.
+func openJoinIndex() (tempIndex *hash.HashIndex, dbName string, err error) {
+	dbName, err = db.GetTempDB()
+	if err != nil {
+		return nil, "", err
+	}
+	tempIndex, err = hash.OpenTableBounded(dbName, JOIN_MAX_DEPTH.Get())
+	if err != nil {
+		removeTempIndex(nil, dbName)
+		return nil, "", err
+	}
+	return tempIndex, dbName, nil
+}
+
 // buildHashIndex constructs a temporary hash table for all the entries in the given sourceTable.
+// Built on values, the table holds every entry sharing a value under the same key, so
+// entries are added with InsertDuplicate; an error inserting any entry fails the build,
+// since a join missing entries would be silently incomplete.
 func buildHashIndex(
 	sourceTable db.Index,
 	useKey bool,
 ) (tempIndex *hash.HashIndex, dbName string, err error) {
-	// Get a temporary db file.
-	dbName, err = db.GetTempDB()
-	if err != nil {
-		return nil, "", err
-	}
 	// Init the temporary hash table.
-	tempIndex, err = hash.OpenTable(dbName)
+	tempIndex, dbName, err = openJoinIndex()
 	if err != nil {
 		return nil, "", err
 	}
 	// Build the hash index.
 	/* SOLUTION {{{ */
-	// Get the cursor and load the hash table.
-	cursor, err := sourceTable.TableStart()
+	// Load every entry, holding off auto-vacuum so none move under the scan.
+	err = db.Scan(sourceTable, func(val utils.Entry) error {
+		// Swap keys and values if needed, this needs to be swapped back later.
+		if useKey {
+			return tempIndex.InsertDuplicate(val.GetKey(), val.GetValue())
+		}
+		return tempIndex.InsertDuplicate(val.GetValue(), val.GetKey())
+	})
 	if err != nil {
+		removeTempIndex(tempIndex, dbName)
 		return nil, "", err
 	}
-	// Loop through all entries.
-	for {
-		if !cursor.IsEnd() {
-			val, err := cursor.GetEntry()
-			if err != nil {
-				return nil, "", err
-			}
-			// Swap keys and values if needed, this needs to be swapped back later.
-			if useKey {
-				tempIndex.Insert(val.GetKey(), val.GetValue())
-			} else {
-				tempIndex.Insert(val.GetValue(), val.GetKey())
-			}
-		}
-		if cursor.StepForward() {
-			break
-		}
-	}
 	return tempIndex, dbName, nil
 	/* SOLUTION }}} */
 }
 
 // sendResult attempts to send a single join result to the resultsChan channel as long as the errgroup hasn't been cancelled.
+// sent is incremented once the result is sent, and never if it isn't.
 func sendResult(
 	ctx context.Context,
 	resultsChan chan EntryPair,
+	sent *int64,
 	result EntryPair,
 ) (err error) {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case resultsChan <- result:
+		atomic.AddInt64(sent, 1)
 		return nil
 	}
 }
 
-// See which entries in rBucket have a match in lBucket.
+// readBucketPair copies out the entries of a pair of buckets, overflow pages included,
+// releasing their pages before returning.
+func readBucketPair(
+	leftHashTable *hash.HashTable,
+	rightHashTable *hash.HashTable,
+	lBucketPN int64,
+	rBucketPN int64,
+) (lBucketEntries []utils.Entry, rBucketEntries []utils.Entry, err error) {
+	if lBucketEntries, err = readBucket(leftHashTable, lBucketPN); err != nil {
+		return nil, nil, err
+	}
+	if rBucketEntries, err = readBucket(rightHashTable, rBucketPN); err != nil {
+		return nil, nil, err
+	}
+	return lBucketEntries, rBucketEntries, nil
+}
+
+// readBucket copies out the entries of the bucket on the given page and its overflow pages,
+// pinning one page at a time.
+func readBucket(hashTable *hash.HashTable, pn int64) ([]utils.Entry, error) {
+	entries := make([]utils.Entry, 0)
+	for _, chainPN := range hashTable.GetChain(pn) {
+		bucket, err := hashTable.GetBucketByPN(chainPN)
+		if err != nil {
+			return nil, err
+		}
+		bucketEntries, err := bucket.Select()
+		bucket.GetPage().Put()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, bucketEntries...)
+	}
+	return entries, nil
+}
+
+// joinResult swaps an entry of a temporary hash table back into its original orientation.
+func joinResult(entry utils.Entry, joinOnKey bool) (result hash.HashEntry) {
+	if joinOnKey {
+		result.SetKey(entry.GetKey())
+		result.SetValue(entry.GetValue())
+	} else {
+		result.SetKey(entry.GetValue())
+		result.SetValue(entry.GetKey())
+	}
+	return result
+}
+
+// See which entries in rBucketEntries have a match in lBucketEntries.
+// Every pair of entries with equal keys is emitted, so groups of duplicates on both sides
+// produce their Cartesian product. Unmatched left entries for which leftOwned returns true
+// are emitted alone, as are unmatched right entries for which rightOwned does; either
+// may be nil to emit none.
 func probeBuckets(
 	ctx context.Context,
 	resultsChan chan EntryPair,
-	lBucket *hash.HashBucket,
-	rBucket *hash.HashBucket,
+	sent *int64,
+	lBucketEntries []utils.Entry,
+	rBucketEntries []utils.Entry,
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
+	leftOwned func(key int64) bool,
+	rightOwned func(key int64) bool,
 ) (err error) {
-	defer lBucket.GetPage().Put()
-	defer rBucket.GetPage().Put()
 	// Probe buckets.
 	/* SOLUTION {{{ */
-	// Get bucket entries.
-	lBucketEntries, err := lBucket.Select()
-	if err != nil {
-		return err
-	}
-	rBucketEntries, err := rBucket.Select()
-	if err != nil {
-		return err
-	}
-	// Set up the bloom filter.
-	filter := CreateFilter(DEFAULT_FILTER_SIZE)
+	// Set up the bloom filter, so left entries it rules out skip scanning the right bucket.
+	// A full bucket of 203 entries leaves a 1024-bit filter with a false-positive rate
+	// near 10%, so it spares about 90% of the scans for left keys without a match; a
+	// 1-bit filter never rules a key out.
+	filter := CreateFilter(DEFAULT_FILTER_SIZE.Get())
 	for _, rEntry := range rBucketEntries {
 		filter.Insert(rEntry.GetKey())
 	}
+	rMatched := make([]bool, len(rBucketEntries))
 	for _, lEntry := range lBucketEntries {
 		lMatchKey := lEntry.GetKey()
-		// Check the bloom filter first.
-		if !filter.Contains(lMatchKey) {
-			continue
-		}
-		// Check all entries if the key is in the filter.
-		for _, rEntry := range rBucketEntries {
-			rMatchKey := rEntry.GetKey()
-			if lMatchKey == rMatchKey {
+		lMatched := false
+		// Check the bloom filter first; if the key is in the filter, check all entries.
+		for i := 0; filter.Contains(lMatchKey) && i < len(rBucketEntries); i++ {
+			rEntry := rBucketEntries[i]
+			if lMatchKey == rEntry.GetKey() {
+				lMatched, rMatched[i] = true, true
 				// Swap keys and values as needed.
-				var lResult, rResult hash.HashEntry
-				if joinOnLeftKey {
-					lResult.SetKey(lEntry.GetKey())
-					lResult.SetValue(lEntry.GetValue())
-				} else {
-					lResult.SetKey(lEntry.GetValue())
-					lResult.SetValue(lEntry.GetKey())
-				}
-				if joinOnRightKey {
-					rResult.SetKey(rEntry.GetKey())
-					rResult.SetValue(rEntry.GetValue())
-				} else {
-					rResult.SetKey(rEntry.GetValue())
-					rResult.SetValue(rEntry.GetKey())
-				}
-				err = sendResult(ctx, resultsChan, EntryPair{l: lResult, r: rResult})
-				if err != nil {
+				result := EntryPair{l: joinResult(lEntry, joinOnLeftKey), r: joinResult(rEntry, joinOnRightKey)}
+				if err = sendResult(ctx, resultsChan, sent, result); err != nil {
 					return err
 				}
 			}
 		}
+		if !lMatched && leftOwned != nil && leftOwned(lMatchKey) {
+			if err = sendResult(ctx, resultsChan, sent, EntryPair{l: joinResult(lEntry, joinOnLeftKey)}); err != nil {
+				return err
+			}
+		}
+	}
+	for i, rEntry := range rBucketEntries {
+		if !rMatched[i] && rightOwned != nil && rightOwned(rEntry.GetKey()) {
+			if err = sendResult(ctx, resultsChan, sent, EntryPair{r: joinResult(rEntry, joinOnRightKey)}); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 	/* SOLUTION }}} */
 }
 
-// Join leftTable on rightTable using Grace Hash Join.
-func Join(
+// Returned by the scan in readJoinEntries to stop at a table that's too large.
+var errTooManyEntries = errors.New("too many entries")
+
+// readJoinEntries reads the entries of table, keyed on the attribute being joined on as
+// in a temporary hash table, unless there are more than max; a negative max has no limit.
+func readJoinEntries(table db.Index, joinOnKey bool, max int64) (entries []utils.Entry, ok bool, err error) {
+	entries = make([]utils.Entry, 0)
+	err = db.Scan(table, func(entry utils.Entry) error {
+		if max >= 0 && int64(len(entries)) == max {
+			return errTooManyEntries
+		}
+		entries = append(entries, joinResult(entry, joinOnKey))
+		return nil
+	})
+	if err == errTooManyEntries {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, true, nil
+}
+
+// NestedLoopJoin joins leftTable on rightTable like Join, but compares every pair of
+// entries in memory rather than building temporary hash tables, which is faster for
+// tiny tables. Nothing needs cleaning up, but cleanupCallback is returned like Join's.
+func NestedLoopJoin(
 	ctx context.Context,
 	leftTable db.Index,
 	rightTable db.Index,
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
 ) (resultsChan chan EntryPair, ctxt context.Context, group *errgroup.Group, cleanupCallback func(), err error) {
-	leftHashIndex, leftDbName, err := buildHashIndex(leftTable, joinOnLeftKey)
+	lEntries, _, err := readJoinEntries(leftTable, joinOnLeftKey, -1)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	rightHashIndex, rightDbName, err := buildHashIndex(rightTable, joinOnRightKey)
+	rEntries, _, err := readJoinEntries(rightTable, joinOnRightKey, -1)
 	if err != nil {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
 		return nil, nil, nil, nil, err
 	}
+	resultsChan, ctx, group, _, err = nestedLoopJoin(ctx, lEntries, rEntries, joinOnLeftKey, joinOnRightKey, DefaultJoinConfig())
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return resultsChan, ctx, group, func() {}, nil
+}
+
+// nestedLoopJoin probes the entries of both tables against each other as a single bucket pair.
+func nestedLoopJoin(
+	ctx context.Context,
+	lEntries []utils.Entry,
+	rEntries []utils.Entry,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	joinConfig JoinConfig,
+) (resultsChan chan EntryPair, ctxt context.Context, group *errgroup.Group, sent func() int64, err error) {
+	if err = joinConfig.validate(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	group, ctx = errgroup.WithContext(ctx)
+	resultsChan = make(chan EntryPair, joinConfig.ChannelBuffer)
+	numSent := new(int64)
+	// The single pair sees every entry, so it reports all the unmatched ones.
+	everything := func(key int64) bool { return true }
+	var leftOwned, rightOwned func(key int64) bool
+	if joinConfig.Type == LEFT_OUTER || joinConfig.Type == FULL_OUTER {
+		leftOwned = everything
+	}
+	if joinConfig.Type == RIGHT_OUTER || joinConfig.Type == FULL_OUTER {
+		rightOwned = everything
+	}
+	group.Go(func() error {
+		return probeBuckets(ctx, resultsChan, numSent, lEntries, rEntries, joinOnLeftKey, joinOnRightKey, leftOwned, rightOwned)
+	})
+	return resultsChan, ctx, group, func() int64 { return atomic.LoadInt64(numSent) }, nil
+}
+
+// Join leftTable on rightTable using Grace Hash Join, or a nested-loop join if both
+// have at most NESTED_LOOP_JOIN_MAX_ENTRIES entries.
+func Join(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) (resultsChan chan EntryPair, ctxt context.Context, group *errgroup.Group, cleanupCallback func(), err error) {
+	return JoinWithType(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, INNER)
+}
+
+// JoinWithType joins leftTable on rightTable like Join, also emitting the unmatched entries
+// joinType asks for. Every bucket a left entry may share a pair with is probed, but only
+// the pair holding the right bucket its key hashes to can find its match, so that pair
+// alone emits it if unmatched; likewise for right entries.
+func JoinWithType(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	joinType JoinType,
+) (resultsChan chan EntryPair, ctxt context.Context, group *errgroup.Group, cleanupCallback func(), err error) {
+	joinConfig := DefaultJoinConfig()
+	joinConfig.Type = joinType
+	resultsChan, ctxt, group, cleanupCallback, _, err = JoinWithConfig(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, joinConfig)
+	return resultsChan, ctxt, group, cleanupCallback, err
+}
+
+// JoinWithConfig joins leftTable on rightTable like JoinWithType, as configured by joinConfig.
+// sent returns how many results have been sent on resultsChan so far; those not yet
+// received are pending.
+func JoinWithConfig(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	joinConfig JoinConfig,
+) (resultsChan chan EntryPair, ctxt context.Context, group *errgroup.Group, cleanupCallback func(), sent func() int64, err error) {
+	if err = joinConfig.validate(); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	// Join tiny tables in memory.
+	maxEntries := NESTED_LOOP_JOIN_MAX_ENTRIES.Get()
+	lEntries, lFits, err := readJoinEntries(leftTable, joinOnLeftKey, maxEntries)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	if lFits {
+		rEntries, rFits, err := readJoinEntries(rightTable, joinOnRightKey, maxEntries)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		if rFits {
+			resultsChan, ctx, group, sent, err = nestedLoopJoin(ctx, lEntries, rEntries, joinOnLeftKey, joinOnRightKey, joinConfig)
+			if err != nil {
+				return nil, nil, nil, nil, nil, err
+			}
+			return resultsChan, ctx, group, func() {}, sent, nil
+		}
+	}
+	// Build both hash indices at once. GetTempDB creates each file exclusively, so the
+	// builds never share a name.
+	var leftHashIndex, rightHashIndex *hash.HashIndex
+	var leftDbName, rightDbName string
+	var buildGroup errgroup.Group
+	buildGroup.Go(func() (err error) {
+		leftHashIndex, leftDbName, err = buildHashIndex(leftTable, joinOnLeftKey)
+		return err
+	})
+	buildGroup.Go(func() (err error) {
+		rightHashIndex, rightDbName, err = buildHashIndex(rightTable, joinOnRightKey)
+		return err
+	})
+	if err = buildGroup.Wait(); err != nil {
+		// A failed build removes its own index; remove the other if it succeeded.
+		if leftHashIndex != nil {
+			removeTempIndex(leftHashIndex, leftDbName)
+		}
+		if rightHashIndex != nil {
+			removeTempIndex(rightHashIndex, rightDbName)
+		}
+		return nil, nil, nil, nil, nil, err
+	}
 	cleanupCallback = func() {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
-		os.Remove(rightDbName)
-		os.Remove(rightDbName + ".meta")
+		removeTempIndex(leftHashIndex, leftDbName)
+		removeTempIndex(rightHashIndex, rightDbName)
 	}
 	// Make both hash indices the same global size.
 	leftHashTable := leftHashIndex.GetTable()
@@ -185,11 +463,19 @@ func Join(
 	}
 	// Probe phase: match buckets to buckets and emit entries that match.
 	group, ctx = errgroup.WithContext(ctx)
-	resultsChan = make(chan EntryPair, 1024)
+	resultsChan = make(chan EntryPair, joinConfig.ChannelBuffer)
+	numSent := new(int64)
 	// Iterate through hash buckets, keeping track of pairs we've seen before.
 	leftBuckets := leftHashTable.GetBuckets()
 	rightBuckets := rightHashTable.GetBuckets()
+	depth := leftHashTable.GetDepth()
+	hashFn := leftHashTable.GetHashFn()
 	seenList := make(map[pair]bool)
+	maxPinned := JOIN_MAX_PINNED_BUCKETS.Get()
+	if maxPinned < 1 {
+		maxPinned = 1
+	}
+	pinSlots := make(chan struct{}, maxPinned)
 	for i, lBucketPN := range leftBuckets {
 		rBucketPN := rightBuckets[i]
 		bucketPair := pair{l: lBucketPN, r: rBucketPN}
@@ -197,19 +483,31 @@ func Join(
 			continue
 		}
 		seenList[bucketPair] = true
-
-		lBucket, err := leftHashTable.GetBucketByPN(lBucketPN)
-		if err != nil {
-			return nil, nil, nil, cleanupCallback, err
+		var leftOwned, rightOwned func(key int64) bool
+		if joinConfig.Type == LEFT_OUTER || joinConfig.Type == FULL_OUTER {
+			leftOwned = func(key int64) bool { return rightBuckets[hashFn(key, depth)] == bucketPair.r }
 		}
-		rBucket, err := rightHashTable.GetBucketByPN(rBucketPN)
-		if err != nil {
-			lBucket.GetPage().Put()
-			return nil, nil, nil, cleanupCallback, err
+		if joinConfig.Type == RIGHT_OUTER || joinConfig.Type == FULL_OUTER {
+			rightOwned = func(key int64) bool { return leftBuckets[hashFn(key, depth)] == bucketPair.l }
 		}
+
 		group.Go(func() error {
-			return probeBuckets(ctx, resultsChan, lBucket, rBucket, joinOnLeftKey, joinOnRightKey)
+			// Hold a slot until the copied entries are probed, so a slow reader bounds memory.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case pinSlots <- struct{}{}:
+			}
+			defer func() { <-pinSlots }()
+			lBucketEntries, rBucketEntries, err := readBucketPair(leftHashTable, rightHashTable, bucketPair.l, bucketPair.r)
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(&bucketPairsInFlight, 1)
+			defer atomic.AddInt64(&bucketPairsInFlight, -1)
+			return probeBuckets(ctx, resultsChan, numSent, lBucketEntries, rBucketEntries, joinOnLeftKey, joinOnRightKey,
+				leftOwned, rightOwned)
 		})
 	}
-	return resultsChan, ctx, group, cleanupCallback, nil
+	return resultsChan, ctx, group, cleanupCallback, func() int64 { return atomic.LoadInt64(numSent) }, nil
 }
\ No newline at end of file
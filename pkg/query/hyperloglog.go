@@ -0,0 +1,81 @@
+package query
+
+import (
+	"math"
+	"math/bits"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// Default number of index bits; the standard error is 1.04 / sqrt(2^14), about 0.8%.
+const HLL_PRECISION uint = 14
+
+// hash.Hasher yields this many usable bits at most, since it keeps hashes non-negative.
+const HLL_HASH_BITS int64 = 62
+
+// HyperLogLog estimates how many distinct keys have been added to it,
+// using 2^precision one-byte registers.
+type HyperLogLog struct {
+	precision uint
+	registers []uint8
+}
+
+// CreateHyperLogLog initializes an empty sketch with the given number of index bits.
+func CreateHyperLogLog(precision uint) *HyperLogLog {
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// Insert adds a key to the sketch.
+func (hll *HyperLogLog) Insert(key int64) {
+	h := uint64(hash.Hasher(key, HLL_HASH_BITS)) & (1<<uint(HLL_HASH_BITS) - 1)
+	// The low bits pick a register; the rest record the longest run of leading zeros.
+	register := h & (1<<hll.precision - 1)
+	width := uint(HLL_HASH_BITS) - hll.precision
+	rank := uint8(bits.LeadingZeros64(h>>hll.precision)-(64-int(width))) + 1
+	if rank > hll.registers[register] {
+		hll.registers[register] = rank
+	}
+}
+
+// Estimate returns the approximate number of distinct keys added so far.
+func (hll *HyperLogLog) Estimate() int64 {
+	m := float64(len(hll.registers))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range hll.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Fall back to linear counting while many registers are still empty.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// ApproxDistinct estimates the number of distinct keys, or values, in the given index
+// with a HyperLogLog sketch, streaming entries rather than collecting them.
+func ApproxDistinct(idx db.Index, onKey bool) (int64, error) {
+	hll := CreateHyperLogLog(HLL_PRECISION)
+	err := db.Scan(idx, func(entry utils.Entry) error {
+		if onKey {
+			hll.Insert(entry.GetKey())
+		} else {
+			hll.Insert(entry.GetValue())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return hll.Estimate(), nil
+}
@@ -0,0 +1,120 @@
+package query
+
+import (
+	"context"
+	"errors"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+
+	errgroup "golang.org/x/sync/errgroup"
+)
+
+// JoinSpec says which side of each entry a pairwise join matches on.
+type JoinSpec struct {
+	LeftOnKey  bool // Match on the left entry's key, else its value.
+	RightOnKey bool // Match on the right entry's key, else its value.
+}
+
+// MultiJoin joins a chain of tables with a left-deep plan of pairwise hash joins.
+// specs[i] joins tables[i] with tables[i+1]. Between joins, the tables[i+1] entry of
+// every matching pair is materialized into a temporary hash index, which becomes the
+// left input of the next join; so specs[i].LeftOnKey refers to tables[i]'s entries, and
+// an entry appears once per chain of matches leading to it.
+// The results are pairs of matching tables[n-2] and tables[n-1] entries, returned as by Join.
+// Intermediate indexes are removed as soon as the next join has consumed them, and on error;
+// cleanupCallback removes the rest.
+func MultiJoin(
+	ctx context.Context,
+	tables []db.Index,
+	specs []JoinSpec,
+) (resultsChan chan EntryPair, ctxt context.Context, group *errgroup.Group, cleanupCallback func(), err error) {
+	if len(tables) < 2 {
+		return nil, nil, nil, nil, errors.New("multi join needs at least two tables")
+	}
+	if len(specs) != len(tables)-1 {
+		return nil, nil, nil, nil, errors.New("multi join needs one spec per pair of adjacent tables")
+	}
+	left := tables[0]
+	var tempIndex *hash.HashIndex
+	var tempDbName string
+	for i := 1; i < len(tables)-1; i++ {
+		if err = ctx.Err(); err != nil {
+			removeTempIndex(tempIndex, tempDbName)
+			return nil, nil, nil, nil, err
+		}
+		nextIndex, nextDbName, err := materializeJoin(ctx, left, tables[i], specs[i-1])
+		// The previous intermediate has been read in full by now.
+		if tempIndex != nil {
+			removeTempIndex(tempIndex, tempDbName)
+		}
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		tempIndex, tempDbName = nextIndex, nextDbName
+		left = tempIndex
+	}
+	// The final join streams its results to the caller.
+	last := len(tables) - 1
+	resultsChan, ctxt, group, joinCleanup, err := Join(ctx, left, tables[last], specs[last-1].LeftOnKey, specs[last-1].RightOnKey)
+	if err != nil {
+		// A failed join removes its own indexes.
+		if tempIndex != nil {
+			removeTempIndex(tempIndex, tempDbName)
+		}
+		return nil, nil, nil, nil, err
+	}
+	cleanupCallback = func() {
+		joinCleanup()
+		if tempIndex != nil {
+			removeTempIndex(tempIndex, tempDbName)
+		}
+	}
+	return resultsChan, ctxt, group, cleanupCallback, nil
+}
+
+// materializeJoin joins left and right and stores the right entry of every matching pair
+// in a new temporary hash index. A right entry matching many left entries is stored once
+// for each, chained on overflow pages once they outgrow a bucket; see openJoinIndex.
+func materializeJoin(
+	ctx context.Context,
+	left db.Index,
+	right db.Index,
+	spec JoinSpec,
+) (tempIndex *hash.HashIndex, dbName string, err error) {
+	// Get a temporary db file and init the hash table.
+	tempIndex, dbName, err = openJoinIndex()
+	if err != nil {
+		return nil, "", err
+	}
+	resultsChan, _, group, cleanupCallback, err := Join(ctx, left, right, spec.LeftOnKey, spec.RightOnKey)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		removeTempIndex(tempIndex, dbName)
+		return nil, "", err
+	}
+	// Keep draining after a failed insert so the probes don't block.
+	done := make(chan error)
+	go func() {
+		var insertErr error
+		for pair := range resultsChan {
+			if insertErr == nil {
+				insertErr = tempIndex.InsertDuplicate(pair.r.GetKey(), pair.r.GetValue())
+			}
+		}
+		done <- insertErr
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	insertErr := <-done
+	if err == nil {
+		err = insertErr
+	}
+	if err != nil {
+		removeTempIndex(tempIndex, dbName)
+		return nil, "", err
+	}
+	return tempIndex, dbName, nil
+}
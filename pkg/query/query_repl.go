@@ -8,6 +8,7 @@ import (
 
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // Query REPL.
@@ -55,8 +56,7 @@ func HandleJoin(d *db.Database, payload string, w io.Writer) (err error) {
 			if !valid {
 				break
 			}
-			io.WriteString(w, fmt.Sprintf("{(%v, %v), (%v, %v)}\n",
-				pair.l.GetKey(), pair.l.GetValue(), pair.r.GetKey(), pair.r.GetValue()))
+			repl.WriteRow(w, pairRow(pair))
 		}
 		done <- true
 	}()
@@ -68,3 +68,28 @@ func HandleJoin(d *db.Database, payload string, w io.Writer) (err error) {
 	}
 	return nil
 }
+
+// pairRow renders a pair of joined entries as a result row; a missing entry of an
+// outer join renders as NULL, or null in JSON.
+func pairRow(pair EntryPair) repl.Row {
+	return repl.Row{
+		Text:   fmt.Sprintf("{%s, %s}", entryText(pair.l), entryText(pair.r)),
+		Fields: map[string]interface{}{"left": entryFields(pair.l), "right": entryFields(pair.r)},
+	}
+}
+
+// entryText renders one side of a joined pair.
+func entryText(entry utils.Entry) string {
+	if entry == nil {
+		return "NULL"
+	}
+	return fmt.Sprintf("(%v, %v)", entry.GetKey(), entry.GetValue())
+}
+
+// entryFields renders one side of a joined pair as JSON members.
+func entryFields(entry utils.Entry) map[string]interface{} {
+	if entry == nil {
+		return nil
+	}
+	return map[string]interface{}{"key": entry.GetKey(), "value": entry.GetValue()}
+}
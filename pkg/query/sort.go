@@ -0,0 +1,263 @@
+package query
+
+import (
+	"container/heap"
+	"errors"
+	"os"
+	"sort"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// An entry being sorted.
+type sortEntry struct {
+	key   int64
+	value int64
+}
+
+// sortLess orders entries by key, or by value then key if onKey is false.
+func sortLess(a sortEntry, b sortEntry, onKey bool) bool {
+	if onKey || a.value == b.value {
+		return a.key < b.key
+	}
+	return a.value < b.value
+}
+
+// removeTempTable closes a temporary btree, if open, then deletes its file.
+func removeTempTable(tempTable *btree.BTreeIndex, dbName string) {
+	if tempTable != nil {
+		tempTable.Close()
+	}
+	os.Remove(dbName)
+}
+
+// Sort returns a new index holding the entries of source in ascending order of key, or of
+// value if onKey is false, with ties broken by key. Entry i of the result has key i and
+// values (source key, source value), so a cursor from TableStart visits them in order.
+// Up to maxInMemory entries are buffered. If all of source fits, it is sorted in memory
+// into a table without a backing file, and no temporary files are created. Otherwise each
+// full buffer is sorted and spilled to a temporary run, and the runs are merged into a
+// temporary file; the runs are removed as soon as they are merged, and on error.
+// cleanupCallback closes the result and removes the file behind it, if any.
+func Sort(
+	source db.Index,
+	onKey bool,
+	maxInMemory int64,
+) (sorted *btree.BTreeIndex, cleanupCallback func(), err error) {
+	if maxInMemory < 1 {
+		return nil, nil, errors.New("sort needs room for at least one entry in memory")
+	}
+	buffer := make([]sortEntry, 0)
+	runs := make([]*btree.BTreeIndex, 0)
+	runNames := make([]string, 0)
+	removeRuns := func() {
+		for i, run := range runs {
+			removeTempTable(run, runNames[i])
+		}
+	}
+	spill := func() error {
+		run, runName, err := writeRun(buffer, onKey)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		runNames = append(runNames, runName)
+		buffer = buffer[:0]
+		return nil
+	}
+	// Run generation: fill the buffer, spilling it whenever it overflows.
+	err = db.Scan(source, func(entry utils.Entry) error {
+		if int64(len(buffer)) == maxInMemory {
+			if err := spill(); err != nil {
+				return err
+			}
+		}
+		buffer = append(buffer, sortEntry{key: entry.GetKey(), value: entry.GetValue()})
+		return nil
+	})
+	if err != nil {
+		removeRuns()
+		return nil, nil, err
+	}
+	if len(runs) == 0 {
+		sorted, err = sortInMemory(buffer, onKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sorted != nil {
+			return sorted, func() { sorted.Close() }, nil
+		}
+	}
+	// The input overflowed the buffer, or the result would overflow the buffer pool.
+	if len(buffer) > 0 {
+		if err = spill(); err != nil {
+			removeRuns()
+			return nil, nil, err
+		}
+	}
+	if len(runs) == 1 {
+		// A single run is already the result.
+		run, runName := runs[0], runNames[0]
+		return run, func() { removeTempTable(run, runName) }, nil
+	}
+	sorted, dbName, err := mergeRuns(runs, onKey)
+	removeRuns()
+	if err != nil {
+		return nil, nil, err
+	}
+	return sorted, func() { removeTempTable(sorted, dbName) }, nil
+}
+
+// sortInMemory sorts entries into a table without a backing file, or returns nil if
+// the result would not fit in its buffer pool.
+func sortInMemory(entries []sortEntry, onKey bool) (*btree.BTreeIndex, error) {
+	// Ranks are inserted in ascending order, so keep every node full.
+	sorted, err := btree.NewMemoryTable(btree.RIGHT_BIASED_SPLIT, 2)
+	if err != nil {
+		return nil, err
+	}
+	if _, willFit := db.EstimateInsertCost(sorted, int64(len(entries))); !willFit {
+		sorted.Close()
+		return nil, nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortLess(entries[i], entries[j], onKey)
+	})
+	if err = writeSorted(sorted, entries); err != nil {
+		sorted.Close()
+		return nil, err
+	}
+	return sorted, nil
+}
+
+// writeRun sorts entries into a new temporary run.
+func writeRun(entries []sortEntry, onKey bool) (run *btree.BTreeIndex, dbName string, err error) {
+	dbName, err = db.GetTempDB()
+	if err != nil {
+		return nil, "", err
+	}
+	run, err = btree.OpenTableWithValues(dbName, 2)
+	if err != nil {
+		removeTempTable(nil, dbName)
+		return nil, "", err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortLess(entries[i], entries[j], onKey)
+	})
+	if err = writeSorted(run, entries); err != nil {
+		removeTempTable(run, dbName)
+		return nil, "", err
+	}
+	return run, dbName, nil
+}
+
+// writeSorted inserts sorted entries into an empty table, keyed by their rank.
+func writeSorted(table *btree.BTreeIndex, entries []sortEntry) error {
+	for i, entry := range entries {
+		if err := table.InsertValues(int64(i), []int64{entry.key, entry.value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The entry at the front of a run, during a merge.
+type runHead struct {
+	entry  sortEntry
+	cursor utils.Cursor
+}
+
+// A min-heap of run heads; implements heap.Interface.
+type runHeap struct {
+	heads []runHead
+	onKey bool
+}
+
+func (h *runHeap) Len() int {
+	return len(h.heads)
+}
+
+func (h *runHeap) Less(i, j int) bool {
+	return sortLess(h.heads[i].entry, h.heads[j].entry, h.onKey)
+}
+
+func (h *runHeap) Swap(i, j int) {
+	h.heads[i], h.heads[j] = h.heads[j], h.heads[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	h.heads = append(h.heads, x.(runHead))
+}
+
+func (h *runHeap) Pop() interface{} {
+	head := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return head
+}
+
+// readRun reads the entry under cursor, returning false if the run is exhausted.
+func readRun(cursor utils.Cursor) (entry sortEntry, ok bool, err error) {
+	if cursor.IsEnd() {
+		return sortEntry{}, false, nil
+	}
+	e, err := cursor.GetEntry()
+	if err != nil {
+		return sortEntry{}, false, err
+	}
+	values := e.Values()
+	return sortEntry{key: values[0], value: values[1]}, true, nil
+}
+
+// mergeRuns merges sorted runs into a new temporary table.
+func mergeRuns(runs []*btree.BTreeIndex, onKey bool) (sorted *btree.BTreeIndex, dbName string, err error) {
+	dbName, err = db.GetTempDB()
+	if err != nil {
+		return nil, "", err
+	}
+	sorted, err = btree.OpenTableWithValues(dbName, 2)
+	if err != nil {
+		removeTempTable(nil, dbName)
+		return nil, "", err
+	}
+	fail := func(err error) (*btree.BTreeIndex, string, error) {
+		removeTempTable(sorted, dbName)
+		return nil, "", err
+	}
+	// Start a cursor at the front of every run.
+	h := &runHeap{heads: make([]runHead, 0, len(runs)), onKey: onKey}
+	for _, run := range runs {
+		cursor, err := run.TableStart()
+		if err != nil {
+			return fail(err)
+		}
+		entry, ok, err := readRun(cursor)
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			h.heads = append(h.heads, runHead{entry: entry, cursor: cursor})
+		}
+	}
+	heap.Init(h)
+	// Repeatedly move the smallest head to the output.
+	for rank := int64(0); h.Len() > 0; rank++ {
+		head := &h.heads[0]
+		if err = sorted.InsertValues(rank, []int64{head.entry.key, head.entry.value}); err != nil {
+			return fail(err)
+		}
+		head.cursor.StepForward()
+		entry, ok, err := readRun(head.cursor)
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			heap.Pop(h)
+			continue
+		}
+		head.entry = entry
+		heap.Fix(h, 0)
+	}
+	return sorted, dbName, nil
+}
@@ -0,0 +1,74 @@
+package recovery
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrCrashed is returned by log writes made after a simulated crash.
+var ErrCrashed = errors.New("simulated crash: log is closed")
+
+// A crash armed by WithCrashAfter.
+type crashPoint struct {
+	remaining int  // Log records still to be written before the crash.
+	crashed   bool // Whether the crash has happened.
+}
+
+// The armed crash, or nil; log writes only consult it while a crash is armed.
+var armedCrash *crashPoint
+
+// Guards armedCrash.
+var crashMtx sync.Mutex
+
+// WithCrashAfter runs fn, simulating a crash once n log records have been written by any
+// recovery manager: right after the n-th record reaches the log, the log is closed and every
+// later write fails with ErrCrashed. Pages are not touched; since Prime discards the database
+// folder for the copy taken at the last checkpoint, nothing done after the crash survives a
+// restart. The recovery manager that crashed cannot be used again.
+// Returns whether the crash happened before fn returned.
+func WithCrashAfter(n int, fn func()) (crashed bool) {
+	crash := &crashPoint{remaining: n}
+	crashMtx.Lock()
+	armedCrash = crash
+	crashMtx.Unlock()
+	defer func() {
+		crashMtx.Lock()
+		armedCrash = nil
+		crashed = crash.crashed
+		crashMtx.Unlock()
+	}()
+	fn()
+	return
+}
+
+// beforeWrite returns ErrCrashed if the log may not be written to because of a simulated crash.
+func (rm *RecoveryManager) beforeWrite() error {
+	crashMtx.Lock()
+	defer crashMtx.Unlock()
+	if armedCrash == nil {
+		return nil
+	}
+	if !armedCrash.crashed && armedCrash.remaining <= 0 {
+		rm.crash()
+	}
+	if armedCrash.crashed {
+		return ErrCrashed
+	}
+	armedCrash.remaining--
+	return nil
+}
+
+// afterWrite crashes if the record just written was the last one allowed.
+func (rm *RecoveryManager) afterWrite() {
+	crashMtx.Lock()
+	defer crashMtx.Unlock()
+	if armedCrash != nil && !armedCrash.crashed && armedCrash.remaining <= 0 {
+		rm.crash()
+	}
+}
+
+// crash closes the log of the recovery manager. Expects crashMtx to be locked.
+func (rm *RecoveryManager) crash() {
+	armedCrash.crashed = true
+	rm.fd.Close()
+}
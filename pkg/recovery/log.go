@@ -34,6 +34,11 @@ type Log interface {
 	toString() string
 }
 
+// ToString returns the textual form of a log, as written to the log file.
+func ToString(log Log) string {
+	return log.toString()
+}
+
 // Log for creating a table.
 type tableLog struct {
 	tblType string // The type of table created, either "btree" or "hash"
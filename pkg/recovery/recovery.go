@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -21,6 +22,7 @@ type RecoveryManager struct {
 	txStack map[uuid.UUID]([]Log)
 	fd      *os.File
 	mtx     sync.Mutex
+	debug   bool // Whether Recover checks its own result with VerifyRecovered.
 }
 
 // Construct a recovery manager.
@@ -41,8 +43,17 @@ func NewRecoveryManager(
 	}, nil
 }
 
+// Set whether Recover verifies that it left no transactions or locks behind.
+func (rm *RecoveryManager) SetDebug(debug bool) {
+	rm.debug = debug
+}
+
 // Write the string `s` to the log file. Expects rm.mtx to be locked
 func (rm *RecoveryManager) writeToBuffer(s string) error {
+	if err := rm.beforeWrite(); err != nil {
+		return err
+	}
+	defer rm.afterWrite()
 	_, err := rm.fd.WriteString(s)
 	if err != nil {
 		return err
@@ -102,7 +113,9 @@ func (rm *RecoveryManager) Commit(clientId uuid.UUID) {
 }
 
 // Flush all pages to disk and write a checkpoint log.
-func (rm *RecoveryManager) Checkpoint() {
+// Returns the byte offset of the checkpoint log in the log file and the number of
+// active transactions it records; recovery will start from that log.
+func (rm *RecoveryManager) Checkpoint() (offset int64, numActive int, err error) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 	var idsList []uuid.UUID
@@ -117,9 +130,18 @@ func (rm *RecoveryManager) Checkpoint() {
 		table.GetPager().FlushAllPages()
 		table.GetPager().UnlockAllUpdates()
 	}
-	rm.writeToBuffer(cpl.toString())
+	// The log is opened for appending, so the record lands at the current end of the file.
+	info, err := rm.fd.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	offset = info.Size()
+	if err = rm.writeToBuffer(cpl.toString()); err != nil {
+		return 0, 0, err
+	}
 	// add to the stack? 
-	rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+	err = rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+	return offset, len(idsList), err
 }
 
 // Redo a given log's action.
@@ -136,6 +158,9 @@ func (rm *RecoveryManager) Redo(log Log) error {
 		case INSERT_ACTION:
 			payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
 			err := db.HandleInsert(rm.d, payload)
+			if errors.Is(err, db.ErrTableNotFound) {
+				return err
+			}
 			if err != nil {
 				// There is already an entry, try updating
 				payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
@@ -147,6 +172,9 @@ func (rm *RecoveryManager) Redo(log Log) error {
 		case UPDATE_ACTION:
 			payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
 			err := db.HandleUpdate(rm.d, payload)
+			if errors.Is(err, db.ErrTableNotFound) {
+				return err
+			}
 			if err != nil {
 				// Entry may have been deleted, try inserting
 				payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
@@ -159,7 +187,7 @@ func (rm *RecoveryManager) Redo(log Log) error {
 			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
 			err := db.HandleDelete(rm.d, payload)
 			if err != nil {
-				return errors.New("table delete error")
+				return fmt.Errorf("table delete error: %w", err)
 			}
 		}
 	default:
@@ -230,7 +258,7 @@ func (rm *RecoveryManager) Recover() error {
 
 	// Restart all transactions in transaction manager
 	for id := range activeTran {
-		if _, found := rm.tm.GetTransactions()[id]; !found {
+		if _, found := rm.tm.GetTransaction(id); !found {
 			err := rm.tm.Begin(id)
 			if err != nil {
 				return err
@@ -286,6 +314,22 @@ func (rm *RecoveryManager) Recover() error {
 			}
 		}
 	}
+	if rm.debug {
+		return rm.VerifyRecovered()
+	}
+	return nil
+}
+
+// Check that recovery rolled back every interrupted transaction: none should still be
+// running, and no resources should still be locked.
+func (rm *RecoveryManager) VerifyRecovered() error {
+	for id := range rm.tm.GetTransactions() {
+		return fmt.Errorf("transaction %v still active after recovery", id)
+	}
+	if held := rm.tm.GetLockManager().GetHeldResources(); len(held) > 0 {
+		return fmt.Errorf("%v resource(s) still locked after recovery, including %v in %v",
+			len(held), held[0].GetResourceKey(), held[0].GetTableName())
+	}
 	return nil
 }
 
@@ -352,20 +396,29 @@ func Prime(folder string) (*db.Database, error) {
 		}
 		return nil, err
 	}
+	// Don't clobber a database that is still open; a crash leaves a stale lock behind.
+	if err := db.BreakStaleLock(dbFolder); err != nil {
+		return nil, err
+	}
 	os.RemoveAll(dbFolder)
-	err := copy.Copy(recoveryFolder, dbFolder)
+	err := copy.Copy(recoveryFolder, dbFolder, copy.Options{Skip: skipLockFile})
 	if err != nil {
 		return nil, err
 	}
 	return db.Open(dbFolder)
 }
 
+// skipLockFile tells copy.Copy to leave out the database lockfile.
+func skipLockFile(src string) (bool, error) {
+	return filepath.Base(src) == db.LOCK_FILE_NAME, nil
+}
+
 // Should be called at end of Checkpoint.
 func (rm *RecoveryManager) Delta() error {
 	folder := strings.TrimSuffix(rm.d.GetBasePath(), "/")
 	recoveryFolder := folder + "-recovery/"
 	folder += "/"
 	os.RemoveAll(recoveryFolder)
-	err := copy.Copy(folder, recoveryFolder)
+	err := copy.Copy(folder, recoveryFolder, copy.Options{Skip: skipLockFile})
 	return err
 }
@@ -57,6 +57,9 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	// Shorthands for the most common commands; their targets are registered above.
+	r.AddAlias("b", "transaction begin")
+	r.AddAlias("c", "transaction commit")
 	return r
 }
 
@@ -115,13 +118,13 @@ func HandleInsert(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 		return fmt.Errorf("usage: insert <key> <value> into <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if newval, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if table, err = d.GetTable(fields[4]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	// First, check that the desired value doesn't exist.
 	_, err = table.Find(int64(key))
@@ -158,13 +161,13 @@ func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 		return fmt.Errorf("usage: update <table> <key> <value>")
 	}
 	if key, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	if newval, err = strconv.Atoi(fields[3]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	if table, err = d.GetTable(fields[1]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	// First, check that the desired value exists.
 	oldval, err := table.Find(int64(key))
@@ -201,10 +204,10 @@ func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 		return fmt.Errorf("usage: delete <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	if table, err = d.GetTable(fields[3]); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	// First, check that the desired value exists.
 	oldval, err := table.Find(int64(key))
@@ -269,9 +272,13 @@ func HandleCheckpoint(d *db.Database, tm *concurrency.TransactionManager, rm *Re
 	if numFields != 1 {
 		return fmt.Errorf("usage: checkpoint")
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	rm.Checkpoint()
-	return err
+	// Checkpoint, then report where recovery will start from.
+	offset, numActive, err := rm.Checkpoint()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "checkpoint written at log offset %v with %v active transaction(s)\n", offset, numActive)
+	return nil
 }
 
 // Handle abort.
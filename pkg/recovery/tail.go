@@ -0,0 +1,69 @@
+package recovery
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
+)
+
+// How long Tail waits before checking the log file for new records again.
+var TAIL_POLL_INTERVAL = config.NewDurationSetting("tail_poll_interval", 50*time.Millisecond, time.Millisecond, time.Minute,
+	"how often a log tail checks for new records")
+
+// Size of the buffer Tail reads the log file into, reused across reads.
+const TAIL_READ_SIZE int = 4096
+
+// Tail delivers each record appended to the log after it is called to fn, in order,
+// until ctx is cancelled, like tail -f. A record is only parsed once its whole line
+// has been written. Returns nil once cancelled, or the first read or parse error.
+func (rm *RecoveryManager) Tail(ctx context.Context, fn func(Log)) error {
+	// Start at a record boundary; writeToBuffer appends whole records under the lock.
+	rm.mtx.Lock()
+	fstats, err := rm.fd.Stat()
+	rm.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	offset := fstats.Size()
+	buf := make([]byte, TAIL_READ_SIZE)
+	pending := make([]byte, 0)
+	for {
+		// Read everything appended since the last read.
+		n, err := rm.fd.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		offset += int64(n)
+		pending = append(pending, buf[:n]...)
+		// Deliver every complete line, keeping any partial trailing record.
+		for {
+			end := bytes.IndexByte(pending, '\n')
+			if end < 0 {
+				break
+			}
+			line := string(pending[:end])
+			pending = pending[end+1:]
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			log, err := FromString(line)
+			if err != nil {
+				return err
+			}
+			fn(log)
+		}
+		// Keep reading while the buffer comes back full; otherwise wait for more.
+		if n == len(buf) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(TAIL_POLL_INTERVAL.Get()):
+		}
+	}
+}
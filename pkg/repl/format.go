@@ -0,0 +1,69 @@
+package repl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// OutputFormat determines how commands render their results.
+type OutputFormat string
+
+const (
+	TEXT_FORMAT OutputFormat = "text" // Human-readable lines.
+	JSON_FORMAT OutputFormat = "json" // One JSON object per line.
+)
+
+// ParseFormat returns the output format with the given name.
+func ParseFormat(name string) (OutputFormat, error) {
+	switch OutputFormat(name) {
+	case TEXT_FORMAT, JSON_FORMAT:
+		return OutputFormat(name), nil
+	}
+	return "", fmt.Errorf("unknown format %s; expected %s or %s", name, TEXT_FORMAT, JSON_FORMAT)
+}
+
+// FormatWriter is the writer handed to commands; it carries the session's output format.
+type FormatWriter struct {
+	io.Writer
+	format OutputFormat
+}
+
+// Get the output format.
+func (fw *FormatWriter) GetFormat() OutputFormat {
+	return fw.format
+}
+
+// GetFormat returns the output format results written to w should use: that of a
+// FormatWriter, else TEXT_FORMAT.
+func GetFormat(w io.Writer) OutputFormat {
+	if fw, ok := w.(*FormatWriter); ok {
+		return fw.format
+	}
+	return TEXT_FORMAT
+}
+
+// Row is a result row, in both of its renderings.
+type Row struct {
+	Text   string                 // The text rendering, without its newline.
+	Fields map[string]interface{} // The members of the JSON rendering.
+}
+
+// FormatRow renders row as a line in the given format.
+func FormatRow(format OutputFormat, row Row) string {
+	if format == JSON_FORMAT {
+		// Maps are encoded with their keys sorted, so rows always read the same.
+		encoded, err := json.Marshal(row.Fields)
+		if err != nil {
+			return fmt.Sprintf("{\"error\": %q}\n", err.Error())
+		}
+		return string(encoded) + "\n"
+	}
+	return row.Text + "\n"
+}
+
+// WriteRow writes row to w in the output format of w.
+func WriteRow(w io.Writer, row Row) error {
+	_, err := io.WriteString(w, FormatRow(GetFormat(w), row))
+	return err
+}
@@ -0,0 +1,84 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
+)
+
+// Number of commands each session remembers for .history.
+var HISTORY_SIZE = config.NewIntSetting("history_size", 100, 1, 1<<16,
+	"number of commands each session remembers for .history")
+
+// A session's most recent commands. Commands are numbered from 1 in the order they
+// were run; numbers stay the same as older commands are forgotten.
+type history struct {
+	entries   []string // The remembered commands, a ring starting at head.
+	head      int      // Index of the oldest remembered command once entries is full.
+	forgotten int      // Number of commands forgotten before the oldest one.
+}
+
+// record remembers a command, forgetting the oldest ones beyond HISTORY_SIZE.
+func (h *history) record(payload string) {
+	size := HISTORY_SIZE.Get()
+	// Lay the ring out oldest first again if HISTORY_SIZE changed since it filled up.
+	if len(h.entries) > size || (h.head != 0 && len(h.entries) < size) {
+		ordered := make([]string, 0, size)
+		for i := range h.entries {
+			ordered = append(ordered, h.at(i))
+		}
+		if extra := len(ordered) - size; extra > 0 {
+			ordered = ordered[extra:]
+			h.forgotten += extra
+		}
+		h.entries, h.head = ordered, 0
+	}
+	if len(h.entries) < size {
+		h.entries = append(h.entries, payload)
+		return
+	}
+	h.entries[h.head] = payload
+	h.head = (h.head + 1) % len(h.entries)
+	h.forgotten++
+}
+
+// at returns the i-th oldest remembered command.
+func (h *history) at(i int) string {
+	return h.entries[(h.head+i)%len(h.entries)]
+}
+
+// get returns command n.
+func (h *history) get(n int) (string, error) {
+	if n <= h.forgotten || n > h.forgotten+len(h.entries) {
+		return "", fmt.Errorf("no command %v in history", n)
+	}
+	return h.at(n - h.forgotten - 1), nil
+}
+
+// write lists the remembered commands with their numbers.
+func (h *history) write(w io.Writer) {
+	for i := range h.entries {
+		io.WriteString(w, fmt.Sprintf("%v: %s\n", h.forgotten+i+1, h.at(i)))
+	}
+}
+
+// rerun runs the command numbered by a ".!<n>" trigger again, echoing it first.
+func (r *REPL) rerun(trigger string, replConfig *REPLConfig) {
+	n, err := strconv.Atoi(strings.TrimPrefix(trigger, ".!"))
+	if err != nil {
+		io.WriteString(replConfig.writer, r.formatError(fmt.Errorf("usage: .!<n>")))
+		return
+	}
+	payload, err := replConfig.history.get(n)
+	if err != nil {
+		io.WriteString(replConfig.writer, r.formatError(err))
+		return
+	}
+	// Only commands that tokenized are recorded.
+	fields, _ := Tokenize(payload)
+	io.WriteString(replConfig.writer, payload+"\n")
+	r.runCommand(cleanInput(fields[0]), payload, replConfig)
+}
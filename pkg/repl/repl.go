@@ -8,6 +8,9 @@ import (
 	"net"
 	"os"
 	"strings"
+	"unicode"
+
+	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
 
 	uuid "github.com/google/uuid"
 )
@@ -15,19 +18,91 @@ import (
 // REPL struct.
 type REPL struct {
 	//Map (string, func())
-	commands map[string]func(string, *REPLConfig) error
-	help     map[string]string
+	commands    map[string]func(string, *REPLConfig) error
+	help        map[string]string
+	aliases     map[string]string                 // Maps an alias to the command line it stands for.
+	arities     map[string]arity                  // Argument counts of commands added with AddCommandN.
+	notFound    func(payload string, w io.Writer) // Called on unknown commands.
+	formatError func(err error) string            // Formats errors returned by commands.
+	echo        bool                              // Whether RunChan echoes each payload.
+}
+
+// The number of arguments a command takes; a negative max means there's no limit.
+type arity struct {
+	min int
+	max int
+}
+
+// accepts returns whether n arguments are allowed.
+func (a arity) accepts(n int) bool {
+	return n >= a.min && (a.max < 0 || n <= a.max)
+}
+
+// REPLOption customizes a REPL built by NewRepl or CombineRepls.
+type REPLOption func(*REPL)
+
+// WithNotFoundHandler sets the function called when a command isn't recognized.
+func WithNotFoundHandler(notFound func(payload string, w io.Writer)) REPLOption {
+	return func(r *REPL) {
+		r.notFound = notFound
+	}
+}
+
+// WithErrorFormatter sets how errors returned by commands are written out.
+func WithErrorFormatter(formatError func(err error) string) REPLOption {
+	return func(r *REPL) {
+		r.formatError = formatError
+	}
+}
+
+// WithoutEcho stops RunChan from echoing each payload it receives.
+func WithoutEcho() REPLOption {
+	return func(r *REPL) {
+		r.echo = false
+	}
 }
 
 // REPL Config struct.
 type REPLConfig struct {
 	writer   io.Writer
 	clientId uuid.UUID
+	format   OutputFormat // How commands render results; set with .format.
+	history  history      // Recent commands, for .history and .!<n>.
 }
 
-// Get writer.
+// Get writer, which carries the session's output format; see GetFormat.
 func (replConfig *REPLConfig) GetWriter() io.Writer {
-	return replConfig.writer
+	return &FormatWriter{Writer: replConfig.writer, format: replConfig.format}
+}
+
+// Printf formats according to a format specifier and writes to this client. A nil config
+// prints to stdout.
+func (replConfig *REPLConfig) Printf(format string, args ...interface{}) {
+	io.WriteString(replConfig.output(), fmt.Sprintf(format, args...))
+}
+
+// Println formats its arguments as fmt.Println does and writes them to this client. A nil
+// config prints to stdout.
+func (replConfig *REPLConfig) Println(args ...interface{}) {
+	io.WriteString(replConfig.output(), fmt.Sprintln(args...))
+}
+
+// output returns where Printf and Println write.
+func (replConfig *REPLConfig) output() io.Writer {
+	if replConfig == nil {
+		return os.Stdout
+	}
+	return replConfig.GetWriter()
+}
+
+// Get the output format.
+func (replConfig *REPLConfig) GetFormat() OutputFormat {
+	return replConfig.format
+}
+
+// Set the output format.
+func (replConfig *REPLConfig) SetFormat(format OutputFormat) {
+	replConfig.format = format
 }
 
 // Get address.
@@ -36,9 +111,24 @@ func (replConfig *REPLConfig) GetAddr() uuid.UUID {
 }
 
 // Construct an empty REPL.
-func NewRepl() *REPL {
-	return &REPL{make(map[string]func(string, *REPLConfig) error),
-		make(map[string]string)}
+func NewRepl(opts ...REPLOption) *REPL {
+	r := &REPL{
+		commands: make(map[string]func(string, *REPLConfig) error),
+		help:     make(map[string]string),
+		aliases:  make(map[string]string),
+		arities:  make(map[string]arity),
+		notFound: func(payload string, w io.Writer) {
+			io.WriteString(w, "command not found\n")
+		},
+		formatError: func(err error) string {
+			return fmt.Sprintf("%v\n", err)
+		},
+		echo: true,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 // helper function for contain
@@ -52,23 +142,34 @@ func contains(s []string, str string) bool {
 	return false
 }
 
-// Combines a slice of REPLs.
-func CombineRepls(repls []*REPL) (*REPL, error) {
+// Combines a slice of REPLs; errors if two of them define the same command.
+func CombineRepls(repls []*REPL, opts ...REPLOption) (*REPL, error) {
 	if len(repls) == 0 {
-		return NewRepl(), nil
+		return NewRepl(opts...), nil
 	} else {
-		newrepl := NewRepl()
+		newrepl := NewRepl(opts...)
 		var listexist []string
 		for i := 0; i < len(repls); i++ {
 			for key, value := range repls[i].commands {
 				if contains(listexist, key) {
-					return nil, errors.New("found overlapping")
+					return nil, fmt.Errorf("found overlapping command %s", key)
 				} else {
 					newrepl.AddCommand(key, value, repls[i].help[key])
+					if a, exists := repls[i].arities[key]; exists {
+						newrepl.arities[key] = a
+					}
 					listexist = append(listexist, key)
 				}
 			}
 		}
+		// Add aliases once every command they might point at exists.
+		for i := 0; i < len(repls); i++ {
+			for alias, target := range repls[i].aliases {
+				if err := newrepl.AddAlias(alias, target); err != nil {
+					return nil, err
+				}
+			}
+		}
 		return newrepl, nil
 	}
 }
@@ -83,22 +184,150 @@ func (r *REPL) GetHelp() map[string]string {
 	return r.help
 }
 
-// Add a command, along with its help string, to the set of commands.
+// Get aliases.
+func (r *REPL) GetAliases() map[string]string {
+	return r.aliases
+}
+
+// Add a command, along with its help string, to the set of commands. Triggers starting
+// with a '.' are reserved for meta-commands; AddCommand panics if given one.
 func (r *REPL) AddCommand(trigger string, action func(string, *REPLConfig) error, help string) {
+	if strings.HasPrefix(trigger, ".") {
+		panic(fmt.Sprintf("command trigger %s is reserved for meta-commands", trigger))
+	}
 	r.commands[trigger] = action
 	r.help[trigger] = help
 }
 
+// AddCommandN adds a command that takes between minArgs and maxArgs arguments, not counting
+// the trigger; a negative maxArgs means there's no upper limit. The REPL checks the count
+// before calling action, and writes a usage error with the help string if it is wrong.
+func (r *REPL) AddCommandN(trigger string, minArgs int, maxArgs int, action func(string, *REPLConfig) error, help string) {
+	r.AddCommand(trigger, action, help)
+	r.arities[trigger] = arity{min: minArgs, max: maxArgs}
+}
+
+// AddAlias makes alias a shorthand for target, which starts with an existing command's trigger
+// and may go on with leading arguments (e.g. "transaction begin"). Arguments given after the
+// alias are appended to target.
+func (r *REPL) AddAlias(alias string, target string) error {
+	targetFields := strings.Fields(target)
+	if len(strings.Fields(alias)) != 1 || alias != strings.TrimSpace(alias) {
+		return fmt.Errorf("invalid alias %q", alias)
+	}
+	if len(targetFields) == 0 {
+		return fmt.Errorf("alias %s has no target", alias)
+	}
+	if _, exists := r.commands[targetFields[0]]; !exists {
+		return fmt.Errorf("alias %s points at unknown command %s", alias, targetFields[0])
+	}
+	if _, exists := r.commands[alias]; exists {
+		return fmt.Errorf("alias %s would shadow a command", alias)
+	}
+	target = strings.Join(targetFields, " ")
+	if existing, exists := r.aliases[alias]; exists && existing != target {
+		return fmt.Errorf("alias %s already points at %s", alias, existing)
+	}
+	r.aliases[alias] = target
+	return nil
+}
+
+// runCommand runs the command matching the trigger, writing out any error.
+func (r *REPL) runCommand(trigger string, payload string, replConfig *REPLConfig) {
+	replConfig.history.record(payload)
+	// Expand aliases into the command line they stand for.
+	if target, isAlias := r.aliases[trigger]; isAlias {
+		payload = strings.TrimLeftFunc(payload, unicode.IsSpace)
+		payload = target + payload[len(strings.Fields(payload)[0]):]
+		trigger = strings.Fields(target)[0]
+	}
+	if command, exists := r.commands[trigger]; exists {
+		if a, exists := r.arities[trigger]; exists {
+			fields, err := Tokenize(payload)
+			if err == nil && !a.accepts(len(fields)-1) {
+				io.WriteString(replConfig.writer, r.formatError(
+					fmt.Errorf("wrong number of arguments to %s: %s", trigger, r.help[trigger])))
+				return
+			}
+		}
+		// Call a hardcoded function.
+		err := command(payload, replConfig)
+		if err != nil {
+			io.WriteString(replConfig.writer, r.formatError(err))
+		}
+	} else {
+		r.notFound(payload, replConfig.writer)
+	}
+}
+
+// runMetaCommand runs the meta-command matching the trigger, if any; returns false if there is none.
+func (r *REPL) runMetaCommand(trigger string, payload string, replConfig *REPLConfig) bool {
+	w := replConfig.writer
+	fields := strings.Fields(payload)
+	switch trigger {
+	case ".help":
+		io.WriteString(w, r.HelpString())
+	case ".set":
+		// Usage: .set <name> <value>
+		if len(fields) != 3 {
+			io.WriteString(w, r.formatError(errors.New("usage: .set <name> <value>")))
+		} else if err := config.SetSetting(fields[1], fields[2]); err != nil {
+			io.WriteString(w, r.formatError(err))
+		} else {
+			value, _ := config.ShowSetting(fields[1])
+			io.WriteString(w, fmt.Sprintf("%s = %s\n", fields[1], value))
+		}
+	case ".show":
+		// Usage: .show [name]
+		names := fields[1:]
+		if len(names) == 0 {
+			names = config.SettingNames()
+		}
+		for _, name := range names {
+			value, err := config.ShowSetting(name)
+			if err != nil {
+				io.WriteString(w, r.formatError(err))
+				continue
+			}
+			io.WriteString(w, fmt.Sprintf("%s = %s (%s)\n", name, value, config.SettingHelp(name)))
+		}
+	case ".format":
+		// Usage: .format [text|json]
+		if len(fields) > 2 {
+			io.WriteString(w, r.formatError(errors.New("usage: .format [text|json]")))
+		} else if len(fields) == 1 {
+			io.WriteString(w, fmt.Sprintf("format = %s\n", replConfig.format))
+		} else if format, err := ParseFormat(fields[1]); err != nil {
+			io.WriteString(w, r.formatError(err))
+		} else {
+			replConfig.SetFormat(format)
+			io.WriteString(w, fmt.Sprintf("format = %s\n", format))
+		}
+	case ".history":
+		replConfig.history.write(w)
+	default:
+		if !strings.HasPrefix(trigger, ".!") {
+			return false
+		}
+		// Usage: .!<n>
+		r.rerun(trigger, replConfig)
+	}
+	return true
+}
+
 // Return all REPL usage information as a string.
 func (r *REPL) HelpString() string {
 	var sb strings.Builder
 	for k, v := range r.help {
 		sb.WriteString(fmt.Sprintf("%s: %s\n", k, v))
 	}
+	for alias, target := range r.aliases {
+		sb.WriteString(fmt.Sprintf("%s: alias for %s\n", alias, target))
+	}
 	return sb.String()
 }
 
-// Run the REPL.
+// Run the REPL until EOF, or until the client sends .quit or .exit.
 func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 	// Get reader and writer; stdin and stdout if no conn.
 	var reader io.Reader
@@ -111,37 +340,37 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 		writer = c
 	}
 	scanner := bufio.NewScanner((reader))
-	replConfig := &REPLConfig{writer: writer, clientId: clientId}
+	replConfig := &REPLConfig{writer: writer, clientId: clientId, format: TEXT_FORMAT}
 	// Begin the repl loop!
 	/* SOLUTION {{{ */
 	io.WriteString(writer, prompt)
 	for scanner.Scan() {
 		payload := cleanInput(scanner.Text())
-		fields := strings.Fields(payload)
+		fields, err := Tokenize(payload)
+		if err != nil {
+			io.WriteString(writer, r.formatError(err))
+			io.WriteString(writer, prompt)
+			continue
+		}
 		if len(fields) == 0 {
 			io.WriteString(writer, prompt)
 			continue
 		}
 		trigger := cleanInput(fields[0])
+		// End the session on .quit or .exit, as on EOF.
+		if trigger == ".quit" || trigger == ".exit" {
+			break
+		}
 		// Check for a meta-command.
-		if trigger == ".help" {
-			io.WriteString(writer, r.HelpString())
+		if r.runMetaCommand(trigger, payload, replConfig) {
 			io.WriteString(writer, prompt)
 			continue
 		}
 		// Else, check user commands.
-		if command, exists := r.commands[trigger]; exists {
-			// Call a hardcoded function.
-			err := command(payload, replConfig)
-			if err != nil {
-				io.WriteString(writer, fmt.Sprintf("%v\n", err))
-			}
-		} else {
-			io.WriteString(writer, "command not found\n")
-		}
+		r.runCommand(trigger, payload, replConfig)
 		io.WriteString(writer, prompt)
 	}
-	// Print an additional line if we encountered an EOF character.
+	// Print an additional line if we encountered an EOF character, or were asked to quit.
 	io.WriteString(writer, "\n")
 	/* SOLUTION }}} */
 }
@@ -150,35 +379,33 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 func (r *REPL) RunChan(c chan string, clientId uuid.UUID, prompt string) {
 	// Get reader and writer; stdin and stdout if no conn.
 	writer := os.Stdout
-	replConfig := &REPLConfig{writer: writer, clientId: clientId}
+	replConfig := &REPLConfig{writer: writer, clientId: clientId, format: TEXT_FORMAT}
 	// Begin the repl loop!
 	io.WriteString(writer, prompt)
 	for payload := range c {
 		// Emit the payload for debugging purposes.
-		io.WriteString(writer, payload+"\n")
+		if r.echo {
+			io.WriteString(writer, payload+"\n")
+		}
 		// Parse the payload.
-		fields := strings.Fields(payload)
+		fields, err := Tokenize(payload)
+		if err != nil {
+			io.WriteString(writer, r.formatError(err))
+			io.WriteString(writer, prompt)
+			continue
+		}
 		if len(fields) == 0 {
 			io.WriteString(writer, prompt)
 			continue
 		}
 		trigger := cleanInput(fields[0])
 		// Check for a meta-command.
-		if trigger == ".help" {
-			io.WriteString(writer, r.HelpString())
+		if r.runMetaCommand(trigger, payload, replConfig) {
 			io.WriteString(writer, prompt)
 			continue
 		}
 		// Else, check user commands.
-		if command, exists := r.commands[trigger]; exists {
-			// Call a hardcoded function.
-			err := command(payload, replConfig)
-			if err != nil {
-				io.WriteString(writer, fmt.Sprintf("%v\n", err))
-			}
-		} else {
-			io.WriteString(writer, "command not found\n")
-		}
+		r.runCommand(trigger, payload, replConfig)
 		io.WriteString(writer, prompt)
 	}
 	// Print an additional line if we encountered an EOF character.
@@ -0,0 +1,46 @@
+package repl
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits a command line into arguments at whitespace. Text between double quotes
+// is one argument, spaces and all, and a backslash includes the next character as is, so
+// \" is a literal quote. Errors on an unclosed quote or a trailing backslash.
+func Tokenize(line string) ([]string, error) {
+	tokens := make([]string, 0)
+	var token strings.Builder
+	inToken, inQuotes, escaped := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			token.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			inToken, escaped = true, true
+		case c == '"':
+			inToken, inQuotes = true, !inQuotes
+		case unicode.IsSpace(c) && !inQuotes:
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			inToken = true
+			token.WriteRune(c)
+		}
+	}
+	if escaped {
+		return nil, errors.New("unfinished escape sequence")
+	}
+	if inQuotes {
+		return nil, errors.New("unbalanced quotes")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
@@ -1,11 +1,20 @@
 package test
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // Set to some other value
@@ -27,9 +36,29 @@ func TestBTreeTA(t *testing.T) {
 	t.Run("TestBTreeDeleteTen", testBTreeDeleteTen)
 	t.Run("TestBTreeUpdateTenNoWrite", testBTreeUpdateTenNoWrite)
 	t.Run("TestBTreeUpdateTen", testBTreeUpdateTen)
+	t.Run("TestBTreeRightBiasedSplit", testBTreeRightBiasedSplit)
+	t.Run("TestBTreeCursorNoSibling", testBTreeCursorNoSibling)
+	t.Run("TestBTreeRangeCursorHalfOpen", testBTreeRangeCursorHalfOpen)
+	t.Run("TestBTreeFindRangeInclusive", testBTreeFindRangeInclusive)
+	t.Run("TestBTreeFindRangeEx", testBTreeFindRangeEx)
+	t.Run("TestBTreeStepBackward", testBTreeStepBackward)
+	t.Run("TestBTreeDeleteShrinks", func(t *testing.T) { testBTreeDeleteShrinks(t, 1000, 950) })
+	t.Run("TestBTreeDeleteShrinksDeep", func(t *testing.T) { testBTreeDeleteShrinks(t, 30000, 29500) })
+	t.Run("TestBTreeSplitFullLeaf", testBTreeSplitFullLeaf)
+	t.Run("TestBTreeBulkLoad", testBTreeBulkLoad)
+	t.Run("TestBTreeBulkLoadInvalid", testBTreeBulkLoadInvalid)
+	t.Run("TestBTreeStrictHealthy", testBTreeStrictHealthy)
+	t.Run("TestBTreeStrictInvariants", testBTreeStrictInvariants)
+	t.Run("TestBTreeDeleteSeparators", testBTreeDeleteSeparators)
+	t.Run("TestBTreeMultiFiveValues", testBTreeMultiFiveValues)
+	t.Run("TestBTreeMultiLongRuns", testBTreeMultiLongRuns)
+	t.Run("TestBTreeMultiScanOrder", testBTreeMultiScanOrder)
+	t.Run("TestBTreePublicAPIRootSplit", testBTreePublicAPIRootSplit)
+	t.Run("TestBTreeConcurrentScan", testBTreeConcurrentScan)
+	t.Run("TestBTreeAggregates", testBTreeAggregates)
+	t.Run("TestBTreeTableEndEmpty", testBTreeTableEndEmpty)
 }
 
-
 func testBTreeInsertTenNoWrite(t *testing.T) {
 	dbName := getTempBTreeDB(t)
 	defer os.Remove(dbName)
@@ -353,3 +382,1470 @@ func testBTreeUpdateTen(t *testing.T) {
 	}
 	index.Close()
 }
+
+// insertAscending fills a fresh table with ascending keys and returns its page count.
+func insertAscending(t *testing.T, policy btree.SplitPolicy, n int64) int64 {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTableWithPolicy(dbName, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < n; i++ {
+		err = index.Insert(i, i%btree_salt)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// Every entry should still be reachable.
+	for i := int64(0); i < n; i++ {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if entry.GetValue() != i%btree_salt {
+			t.Error("Entry found has the wrong value")
+		}
+	}
+	return index.GetPager().GetNumPages()
+}
+
+func testBTreeRightBiasedSplit(t *testing.T) {
+	n := int64(10000)
+	medianPages := insertAscending(t, btree.MEDIAN_SPLIT, n)
+	biasedPages := insertAscending(t, btree.RIGHT_BIASED_SPLIT, n)
+	// Median splits leave ascending leaves half full; right-biased ones leave them full.
+	if biasedPages*10 > medianPages*7 {
+		t.Errorf("Right-biased split used %d pages, median split used %d", biasedPages, medianPages)
+	}
+}
+
+func testBTreeCursorNoSibling(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// A single leaf with no right sibling.
+	for i := int64(0); i < 3; i++ {
+		index.Insert(i, i)
+	}
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 2; i++ {
+		if cursor.StepForward() {
+			t.Fatal("Cursor reached the end too early")
+		}
+	}
+	// Stepping off the last leaf should end the cursor rather than fetch a sibling.
+	if !cursor.StepForward() || !cursor.IsEnd() {
+		t.Error("Cursor should be at the end after the last entry")
+	}
+	if !cursor.StepForward() {
+		t.Error("Stepping past the end should stay at the end")
+	}
+	if _, err := cursor.GetEntry(); err == nil {
+		t.Error("GetEntry past the end should fail")
+	}
+	// Finding past the last key lands at the end too.
+	cursor, err = index.TableFind(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.IsEnd() {
+		t.Error("TableFind past the last key should be at the end")
+	}
+}
+
+// The range cursor includes its start key but not its end key.
+func testBTreeRangeCursorHalfOpen(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even keys only, across many leaves.
+	for i := int64(0); i < 20000; i += 2 {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Bounds that aren't keys; [1001, 15001) holds 1002, 1004, ..., 15000.
+	cursor, err := index.TableRangeCursor(1001, 15001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := int64(1002)
+	for !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetKey() != expected {
+			t.Fatalf("Expected key %v, got %v", expected, entry.GetKey())
+		}
+		expected += 2
+		cursor.StepForward()
+	}
+	if expected != 15002 {
+		t.Fatalf("Range ended before key %v, expected it to end before 15002", expected)
+	}
+	if !cursor.StepForward() {
+		t.Error("Stepping past the end should stay at the end")
+	}
+	if _, err := cursor.GetEntry(); err == nil {
+		t.Error("GetEntry past the end should fail")
+	}
+	// Empty ranges, inside and past the table, start at the end.
+	for _, bounds := range [][2]int64{{1001, 1002}, {30000, 40000}, {500, 100}} {
+		cursor, err = index.TableRangeCursor(bounds[0], bounds[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cursor.IsEnd() {
+			t.Errorf("Range %v should be empty", bounds)
+		}
+	}
+	// Bounds that are keys: [1000, 1004) holds 1000 and 1002, but not 1004.
+	cursor, err = index.TableRangeCursor(1000, 1004)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]int64, 0)
+	for !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, entry.GetKey())
+		cursor.StepForward()
+	}
+	if len(keys) != 2 || keys[0] != 1000 || keys[1] != 1002 {
+		t.Errorf("Expected keys [1000 1002], got %v", keys)
+	}
+	// The materialized range includes both bounds.
+	entries, err := index.TableFindRange(1001, 15001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7000 {
+		t.Errorf("Expected 7000 entries, got %v", len(entries))
+	}
+	if entries, err = index.TableFindRange(1000, 1004); err != nil || len(entries) != 3 {
+		t.Errorf("Expected 3 entries in [1000, 1004], got %v (%v)", len(entries), err)
+	}
+	// No pages may be left pinned.
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeFindRangeInclusive(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even keys only, across many leaves.
+	for i := int64(0); i < 20000; i += 2 {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRange := func(startKey int64, endKey int64, first int64, last int64) {
+		entries, err := index.TableFindRange(startKey, endKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := first
+		for _, entry := range entries {
+			if entry.GetKey() != expected || entry.GetValue() != expected%btree_salt {
+				t.Fatalf("Range [%v, %v]: expected key %v, got %v", startKey, endKey, expected, entry.GetKey())
+			}
+			expected += 2
+		}
+		if expected != last+2 {
+			t.Errorf("Range [%v, %v]: ended before key %v, expected it to end after %v", startKey, endKey, expected, last)
+		}
+	}
+	// Both ends are included.
+	checkRange(1000, 15000, 1000, 15000)
+	// Ends beyond the largest key stop at the end of the table.
+	checkRange(19000, 50000, 19000, 19998)
+	checkRange(-5, math.MaxInt64, 0, 19998)
+	// Single-element ranges.
+	checkRange(500, 500, 500, 500)
+	checkRange(499, 501, 500, 500)
+	checkRange(19998, 19998, 19998, 19998)
+	// Empty ranges: between keys, past the table, and reversed.
+	checkRange(501, 501, 0, -2)
+	checkRange(30000, 40000, 0, -2)
+	checkRange(500, 100, 0, -2)
+	// No pages may be left pinned.
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeFindRangeEx(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even keys only, across many leaves.
+	for i := int64(0); i < 20000; i += 2 {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An empty range has first past last.
+	tests := []struct {
+		startKey, endKey         int64
+		includeStart, includeEnd bool
+		first, last              int64
+	}{
+		// Bounds that are keys.
+		{1000, 15000, true, true, 1000, 15000},
+		{1000, 15000, true, false, 1000, 14998},
+		{1000, 15000, false, true, 1002, 15000},
+		{1000, 15000, false, false, 1002, 14998},
+		// Bounds that aren't keys are unaffected by the flags.
+		{1001, 15001, true, true, 1002, 15000},
+		{1001, 15001, true, false, 1002, 15000},
+		{1001, 15001, false, true, 1002, 15000},
+		{1001, 15001, false, false, 1002, 15000},
+		// A single key is only found if both bounds include it.
+		{500, 500, true, true, 500, 500},
+		{500, 500, true, false, 0, -2},
+		{500, 500, false, true, 0, -2},
+		{500, 500, false, false, 0, -2},
+		// Adjacent keys.
+		{500, 502, true, false, 500, 500},
+		{500, 502, false, true, 502, 502},
+		{500, 502, false, false, 0, -2},
+		// Reversed ranges are empty.
+		{502, 500, true, true, 0, -2},
+		{502, 500, false, false, 0, -2},
+		// Extreme bounds.
+		{math.MinInt64, math.MaxInt64, false, false, 0, 19998},
+		{math.MaxInt64, math.MaxInt64, false, true, 0, -2},
+		{math.MinInt64, math.MinInt64, true, false, 0, -2},
+		{19998, math.MaxInt64, false, true, 0, -2},
+	}
+	for _, test := range tests {
+		entries, err := index.TableFindRangeEx(test.startKey, test.endKey, test.includeStart, test.includeEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := test.first
+		for _, entry := range entries {
+			if entry.GetKey() != expected || entry.GetValue() != expected%btree_salt {
+				t.Fatalf("%+v: expected key %v, got %v", test, expected, entry.GetKey())
+			}
+			expected += 2
+		}
+		if expected != test.last+2 {
+			t.Errorf("%+v: ended before key %v, expected it to end after %v", test, expected, test.last)
+		}
+	}
+	// No pages may be left pinned.
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// walkBothWays walks the table forward to the end, then backward to the start,
+// and checks the backward walk visits the forward walk's keys in reverse.
+func walkBothWays(t *testing.T, index *btree.BTreeIndex) []int64 {
+	c, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := c.(*btree.BTreeCursor)
+	forward := make([]int64, 0)
+	for !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		forward = append(forward, entry.GetKey())
+		cursor.StepForward()
+	}
+	for i := len(forward) - 1; i >= 0; i-- {
+		if cursor.StepBackward() {
+			t.Fatalf("Reached the start with %v entries left", i+1)
+		}
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetKey() != forward[i] {
+			t.Fatalf("Expected key %v stepping backward, got %v", forward[i], entry.GetKey())
+		}
+	}
+	// Stepping before the first entry stays on it.
+	if !cursor.StepBackward() {
+		t.Error("Stepping before the start should report the start")
+	}
+	if len(forward) > 0 {
+		entry, err := cursor.GetEntry()
+		if err != nil || entry.GetKey() != forward[0] {
+			t.Error("Stepping before the start should stay on the first entry")
+		}
+	}
+	return forward
+}
+
+func testBTreeStepBackward(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty table has nothing to step back to.
+	walkBothWays(t, index)
+	// Random order splits leaves in the middle of the chain.
+	n := 20000
+	for _, i := range rand.Perm(n) {
+		if err = index.Insert(int64(i), int64(i)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := walkBothWays(t, index); len(keys) != n {
+		t.Fatalf("Expected %v keys, got %v", n, len(keys))
+	}
+	// The sibling pointers survive closing the table.
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleted entries are skipped both ways.
+	index.SetDeleteMode(utils.TOMBSTONE_DELETE)
+	for i := 0; i < n; i++ {
+		if i%3 != 0 {
+			continue
+		}
+		if err = index.Delete(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := walkBothWays(t, index)
+	if len(keys) != n-(n+2)/3 {
+		t.Fatalf("Expected %v keys, got %v", n-(n+2)/3, len(keys))
+	}
+	for i, key := range keys {
+		if key%3 == 0 {
+			t.Fatalf("Deleted key %v was visited", key)
+		}
+		if i > 0 && key <= keys[i-1] {
+			t.Fatalf("Key %v came after %v", key, keys[i-1])
+		}
+	}
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeDeleteShrinks(t *testing.T, n int, numDeletes int) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range rand.Perm(n) {
+		if err = index.Insert(int64(i), int64(i)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fullHeight, err := index.GetHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delete keys in random order, so that nodes borrow as well as merge.
+	perm := rand.Perm(n)
+	deleted := make(map[int64]bool)
+	for _, i := range perm[:numDeletes] {
+		if err = index.Delete(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		deleted[int64(i)] = true
+	}
+	height, err := index.GetHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height >= fullHeight {
+		t.Errorf("Expected the tree to shrink below height %v, got %v", fullHeight, height)
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatalf("Tree is no longer a B+ tree: %v", err)
+	}
+	// The remaining keys are all still there, and the deleted ones are gone.
+	for i := int64(0); i < int64(n); i++ {
+		entry, err := index.Find(i)
+		if deleted[i] {
+			if err == nil {
+				t.Fatalf("Deleted key %v was found", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Key %v could not be found: %v", i, err)
+		}
+		if entry.GetValue() != i%btree_salt {
+			t.Fatalf("Key %v has the wrong value", i)
+		}
+	}
+	// The leaves are still linked both ways.
+	if keys := walkBothWays(t, index); len(keys) != n-numDeletes {
+		t.Fatalf("Expected %v keys, got %v", n-numDeletes, len(keys))
+	}
+	// Emptying the tree leaves a single leaf, which still takes inserts.
+	for _, i := range perm[numDeletes:] {
+		if err = index.Delete(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if height, err = index.GetHeight(); err != nil || height != 1 {
+		t.Errorf("Expected an empty tree to have height 1, got %v", height)
+	}
+	for i := int64(0); i < int64(n); i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := walkBothWays(t, index); len(keys) != n {
+		t.Fatalf("Expected %v keys after reinserting, got %v", n, len(keys))
+	}
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// leafSizes returns the number of entries in each leaf, as printed by the table.
+func leafSizes(index *btree.BTreeIndex) []int64 {
+	var sb strings.Builder
+	index.Print(&sb)
+	sizes := make([]int64, 0)
+	for _, line := range strings.Split(sb.String(), "\n") {
+		if !strings.Contains(line, " Leaf") {
+			continue
+		}
+		size, err := strconv.ParseInt(line[strings.LastIndex(line, " ")+1:], 10, 64)
+		if err == nil {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+func testBTreeSplitFullLeaf(t *testing.T) {
+	// Leaves of single-value tables hold an even number of entries, and of 6- and 7-value tables an odd number.
+	for _, numValues := range []int64{1, 6, 7} {
+		capacity := btree.EntriesPerLeafNode(numValues)
+		dbName := getTempBTreeDB(t)
+		defer os.Remove(dbName)
+		index, err := btree.OpenTableWithValues(dbName, numValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Fill the root leaf exactly.
+		for _, i := range rand.Perm(int(capacity)) {
+			if err = index.Insert(int64(i), int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sizes := leafSizes(index); len(sizes) != 1 || sizes[0] != capacity {
+			t.Fatalf("%v values: expected one full leaf of %v entries, got %v", numValues, capacity, sizes)
+		}
+		// One more entry splits it; both halves fit with room to spare.
+		if err = index.Insert(capacity, capacity); err != nil {
+			t.Fatal(err)
+		}
+		sizes := leafSizes(index)
+		if len(sizes) != 2 || sizes[0]+sizes[1] != capacity+1 {
+			t.Fatalf("%v values: expected two leaves holding %v entries, got %v", numValues, capacity+1, sizes)
+		}
+		for _, size := range sizes {
+			if size >= capacity || size < capacity/2 {
+				t.Errorf("%v values: leaf of %v entries is not about half of %v", numValues, size, capacity)
+			}
+		}
+		// The next insert into the left half doesn't split again.
+		if err = index.Insert(-1, -1); err != nil {
+			t.Fatal(err)
+		}
+		if sizes = leafSizes(index); len(sizes) != 2 {
+			t.Errorf("%v values: expected two leaves after another insert, got %v", numValues, sizes)
+		}
+		if err = index.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sortedEntries returns n entries with the keys 0, 2, 4, ..., each key's value derived from it.
+func sortedEntries(n int64) []utils.Entry {
+	entries := make([]utils.Entry, n)
+	for i := range entries {
+		entry := hash.HashEntry{}
+		entry.SetKey(int64(i) * 2)
+		entry.SetValue(int64(i) * 2 % btree_salt)
+		entries[i] = &entry
+	}
+	return entries
+}
+
+// bulkLoadTarget returns a filename that doesn't exist yet.
+func bulkLoadTarget(t *testing.T) string {
+	dbName := getTempBTreeDB(t)
+	os.Remove(dbName)
+	return dbName
+}
+
+func testBTreeBulkLoad(t *testing.T) {
+	capacity := btree.ENTRIES_PER_LEAF_NODE
+	// Empty, a single leaf, just past a leaf, and three levels.
+	for _, n := range []int64{0, 1, capacity, capacity + 1, 50000} {
+		dbName := bulkLoadTarget(t)
+		defer os.Remove(dbName)
+		entries := sortedEntries(n)
+		index, err := btree.BulkLoad(dbName, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = btree.IsBTreeStrict(index); err != nil {
+			t.Fatalf("%v entries: bulk loaded tree is not a B+ tree: %v", n, err)
+		}
+		for _, entry := range entries {
+			found, err := index.Find(entry.GetKey())
+			if err != nil {
+				t.Fatalf("%v entries: key %v could not be found: %v", n, entry.GetKey(), err)
+			}
+			if found.GetValue() != entry.GetValue() {
+				t.Fatalf("%v entries: key %v has the wrong value", n, entry.GetKey())
+			}
+		}
+		if _, err = index.Find(1); err == nil {
+			t.Fatalf("%v entries: found a key that was never loaded", n)
+		}
+		// The leaves are linked both ways.
+		if keys := walkBothWays(t, index); int64(len(keys)) != n {
+			t.Fatalf("%v entries: expected %v keys, got %v", n, n, len(keys))
+		}
+		// The tree takes inserts and deletes as usual, and survives reopening.
+		for i := int64(1); i < 2000; i += 2 {
+			if err = index.Insert(i, i%btree_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := int64(0); i < 2*n; i += 6 {
+			if err = index.Delete(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = index.Close(); err != nil {
+			t.Fatal(err)
+		}
+		index, err = btree.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 2*n || i < 2000; i++ {
+			_, err := index.Find(i)
+			present := (i%2 == 1 && i < 2000) || (i%2 == 0 && i < 2*n && i%6 != 0)
+			if present != (err == nil) {
+				t.Fatalf("%v entries: expected key %v to be present: %v", n, i, present)
+			}
+		}
+		if err = index.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Bulk loading packs the leaves more tightly than inserting one key at a time.
+	entries := sortedEntries(50000)
+	bulkName := bulkLoadTarget(t)
+	defer os.Remove(bulkName)
+	bulkIndex, err := btree.BulkLoad(bulkName, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bulkIndex.Close()
+	insertName := getTempBTreeDB(t)
+	defer os.Remove(insertName)
+	insertIndex, err := btree.OpenTable(insertName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insertIndex.Close()
+	for _, entry := range entries {
+		if err = insertIndex.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bulkIndex.GetPager().GetNumPages() >= insertIndex.GetPager().GetNumPages() {
+		t.Errorf("Expected bulk loading to use fewer than %v pages, used %v",
+			insertIndex.GetPager().GetNumPages(), bulkIndex.GetPager().GetNumPages())
+	}
+	// Entries keep all their values.
+	memory, err := btree.NewMemoryTable(btree.MEDIAN_SPLIT, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		if err = memory.InsertValues(i, []int64{i, -i, i * i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	multiEntries, err := memory.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory.Close()
+	multiName := bulkLoadTarget(t)
+	defer os.Remove(multiName)
+	multiIndex, err := btree.BulkLoad(multiName, multiEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multiIndex.Close()
+	if multiIndex.GetNumValues() != 3 {
+		t.Fatalf("Expected 3 values per entry, got %v", multiIndex.GetNumValues())
+	}
+	for i := int64(0); i < 1000; i++ {
+		entry, err := multiIndex.Find(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values := entry.Values(); values[0] != i || values[1] != -i || values[2] != i*i {
+			t.Fatalf("Key %v has the wrong values %v", i, values)
+		}
+	}
+}
+
+func testBTreeBulkLoadInvalid(t *testing.T) {
+	entries := sortedEntries(1000)
+	// Duplicate and unsorted keys are refused, without leaving a file behind.
+	duplicate := append(append([]utils.Entry{}, entries[:500]...), entries[499:]...)
+	unsorted := append(append([]utils.Entry{}, entries[500:]...), entries[:500]...)
+	for _, bad := range [][]utils.Entry{duplicate, unsorted} {
+		dbName := bulkLoadTarget(t)
+		if _, err := btree.BulkLoad(dbName, bad); err == nil {
+			t.Error("Expected bulk loading bad keys to fail")
+		}
+		if _, err := os.Stat(dbName); err == nil {
+			os.Remove(dbName)
+			t.Error("A failed bulk load left a file behind")
+		}
+	}
+	// An existing file is refused.
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	if _, err := btree.BulkLoad(dbName, entries); err == nil {
+		t.Error("Expected bulk loading over an existing file to fail")
+	}
+}
+
+func BenchmarkBTreeBulkLoad(b *testing.B) {
+	entries := sortedEntries(50000)
+	load := map[string]func(filename string) (*btree.BTreeIndex, error){
+		"bulk": func(filename string) (*btree.BTreeIndex, error) {
+			return btree.BulkLoad(filename, entries)
+		},
+		"insert": func(filename string) (*btree.BTreeIndex, error) {
+			index, err := btree.OpenTable(filename)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if err = index.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+					return nil, err
+				}
+			}
+			return index, nil
+		},
+	}
+	for _, name := range []string{"bulk", "insert"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tmpfile, err := ioutil.TempFile(".", "db-*")
+				if err != nil {
+					b.Fatal(err)
+				}
+				tmpfile.Close()
+				os.Remove(tmpfile.Name())
+				index, err := load[name](tmpfile.Name())
+				if err != nil {
+					b.Fatal(err)
+				}
+				index.Close()
+				os.Remove(tmpfile.Name())
+			}
+		})
+	}
+}
+
+// readPageVarint returns the varint at the given offset of the given page of the table.
+func readPageVarint(t *testing.T, index *btree.BTreeIndex, pn int64, offset int64) int64 {
+	page, err := index.GetPager().GetPage(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	value, _ := binary.Varint((*page.GetData())[offset:])
+	return value
+}
+
+// overwritePageVarint writes a varint at the given offset of the given page of the table.
+func overwritePageVarint(t *testing.T, index *btree.BTreeIndex, pn int64, offset int64, size int64, value int64) {
+	page, err := index.GetPager().GetPage(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	data := make([]byte, size)
+	binary.PutVarint(data, value)
+	page.Update(data, offset, size)
+}
+
+func testBTreeStrictHealthy(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatalf("Empty tree: %v", err)
+	}
+	// Through splits in random order, and through merges.
+	n := 30000
+	for _, i := range rand.Perm(n) {
+		if err = index.Insert(int64(i), int64(i)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatalf("After inserts: %v", err)
+	}
+	for _, i := range rand.Perm(n)[:n-n/10] {
+		if err = index.Delete(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatalf("After deletes: %v", err)
+	}
+}
+
+func testBTreeStrictInvariants(t *testing.T) {
+	// A bulk loaded tree of three levels: the root's first child is internal, and its first child a leaf.
+	child := func(index *btree.BTreeIndex, pn int64, i int64) int64 {
+		return readPageVarint(t, index, pn, btree.PNS_OFFSET+i*btree.PN_SIZE)
+	}
+	corruptions := []struct {
+		name    string
+		corrupt func(index *btree.BTreeIndex)
+		message string
+	}{
+		{"overfull leaf", func(index *btree.BTreeIndex) {
+			leaf := child(index, child(index, 0, 0), 0)
+			overwritePageVarint(t, index, leaf, btree.NUM_KEYS_OFFSET, btree.NUM_KEYS_SIZE, btree.ENTRIES_PER_LEAF_NODE+1)
+		}, fmt.Sprintf("holds %v entries", btree.ENTRIES_PER_LEAF_NODE+1)},
+		{"empty internal node", func(index *btree.BTreeIndex) {
+			overwritePageVarint(t, index, child(index, 0, 0), btree.NUM_KEYS_OFFSET, btree.NUM_KEYS_SIZE, 0)
+		}, "holds 0 keys"},
+		{"unsorted internal keys", func(index *btree.BTreeIndex) {
+			overwritePageVarint(t, index, child(index, 0, 0), btree.KEYS_OFFSET+btree.KEY_SIZE, btree.KEY_SIZE, -7)
+		}, "has key -7 after"},
+		{"unsorted leaf keys", func(index *btree.BTreeIndex) {
+			leaf := child(index, child(index, 0, 0), 0)
+			overwritePageVarint(t, index, leaf, btree.LEAF_NODE_HEADER_SIZE+btree.ENTRYSIZE, btree.KEY_SIZE, -1)
+		}, "has key -1 after 0"},
+		{"leaf key outside its parent's bounds", func(index *btree.BTreeIndex) {
+			leaf := child(index, child(index, 0, 0), 1)
+			overwritePageVarint(t, index, leaf, btree.LEAF_NODE_HEADER_SIZE, btree.KEY_SIZE, -5)
+		}, "has key -5 outside its bounds"},
+		{"leaves at different depths", func(index *btree.BTreeIndex) {
+			leaf := child(index, child(index, 0, 0), 0)
+			overwritePageVarint(t, index, 0, btree.PNS_OFFSET, btree.PN_SIZE, leaf)
+		}, "at depth 3, not 2"},
+		{"broken right sibling", func(index *btree.BTreeIndex) {
+			leaf := child(index, child(index, 0, 0), 0)
+			overwritePageVarint(t, index, leaf, btree.RIGHT_SIBLING_PN_OFFSET, btree.RIGHT_SIBLING_PN_SIZE, btree.NO_SIBLING_PN)
+		}, "points right to page -1"},
+		{"broken left sibling", func(index *btree.BTreeIndex) {
+			leaf := child(index, child(index, 0, 0), 1)
+			overwritePageVarint(t, index, leaf, btree.LEFT_SIBLING_PN_OFFSET, btree.LEFT_SIBLING_PN_SIZE, btree.NO_SIBLING_PN)
+		}, "points left to page -1"},
+		{"cycle", func(index *btree.BTreeIndex) {
+			internal := child(index, 0, 0)
+			overwritePageVarint(t, index, internal, btree.PNS_OFFSET+btree.PN_SIZE, btree.PN_SIZE, internal)
+		}, "reachable twice"},
+	}
+	for _, corruption := range corruptions {
+		dbName := bulkLoadTarget(t)
+		defer os.Remove(dbName)
+		index, err := btree.BulkLoad(dbName, sortedEntries(50000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height, err := index.GetHeight(); err != nil || height != 3 {
+			t.Fatalf("%s: expected a tree of height 3, got %v", corruption.name, height)
+		}
+		if err = btree.IsBTreeStrict(index); err != nil {
+			t.Fatalf("%s: expected a valid tree before corrupting it, got %v", corruption.name, err)
+		}
+		corruption.corrupt(index)
+		err = btree.IsBTreeStrict(index)
+		if err == nil || !strings.Contains(err.Error(), corruption.message) {
+			t.Fatalf("%s: expected an error containing %q, got %v", corruption.name, corruption.message, err)
+		}
+		index.Close()
+	}
+}
+
+// separatorKeys returns the keys stored in the internal nodes of the subtree rooted at page pn.
+func separatorKeys(t *testing.T, index *btree.BTreeIndex, pn int64, height int64) []int64 {
+	if height == 1 {
+		return nil
+	}
+	numKeys := readPageVarint(t, index, pn, btree.NUM_KEYS_OFFSET)
+	keys := make([]int64, 0)
+	for i := int64(0); i <= numKeys; i++ {
+		if i < numKeys {
+			keys = append(keys, readPageVarint(t, index, pn, btree.KEYS_OFFSET+i*btree.KEY_SIZE))
+		}
+		childPN := readPageVarint(t, index, pn, btree.PNS_OFFSET+i*btree.PN_SIZE)
+		keys = append(keys, separatorKeys(t, index, childPN, height-1)...)
+	}
+	return keys
+}
+
+func testBTreeDeleteSeparators(t *testing.T) {
+	dbName := bulkLoadTarget(t)
+	defer os.Remove(dbName)
+	n := int64(50000)
+	index, err := btree.BulkLoad(dbName, sortedEntries(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	height, err := index.GetHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	separators := separatorKeys(t, index, 0, height)
+	if len(separators) == 0 {
+		t.Fatal("Expected the tree to have internal nodes")
+	}
+	// Delete exactly the keys the internal nodes route by.
+	deleted := make(map[int64]bool)
+	for _, key := range separators {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		deleted[key] = true
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+	// Every other key is still found, and the deleted ones and their neighbours route correctly.
+	for i := int64(0); i < 2*n; i += 2 {
+		_, err := index.Find(i)
+		if deleted[i] != (err != nil) {
+			t.Fatalf("Key %v: deleted %v, but Find returned %v", i, deleted[i], err)
+		}
+		if _, err = index.Find(i + 1); err == nil {
+			t.Fatalf("Found key %v, which was never inserted", i+1)
+		}
+	}
+	// Reinserting a separator's key puts it back where lookups and cursors find it.
+	for _, key := range separators {
+		if err = index.Insert(key, -key); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := index.Find(key)
+		if err != nil || entry.GetValue() != -key {
+			t.Fatalf("Reinserted key %v could not be found", key)
+		}
+		cursor, err := index.TableFind(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, err = cursor.GetEntry(); err != nil || entry.GetKey() != key {
+			t.Fatalf("Cursor for reinserted key %v points elsewhere", key)
+		}
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeMultiFiveValues(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTableMulti(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Four more values under one key, out of order; only an exact repeat is a duplicate.
+	for _, value := range []int64{504, 501, 503, 502} {
+		if err = index.Insert(50, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.Insert(50, 503); err == nil {
+		t.Error("Inserting the same key and value twice should fail")
+	}
+	if err = index.Update(50, 7); err == nil {
+		t.Error("Updating a key that may repeat should fail")
+	}
+	checkAll := func(key int64, expected []int64) {
+		values, err := index.GetAll(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(values) != fmt.Sprint(expected) {
+			t.Fatalf("Key %v: expected values %v, got %v", key, expected, values)
+		}
+	}
+	checkAll(50, []int64{50, 501, 502, 503, 504})
+	checkAll(49, []int64{49})
+	if _, err = index.GetAll(100); err == nil {
+		t.Error("GetAll of a missing key should fail")
+	}
+	// Lookups and cursors land on the first of the run.
+	if entry, err := index.Find(50); err != nil || entry.GetValue() != 50 {
+		t.Errorf("Expected Find to return the first entry of the run, got %v, %v", entry, err)
+	}
+	cursor, err := index.TableFind(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != 50 || entry.GetValue() != 50 {
+		t.Errorf("Expected TableFind to point at the first entry of the run, got %v, %v", entry, err)
+	}
+	// Range scans return the whole run.
+	entries, err := index.TableFindRange(49, 51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Errorf("Expected 7 entries in [49, 51], got %v", len(entries))
+	}
+	// The mode isn't persisted, but the entries are.
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = btree.OpenTableMulti(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkAll(50, []int64{50, 501, 502, 503, 504})
+	// Deleting the key removes every entry it holds.
+	if err = index.Delete(50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = index.GetAll(50); err == nil {
+		t.Error("Deleted key should have no values left")
+	}
+	checkAll(51, []int64{51})
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeMultiLongRuns(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTableMulti(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Each key's run spans several leaves, so internal nodes repeat keys.
+	numKeys, runLength := 10, 1000
+	for _, i := range rand.Perm(numKeys * runLength) {
+		if err = index.Insert(int64(i%numKeys), int64(i/numKeys)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+	checkRun := func(key int64) {
+		values, err := index.GetAll(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != runLength {
+			t.Fatalf("Key %v: expected %v values, got %v", key, runLength, len(values))
+		}
+		for i, value := range values {
+			if value != int64(i) {
+				t.Fatalf("Key %v: expected value %v at %v, got %v", key, i, i, value)
+			}
+		}
+		cursor, err := index.TableFind(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != key || entry.GetValue() != 0 {
+			t.Fatalf("Key %v: expected TableFind to point at the first entry of the run, got %v, %v", key, entry, err)
+		}
+	}
+	for key := int64(0); key < int64(numKeys); key++ {
+		checkRun(key)
+	}
+	entries, err := index.TableFindRange(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3*runLength {
+		t.Errorf("Expected %v entries in [3, 5], got %v", 3*runLength, len(entries))
+	}
+	// Deleting whole runs merges the leaves they spanned.
+	for key := int64(0); key < int64(numKeys); key += 2 {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+	for key := int64(0); key < int64(numKeys); key++ {
+		if key%2 == 0 {
+			if _, err = index.GetAll(key); err == nil {
+				t.Fatalf("Deleted key %v still has values", key)
+			}
+			continue
+		}
+		checkRun(key)
+	}
+	if entries, err = index.TableFindRange(3, 5); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2*runLength {
+		t.Errorf("Expected %v entries in [3, 5], got %v", 2*runLength, len(entries))
+	}
+}
+
+// Range scans over repeated keys return them by value ascending, whatever order they were inserted in.
+func testBTreeMultiScanOrder(t *testing.T) {
+	numKeys, runLength := 5, 300
+	scan := func(order []int) []utils.Entry {
+		dbName := getTempBTreeDB(t)
+		defer os.Remove(dbName)
+		index, err := btree.OpenTableMulti(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for _, i := range order {
+			if err = index.Insert(int64(i%numKeys), int64(i/numKeys)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := index.TableFindRange(1, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	ascending := make([]int, numKeys*runLength)
+	descending := make([]int, numKeys*runLength)
+	for i := range ascending {
+		ascending[i] = i
+		descending[len(descending)-1-i] = i
+	}
+	expected := scan(ascending)
+	if len(expected) != 3*runLength {
+		t.Fatalf("Expected %v entries in [1, 3], got %v", 3*runLength, len(expected))
+	}
+	for i, entry := range expected {
+		key, value := int64(1+i/runLength), int64(i%runLength)
+		if entry.GetKey() != key || entry.GetValue() != value {
+			t.Fatalf("Expected entry %v to be (%v, %v), got (%v, %v)",
+				i, key, value, entry.GetKey(), entry.GetValue())
+		}
+	}
+	for _, order := range [][]int{descending, rand.Perm(numKeys * runLength)} {
+		entries := scan(order)
+		if len(entries) != len(expected) {
+			t.Fatalf("Expected %v entries in [1, 3], got %v", len(expected), len(entries))
+		}
+		for i := range entries {
+			if entries[i].GetKey() != expected[i].GetKey() || entries[i].GetValue() != expected[i].GetValue() {
+				t.Fatalf("Scan order depends on insertion order at entry %v: (%v, %v) vs (%v, %v)", i,
+					entries[i].GetKey(), entries[i].GetValue(), expected[i].GetKey(), expected[i].GetValue())
+			}
+		}
+	}
+}
+
+func testBTreePublicAPIRootSplit(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkHeight := func(expected int64) {
+		height, err := index.GetHeight()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != expected {
+			t.Fatalf("Expected height %v, got %v", expected, height)
+		}
+	}
+	checkFind := func(key int64, value int64) {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Fatalf("Key %v not found: %v", key, err)
+		}
+		if entry.GetKey() != key || entry.GetValue() != value {
+			t.Fatalf("Key %v found as (%v, %v), expected value %v", key, entry.GetKey(), entry.GetValue(), value)
+		}
+	}
+	// Fill the root leaf; the next insert splits it and grows a new root.
+	capacity := btree.EntriesPerLeafNode(1)
+	for i := int64(0); i <= capacity; i++ {
+		if i == capacity {
+			checkHeight(1)
+		}
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+		checkFind(i, i)
+	}
+	checkHeight(2)
+	for i := int64(0); i <= capacity; i++ {
+		checkFind(i, i)
+	}
+	// Errors from below the root reach the caller.
+	if err = index.Insert(capacity, 0); err == nil {
+		t.Error("Inserting a duplicate key should fail")
+	}
+	if err = index.Update(capacity+1, 0); err == nil {
+		t.Error("Updating a missing key should fail")
+	}
+	if err = index.Delete(capacity + 1); err == nil {
+		t.Error("Deleting a missing key should fail")
+	}
+	for i := int64(0); i <= capacity; i++ {
+		if err = index.Update(i, -i); err != nil {
+			t.Fatal(err)
+		}
+		checkFind(i, -i)
+	}
+	// Deleting shrinks the tree back to a single leaf.
+	for i := int64(0); i <= capacity; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = index.Find(i); err == nil {
+			t.Fatalf("Deleted key %v is still found", i)
+		}
+		if i < capacity {
+			checkFind(i+1, -(i + 1))
+		}
+	}
+	checkHeight(1)
+	if err = index.Delete(0); err == nil {
+		t.Error("Deleting a key twice should fail")
+	}
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scanOnce walks the whole table forward, or backward from the end, checking that keys come
+// in order, that each entry is read whole, and that every even key is seen.
+func scanOnce(index *btree.BTreeIndex, forward bool, numEven int64) error {
+	var c utils.Cursor
+	var err error
+	if forward {
+		c, err = index.TableStart()
+	} else {
+		c, err = index.TableEnd()
+	}
+	if err != nil {
+		return err
+	}
+	cursor := c.(*btree.BTreeCursor)
+	var evens int64
+	var prev int64
+	for i := 0; !cursor.IsEnd(); i++ {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			return err
+		}
+		key := entry.GetKey()
+		if entry.GetValue() != -key {
+			return fmt.Errorf("torn read: key %v has value %v", key, entry.GetValue())
+		}
+		if i > 0 && (forward && key <= prev || !forward && key >= prev) {
+			return fmt.Errorf("scan returned key %v after %v", key, prev)
+		}
+		if key%2 == 0 {
+			evens++
+		}
+		prev = key
+		if forward && cursor.StepForward() || !forward && cursor.StepBackward() {
+			break
+		}
+	}
+	if evens != numEven {
+		return fmt.Errorf("scan saw %v of the %v even keys", evens, numEven)
+	}
+	return nil
+}
+
+func testBTreeConcurrentScan(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Even keys stay put while the writer inserts and deletes odd keys around them,
+	// splitting and merging the leaves that readers are scanning.
+	n := 4000
+	for i := int64(0); i < int64(2*n); i += 2 {
+		if err = index.Insert(i, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One reader scans forward, the other backward.
+	var wg sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func(forward bool) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := scanOnce(index, forward, int64(n)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(r%2 == 0)
+	}
+	for _, i := range rand.Perm(n) {
+		key := int64(2*i + 1)
+		if err = index.Insert(key, -key); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, i := range rand.Perm(n) {
+		if err = index.Delete(int64(2*i + 1)); err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+	if err = btree.IsBTreeStrict(index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeAggregates(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	check := func(count int64, sum int64, minKey int64, maxKey int64) {
+		if got, err := index.Count(); err != nil || got != count {
+			t.Fatalf("Expected count %v, got %v, %v", count, got, err)
+		}
+		if got, err := index.SumValues(); err != nil || got != sum {
+			t.Fatalf("Expected sum %v, got %v, %v", sum, got, err)
+		}
+		if count == 0 {
+			if _, err := index.MinKey(); err == nil {
+				t.Fatal("MinKey of an empty table should fail")
+			}
+			if _, err := index.MaxKey(); err == nil {
+				t.Fatal("MaxKey of an empty table should fail")
+			}
+			return
+		}
+		if got, err := index.MinKey(); err != nil || got != minKey {
+			t.Fatalf("Expected min key %v, got %v, %v", minKey, got, err)
+		}
+		if got, err := index.MaxKey(); err != nil || got != maxKey {
+			t.Fatalf("Expected max key %v, got %v, %v", maxKey, got, err)
+		}
+	}
+	check(0, 0, 0, 0)
+	// Keys run from -n/2 to n/2-1, each with value 3*key.
+	n := int64(5000)
+	count, sum := int64(0), int64(0)
+	for i, perm := range rand.Perm(int(n)) {
+		key := int64(perm) - n/2
+		if err = index.Insert(key, 3*key); err != nil {
+			t.Fatal(err)
+		}
+		count++
+		sum += 3 * key
+		if i%1000 == 999 {
+			if got, err := index.Count(); err != nil || got != count {
+				t.Fatalf("Expected count %v, got %v, %v", count, got, err)
+			}
+		}
+	}
+	check(n, sum, -n/2, n/2-1)
+	// Deleting the smallest and largest keys moves the bounds.
+	for _, key := range []int64{-n / 2, n/2 - 1} {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		sum -= 3 * key
+	}
+	check(n-2, sum, -n/2+1, n/2-2)
+	// Entries deleted in place don't count, even across several trailing leaves.
+	index.SetDeleteMode(utils.TOMBSTONE_DELETE)
+	for key := n/2 - 2; key >= n/2-600; key-- {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		sum -= 3 * key
+	}
+	check(n-601, sum, -n/2+1, n/2-601)
+	// Compacting leaves the trailing leaves empty.
+	if _, err = index.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(n-601, sum, -n/2+1, n/2-601)
+	for key := -n/2 + 1; key <= n/2-601; key++ {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(0, 0, 0, 0)
+	// A sum that doesn't fit is an error.
+	if err = index.Insert(n, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Insert(n+1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = index.SumValues(); err == nil {
+		t.Error("Expected SumValues to report overflow")
+	}
+}
+
+func testBTreeTableEndEmpty(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkEmpty := func() {
+		c, err := index.TableEnd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.IsEnd() {
+			t.Fatal("TableEnd of an empty table should be at the end")
+		}
+		if _, err = c.GetEntry(); err == nil {
+			t.Error("GetEntry at the end of an empty table should fail")
+		}
+		cursor := c.(*btree.BTreeCursor)
+		if !cursor.StepBackward() {
+			t.Error("Stepping back in an empty table should report the start")
+		}
+		if !cursor.StepForward() {
+			t.Error("Stepping forward in an empty table should report the end")
+		}
+	}
+	checkLast := func(key int64) {
+		c, err := index.TableEnd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.IsEnd() {
+			t.Fatalf("Expected TableEnd to point at key %v, but it is at the end", key)
+		}
+		entry, err := c.GetEntry()
+		if err != nil || entry.GetKey() != key {
+			t.Fatalf("Expected TableEnd to point at key %v, got %v, %v", key, entry, err)
+		}
+	}
+	checkEmpty()
+	// A table emptied by deletes is empty again.
+	if err = index.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkLast(1)
+	if err = index.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	checkEmpty()
+	// Trailing entries deleted in place, and the leaves compaction empties, are skipped.
+	n := int64(1000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.SetDeleteMode(utils.TOMBSTONE_DELETE)
+	for i := n - 1; i >= n-300; i-- {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkLast(n - 301)
+	if _, err = index.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkLast(n - 301)
+	for i := int64(0); i < n-300; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkEmpty()
+}
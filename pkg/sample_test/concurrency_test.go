@@ -0,0 +1,596 @@
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	uuid "github.com/google/uuid"
+)
+
+func TestConcurrencyTA(t *testing.T) {
+	t.Run("TestOptimisticValidation", testOptimisticValidation)
+	t.Run("TestOptimisticAbortDropsWrites", testOptimisticAbortDropsWrites)
+	t.Run("TestOptimisticAgainstPessimistic", testOptimisticAgainstPessimistic)
+	t.Run("TestOptimisticCommitIsAtomic", testOptimisticCommitIsAtomic)
+	t.Run("TestNestedAbortKeepsParentLocks", testNestedAbortKeepsParentLocks)
+	t.Run("TestNestedCommitHandsLocksToParent", testNestedCommitHandsLocksToParent)
+	t.Run("TestAbortMidNested", testAbortMidNested)
+	t.Run("TestCommitAfterOpenNested", testCommitAfterOpenNested)
+	t.Run("TestBeginOrGet", testBeginOrGet)
+	t.Run("TestRecentDeadlocks", testRecentDeadlocks)
+}
+
+func testOptimisticValidation(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	first, second := uuid.New(), uuid.New()
+	for _, clientId := range []uuid.UUID{first, second} {
+		if err = tm.BeginWithMode(clientId, concurrency.OPTIMISTIC_MODE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both transactions read then write the same key; neither blocks.
+	for _, clientId := range []uuid.UUID{first, second} {
+		if err = tm.Lock(clientId, index, 1, concurrency.R_LOCK); err != nil {
+			t.Fatal(err)
+		}
+		if err = tm.Lock(clientId, index, 1, concurrency.W_LOCK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tm.Commit(first); err != nil {
+		t.Fatal(err)
+	}
+	// The second committer read a version that has since changed.
+	if err = tm.Commit(second); err != concurrency.ErrValidationFailed {
+		t.Fatalf("Expected ErrValidationFailed, got %v", err)
+	}
+	if _, found := tm.GetTransaction(second); found {
+		t.Error("Aborted transaction should be removed")
+	}
+	// A fresh transaction sees the new version and commits.
+	if err = tm.BeginWithMode(second, concurrency.OPTIMISTIC_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(second, index, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Commit(second); err != nil {
+		t.Error(err)
+	}
+}
+
+func testOptimisticAbortDropsWrites(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, "create btree table t", &w); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := int64(1); key <= 2; key++ {
+		if err = table.Insert(key, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	first, second := uuid.New(), uuid.New()
+	for _, clientId := range []uuid.UUID{first, second} {
+		if err = tm.BeginWithMode(clientId, concurrency.OPTIMISTIC_MODE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = concurrency.HandleUpdate(d, tm, "update t 1 20", first); err != nil {
+		t.Fatal(err)
+	}
+	if err = concurrency.HandleUpdate(d, tm, "update t 1 30", second); err != nil {
+		t.Fatal(err)
+	}
+	if err = concurrency.HandleInsert(d, tm, "insert 3 30 into t", second); err != nil {
+		t.Fatal(err)
+	}
+	if err = concurrency.HandleDelete(d, tm, "delete 2 from t", second); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is written until commit, but each transaction sees its own writes.
+	if entry, err := table.Find(1); err != nil || entry.GetValue() != 10 {
+		t.Fatalf("Uncommitted update reached the table: %v, %v", entry, err)
+	}
+	w.Reset()
+	if err = concurrency.HandleFind(d, tm, "find 1 from t", &w, second); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.String(), "(1, 30)") {
+		t.Errorf("Transaction should see its own update, got %q", w.String())
+	}
+	if err = concurrency.HandleFind(d, tm, "find 2 from t", &w, second); err == nil {
+		t.Error("Transaction should see its own delete")
+	}
+	if err = tm.Commit(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Commit(second); err != concurrency.ErrValidationFailed {
+		t.Fatalf("Expected ErrValidationFailed, got %v", err)
+	}
+	// Only the transaction that validated left its writes in the table.
+	if entry, err := table.Find(1); err != nil || entry.GetValue() != 20 {
+		t.Errorf("Expected (1, 20) after the failed commit, got %v, %v", entry, err)
+	}
+	if entry, err := table.Find(2); err != nil || entry.GetValue() != 10 {
+		t.Errorf("Aborted delete reached the table: %v, %v", entry, err)
+	}
+	if entry, _ := table.Find(3); entry != nil {
+		t.Errorf("Aborted insert reached the table: %v", entry)
+	}
+}
+
+// openTestTable opens a database in a fresh folder with a btree table t holding keys 1 and 2.
+func openTestTable(t *testing.T) (*db.Database, db.Index, func()) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(folder)
+	if err != nil {
+		os.RemoveAll(folder)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		d.Close()
+		os.RemoveAll(folder)
+	}
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, "create btree table t", &w); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for key := int64(1); key <= 2; key++ {
+		if err = table.Insert(key, 10); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	return d, table, cleanup
+}
+
+func testOptimisticAgainstPessimistic(t *testing.T) {
+	d, table, cleanup := openTestTable(t)
+	defer cleanup()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	optimistic, pessimistic := uuid.New(), uuid.New()
+
+	// A pessimistic write to a key an optimistic transaction read fails its validation.
+	if err := tm.BeginWithMode(optimistic, concurrency.OPTIMISTIC_MODE); err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	if err := concurrency.HandleFind(d, tm, "find 1 from t", &w, optimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Begin(pessimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := concurrency.HandleUpdate(d, tm, "update t 1 40", pessimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(pessimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := concurrency.HandleUpdate(d, tm, "update t 2 50", optimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(optimistic); err != concurrency.ErrValidationFailed {
+		t.Fatalf("Expected ErrValidationFailed after a pessimistic write, got %v", err)
+	}
+
+	// An optimistic commit can't write a key a pessimistic transaction has locked.
+	if err := tm.Begin(pessimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := concurrency.HandleUpdate(d, tm, "update t 2 60", pessimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.BeginWithMode(optimistic, concurrency.OPTIMISTIC_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if err := concurrency.HandleUpdate(d, tm, "update t 2 70", optimistic); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(optimistic); err != concurrency.ErrValidationFailed {
+		t.Fatalf("Expected ErrValidationFailed on a locked key, got %v", err)
+	}
+	if err := tm.Commit(pessimistic); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := table.Find(2); err != nil || entry.GetValue() != 60 {
+		t.Errorf("Expected (2, 60), got %v, %v", entry, err)
+	}
+}
+
+func testOptimisticCommitIsAtomic(t *testing.T) {
+	d, table, cleanup := openTestTable(t)
+	defer cleanup()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	clientId := uuid.New()
+	if err := tm.BeginWithMode(clientId, concurrency.OPTIMISTIC_MODE); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"update t 1 20", "insert 3 30 into t", "delete 2 from t", "insert 4 40 into t"} {
+		var err error
+		if strings.HasPrefix(payload, "update") {
+			err = concurrency.HandleUpdate(d, tm, payload, clientId)
+		} else if strings.HasPrefix(payload, "insert") {
+			err = concurrency.HandleInsert(d, tm, payload, clientId)
+		} else {
+			err = concurrency.HandleDelete(d, tm, payload, clientId)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A write outside any transaction makes the last buffered insert fail.
+	if err := table.Insert(4, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(clientId); err == nil {
+		t.Fatal("Expected the commit to fail on a duplicate key")
+	}
+	// None of the transaction's writes are left behind.
+	for key, value := range map[int64]int64{1: 10, 2: 10, 4: 1} {
+		if entry, err := table.Find(key); err != nil || entry.GetValue() != value {
+			t.Errorf("Expected (%v, %v), got %v, %v", key, value, entry, err)
+		}
+	}
+	if entry, _ := table.Find(3); entry != nil {
+		t.Errorf("Insert from the failed commit reached the table: %v", entry)
+	}
+}
+
+// holdsKey checks if the transaction's own resources include the given key.
+func holdsKey(tx *concurrency.Transaction, key int64) bool {
+	for r := range tx.GetResources() {
+		if r.GetResourceKey() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// lockWithin tries to lock the key, reporting whether the lock was granted within the timeout.
+// The attempt keeps running in the background if it times out.
+func lockWithin(tm *concurrency.TransactionManager, clientId uuid.UUID, index *btree.BTreeIndex, key int64, timeout time.Duration) (chan error, bool) {
+	done := make(chan error, 1)
+	go func() {
+		done <- tm.Lock(clientId, index, key, concurrency.W_LOCK)
+	}()
+	select {
+	case <-time.After(timeout):
+		return done, false
+	case err := <-done:
+		done <- err
+		return done, true
+	}
+}
+
+func testNestedAbortKeepsParentLocks(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	parent, other := uuid.New(), uuid.New()
+	if err = tm.Begin(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(parent, index, 1, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	child, err := tm.BeginNested(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The child already holds its parent's lock, and takes a new one of its own.
+	if err = tm.Lock(child, index, 1, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(child, index, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Commit(parent); err == nil {
+		t.Fatal("Parent committed while a nested transaction was open")
+	}
+	if err = tm.AbortNested(child); err != nil {
+		t.Fatal(err)
+	}
+	parentTx, _ := tm.GetTransaction(parent)
+	if !holdsKey(parentTx, 1) || holdsKey(parentTx, 2) {
+		t.Fatal("Parent should hold only the lock it took itself")
+	}
+	// The child's lock is free; the parent's is not.
+	if err = tm.Begin(other); err != nil {
+		t.Fatal(err)
+	}
+	if done, ok := lockWithin(tm, other, index, 2, time.Second); !ok || <-done != nil {
+		t.Fatal("Aborting the child should release its lock")
+	}
+	done, ok := lockWithin(tm, other, index, 1, 50*time.Millisecond)
+	if ok {
+		t.Fatal("Aborting the child released a lock its parent held")
+	}
+	if err = tm.Commit(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Commit(other); err != nil {
+		t.Error(err)
+	}
+}
+
+func testAbortMidNested(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	parent, other := uuid.New(), uuid.New()
+	if err = tm.Begin(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(parent, index, 1, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	child, err := tm.BeginNested(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(child, index, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Abort(child); err == nil {
+		t.Fatal("Aborted a nested transaction as a top-level one")
+	}
+	// The client disconnects with the child still open, as the server tears it down.
+	if err = tm.Abort(parent); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := tm.GetTransaction(parent); found {
+		t.Error("Parent transaction still running after abort")
+	}
+	if _, found := tm.GetTransaction(child); found {
+		t.Error("Nested transaction still running after abort")
+	}
+	// Both the parent's and the child's locks are free again.
+	if err = tm.Begin(other); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []int64{1, 2} {
+		if done, ok := lockWithin(tm, other, index, key, time.Second); !ok || <-done != nil {
+			t.Fatalf("Lock on key %v was not released by the abort", key)
+		}
+	}
+	if err = tm.Commit(other); err != nil {
+		t.Error(err)
+	}
+}
+
+// Tears down a client the way the server does when it disconnects mid-subtransaction.
+func testCommitAfterOpenNested(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	parent, other := uuid.New(), uuid.New()
+	if err = tm.Begin(parent); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := tm.GetOpenNested(parent); found {
+		t.Fatal("Found a nested transaction before beginning one")
+	}
+	child, err := tm.BeginNested(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grandchild, err := tm.BeginNested(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(grandchild, index, 1, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []uuid.UUID{grandchild, child} {
+		childId, found := tm.GetOpenNested(parent)
+		if !found || childId != expected {
+			t.Fatalf("Expected open nested transaction %v, got %v", expected, childId)
+		}
+		if err = tm.AbortNested(childId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, found := tm.GetOpenNested(parent); found {
+		t.Fatal("Found a nested transaction after aborting them all")
+	}
+	if err = tm.Commit(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Begin(other); err != nil {
+		t.Fatal(err)
+	}
+	if done, ok := lockWithin(tm, other, index, 1, time.Second); !ok || <-done != nil {
+		t.Fatal("Lock taken by an aborted nested transaction was not released")
+	}
+	if err = tm.Commit(other); err != nil {
+		t.Error(err)
+	}
+}
+
+func testNestedCommitHandsLocksToParent(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	parent := uuid.New()
+	if err = tm.Begin(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(parent, index, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	child, err := tm.BeginNested(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(child, index, 1, concurrency.W_LOCK); err == nil {
+		t.Fatal("Child upgraded a lock held by its parent")
+	}
+	if err = tm.Lock(child, index, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.CommitNested(child); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := tm.GetTransaction(child); found {
+		t.Error("Committed child should be removed")
+	}
+	parentTx, _ := tm.GetTransaction(parent)
+	if !holdsKey(parentTx, 1) || !holdsKey(parentTx, 2) {
+		t.Fatal("Parent should hold the child's locks after it commits")
+	}
+	if err = tm.Commit(parent); err != nil {
+		t.Fatal(err)
+	}
+	// Everything was released at the top-level commit.
+	other := uuid.New()
+	if err = tm.Begin(other); err != nil {
+		t.Fatal(err)
+	}
+	if done, ok := lockWithin(tm, other, index, 2, time.Second); !ok || <-done != nil {
+		t.Error("Parent commit should release the child's lock")
+	}
+}
+
+func testBeginOrGet(t *testing.T) {
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	clientId := uuid.New()
+	first, began, err := tm.BeginOrGet(clientId)
+	if err != nil || !began || first == nil {
+		t.Fatalf("Expected a new transaction, got %v, %v, %v", first, began, err)
+	}
+	second, began, err := tm.BeginOrGet(clientId)
+	if err != nil || began {
+		t.Fatalf("Expected the existing transaction, got %v, %v", began, err)
+	}
+	if second != first {
+		t.Error("BeginOrGet returned a different transaction")
+	}
+	if tm.NumTransactions() != 1 {
+		t.Errorf("Expected 1 transaction, got %v", tm.NumTransactions())
+	}
+	// The strict Begin still refuses.
+	if err = tm.Begin(clientId); err == nil {
+		t.Error("Begin should fail for a running transaction")
+	}
+	if err = tm.Commit(clientId); err != nil {
+		t.Fatal(err)
+	}
+	if _, began, _ = tm.BeginOrGet(clientId); !began {
+		t.Error("Expected a new transaction after commit")
+	}
+}
+
+func testRecentDeadlocks(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	first, second := uuid.New(), uuid.New()
+	for i, clientId := range []uuid.UUID{first, second} {
+		if err = tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+		if err = tm.Lock(clientId, index, int64(i), concurrency.W_LOCK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each now waits on the other.
+	done, ok := lockWithin(tm, first, index, 1, 50*time.Millisecond)
+	if ok {
+		t.Fatal("Lock held by another transaction was granted")
+	}
+	if err = tm.Lock(second, index, 0, concurrency.W_LOCK); err == nil {
+		t.Fatal("Expected a deadlock")
+	}
+	if err = tm.Commit(second); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Commit(first); err != nil {
+		t.Fatal(err)
+	}
+	if tm.NumDeadlocks() != 1 || tm.NumRecentDeadlocks() != 1 {
+		t.Errorf("Expected 1 deadlock, recently, got %v, %v recently", tm.NumDeadlocks(), tm.NumRecentDeadlocks())
+	}
+	// Once it is no longer recent, only the total counts it.
+	defer func(window time.Duration) { concurrency.RECENT_DEADLOCK_WINDOW = window }(concurrency.RECENT_DEADLOCK_WINDOW)
+	concurrency.RECENT_DEADLOCK_WINDOW = 0
+	if tm.NumDeadlocks() != 1 || tm.NumRecentDeadlocks() != 0 {
+		t.Errorf("Expected 1 deadlock, none recently, got %v, %v recently", tm.NumDeadlocks(), tm.NumRecentDeadlocks())
+	}
+}
@@ -0,0 +1,1209 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+func TestDBTA(t *testing.T) {
+	t.Run("TestBatchApply", testBatchApply)
+	t.Run("TestBatchRollback", testBatchRollback)
+	t.Run("TestBatchRollbackMultiValueBTree", func(t *testing.T) { testBatchRollbackMultiValue(t, "btree") })
+	t.Run("TestBatchRollbackMultiValueHash", func(t *testing.T) { testBatchRollbackMultiValue(t, "hash") })
+	t.Run("TestBatchWaitsForBatch", testBatchWaitsForBatch)
+	t.Run("TestSelectLargeBTree", func(t *testing.T) { testSelectLarge(t, "btree") })
+	t.Run("TestSelectLargeHash", func(t *testing.T) { testSelectLarge(t, "hash") })
+	t.Run("TestEstimateInsertCost", testEstimateInsertCost)
+	t.Run("TestCloseReleasesFile", testCloseReleasesFile)
+	t.Run("TestTombstoneScanBTree", func(t *testing.T) { testTombstoneScan(t, "btree") })
+	t.Run("TestTombstoneScanHash", func(t *testing.T) { testTombstoneScan(t, "hash") })
+	t.Run("TestRepairHashTable", testRepairHashTable)
+	t.Run("TestVerifyIndexMismatch", testVerifyIndexMismatch)
+	t.Run("TestMultiValueBTree", func(t *testing.T) { testMultiValue(t, "btree") })
+	t.Run("TestMultiValueHash", func(t *testing.T) { testMultiValue(t, "hash") })
+	t.Run("TestMissingTable", testMissingTable)
+	t.Run("TestGetTablesWhileCreating", testGetTablesWhileCreating)
+	t.Run("TestOpenLocked", testOpenLocked)
+	t.Run("TestBreakEmptyLock", testBreakEmptyLock)
+	t.Run("TestInsertSelect", testInsertSelect)
+	t.Run("TestSelectWhereValueBTree", func(t *testing.T) { testSelectWhereValue(t, "btree") })
+	t.Run("TestSelectWhereValueHash", func(t *testing.T) { testSelectWhereValue(t, "hash") })
+	t.Run("TestNegativeKeysBTree", func(t *testing.T) { testNegativeKeys(t, "btree") })
+	t.Run("TestNegativeKeysHash", func(t *testing.T) { testNegativeKeys(t, "hash") })
+	t.Run("TestAutoVacuumBTree", func(t *testing.T) { testAutoVacuum(t, "btree") })
+	t.Run("TestAutoVacuumHash", func(t *testing.T) { testAutoVacuum(t, "hash") })
+	t.Run("TestPinResidentBTree", func(t *testing.T) { testPinResident(t, "btree") })
+	t.Run("TestPinResidentHash", func(t *testing.T) { testPinResident(t, "hash") })
+	t.Run("TestStreamEntries", testStreamEntries)
+}
+
+// countOpenFiles returns the number of open file descriptors, or -1 if unknown.
+func countOpenFiles() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// testSelectLarge selects from a table spanning many more pages than the buffer pool holds.
+func testSelectLarge(t *testing.T, indexType string) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, fmt.Sprintf("create %s table t", indexType), &w); err != nil {
+		t.Fatal(err)
+	}
+	index, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.GetPager().Close()
+	n := int64(10000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.GetPager().GetNumPages() <= 32 {
+		t.Fatal("Table should not fit in the buffer pool")
+	}
+	w.Reset()
+	if err = db.HandleSelect(d, "select from t", &w); err != nil {
+		t.Fatal(err)
+	}
+	// Every row should be printed exactly once.
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(w.String()), "\n") {
+		if seen[line] {
+			t.Errorf("Row %s printed more than once", line)
+		}
+		seen[line] = true
+	}
+	for i := int64(0); i < n; i++ {
+		if !seen[fmt.Sprintf("(%v, %v)", i, i%btree_salt)] {
+			t.Errorf("Row %d was not printed", i)
+		}
+	}
+}
+
+func testBatchApply(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Insert(1, 1)
+	index.Insert(2, 2)
+	// Apply a batch touching every operation type.
+	b := db.NewWriteBatch()
+	b.Insert(3, 3)
+	b.Update(1, 10)
+	b.Delete(2)
+	if err = db.ApplyBatch(index, b); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(1); err != nil || entry.GetValue() != 10 {
+		t.Error("Batch update was not applied")
+	}
+	if _, err := index.Find(2); err == nil {
+		t.Error("Batch delete was not applied")
+	}
+	if entry, err := index.Find(3); err != nil || entry.GetValue() != 3 {
+		t.Error("Batch insert was not applied")
+	}
+}
+
+func testBatchRollback(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 10; i++ {
+		index.Insert(i, i)
+	}
+	// The third operation updates a missing key, so the batch must fail.
+	b := db.NewWriteBatch()
+	b.Delete(4)
+	b.Update(5, 50)
+	b.Update(100, 100)
+	b.Insert(11, 11)
+	if err = db.ApplyBatch(index, b); err == nil {
+		t.Fatal("Expected batch to fail")
+	}
+	// The index should be exactly as it was.
+	for i := int64(0); i < 10; i++ {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Errorf("Entry %d missing after rollback", i)
+			continue
+		}
+		if entry.GetValue() != i {
+			t.Errorf("Entry %d has value %d after rollback", i, entry.GetValue())
+		}
+	}
+	for _, key := range []int64{11, 100} {
+		if _, err := index.Find(key); err == nil {
+			t.Errorf("Entry %d should not exist after rollback", key)
+		}
+	}
+}
+
+func testBatchRollbackMultiValue(t *testing.T, indexType string) {
+	var dbName string
+	if indexType == "btree" {
+		dbName = getTempBTreeDB(t)
+	} else {
+		dbName = getTempHashDB(t)
+	}
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := openMultiValueIndex(indexType, dbName, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 10; i++ {
+		if err = index.InsertValues(i, []int64{i, 2 * i, 3 * i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last operation inserts an existing key, so the batch must fail.
+	b := db.NewWriteBatch()
+	b.Update(4, 40)
+	b.Delete(5)
+	b.Delete(4)
+	b.Insert(1, 1)
+	if err = db.ApplyBatch(index, b); err == nil {
+		t.Fatal("Expected batch to fail")
+	}
+	// Every value of the updated and deleted entries is restored.
+	for i := int64(0); i < 10; i++ {
+		checkValues(t, index, i, []int64{i, 2 * i, 3 * i})
+	}
+}
+
+func testBatchWaitsForBatch(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Hold the index's batch lock as another batch would while it is applied.
+	index.BeginBatch()
+	b := db.NewWriteBatch()
+	b.Insert(1, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- db.ApplyBatch(index, b)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Batch applied while another batch held the index")
+	case <-time.After(50 * time.Millisecond):
+	}
+	index.EndBatch()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(1); err != nil || entry.GetValue() != 10 {
+		t.Error("Batch was not applied once the index was free")
+	}
+}
+
+// checkEstimate compares the estimated page growth of inserting keys [start, end) with the actual growth.
+func checkEstimate(t *testing.T, index db.Index, start int64, end int64) {
+	before := index.GetPager().GetNumPages()
+	estimate, willFit := db.EstimateInsertCost(index, end-start)
+	if !willFit {
+		t.Error("A file-backed index should always fit")
+	}
+	for i := start; i < end; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actual := index.GetPager().GetNumPages() - before
+	// Allow 20% error either way, plus a couple of pages of slack for small inserts.
+	if diff := estimate - actual; diff*5 > actual+10 || -diff*5 > actual+10 {
+		t.Errorf("Estimated %d new pages for keys [%d, %d), actually used %d", estimate, start, end, actual)
+	}
+}
+
+func testEstimateInsertCost(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	btreeIndex, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	// Estimate from an empty tree, then from the fill factor it ends up with.
+	checkEstimate(t, btreeIndex, 0, 10000)
+	checkEstimate(t, btreeIndex, 10000, 20000)
+
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	checkEstimate(t, hashIndex, 0, 10000)
+	checkEstimate(t, hashIndex, 10000, 20000)
+}
+
+func testCloseReleasesFile(t *testing.T) {
+	if countOpenFiles() < 0 {
+		t.Skip("cannot count open files on this platform")
+	}
+	open := map[string]func(string) (db.Index, error){
+		"btree": func(name string) (db.Index, error) { return btree.OpenTable(name) },
+		"hash":  func(name string) (db.Index, error) { return hash.OpenTable(name) },
+	}
+	for indexType, openTable := range open {
+		dbName := getTempBTreeDB(t)
+		before := countOpenFiles()
+		index, err := openTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 100; i++ {
+			index.Insert(i, i)
+		}
+		if err = index.Close(); err != nil {
+			t.Errorf("%s: %v", indexType, err)
+		}
+		if after := countOpenFiles(); after != before {
+			t.Errorf("%s: %d files open before, %d after close", indexType, before, after)
+		}
+		if err = os.Remove(dbName); err != nil {
+			t.Errorf("%s: %v", indexType, err)
+		}
+		os.Remove(dbName + ".meta")
+	}
+}
+
+// tombstoneIndex is an index that can delete entries in place.
+type tombstoneIndex interface {
+	db.Index
+	SetDeleteMode(utils.DeleteMode)
+	Compact() (int64, error)
+}
+
+// openTombstoneIndex opens a fresh index of the given type holding keys [0, n), deleting in place.
+// The returned function closes the index and removes its files.
+func openTombstoneIndex(t *testing.T, indexType string, n int64) (tombstoneIndex, func()) {
+	var index tombstoneIndex
+	var cleanup func()
+	if indexType == "btree" {
+		dbName := getTempBTreeDB(t)
+		bIndex, err := btree.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, cleanup = bIndex, func() {
+			bIndex.Close()
+			os.Remove(dbName)
+		}
+	} else {
+		dbName := getTempHashDB(t)
+		hIndex, err := hash.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, cleanup = hIndex, func() {
+			hIndex.Close()
+			os.Remove(dbName)
+			os.Remove(dbName + ".meta")
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.SetDeleteMode(utils.TOMBSTONE_DELETE)
+	return index, cleanup
+}
+
+func testTombstoneScan(t *testing.T, indexType string) {
+	n := int64(2000)
+	// Deleting each entry just after reading it must not skip the next one.
+	index, cleanup := openTombstoneIndex(t, indexType, n)
+	seen := make(map[int64]bool)
+	err := db.Scan(index, func(entry utils.Entry) error {
+		if seen[entry.GetKey()] {
+			t.Fatalf("Key %v read twice", entry.GetKey())
+		}
+		seen[entry.GetKey()] = true
+		return index.Delete(entry.GetKey())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(seen)) != n {
+		t.Errorf("Expected to read %v entries, read %v", n, len(seen))
+	}
+	if entries, _ := index.Select(); len(entries) != 0 {
+		t.Errorf("Expected no entries after deleting them all, found %v", len(entries))
+	}
+	if removed, err := index.Compact(); err != nil || removed != n {
+		t.Errorf("Expected Compact to remove %v entries, removed %v (%v)", n, removed, err)
+	}
+	cleanup()
+
+	// Delete the odd keys while another goroutine scans.
+	index, cleanup = openTombstoneIndex(t, indexType, n)
+	defer cleanup()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int64(1); i < n; i += 2 {
+			index.Delete(i)
+		}
+	}()
+	seen = make(map[int64]bool)
+	last := int64(-1)
+	err = db.Scan(index, func(entry utils.Entry) error {
+		key := entry.GetKey()
+		if seen[key] {
+			t.Fatalf("Key %v read twice", key)
+		}
+		if indexType == "btree" && key <= last {
+			t.Fatalf("Key %v read after %v", key, last)
+		}
+		seen[key] = true
+		last = key
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < n; i += 2 {
+		if !seen[i] {
+			t.Fatalf("Key %v was never deleted but wasn't read", i)
+		}
+	}
+	// Deleted keys are gone once compacted, and can be inserted again.
+	if _, err = index.Find(1); err == nil {
+		t.Error("Found a deleted key")
+	}
+	if removed, err := index.Compact(); err != nil || removed != n/2 {
+		t.Errorf("Expected Compact to remove %v entries, removed %v (%v)", n/2, removed, err)
+	}
+	if entries, _ := index.Select(); int64(len(entries)) != n/2 {
+		t.Errorf("Expected %v entries after compaction, found %v", n/2, len(entries))
+	}
+	if err = index.Insert(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(1); err != nil || entry.GetValue() != 100 {
+		t.Errorf("Reinserted key not found: %v", err)
+	}
+}
+
+func testVerifyIndexMismatch(t *testing.T) {
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	for i := int64(0); i < 100; i++ {
+		btreeIndex.Insert(i, i)
+		hashIndex.Insert(i, i)
+	}
+	// Each index verifies as its own type and fails cleanly as the other.
+	if err = db.VerifyIndex(btreeIndex, db.BTreeIndexType); err != nil {
+		t.Errorf("Valid btree failed verification: %v", err)
+	}
+	if err = db.VerifyIndex(hashIndex, db.HashIndexType); err != nil {
+		t.Errorf("Valid hash table failed verification: %v", err)
+	}
+	if err = db.VerifyIndex(btreeIndex, db.HashIndexType); err == nil || !strings.Contains(err.Error(), "expected hash index") {
+		t.Errorf("Expected a hash index type error, got %v", err)
+	}
+	if err = db.VerifyIndex(hashIndex, db.BTreeIndexType); err == nil || !strings.Contains(err.Error(), "expected btree index") {
+		t.Errorf("Expected a btree index type error, got %v", err)
+	}
+}
+
+func testRepairHashTable(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, "create hash table repaired", &w); err != nil {
+		t.Fatal(err)
+	}
+	index, err := d.GetTable("repaired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rotate the directory so every slot points at the wrong bucket.
+	buckets := index.(*hash.HashIndex).GetTable().GetBuckets()
+	first := buckets[0]
+	copy(buckets, buckets[1:])
+	buckets[len(buckets)-1] = first
+	if ok, _ := hash.IsHash(index.(*hash.HashIndex)); ok {
+		t.Fatal("Expected the corrupted directory to fail IsHash")
+	}
+
+	w.Reset()
+	if err = db.HandleRepair(d, "repair repaired", &w); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.String(), fmt.Sprintf("%v entries", n)) {
+		t.Errorf("Unexpected repair output %q", w.String())
+	}
+	index, err = d.GetTable("repaired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Close the pager directly so no directory file is left behind.
+	defer os.Remove("repaired.meta")
+	defer index.GetPager().Close()
+	if ok, err := hash.IsHash(index.(*hash.HashIndex)); !ok || err != nil {
+		t.Fatalf("Repaired table fails IsHash: %v", err)
+	}
+	for i := int64(0); i < n; i++ {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Fatalf("Key %v lost in repair: %v", i, err)
+		}
+		if entry.GetValue() != i%hash_salt {
+			t.Fatalf("Key %v has value %v after repair, expected %v", i, entry.GetValue(), i%hash_salt)
+		}
+	}
+	if err = db.HandleRepair(d, "repair", &w); err == nil {
+		t.Error("Expected a usage error")
+	}
+}
+
+// multiValueIndex is an index storing more than one value per entry.
+type multiValueIndex interface {
+	db.Index
+	InsertValues(int64, []int64) error
+	UpdateValues(int64, []int64) error
+	GetNumValues() int64
+}
+
+// openMultiValueIndex opens the index of the given type at dbName, with numValues values
+// per entry if numValues is nonzero.
+func openMultiValueIndex(indexType string, dbName string, numValues int64) (multiValueIndex, error) {
+	if indexType == "btree" {
+		if numValues == 0 {
+			return btree.OpenTable(dbName)
+		}
+		return btree.OpenTableWithValues(dbName, numValues)
+	}
+	if numValues == 0 {
+		return hash.OpenTable(dbName)
+	}
+	return hash.OpenTableWithValues(dbName, numValues)
+}
+
+// checkValues fails the test unless key is found with exactly the expected values.
+func checkValues(t *testing.T, index db.Index, key int64, expected []int64) {
+	entry, err := index.Find(key)
+	if err != nil {
+		t.Fatalf("Key %v not found: %v", key, err)
+	}
+	if fmt.Sprint(entry.Values()) != fmt.Sprint(expected) || entry.GetValue() != expected[0] {
+		t.Fatalf("Key %v has values %v, expected %v", key, entry.Values(), expected)
+	}
+}
+
+func testMultiValue(t *testing.T, indexType string) {
+	var dbName string
+	if indexType == "btree" {
+		dbName = getTempBTreeDB(t)
+	} else {
+		dbName = getTempHashDB(t)
+	}
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := openMultiValueIndex(indexType, dbName, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough entries to split pages several times over.
+	n := int64(1000)
+	for i := int64(0); i < n; i++ {
+		if err = index.InsertValues(i, []int64{i, -2 * i, 3 * i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Missing values are stored as 0.
+	if err = index.Insert(n, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.InsertValues(n+1, []int64{1, 2, 3, 4}); err == nil {
+		t.Error("Expected an error inserting too many values")
+	}
+	for i := int64(0); i < n; i++ {
+		checkValues(t, index, i, []int64{i, -2 * i, 3 * i})
+	}
+	checkValues(t, index, n, []int64{7, 0, 0})
+	// Updates overwrite only the values given.
+	if err = index.UpdateValues(5, []int64{50, 51, 52}); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Update(6, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.UpdateValues(7, []int64{70, 71}); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, index, 5, []int64{50, 51, 52})
+	checkValues(t, index, 6, []int64{60, -12, 18})
+	checkValues(t, index, 7, []int64{70, 71, 21})
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n+1 {
+		t.Fatalf("Expected %v entries, got %v", n+1, len(entries))
+	}
+
+	// The number of values survives reopening the table.
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openMultiValueIndex(indexType, dbName, 2); err == nil {
+		t.Fatal("Expected an error reopening with a different number of values")
+	}
+	index, err = openMultiValueIndex(indexType, dbName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if index.GetNumValues() != 3 {
+		t.Fatalf("Expected 3 values per entry after reopening, got %v", index.GetNumValues())
+	}
+	checkValues(t, index, 5, []int64{50, 51, 52})
+	checkValues(t, index, n-1, []int64{n - 1, -2 * (n - 1), 3 * (n - 1)})
+}
+
+func testGetTablesWhileCreating(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// Range over the tables, as the metrics server does, while a client creates them.
+	n := 50
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, table := range d.GetTables() {
+				table.GetPager().Stats()
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if err = db.HandleCreateTable(d, fmt.Sprintf("create btree table t%v", i), ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	tables := d.GetTables()
+	if len(tables) != n {
+		t.Fatalf("Expected %v tables, got %v", n, len(tables))
+	}
+	// The snapshot is a copy.
+	delete(tables, "t0")
+	if _, err = d.GetTable("t0"); err != nil || len(d.GetTables()) != n {
+		t.Error("Changing the snapshot changed the database's tables")
+	}
+}
+
+func testMissingTable(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err = d.GetTable("missing"); err != db.ErrTableNotFound {
+		t.Errorf("GetTable returned %v, expected ErrTableNotFound", err)
+	}
+	var w bytes.Buffer
+	handlers := map[string]func() error{
+		"find":   func() error { return db.HandleFind(d, "find 1 from missing", &w) },
+		"insert": func() error { return db.HandleInsert(d, "insert 1 1 into missing") },
+		"update": func() error { return db.HandleUpdate(d, "update missing 1 1") },
+		"delete": func() error { return db.HandleDelete(d, "delete 1 from missing") },
+		"select": func() error { return db.HandleSelect(d, "select from missing", &w) },
+		"pretty": func() error { return db.HandlePretty(d, "pretty from missing", &w) },
+		"repair": func() error { return db.HandleRepair(d, "repair missing", &w) },
+	}
+	for name, handler := range handlers {
+		if err := handler(); !errors.Is(err, db.ErrTableNotFound) {
+			t.Errorf("%v returned %v, expected ErrTableNotFound", name, err)
+		}
+	}
+}
+
+func testOpenLocked(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second open fails while the first is open, and the live lock can't be broken.
+	if _, err = db.Open(folder); !errors.Is(err, db.ErrDatabaseLocked) {
+		t.Fatalf("Second Open returned %v, expected ErrDatabaseLocked", err)
+	}
+	if pid, running, err := db.ReadLock(folder); err != nil || pid != os.Getpid() || !running {
+		t.Errorf("ReadLock returned (%v, %v, %v), expected this process", pid, running, err)
+	}
+	if err = db.BreakStaleLock(folder); !errors.Is(err, db.ErrDatabaseLocked) {
+		t.Errorf("Broke a live lock: %v", err)
+	}
+	// Closing releases the folder.
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = db.Open(folder); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock left by a process that is gone is stale, and can be broken.
+	lockName := filepath.Join(folder, db.LOCK_FILE_NAME)
+	if err = ioutil.WriteFile(lockName, []byte(strconv.Itoa(math.MaxInt32)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Open(folder); !errors.Is(err, db.ErrDatabaseLocked) {
+		t.Fatalf("Open ignored a stale lock: %v", err)
+	}
+	if _, running, err := db.ReadLock(folder); err != nil || running {
+		t.Errorf("Expected a stale lock, got (%v, %v)", running, err)
+	}
+	if err = db.BreakStaleLock(folder); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = db.Open(folder); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+}
+
+func testBreakEmptyLock(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	// A process that crashed between creating the lockfile and writing its pid leaves it empty.
+	lockName := filepath.Join(folder, db.LOCK_FILE_NAME)
+	if err = ioutil.WriteFile(lockName, []byte{}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Open(folder); !errors.Is(err, db.ErrDatabaseLocked) {
+		t.Fatalf("Open ignored an empty lock: %v", err)
+	}
+	if _, _, err = db.ReadLock(folder); err == nil {
+		t.Error("Expected ReadLock to reject an empty lockfile")
+	}
+	if err = db.BreakStaleLock(folder); err != nil {
+		t.Fatalf("Could not break an empty lock: %v", err)
+	}
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+}
+
+func testInsertSelect(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	defer os.Remove("dest.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, "create btree table src", &w); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.HandleCreateTable(d, "create hash table dest", &w); err != nil {
+		t.Fatal(err)
+	}
+	src, err := d.GetTable("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := d.GetTable("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		if err = src.Insert(i, i*3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copying into a table that already holds a key fails unless duplicates are skipped.
+	if err = dest.Insert(0, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.HandleInsertSelect(d, "dest", "src", false); err == nil {
+		t.Error("copying a duplicate key should fail")
+	}
+	if _, err = dest.Find(n - 1); err == nil {
+		t.Error("entries after a duplicate key should not be copied")
+	}
+	copied, err := db.HandleInsertSelect(d, "dest", "src", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != int(n-1) {
+		t.Errorf("copied %v entries, expected %v", copied, n-1)
+	}
+	for i := int64(1); i < n; i++ {
+		entry, err := dest.Find(i)
+		if err != nil {
+			t.Fatalf("key %v not found in destination: %v", i, err)
+		}
+		if entry.GetValue() != i*3 {
+			t.Errorf("key %v has value %v, expected %v", i, entry.GetValue(), i*3)
+		}
+	}
+	if entry, _ := dest.Find(0); entry == nil || entry.GetValue() != -1 {
+		t.Error("a skipped duplicate should keep its existing value")
+	}
+}
+
+func testSelectWhereValue(t *testing.T, indexType string) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	defer os.Remove("vals.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, fmt.Sprintf("create %s table vals", indexType), &w); err != nil {
+		t.Fatal(err)
+	}
+	index, err := d.GetTable("vals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values run backwards from the keys, so a value range isn't a key range.
+	n := int64(5000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, n-i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lo, hi := int64(1000), int64(1999)
+	entries, err := db.HandleSelectWhereValue(d, "vals", lo, hi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != hi-lo+1 {
+		t.Errorf("Expected %v entries, got %v", hi-lo+1, len(entries))
+	}
+	seen := make(map[int64]bool)
+	for _, entry := range entries {
+		if entry.GetValue() < lo || entry.GetValue() > hi || entry.GetKey() != n-entry.GetValue() {
+			t.Errorf("Unexpected entry (%v, %v)", entry.GetKey(), entry.GetValue())
+		}
+		seen[entry.GetValue()] = true
+	}
+	if int64(len(seen)) != hi-lo+1 {
+		t.Errorf("Expected %v distinct values, got %v", hi-lo+1, len(seen))
+	}
+	// The command prints the same entries.
+	w.Reset()
+	if err = db.HandleSelect(d, "select vals where value between 1 3", &w); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []int64{1, 2, 3} {
+		if !strings.Contains(w.String(), fmt.Sprintf("(%v, %v)\n", n-v, v)) {
+			t.Errorf("Value %v missing from output %q", v, w.String())
+		}
+	}
+	if lines := strings.Count(w.String(), "\n"); lines != 3 {
+		t.Errorf("Expected 3 rows, got %v", lines)
+	}
+}
+
+// testNegativeKeys checks that keys anywhere in the int64 range can be stored and found.
+func testNegativeKeys(t *testing.T, indexType string) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	var index db.Index
+	var err error
+	if indexType == "btree" {
+		index, err = btree.OpenTable(dbName)
+	} else {
+		index, err = hash.OpenTable(dbName)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Enough keys on either side of zero to split pages several times over, plus the extremes.
+	keys := []int64{math.MinInt64, math.MinInt64 + 1, math.MaxInt64, math.MaxInt64 - 1}
+	for i := int64(-2000); i <= 2000; i++ {
+		keys = append(keys, i)
+	}
+	for _, key := range keys {
+		if err = index.Insert(key, -key); err != nil {
+			t.Fatalf("Inserting %v: %v", key, err)
+		}
+	}
+	for _, key := range keys {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Fatalf("Key %v not found: %v", key, err)
+		}
+		if entry.GetKey() != key || entry.GetValue() != -key {
+			t.Errorf("Key %v found as (%v, %v)", key, entry.GetKey(), entry.GetValue())
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Errorf("Expected %v entries, got %v", len(keys), len(entries))
+	}
+	// B+trees keep negative keys ahead of positive ones.
+	for i := 1; indexType == "btree" && i < len(entries); i++ {
+		if entries[i-1].GetKey() >= entries[i].GetKey() {
+			t.Fatalf("Keys %v and %v are out of order", entries[i-1].GetKey(), entries[i].GetKey())
+		}
+	}
+	// Deleting a negative key removes only that key.
+	if err = index.Delete(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = index.Find(-1); err == nil {
+		t.Error("Deleted key -1 is still found")
+	}
+	if _, err = index.Find(1); err != nil {
+		t.Error("Deleting -1 removed 1")
+	}
+}
+
+// vacuumIndex is an index that can compact itself.
+type vacuumIndex interface {
+	tombstoneIndex
+	Fragmentation() float64
+	AutoVacuum(float64)
+	BeginScan()
+	EndScan()
+}
+
+func testAutoVacuum(t *testing.T, indexType string) {
+	n := int64(4000)
+	ti, cleanup := openTombstoneIndex(t, indexType, n)
+	defer cleanup()
+	index := ti.(vacuumIndex)
+	if frag := index.Fragmentation(); frag != 0 {
+		t.Fatalf("Expected no fragmentation, got %v", frag)
+	}
+	// Deleting every other key leaves half the slots dead.
+	for i := int64(0); i < n; i += 2 {
+		if err := index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frag := index.Fragmentation(); frag < 0.45 || frag > 0.55 {
+		t.Fatalf("Expected fragmentation near 0.5, got %v", frag)
+	}
+	// Auto-vacuum waits for a running scan to end.
+	index.AutoVacuum(0.5)
+	index.BeginScan()
+	for i := int64(1); i < n/2; i += 2 {
+		if err := index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frag := index.Fragmentation(); frag < 0.7 {
+		t.Fatalf("Auto-vacuum ran during a scan; fragmentation is %v", frag)
+	}
+	index.EndScan()
+	if frag := index.Fragmentation(); frag != 0 {
+		t.Fatalf("Expected auto-vacuum to run once the scan ended; fragmentation is %v", frag)
+	}
+	// Without a scan running, it fires as soon as a check falls due.
+	for i := n/2 + 1; i < n-n/8; i += 2 {
+		if err := index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frag := index.Fragmentation(); frag >= 0.5 {
+		t.Errorf("Expected auto-vacuum to keep fragmentation under 0.5, got %v", frag)
+	}
+	// Every live entry survives.
+	for i := n - n/8 + 1; i < n; i += 2 {
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != i {
+			t.Errorf("Live key %v lost", i)
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n/16 {
+		t.Errorf("Expected %v live entries, got %v", n/16, len(entries))
+	}
+}
+
+func testPinResident(t *testing.T, indexType string) {
+	index, cleanup := openTombstoneIndex(t, indexType, 1000)
+	defer cleanup()
+	p := index.GetPager()
+	numResident := p.GetNumPages()
+	if err := index.PinResident(); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.PinResident(); err == nil {
+		t.Error("Pinning twice should fail")
+	}
+	evictedResident := make([]int64, 0)
+	evictions := 0
+	p.SetEvictionCallback(func(pagenum int64) {
+		evictions++
+		if pagenum < numResident {
+			evictedResident = append(evictedResident, pagenum)
+		}
+	})
+	// Grow the table well past the buffer pool and scan it, evicting everything else.
+	for i := int64(1000); i < 40000; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 40000 {
+		t.Fatalf("Expected 40000 entries, got %v", len(entries))
+	}
+	if evictions == 0 {
+		t.Fatal("Expected the scan to evict pages")
+	}
+	if len(evictedResident) != 0 {
+		t.Errorf("Pinned pages were evicted: %v", evictedResident)
+	}
+	// The table no longer fits, so pinning it again must fail without pinning anything.
+	index.UnpinResident()
+	if err := index.PinResident(); err == nil {
+		t.Error("Pinning a table larger than the buffer pool should fail")
+	}
+	p.SetEvictionCallback(nil)
+	if err := index.Close(); err != nil {
+		t.Errorf("Expected no pages to be left pinned, got %v", err)
+	}
+}
+
+// countingWriter counts writes, failing every write after the first failAfter.
+type countingWriter struct {
+	out       bytes.Buffer
+	writes    int
+	failAfter int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.failAfter > 0 && w.writes > w.failAfter {
+		return 0, errors.New("connection closed")
+	}
+	return w.out.Write(p)
+}
+
+// formatRow formats an entry the way the REPL prints it.
+func formatRow(entry utils.Entry) string {
+	return fmt.Sprintf("(%v, %v)\n", entry.GetKey(), entry.GetValue())
+}
+
+func testStreamEntries(t *testing.T) {
+	index, cleanup := openTombstoneIndex(t, "btree", 1000)
+	defer cleanup()
+	expected := ""
+	for i := 0; i < 1000; i++ {
+		expected += fmt.Sprintf("(%v, %v)\n", i, i)
+	}
+	// The partial final batch is flushed too.
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &countingWriter{}
+	if err = db.StreamEntries(cursor, w, 64, formatRow); err != nil {
+		t.Fatal(err)
+	}
+	if w.out.String() != expected {
+		t.Error("Streamed entries don't match the table")
+	}
+	if w.writes != 16 {
+		t.Errorf("Expected 16 writes, got %v", w.writes)
+	}
+	// A failed write stops the stream.
+	cursor, err = index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = &countingWriter{failAfter: 2}
+	if err = db.StreamEntries(cursor, w, 64, formatRow); err == nil {
+		t.Error("Expected the write error to be returned")
+	}
+	if w.writes != 3 {
+		t.Errorf("Expected streaming to stop after the failed write, got %v writes", w.writes)
+	}
+}
+
+func BenchmarkStreamEntries(b *testing.B) {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+	index, err := btree.OpenTable(tmpfile.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(10000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Stream over loopback to a client that discards everything.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	for _, batchSize := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("batch=%v", batchSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cursor, err := index.TableStart()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = db.StreamEntries(cursor, conn, batchSize, formatRow); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,20 @@
 package test
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 type hash_kv struct {
@@ -49,6 +57,28 @@ func TestHashTA(t *testing.T) {
 	t.Run("TestHashDeleteTen", testHashDeleteTen)
 	t.Run("TestHashUpdateTenNoWrite", testHashUpdateTenNoWrite)
 	t.Run("TestHashUpdateTen", testHashUpdateTen)
+	t.Run("TestHashCursorLastBucket", testHashCursorLastBucket)
+	t.Run("TestHashCursorAfterSplits", testHashCursorAfterSplits)
+	t.Run("TestHashTableFind", testHashTableFind)
+	t.Run("TestHashSelectConcurrent", testHashSelectConcurrent)
+	t.Run("TestHashSelectParallel", testHashSelectParallel)
+	t.Run("TestHashSelectOrdered", testHashSelectOrdered)
+	t.Run("TestHashBucketSplitSignal", testHashBucketSplitSignal)
+	t.Run("TestHashInsertDuplicate", testHashInsertDuplicate)
+	t.Run("TestHashBucketDeleteLast", testHashBucketDeleteLast)
+	t.Run("TestHashInsertBatch", testHashInsertBatch)
+	t.Run("TestHashSetHashFn", testHashSetHashFn)
+	t.Run("TestHashAlwaysCollide", testHashAlwaysCollide)
+	t.Run("TestHashSelectFilter", testHashSelectFilter)
+	t.Run("TestHashStrictInvariants", testHashStrictInvariants)
+	t.Run("TestHashTombstoneCompact", testHashTombstoneCompact)
+	t.Run("TestHashCompactConcurrent", testHashCompactConcurrent)
+	t.Run("TestHashBoundedDepth2", func(t *testing.T) { testHashBounded(t, 2) })
+	t.Run("TestHashBoundedDepth4", func(t *testing.T) { testHashBounded(t, 4) })
+	t.Run("TestHashPrintJSON", testHashPrintJSON)
+	t.Run("TestHashCoalesce", func(t *testing.T) { testHashCoalesce(t, 100) })
+	t.Run("TestHashCoalesceAfterSplits", func(t *testing.T) { testHashCoalesce(t, 2000) })
+	t.Run("TestHashTableFindRange", testHashTableFindRange)
 }
 
 func testHashInsertTenNoWrite(t *testing.T) {
@@ -380,3 +410,1207 @@ func testHashUpdateTen(t *testing.T) {
 	}
 	index.Close()
 }
+
+func testHashCursorLastBucket(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Insert(1, 1)
+	// Walk every bucket; the cursor must stop after the last page.
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for steps := int64(0); ; steps++ {
+		if steps > index.GetPager().GetNumPages()+1 {
+			t.Fatal("Cursor did not stop after the last bucket")
+		}
+		if !cursor.IsEnd() {
+			if _, err := cursor.GetEntry(); err != nil {
+				t.Error(err)
+			}
+			found++
+		}
+		if cursor.StepForward() {
+			break
+		}
+	}
+	if found != 1 {
+		t.Errorf("Expected 1 entry, found %d", found)
+	}
+	if !cursor.StepForward() {
+		t.Error("Stepping past the end should stay at the end")
+	}
+}
+
+// A cursor walks bucket pages in order; every page holds a bucket, even after splits and
+// coalescing, so it should see exactly what Select does.
+func testHashCursorAfterSplits(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, _ := genRandomHashEntries(3000)
+	for _, entry := range entries {
+		if err = index.Insert(entry.key, entry.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range entries[:2500] {
+		if err = index.Delete(entry.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	selected, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[entry.GetKey()] {
+				t.Fatalf("Cursor visited %v twice", entry.GetKey())
+			}
+			seen[entry.GetKey()] = true
+		}
+		if cursor.StepForward() {
+			break
+		}
+	}
+	if len(seen) != len(selected) {
+		t.Fatalf("Cursor visited %v entries, Select returned %v", len(seen), len(selected))
+	}
+	for _, entry := range selected {
+		if !seen[entry.GetKey()] {
+			t.Fatalf("Cursor missed %v", entry.GetKey())
+		}
+	}
+}
+
+func testHashTableFind(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, _ := genRandomHashEntries(1000)
+	for _, entry := range entries {
+		if err = index.Insert(entry.key, entry.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Present keys put the cursor on their entry.
+	for _, entry := range entries {
+		cursor, err := index.TableFind(entry.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor.IsEnd() {
+			t.Fatalf("Expected a cursor at %v, got the end", entry.key)
+		}
+		found, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.GetKey() != entry.key || found.GetValue() != entry.val {
+			t.Fatalf("Expected (%v, %v), got (%v, %v)", entry.key, entry.val, found.GetKey(), found.GetValue())
+		}
+	}
+	// Absent keys, including deleted ones, put it at the end of the table.
+	if err = index.Delete(entries[0].key); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []int64{-1, entries[0].key} {
+		cursor, err := index.TableFind(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cursor.IsEnd() {
+			t.Fatalf("Expected no entry for %v", key)
+		}
+		if _, err := cursor.GetEntry(); err == nil {
+			t.Fatalf("Expected GetEntry to fail for %v", key)
+		}
+		if !cursor.StepForward() {
+			t.Fatalf("Expected the cursor for %v to stay at the end", key)
+		}
+	}
+}
+
+func testHashSelectConcurrent(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 10; i++ {
+		index.Insert(i, i)
+	}
+	// Find a key that lands in some bucket other than the first one scanned.
+	table := index.GetTable()
+	keyB := int64(100)
+	for table.GetBuckets()[hash.Hasher(keyB, table.GetDepth())] == 0 {
+		keyB++
+	}
+	// Hold bucket A (page 0) so the scan is stuck there.
+	bucketA, err := table.GetAndLockBucketByPN(0, hash.WRITE_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectDone := make(chan int)
+	go func() {
+		entries, err := index.SelectConcurrent()
+		if err != nil {
+			t.Error(err)
+		}
+		selectDone <- len(entries)
+	}()
+	// Give the scan time to reach bucket A.
+	time.Sleep(50 * time.Millisecond)
+	// A writer to bucket B should finish while the scan is waiting on bucket A.
+	insertDone := make(chan error)
+	go func() {
+		insertDone <- index.Insert(keyB, keyB)
+	}()
+	select {
+	case err := <-insertDone:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Insert into another bucket was blocked by SelectConcurrent")
+	}
+	select {
+	case <-selectDone:
+		t.Fatal("SelectConcurrent should still be waiting on bucket A")
+	default:
+	}
+	bucketA.WUnlock()
+	bucketA.GetPage().Put()
+	if n := <-selectDone; n < 10 {
+		t.Errorf("SelectConcurrent returned %d entries, expected at least 10", n)
+	}
+}
+
+func testHashSelectParallel(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, _ := genRandomHashEntries(5000)
+	for _, entry := range entries {
+		if err = index.Insert(entry.key, entry.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serial, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[int64]int64)
+	for _, entry := range serial {
+		expected[entry.GetKey()] = entry.GetValue()
+	}
+	for _, workers := range []int{0, 1, 4, 64} {
+		parallel, err := index.SelectParallel(workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parallel) != len(serial) {
+			t.Fatalf("%v workers: expected %v entries, got %v", workers, len(serial), len(parallel))
+		}
+		seen := make(map[int64]bool)
+		for _, entry := range parallel {
+			if value, ok := expected[entry.GetKey()]; !ok || value != entry.GetValue() || seen[entry.GetKey()] {
+				t.Fatalf("%v workers: unexpected entry (%v, %v)", workers, entry.GetKey(), entry.GetValue())
+			}
+			seen[entry.GetKey()] = true
+		}
+	}
+}
+
+// Compares a serial Select against SelectParallel over a table of many buckets.
+func BenchmarkHashSelectParallel(b *testing.B) {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+	defer os.Remove(tmpfile.Name() + ".meta")
+	index, err := hash.OpenTable(tmpfile.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer index.Close()
+	if err = index.GetTable().InsertBatch(batchEntries(50000)); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := index.Select(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, workers := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%v", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := index.SelectParallel(workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func testHashSelectOrdered(t *testing.T) {
+	entries, answerKey := genRandomHashEntries(2000)
+	// Load the same entries into two tables, in different orders.
+	selectAll := func(order []int) []hash_kv {
+		dbName := getTempHashDB(t)
+		defer os.Remove(dbName)
+		defer os.Remove(dbName + ".meta")
+		index, err := hash.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for _, i := range order {
+			if err = index.Insert(entries[i].key, entries[i].val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		selected, err := index.SelectOrdered()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := make([]hash_kv, 0, len(selected))
+		for _, entry := range selected {
+			ret = append(ret, hash_kv{key: entry.GetKey(), val: entry.GetValue()})
+		}
+		return ret
+	}
+	inOrder := make([]int, len(entries))
+	for i := range inOrder {
+		inOrder[i] = i
+	}
+	first := selectAll(inOrder)
+	second := selectAll(rand.Perm(len(entries)))
+	if len(first) != len(answerKey) || len(second) != len(answerKey) {
+		t.Fatalf("Expected %v entries, got %v and %v", len(answerKey), len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Entry %v differs: %v vs %v", i, first[i], second[i])
+		}
+		if i > 0 && first[i-1].key >= first[i].key {
+			t.Fatalf("Entries %v and %v are out of order", i-1, i)
+		}
+		if answerKey[first[i].key] != first[i].val {
+			t.Errorf("Entry %v has the wrong value", first[i].key)
+		}
+	}
+}
+
+func testHashBucketSplitSignal(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	bucket, err := hash.NewHashBucket(p, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.GetPage().Put()
+	// The bucket asks to split once it holds BUCKETSIZE entries, and not before.
+	for i := int64(1); i <= hash.BUCKETSIZE; i++ {
+		split, err := bucket.Insert(i, i*hash_salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if split != (i == hash.BUCKETSIZE) {
+			t.Fatalf("Insert %v of %v: got split signal %v", i, hash.BUCKETSIZE, split)
+		}
+	}
+	for i := int64(1); i <= hash.BUCKETSIZE; i++ {
+		if entry, found := bucket.Find(i); !found || entry.GetValue() != i*hash_salt {
+			t.Fatalf("Expected to find %v", i)
+		}
+	}
+}
+
+func testHashInsertDuplicate(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Enough entries that the key's bucket has split.
+	for i := int64(0); i < 1000; i++ {
+		if err = index.Insert(i, i*hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A second insert of a key fails, as in the btree, and leaves the first in place.
+	for _, key := range []int64{0, 500, 999} {
+		if err = index.Insert(key, -1); err == nil || err.Error() != "cannot insert duplicate key" {
+			t.Errorf("Expected inserting %v again to fail, got %v", key, err)
+		}
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != key*hash_salt {
+			t.Errorf("Expected (%v, %v) to be kept, got %v, %v", key, key*hash_salt, entry, err)
+		}
+	}
+	duplicate := hash.HashEntry{}
+	duplicate.SetKey(3)
+	duplicate.SetValue(-1)
+	if err = index.GetTable().InsertBatch([]utils.Entry{&duplicate}); err == nil {
+		t.Error("Expected InsertBatch to refuse a duplicate key")
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1000 {
+		t.Errorf("Expected 1000 entries, got %v", len(entries))
+	}
+	// InsertDuplicate keeps both.
+	if err = index.InsertDuplicate(7, -7); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = index.Select(); len(entries) != 1001 {
+		t.Errorf("Expected 1001 entries, got %v", len(entries))
+	}
+	// Buckets refuse duplicates too.
+	p := pager.NewPager()
+	if err := p.Open(getTempHashDB(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(p.GetFileName())
+	defer p.Close()
+	bucket, err := hash.NewHashBucket(p, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.GetPage().Put()
+	if _, err = bucket.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bucket.Insert(1, 2); err == nil {
+		t.Error("Expected the bucket to refuse a duplicate key")
+	}
+	if entry, _ := bucket.Find(1); entry == nil || entry.GetValue() != 1 {
+		t.Errorf("Expected (1, 1) to be kept, got %v", entry)
+	}
+}
+
+func testHashBucketDeleteLast(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	bucket, err := hash.NewHashBucket(p, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.GetPage().Put()
+	// Fill the bucket, then delete the entry in its last cell.
+	for i := int64(1); i <= hash.BUCKETSIZE; i++ {
+		if _, err := bucket.Insert(i, i*hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bucket.Delete(hash.BUCKETSIZE); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := bucket.Find(hash.BUCKETSIZE); found {
+		t.Fatalf("Expected %v to be deleted", hash.BUCKETSIZE)
+	}
+	entries, err := bucket.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != hash.BUCKETSIZE-1 {
+		t.Fatalf("Expected %v entries, got %v", hash.BUCKETSIZE-1, len(entries))
+	}
+	for i, entry := range entries {
+		key := int64(i) + 1
+		if entry.GetKey() != key || entry.GetValue() != key*hash_salt {
+			t.Fatalf("Expected entry %v to be (%v, %v), got (%v, %v)",
+				i, key, key*hash_salt, entry.GetKey(), entry.GetValue())
+		}
+	}
+}
+
+// batchEntries returns n entries with random keys, in the form InsertBatch takes.
+func batchEntries(n int) []utils.Entry {
+	kvs, _ := genRandomHashEntries(n)
+	entries := make([]utils.Entry, len(kvs))
+	for i, kv := range kvs {
+		entry := hash.HashEntry{}
+		entry.SetKey(kv.key)
+		entry.SetValue(kv.val)
+		entries[i] = &entry
+	}
+	return entries
+}
+
+func testHashInsertBatch(t *testing.T) {
+	entries := batchEntries(5000)
+	// Load one table with InsertBatch and another one entry at a time.
+	batchName, singleName := getTempHashDB(t), getTempHashDB(t)
+	defer os.Remove(batchName)
+	defer os.Remove(batchName + ".meta")
+	defer os.Remove(singleName)
+	defer os.Remove(singleName + ".meta")
+	batch, err := hash.OpenTable(batchName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Close()
+	single, err := hash.OpenTable(singleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	if err = batch.GetTable().InsertBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err = single.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, index := range []*hash.HashIndex{batch, single} {
+		if ok, err := hash.IsHash(index); err != nil || !ok {
+			t.Fatalf("Expected a valid hash table, got %v, %v", ok, err)
+		}
+	}
+	if batch.GetTable().GetDepth() != single.GetTable().GetDepth() ||
+		batch.GetPager().GetNumPages() != single.GetPager().GetNumPages() {
+		t.Fatalf("Expected the same shape, got depth %v with %v pages and depth %v with %v pages",
+			batch.GetTable().GetDepth(), batch.GetPager().GetNumPages(),
+			single.GetTable().GetDepth(), single.GetPager().GetNumPages())
+	}
+	batchSelected, err := batch.SelectOrdered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleSelected, err := single.SelectOrdered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batchSelected) != len(entries) || len(singleSelected) != len(entries) {
+		t.Fatalf("Expected %v entries, got %v and %v", len(entries), len(batchSelected), len(singleSelected))
+	}
+	for i := range batchSelected {
+		if batchSelected[i].GetKey() != singleSelected[i].GetKey() ||
+			batchSelected[i].GetValue() != singleSelected[i].GetValue() {
+			t.Fatalf("Entry %v differs: (%v, %v) and (%v, %v)", i,
+				batchSelected[i].GetKey(), batchSelected[i].GetValue(),
+				singleSelected[i].GetKey(), singleSelected[i].GetValue())
+		}
+	}
+}
+
+// Compares loading a table with InsertBatch against one Insert per entry.
+func BenchmarkHashInsertBatch(b *testing.B) {
+	entries := batchEntries(20000)
+	load := map[string]func(index *hash.HashIndex) error{
+		"batch": func(index *hash.HashIndex) error {
+			return index.GetTable().InsertBatch(entries)
+		},
+		"single": func(index *hash.HashIndex) error {
+			for _, entry := range entries {
+				if err := index.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	for _, name := range []string{"batch", "single"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tmpfile, err := ioutil.TempFile(".", "db-*")
+				if err != nil {
+					b.Fatal(err)
+				}
+				tmpfile.Close()
+				index, err := hash.OpenTable(tmpfile.Name())
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err = load[name](index); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				index.GetPager().Close()
+				os.Remove(tmpfile.Name())
+			}
+		})
+	}
+}
+
+func testHashSetHashFn(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Hash keys to their own low bits, so multiples of 4 all collide in the starting buckets.
+	index.GetTable().SetHashFn(func(key int64, depth int64) int64 {
+		return key & (1<<uint(depth) - 1)
+	})
+	n := 5 * hash.BUCKETSIZE
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(4*i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth := index.GetTable().GetDepth(); depth <= 2 {
+		t.Fatalf("Expected colliding keys to split buckets, got global depth %v", depth)
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Fatalf("Expected a valid hash table, got %v, %v", ok, err)
+	}
+	for i := int64(0); i < n; i++ {
+		if err = index.Update(4*i, -(i % hash_salt)); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := index.Find(4 * i)
+		if err != nil || entry.GetValue() != -(i%hash_salt) {
+			t.Fatalf("Expected to find %v", 4*i)
+		}
+		if err = index.Delete(4 * i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testHashAlwaysCollide(t *testing.T) {
+	collide := func(key int64, depth int64) int64 { return 0 }
+	// An unbounded table can't split entries that always collide, so inserts past what one
+	// bucket holds fail, rather than split forever.
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.GetTable().SetHashFn(collide)
+	depth := index.GetTable().GetDepth()
+	n := hash.BUCKETSIZE - 1
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 3; i++ {
+		if err = index.Insert(n+i, 0); err == nil {
+			t.Fatal("Expected inserting past a full bucket of colliding keys to fail")
+		}
+	}
+	if d := index.GetTable().GetDepth(); d != depth {
+		t.Errorf("Expected failed inserts to leave global depth %v, got %v", depth, d)
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Fatalf("Expected a valid hash table, got %v, %v", ok, err)
+	}
+	for i := int64(0); i < n; i++ {
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != i%hash_salt {
+			t.Fatalf("Expected to find %v", i)
+		}
+	}
+	if entry, _ := index.Find(n); entry != nil {
+		t.Errorf("Failed insert of %v left an entry behind", n)
+	}
+	// A bounded table splits down to its maximum depth, then chains them.
+	boundedName := getTempHashDB(t)
+	defer os.Remove(boundedName)
+	defer os.Remove(boundedName + ".meta")
+	bounded, err := hash.OpenTableBounded(boundedName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bounded.Close()
+	bounded.GetTable().SetHashFn(collide)
+	n = 3 * hash.BUCKETSIZE
+	for i := int64(0); i < n; i++ {
+		if err = bounded.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		if entry, err := bounded.Find(i); err != nil || entry.GetValue() != i%hash_salt {
+			t.Fatalf("Expected to find %v", i)
+		}
+	}
+}
+
+func testHashSelectFilter(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Enough entries to split into many buckets.
+	n := 5 * hash.BUCKETSIZE
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i*hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.GetPager().GetNumPages() <= 4 {
+		t.Fatalf("Expected the table to split, got %v pages", index.GetPager().GetNumPages())
+	}
+	threshold := (n / 3) * hash_salt
+	filters := []struct {
+		name string
+		pred func(key int64, value int64) bool
+	}{
+		{"even keys", func(key int64, value int64) bool { return key%2 == 0 }},
+		{"values above threshold", func(key int64, value int64) bool { return value > threshold }},
+		{"nothing", func(key int64, value int64) bool { return false }},
+	}
+	for _, filter := range filters {
+		entries, err := index.SelectFilter(func(entry utils.Entry) bool {
+			return filter.pred(entry.GetKey(), entry.GetValue())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := make(map[int64]bool)
+		for i := int64(0); i < n; i++ {
+			if filter.pred(i, i*hash_salt) {
+				expected[i] = true
+			}
+		}
+		if len(entries) != len(expected) {
+			t.Fatalf("%s: expected %v entries, got %v", filter.name, len(expected), len(entries))
+		}
+		for _, entry := range entries {
+			if !expected[entry.GetKey()] || entry.GetValue() != entry.GetKey()*hash_salt {
+				t.Fatalf("%s: unexpected entry (%v, %v)", filter.name, entry.GetKey(), entry.GetValue())
+			}
+			delete(expected, entry.GetKey())
+		}
+	}
+}
+
+// overwriteVarint writes value as a varint at the given offset of a bucket's page.
+func overwriteVarint(t *testing.T, index *hash.HashIndex, pn int64, offset int64, size int64, value int64) {
+	bucket, err := index.GetTable().GetBucketByPN(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.GetPage().Put()
+	data := make([]byte, size)
+	binary.PutVarint(data, value)
+	bucket.GetPage().Update(data, offset, size)
+}
+
+func testHashStrictInvariants(t *testing.T) {
+	corruptions := []struct {
+		name    string
+		corrupt func(index *hash.HashIndex)
+		message string
+	}{
+		{"negative entry count", func(index *hash.HashIndex) {
+			overwriteVarint(t, index, 0, hash.NUM_KEYS_OFFSET, hash.NUM_KEYS_SIZE, -1)
+		}, "holds -1 entries"},
+		{"overfull bucket", func(index *hash.HashIndex) {
+			overwriteVarint(t, index, 0, hash.NUM_KEYS_OFFSET, hash.NUM_KEYS_SIZE, hash.BUCKETSIZE+1)
+		}, fmt.Sprintf("holds %v entries", hash.BUCKETSIZE+1)},
+		{"bucket deeper than the table", func(index *hash.HashIndex) {
+			overwriteVarint(t, index, 0, hash.DEPTH_OFFSET, hash.DEPTH_SIZE, index.GetTable().GetDepth()+1)
+		}, "deeper than global depth"},
+		{"slots swapped", func(index *hash.HashIndex) {
+			buckets := index.GetTable().GetBuckets()
+			buckets[0], buckets[1] = buckets[1], buckets[0]
+		}, "does not hash"},
+	}
+	for _, corruption := range corruptions {
+		dbName := getTempHashDB(t)
+		defer os.Remove(dbName)
+		defer os.Remove(dbName + ".meta")
+		index, err := hash.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for i := int64(0); i < 3*hash.BUCKETSIZE; i++ {
+			if err = index.Insert(i, i%hash_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = hash.IsHashStrict(index); err != nil {
+			t.Fatalf("%s: expected a valid table before corrupting it, got %v", corruption.name, err)
+		}
+		corruption.corrupt(index)
+		err = hash.IsHashStrict(index)
+		if err == nil || !strings.Contains(err.Error(), corruption.message) {
+			t.Fatalf("%s: expected an error containing %q, got %v", corruption.name, corruption.message, err)
+		}
+	}
+}
+
+func testHashTombstoneCompact(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := 3 * hash.BUCKETSIZE
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages := index.GetPager().GetNumPages()
+	// Deleting in place leaves the entries' slots occupied, but Find skips them.
+	index.SetDeleteMode(utils.TOMBSTONE_DELETE)
+	for i := int64(0); i < n; i += 3 {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		_, err := index.Find(i)
+		if deleted := i%3 == 0; deleted != (err != nil) {
+			t.Fatalf("Key %v: deleted %v, but Find returned %v", i, deleted, err)
+		}
+	}
+	if frag := index.Fragmentation(); frag < 0.3 || frag > 0.35 {
+		t.Fatalf("Expected about a third of the slots to be dead, got %v", frag)
+	}
+	// Measuring waits for writers holding the table, such as a split or coalesce.
+	index.GetTable().WLock()
+	measured := make(chan float64)
+	go func() { measured <- index.Fragmentation() }()
+	select {
+	case <-measured:
+		index.GetTable().WUnlock()
+		t.Fatal("Fragmentation should wait for the table's lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	index.GetTable().WUnlock()
+	if frag := <-measured; frag < 0.3 || frag > 0.35 {
+		t.Fatalf("Expected about a third of the slots to be dead, got %v", frag)
+	}
+	// Compacting frees exactly the dead slots, without touching live entries.
+	if removed, err := index.Compact(); err != nil || removed != (n+2)/3 {
+		t.Fatalf("Expected Compact to remove %v entries, removed %v (%v)", (n+2)/3, removed, err)
+	}
+	if frag := index.Fragmentation(); frag != 0 {
+		t.Fatalf("Expected no dead slots after compacting, got %v", frag)
+	}
+	if after := index.GetPager().GetNumPages(); after != pages {
+		t.Fatalf("Expected compaction to keep %v pages, got %v", pages, after)
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Fatalf("Expected a valid hash table, got %v, %v", ok, err)
+	}
+	for i := int64(1); i < n; i++ {
+		if i%3 == 0 {
+			continue
+		}
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != i%hash_salt {
+			t.Fatalf("Expected to find %v after compacting", i)
+		}
+	}
+}
+
+// Compacts over and over while inserts split buckets and deletes coalesce them; run with -race.
+func testHashCompactConcurrent(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(2000)
+	done := make(chan struct{})
+	compacted := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				compacted <- nil
+				return
+			default:
+			}
+			if _, err := index.Compact(); err != nil {
+				compacted <- err
+				return
+			}
+		}
+	}()
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(5); i < n; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err = <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	if pages := index.GetPager().GetNumPages(); pages != 2 {
+		t.Fatalf("Expected the table to shrink to 2 pages, got %v", pages)
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Fatalf("Expected a valid hash table, got %v, %v", ok, err)
+	}
+	for i := int64(0); i < 5; i++ {
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != i%hash_salt {
+			t.Fatalf("Expected to find %v", i)
+		}
+	}
+	// Compact waits for the table's lock, so it can't walk pages a split or coalesce is moving.
+	index.GetTable().RLock()
+	go func() {
+		_, err := index.Compact()
+		compacted <- err
+	}()
+	select {
+	case <-compacted:
+		index.GetTable().RUnlock()
+		t.Fatal("Compact should wait for the table's write lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	index.GetTable().RUnlock()
+	if err = <-compacted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Inserts far more keys than 2^maxDepth buckets hold; the rest must go to overflow pages.
+func testHashBounded(t *testing.T, maxDepth int64) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTableBounded(dbName, maxDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert the first half one at a time, and the second in a batch.
+	n := 3 * hash.BUCKETSIZE << uint(maxDepth)
+	batch := make([]utils.Entry, 0, n/2)
+	for i := int64(0); i < n; i++ {
+		if i < n/2 {
+			if err = index.Insert(i, i%hash_salt); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		entry := hash.HashEntry{}
+		entry.SetKey(i)
+		entry.SetValue(i % hash_salt)
+		batch = append(batch, &entry)
+	}
+	if err = index.GetTable().InsertBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if depth := index.GetTable().GetDepth(); depth != maxDepth {
+		t.Fatalf("Expected global depth %v, got %v", maxDepth, depth)
+	}
+	if pages := index.GetPager().GetNumPages(); pages <= 1<<uint(maxDepth) {
+		t.Fatalf("Expected overflow pages past the %v buckets, got %v pages", 1<<uint(maxDepth), pages)
+	}
+	// Every third key is deleted, and the rest updated.
+	for i := int64(0); i < n; i++ {
+		if i%3 == 0 {
+			err = index.Delete(i)
+		} else {
+			err = index.Update(i, -(i % hash_salt))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		if err := hash.IsHashStrict(index); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < n; i++ {
+			entry, err := index.Find(i)
+			if i%3 == 0 {
+				if err == nil {
+					t.Fatalf("Expected %v to be deleted", i)
+				}
+			} else if err != nil || entry.GetValue() != -(i%hash_salt) {
+				t.Fatalf("Expected to find %v", i)
+			}
+		}
+		if entries, err := index.SelectParallel(4); err != nil || int64(len(entries)) != n-(n+2)/3 {
+			t.Fatalf("Expected %v entries, got %v (%v)", n-(n+2)/3, len(entries), err)
+		}
+	}
+	check()
+	// The bound and the overflow pages outlast reopening the table.
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if got := index.GetTable().GetMaxDepth(); got != maxDepth {
+		t.Fatalf("Expected maximum depth %v after reopening, got %v", maxDepth, got)
+	}
+	check()
+}
+
+// hashBucketJSON is a bucket as PrintJSON writes it.
+type hashBucketJSON struct {
+	PN       int64            `json:"pn"`
+	Depth    int64            `json:"depth"`
+	Entries  [][]int64        `json:"entries"`
+	Overflow []hashBucketJSON `json:"overflow"`
+}
+
+func testHashPrintJSON(t *testing.T) {
+	// A lone bucket.
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := hash.NewHashBucket(p, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		bucket.Insert(i, i*hash_salt)
+	}
+	var out strings.Builder
+	bucket.PrintJSON(&out)
+	bucket.GetPage().Put()
+	p.Close()
+	var parsed hashBucketJSON
+	if err = json.Unmarshal([]byte(out.String()), &parsed); err != nil {
+		t.Fatalf("Bucket JSON %q: %v", out.String(), err)
+	}
+	if parsed.Depth != 3 || len(parsed.Entries) != 3 || parsed.Entries[2][0] != 3 || parsed.Entries[2][1] != 3*hash_salt {
+		t.Fatalf("Unexpected bucket JSON %q", out.String())
+	}
+
+	// Whole tables, with and without overflow pages.
+	for _, maxDepth := range []int64{0, 2} {
+		tableName := getTempHashDB(t)
+		defer os.Remove(tableName)
+		defer os.Remove(tableName + ".meta")
+		index, err := hash.OpenTableBounded(tableName, maxDepth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		n := 10 * hash.BUCKETSIZE
+		for i := int64(0); i < n; i++ {
+			if err = index.Insert(i, i%hash_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out.Reset()
+		index.GetTable().PrintJSON(&out)
+		var table struct {
+			GlobalDepth int64            `json:"globalDepth"`
+			Buckets     []hashBucketJSON `json:"buckets"`
+		}
+		if err = json.Unmarshal([]byte(out.String()), &table); err != nil {
+			t.Fatalf("Table JSON: %v", err)
+		}
+		if table.GlobalDepth != index.GetTable().GetDepth() {
+			t.Fatalf("Expected global depth %v, got %v", index.GetTable().GetDepth(), table.GlobalDepth)
+		}
+		pages, entries := int64(0), int64(0)
+		for _, bucket := range table.Buckets {
+			for _, page := range append([]hashBucketJSON{bucket}, bucket.Overflow...) {
+				if page.Depth > table.GlobalDepth {
+					t.Fatalf("Bucket on page %v is deeper than the table", page.PN)
+				}
+				for _, entry := range page.Entries {
+					if len(entry) != 2 || entry[1] != entry[0]%hash_salt {
+						t.Fatalf("Unexpected entry %v", entry)
+					}
+				}
+				pages++
+				entries += int64(len(page.Entries))
+			}
+		}
+		if pages != index.GetPager().GetNumPages() || entries != n {
+			t.Fatalf("Expected %v pages holding %v entries, got %v holding %v",
+				index.GetPager().GetNumPages(), n, pages, entries)
+		}
+	}
+}
+
+// Inserts n keys, then deletes all but 5; the buckets should coalesce back to the last two.
+func testHashCoalesce(t *testing.T, n int64) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := index.GetPager().GetNumPages()
+	for i := int64(5); i < n; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pages := index.GetPager().GetNumPages(); pages >= grown || pages != 2 {
+		t.Fatalf("Expected %v pages to shrink to 2, got %v", grown, pages)
+	}
+	if depth := index.GetTable().GetDepth(); depth != 1 {
+		t.Fatalf("Expected global depth 1, got %v", depth)
+	}
+	// The table should still be well-formed after reopening.
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if pages := index.GetPager().GetNumPages(); pages != 2 {
+		t.Fatalf("Expected the file to hold 2 pages, got %v", pages)
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Fatalf("Expected a valid hash table, got %v, %v", ok, err)
+	}
+	for i := int64(0); i < n; i++ {
+		entry, err := index.Find(i)
+		if i >= 5 {
+			if err == nil {
+				t.Fatalf("Expected %v to be deleted", i)
+			}
+			continue
+		}
+		if err != nil || entry.GetValue() != i%hash_salt {
+			t.Fatalf("Expected to find %v", i)
+		}
+	}
+}
+
+func testHashTableFindRange(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	btreeName := getTempHashDB(t)
+	defer os.Remove(btreeName)
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	// Insert the same entries into both, in a random order.
+	for _, i := range rand.Perm(3000) {
+		key := int64(i*2 - 1000)
+		if err = hashIndex.Insert(key, key%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+		if err = btreeIndex.Insert(key, key%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Ranges inside, overlapping, and outside the keys, empty and reversed.
+	ranges := [][2]int64{{-2000, 6000}, {-1000, 4999}, {-1001, 0}, {1, 2}, {0, 1},
+		{101, 1501}, {4000, 7000}, {7000, 8000}, {-5000, -1001}, {100, 100}, {500, 100}}
+	for _, r := range ranges {
+		got, err := hashIndex.TableFindRange(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := btreeIndex.TableFindRange(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("range %v: got %v entries, btree has %v", r, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].GetKey() != want[i].GetKey() || got[i].GetValue() != want[i].GetValue() {
+				t.Fatalf("range %v: entry %v is (%v, %v), btree has (%v, %v)", r, i,
+					got[i].GetKey(), got[i].GetValue(), want[i].GetKey(), want[i].GetValue())
+			}
+		}
+	}
+	// The range includes both ends.
+	entries, err := hashIndex.TableFindRange(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 || entries[0].GetKey() != 0 || entries[5].GetKey() != 10 {
+		t.Error("TableFindRange should return the keys in [startKey, endKey]")
+	}
+}
@@ -0,0 +1,449 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	list "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/list"
+	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+)
+
+func TestListTA(t *testing.T) {
+	t.Run("TestTypedListNumeric", testTypedListNumeric)
+	t.Run("TestTypedListMixed", testTypedListMixed)
+	t.Run("TestListInsertBeforeAfter", testListInsertBeforeAfter)
+	t.Run("TestListRemoveWhere", testListRemoveWhere)
+	t.Run("TestListFilter", testListFilter)
+	t.Run("TestListPopHeadTail", testListPopHeadTail)
+	t.Run("TestListMapWhile", testListMapWhile)
+	t.Run("TestListLen", testListLen)
+	t.Run("TestListPopSelfDetaches", testListPopSelfDetaches)
+	t.Run("TestListInsertOnDetached", testListInsertOnDetached)
+	t.Run("TestListReplRemove", testListReplRemove)
+	t.Run("TestListReverse", testListReverse)
+	t.Run("TestListReplQuoted", testListReplQuoted)
+	t.Run("TestListReplClientOutput", testListReplClientOutput)
+}
+
+// checkListOrder checks the list's contents both from head to tail and from tail to head.
+func checkListOrder(t *testing.T, l *list.List, expected ...int) {
+	i := 0
+	for link := l.PeekHead(); link != nil; link = link.GetNext() {
+		if i >= len(expected) || link.GetKey() != expected[i] {
+			t.Fatalf("Forward traversal mismatch at %d, expected %v", i, expected)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("Forward traversal found %d links, expected %d", i, len(expected))
+	}
+	for link := l.PeekTail(); link != nil; link = link.GetPrev() {
+		i--
+		if i < 0 || link.GetKey() != expected[i] {
+			t.Fatalf("Backward traversal mismatch at %d, expected %v", i, expected)
+		}
+	}
+	if i != 0 {
+		t.Fatalf("Backward traversal stopped early, expected %v", expected)
+	}
+}
+
+// runListCommands runs each command line against the given REPL.
+func runListCommands(t *testing.T, r *repl.REPL, lines ...string) {
+	for _, line := range lines {
+		trigger := strings.Fields(line)[0]
+		if err := r.GetCommands()[trigger](line, nil); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+}
+
+// listValues returns the list's values from head to tail.
+func listValues(l *list.List) []interface{} {
+	values := make([]interface{}, 0)
+	l.Map(func(link *list.Link) { values = append(values, link.GetKey()) })
+	return values
+}
+
+func testTypedListNumeric(t *testing.T) {
+	l := list.NewList()
+	r := list.TypedListRepl(l)
+	runListCommands(t, r, "list_push_tail 1", "list_push_tail -20", "list_push_tail 007")
+	values := listValues(l)
+	expected := []int64{1, -20, 7}
+	if len(values) != len(expected) {
+		t.Fatalf("Expected %d values, got %d", len(expected), len(values))
+	}
+	for i, value := range values {
+		if n, ok := value.(int64); !ok || n != expected[i] {
+			t.Errorf("Value %d: expected int64 %d, got %#v", i, expected[i], value)
+		}
+	}
+	// Equality is numeric, so "7" matches the stored 007.
+	runListCommands(t, r, "list_remove 7")
+	if values = listValues(l); len(values) != 2 {
+		t.Errorf("Expected numeric removal, list is %v", values)
+	}
+}
+
+func testTypedListMixed(t *testing.T) {
+	l := list.NewList()
+	r := list.TypedListRepl(l)
+	runListCommands(t, r, "list_push_tail 42", "list_push_tail bees", "list_push_tail 4.2")
+	values := listValues(l)
+	if n, ok := values[0].(int64); !ok || n != 42 {
+		t.Errorf("Expected int64 42, got %#v", values[0])
+	}
+	for _, value := range values[1:] {
+		if _, ok := value.(string); !ok {
+			t.Errorf("Expected a string, got %#v", value)
+		}
+	}
+	runListCommands(t, r, "list_remove bees")
+	if err := r.GetCommands()["list_remove"]("list_remove bees", nil); err == nil {
+		t.Error("Removing a missing element should fail")
+	}
+	// An untyped list keeps numbers as strings.
+	untyped := list.NewList()
+	runListCommands(t, list.ListRepl(untyped), "list_push_head 42")
+	if _, ok := untyped.PeekHead().GetKey().(string); !ok {
+		t.Error("Untyped list should store strings")
+	}
+}
+
+func testListInsertBeforeAfter(t *testing.T) {
+	l := list.NewList()
+	only := l.PushHead(2)
+	// Around a single element.
+	only.InsertBefore(1)
+	checkListOrder(t, l, 1, 2)
+	tail := only.InsertAfter(4)
+	checkListOrder(t, l, 1, 2, 4)
+	// In the middle.
+	tail.InsertBefore(3)
+	checkListOrder(t, l, 1, 2, 3, 4)
+	only.InsertAfter(5)
+	checkListOrder(t, l, 1, 2, 5, 3, 4)
+	// Around the head and tail.
+	l.PeekHead().InsertBefore(0)
+	l.PeekTail().InsertAfter(6)
+	checkListOrder(t, l, 0, 1, 2, 5, 3, 4, 6)
+	if l.PeekHead().GetKey() != 0 || l.PeekTail().GetKey() != 6 {
+		t.Error("Head and tail not updated")
+	}
+	if l.PeekHead().GetNext().InsertAfter(7).GetList() != l {
+		t.Error("Inserted link should belong to the list")
+	}
+}
+
+// newIntList builds a list holding the given values in order.
+func newIntList(values ...int) *list.List {
+	l := list.NewList()
+	for _, v := range values {
+		l.PushTail(v)
+	}
+	return l
+}
+
+func testListRemoveWhere(t *testing.T) {
+	isEven := func(link *list.Link) bool { return link.GetKey().(int)%2 == 0 }
+	// Adjacent matches must not be skipped.
+	l := newIntList(1, 2, 4, 5, 6, 8)
+	if n := l.RemoveWhere(isEven); n != 4 {
+		t.Errorf("Expected 4 removals, got %d", n)
+	}
+	checkListOrder(t, l, 1, 5)
+	// None.
+	if n := l.RemoveWhere(isEven); n != 0 {
+		t.Errorf("Expected 0 removals, got %d", n)
+	}
+	checkListOrder(t, l, 1, 5)
+	// The head.
+	l = newIntList(1, 2, 3)
+	l.RemoveWhere(func(link *list.Link) bool { return link.GetKey() == 1 })
+	checkListOrder(t, l, 2, 3)
+	// The tail.
+	l.RemoveWhere(func(link *list.Link) bool { return link.GetKey() == 3 })
+	checkListOrder(t, l, 2)
+	// All.
+	l = newIntList(1, 2, 3)
+	if n := l.RemoveWhere(func(link *list.Link) bool { return true }); n != 3 {
+		t.Errorf("Expected 3 removals, got %d", n)
+	}
+	if l.PeekHead() != nil || l.PeekTail() != nil {
+		t.Error("List should be empty")
+	}
+}
+
+func testListFilter(t *testing.T) {
+	l := newIntList(1, 2, 3, 4)
+	filtered := l.Filter(func(link *list.Link) bool { return link.GetKey().(int) > 2 })
+	checkListOrder(t, filtered, 3, 4)
+	checkListOrder(t, l, 1, 2, 3, 4)
+	empty := l.Filter(func(link *list.Link) bool { return false })
+	checkListOrder(t, empty)
+}
+
+func testListPopHeadTail(t *testing.T) {
+	// Empty.
+	l := list.NewList()
+	if l.PopHead() != nil || l.PopTail() != nil {
+		t.Error("Popping an empty list should return nil")
+	}
+	// A single element, from either end.
+	l = newIntList(1)
+	only := l.PeekHead()
+	if v := l.PopHead(); v != 1 {
+		t.Errorf("Expected 1, got %v", v)
+	}
+	if l.PeekHead() != nil || l.PeekTail() != nil {
+		t.Error("List should be empty")
+	}
+	if only.GetList() != nil || only.GetPrev() != nil || only.GetNext() != nil {
+		t.Error("Popped link should be detached")
+	}
+	l = newIntList(1)
+	if v := l.PopTail(); v != 1 || l.PeekHead() != nil || l.PeekTail() != nil {
+		t.Errorf("Expected 1 and an empty list, got %v", v)
+	}
+	// Several elements.
+	l = newIntList(1, 2, 3, 4)
+	head, tail := l.PeekHead(), l.PeekTail()
+	if v := l.PopHead(); v != 1 {
+		t.Errorf("Expected 1, got %v", v)
+	}
+	if v := l.PopTail(); v != 4 {
+		t.Errorf("Expected 4, got %v", v)
+	}
+	checkListOrder(t, l, 2, 3)
+	if head.GetNext() != nil || tail.GetPrev() != nil {
+		t.Error("Popped links should be detached")
+	}
+	l.PushHead(0)
+	l.PushTail(5)
+	checkListOrder(t, l, 0, 2, 3, 5)
+	for _, expected := range []int{0, 2, 3, 5} {
+		if v := l.PopHead(); v != expected {
+			t.Errorf("Expected %v, got %v", expected, v)
+		}
+	}
+	if l.PopTail() != nil || l.PeekHead() != nil || l.PeekTail() != nil {
+		t.Error("List should be empty")
+	}
+}
+
+func testListMapWhile(t *testing.T) {
+	// Map visits every link and changes them in place.
+	l := newIntList(1, 2, 3, 4, 5)
+	visited := 0
+	l.Map(func(link *list.Link) {
+		visited++
+		link.SetKey(link.GetKey().(int) * 10)
+	})
+	if visited != 5 {
+		t.Errorf("Expected Map to visit 5 links, visited %v", visited)
+	}
+	checkListOrder(t, l, 10, 20, 30, 40, 50)
+	// MapWhile stops at the first link f returns false on.
+	seen := make([]int, 0)
+	l.MapWhile(func(link *list.Link) bool {
+		seen = append(seen, link.GetKey().(int))
+		return len(seen) < 2
+	})
+	if len(seen) != 2 || seen[0] != 10 || seen[1] != 20 {
+		t.Errorf("Expected MapWhile to stop after 10, 20, saw %v", seen)
+	}
+	// And goes all the way if it never returns false.
+	seen = seen[:0]
+	l.MapWhile(func(link *list.Link) bool {
+		seen = append(seen, link.GetKey().(int))
+		return true
+	})
+	if len(seen) != 5 {
+		t.Errorf("Expected MapWhile to visit 5 links, saw %v", seen)
+	}
+	// Links can be removed along the way.
+	l.MapWhile(func(link *list.Link) bool {
+		link.PopSelf()
+		return link.GetKey() != 30
+	})
+	checkListOrder(t, l, 40, 50)
+	// An empty list is never visited.
+	list.NewList().MapWhile(func(link *list.Link) bool {
+		t.Error("MapWhile visited an empty list")
+		return true
+	})
+}
+
+// checkLen checks the list's length against both Len and a traversal.
+func checkLen(t *testing.T, l *list.List, expected int) {
+	t.Helper()
+	if l.Len() != expected || len(listValues(l)) != expected {
+		t.Errorf("Expected length %v, got Len %v and %v links", expected, l.Len(), len(listValues(l)))
+	}
+}
+
+func testListLen(t *testing.T) {
+	l := list.NewList()
+	checkLen(t, l, 0)
+	a := l.PushHead(1)
+	b := l.PushTail(2)
+	checkLen(t, l, 2)
+	a.InsertAfter(3)
+	b.InsertBefore(4)
+	a.InsertBefore(0)
+	b.InsertAfter(5)
+	checkLen(t, l, 6)
+	// Popping a link twice only removes it once.
+	a.PopSelf()
+	a.PopSelf()
+	checkLen(t, l, 5)
+	l.PopHead()
+	l.PopTail()
+	checkLen(t, l, 3)
+	b.PopSelf()
+	b.PopSelf()
+	checkLen(t, l, 2)
+	l.RemoveWhere(func(link *list.Link) bool { return true })
+	checkLen(t, l, 0)
+	l.PopHead()
+	a.PopSelf()
+	checkLen(t, l, 0)
+	// A popped link's list can be reused.
+	l.PushTail(7)
+	checkLen(t, l, 1)
+	if l.Filter(func(link *list.Link) bool { return true }).Len() != 1 {
+		t.Error("Filtered list has the wrong length")
+	}
+}
+
+func testListPopSelfDetaches(t *testing.T) {
+	// Head, tail, interior and only links are all detached.
+	l := newIntList(1, 2, 3, 4)
+	head, tail := l.PeekHead(), l.PeekTail()
+	interior := head.GetNext()
+	for _, link := range []*list.Link{head, tail, interior} {
+		link.PopSelf()
+		if link.GetNext() != nil || link.GetPrev() != nil || link.GetList() != nil {
+			t.Errorf("Link %v still points into the list", link.GetKey())
+		}
+	}
+	checkListOrder(t, l, 3)
+	only := l.PeekHead()
+	only.PopSelf()
+	if only.GetNext() != nil || only.GetPrev() != nil || only.GetList() != nil {
+		t.Error("Only link still points into the list")
+	}
+	checkListOrder(t, l)
+}
+
+func testListInsertOnDetached(t *testing.T) {
+	// Inserting next to a popped head, tail or interior link adds nothing.
+	l := newIntList(1, 2, 3)
+	head, tail := l.PeekHead(), l.PeekTail()
+	interior := head.GetNext()
+	for _, link := range []*list.Link{head, tail, interior} {
+		link.PopSelf()
+		if link.InsertBefore(0) != nil || link.InsertAfter(0) != nil {
+			t.Errorf("Inserted next to popped link %v", link.GetKey())
+		}
+	}
+	checkListOrder(t, l)
+	checkLen(t, l, 0)
+}
+
+func testListReplRemove(t *testing.T) {
+	l := list.NewList()
+	out := runOverPipe(list.ListRepl(l), "list_push_tail a", "list_push_tail foo", "list_push_tail b",
+		"list_remove foo", "list_print", "list_contains foo", "list_remove foo", "list_remove",
+		"list_push_tail x y")
+	for _, expected := range []string{
+		"> a\nb\n> ",
+		"not found\n",
+		"element foo not found\n",
+		"usage: list_remove <value>\n",
+		"usage: list_push_tail <value>\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in output %q", expected, out)
+		}
+	}
+	checkLen(t, l, 2)
+}
+
+func testListReverse(t *testing.T) {
+	l := newIntList(1, 2, 3, 4, 5)
+	forward := listValues(l)
+	backward := make([]interface{}, 0)
+	l.MapReverse(func(link *list.Link) { backward = append(backward, link.GetKey()) })
+	if len(backward) != len(forward) {
+		t.Fatalf("Expected %v values, got %v", len(forward), len(backward))
+	}
+	for i := range forward {
+		if forward[i] != backward[len(backward)-1-i] {
+			t.Fatalf("Reverse order %v doesn't mirror forward order %v", backward, forward)
+		}
+	}
+	// FindReverse finds the last match, Find the first.
+	isEven := func(link *list.Link) bool { return link.GetKey().(int)%2 == 0 }
+	if link := l.FindReverse(isEven); link == nil || link.GetKey() != 4 {
+		t.Errorf("Expected FindReverse to find 4, got %v", link)
+	}
+	if link := l.Find(isEven); link == nil || link.GetKey() != 2 {
+		t.Errorf("Expected Find to find 2, got %v", link)
+	}
+	if l.FindReverse(func(link *list.Link) bool { return false }) != nil {
+		t.Error("Expected FindReverse to find nothing")
+	}
+	// Removing links already visited is safe.
+	var visited *list.Link
+	seen := make([]interface{}, 0)
+	l.MapReverse(func(link *list.Link) {
+		if visited != nil {
+			visited.PopSelf()
+		}
+		seen = append(seen, link.GetKey())
+		visited = link
+	})
+	if len(seen) != 5 {
+		t.Errorf("Expected to visit 5 links while removing, saw %v", seen)
+	}
+	checkListOrder(t, l, 1)
+	// An empty list is never visited.
+	list.NewList().MapReverse(func(link *list.Link) {
+		t.Error("MapReverse visited an empty list")
+	})
+}
+
+func testListReplQuoted(t *testing.T) {
+	l := list.NewList()
+	r := list.ListRepl(l)
+	runListCommands(t, r, `list_push_tail "hello world"`, `list_push_tail "say \"hi\""`)
+	values := listValues(l)
+	if len(values) != 2 || values[0] != "hello world" || values[1] != `say "hi"` {
+		t.Errorf("Unexpected values %q", values)
+	}
+	runListCommands(t, r, `list_remove "hello world"`)
+	if l.Len() != 1 {
+		t.Errorf("Expected 1 value left, got %v", l.Len())
+	}
+	if err := r.GetCommands()["list_push_tail"](`list_push_tail "open`, nil); err == nil {
+		t.Error("Expected an error on unbalanced quotes")
+	}
+}
+
+func testListReplClientOutput(t *testing.T) {
+	l := list.NewList()
+	l.PushTail("a")
+	r := list.ListRepl(l)
+	// Two clients at once each see only their own output.
+	outputs := make(chan string)
+	go func() { outputs <- runOverPipe(r, "list_contains a", "list_contains a", "list_contains a") }()
+	go func() { outputs <- runOverPipe(r, "list_print", "list_print", "list_print") }()
+	seen := map[string]bool{<-outputs: true, <-outputs: true}
+	for _, expected := range []string{"> found!\n> found!\n> found!\n> ", "> a\n> a\n> a\n> "} {
+		if !seen[expected] {
+			t.Errorf("Expected a client to see %q, got %v", expected, seen)
+		}
+	}
+}
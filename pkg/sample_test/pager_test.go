@@ -0,0 +1,498 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+)
+
+func TestPagerTA(t *testing.T) {
+	t.Run("TestPagerRejectsNoPage", testPagerRejectsNoPage)
+	t.Run("TestPagerCoalescedFlush", testPagerCoalescedFlush)
+	t.Run("TestPageLatchFIFO", testPageLatchFIFO)
+	t.Run("TestPagerEvictionCallback", testPagerEvictionCallback)
+	t.Run("TestPagerBufferPool", testPagerBufferPool)
+	t.Run("TestPagerStats", testPagerStats)
+	t.Run("TestPagerEvictionPolicies", testPagerEvictionPolicies)
+	t.Run("TestPagerClockSecondChance", testPagerClockSecondChance)
+	t.Run("TestPagerPrefetch", testPagerPrefetch)
+}
+
+// dirtyPages writes a marker into pages [0, n) and returns them unpinned.
+func dirtyPages(t testing.TB, p *pager.Pager, n int64, marker byte) {
+	for pn := int64(0); pn < n; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update([]byte{marker, byte(pn)}, 0, 2)
+		page.Put()
+	}
+}
+
+func testPagerRejectsNoPage(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := p.GetPage(pager.NOPAGE); err == nil {
+		t.Error("GetPage(NOPAGE) should fail")
+	}
+	if _, err := p.GetPage(-5); err == nil {
+		t.Error("GetPage with a negative pagenum should fail")
+	}
+	if p.GetNumPages() != 0 {
+		t.Error("Rejected requests should not allocate pages")
+	}
+}
+
+func testPagerCoalescedFlush(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	// Dirty a contiguous range with a gap, so both runs and single pages are written.
+	n := int64(pager.MAXPAGES)
+	dirtyPages(t, p, n, 7)
+	page, err := p.GetPage(n / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.SetDirty(false)
+	page.Put()
+	p.FlushAllPages()
+	p.Close()
+	// Read the pages back from disk.
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for pn := int64(0); pn < n; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := *page.GetData()
+		if pn == n/2 {
+			if data[0] != 0 {
+				t.Errorf("Clean page %d should not have been written", pn)
+			}
+		} else if data[0] != 7 || data[1] != byte(pn) {
+			t.Errorf("Page %d has wrong contents after flush", pn)
+		}
+		page.Put()
+	}
+}
+
+func BenchmarkFlushAllPages(b *testing.B) {
+	for _, coalesce := range []bool{false, true} {
+		b.Run(fmt.Sprintf("coalesce=%v", coalesce), func(b *testing.B) {
+			tmpfile, err := ioutil.TempFile(".", "db-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			tmpfile.Close()
+			defer os.Remove(tmpfile.Name())
+			p := pager.NewPager()
+			if err := p.Open(tmpfile.Name()); err != nil {
+				b.Fatal(err)
+			}
+			defer p.Close()
+			p.SetCoalesceFlushes(coalesce)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dirtyPages(b, p, pager.MAXPAGES, byte(i))
+				p.FlushAllPages()
+			}
+		})
+	}
+}
+
+func testPageLatchFIFO(t *testing.T) {
+	p := pager.NewPager()
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	// Queue writers and readers alternately behind a reader holding the page.
+	page.RLock()
+	var mtx sync.Mutex
+	order := make([]string, 0)
+	var wg sync.WaitGroup
+	expected := []string{"w1", "r2", "w3", "r4"}
+	for _, name := range expected {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if name[0] == 'w' {
+				page.WLock()
+				defer page.WUnlock()
+			} else {
+				page.RLock()
+				defer page.RUnlock()
+			}
+			mtx.Lock()
+			order = append(order, name)
+			mtx.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}(name)
+		// Give each request time to join the queue before the next arrives.
+		time.Sleep(10 * time.Millisecond)
+	}
+	page.RUnlock()
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued requests were never granted the latch")
+	}
+	// Each request is granted in arrival order; a reader never overtakes an earlier writer.
+	if strings.Join(order, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected the latch to be granted in order %v, got %v", expected, order)
+	}
+}
+
+func testPagerEvictionCallback(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	evicted := make([]int64, 0)
+	p.SetEvictionCallback(func(pagenum int64) {
+		evicted = append(evicted, pagenum)
+	})
+	// Filling the pool from free frames evicts nothing.
+	n := int64(pager.MAXPAGES)
+	dirtyPages(t, p, n, 1)
+	if len(evicted) != 0 {
+		t.Fatalf("Expected no evictions, got %v", evicted)
+	}
+	// Touch page 0 so page 1 is the least recently unpinned.
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	page, err = p.GetPage(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	if len(evicted) != 1 || evicted[0] != 1 {
+		t.Fatalf("Expected page 1 to be evicted, got %v", evicted)
+	}
+	// Evicted pages were flushed before the callback; removing it stops the calls.
+	p.SetEvictionCallback(nil)
+	page, err = p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := *page.GetData(); data[0] != 1 || data[1] != 1 {
+		t.Errorf("Evicted page was not written back: got %v", data[:2])
+	}
+	page.Put()
+	if len(evicted) != 1 {
+		t.Errorf("Callback ran after being removed: %v", evicted)
+	}
+}
+
+func testPagerBufferPool(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// Pin pages 0 and 2, dirty and unpin page 1, then unpin page 0.
+	page0, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page1, err := p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page2, err := p.GetPage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page2.Get()
+	page1.Update([]byte{9}, 0, 1)
+	page1.Put()
+	page0.SetDirty(false)
+	page0.Put()
+	expected := []pager.FrameInfo{
+		{List: pager.PINNED_FRAME, PageNum: 2, PinCount: 2, Dirty: true},
+		{List: pager.UNPINNED_FRAME, PageNum: 1, PinCount: 0, Dirty: true},
+		{List: pager.UNPINNED_FRAME, PageNum: 0, PinCount: 0, Dirty: false},
+	}
+	frames := p.Frames()
+	if len(frames) != pager.MAXPAGES {
+		t.Fatalf("Expected %v frames, got %v", pager.MAXPAGES, len(frames))
+	}
+	for i, frame := range frames {
+		if i < len(expected) && frame != expected[i] {
+			t.Errorf("Frame %v: expected %+v, got %+v", i, expected[i], frame)
+		}
+		if i >= len(expected) && (frame.List != pager.FREE_FRAME || frame.PageNum != pager.NOPAGE) {
+			t.Errorf("Frame %v: expected a free frame, got %+v", i, frame)
+		}
+	}
+	// The REPL command lists the same frames.
+	var out bytes.Buffer
+	if err = pager.HandleBufferPool(p, "pager_bufferpool", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "pinned (pagenum: 2, pincount: 2, dirty: true)\n"+
+		"unpinned (pagenum: 1, pincount: 0, dirty: true)\n") {
+		t.Errorf("Unexpected listing:\n%v", out.String())
+	}
+	// Resetting refuses while a page is pinned.
+	if err = pager.HandleBufferPool(p, "pager_bufferpool reset", &out); err == nil {
+		t.Error("Expected reset to refuse while a page is pinned")
+	}
+	page2.Put()
+	page2.Put()
+	if dropped, err := p.DropUnpinned(); err != nil || dropped != 3 {
+		t.Fatalf("Expected 3 pages dropped, got %v, %v", dropped, err)
+	}
+	for _, frame := range p.Frames() {
+		if frame.List != pager.FREE_FRAME {
+			t.Errorf("Expected every frame to be free, got %+v", frame)
+		}
+	}
+	// Dropped pages were written back.
+	page1, err = p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*page1.GetData())[0] != 9 {
+		t.Error("Dropped page was not flushed")
+	}
+	page1.Put()
+}
+
+func testPagerStats(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	dirtyPages(t, p, 1, 1)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reading a page twice from a cold pool misses once, then hits.
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for i := 0; i < 2; i++ {
+		page, err := p.GetPage(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	if stats := p.Stats(); stats != (pager.PagerStats{Hits: 1, Misses: 1}) {
+		t.Fatalf("Expected one miss and one hit, got %+v", stats)
+	}
+	// Overfilling the pool evicts the least recently used page, flushing it first.
+	p.ResetStats()
+	n := int64(pager.MAXPAGES)
+	dirtyPages(t, p, n+1, 2)
+	expected := pager.PagerStats{Hits: 1, Misses: n, Evictions: 1, Flushes: 1}
+	if stats := p.Stats(); stats != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, stats)
+	}
+	// Flushing writes back every other dirty page.
+	p.FlushAllPages()
+	expected.Flushes += n
+	if stats := p.Stats(); stats != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, stats)
+	}
+	p.ResetStats()
+	if stats := p.Stats(); stats != (pager.PagerStats{}) {
+		t.Errorf("Expected reset stats to be zero, got %+v", stats)
+	}
+}
+
+func testPagerEvictionPolicies(t *testing.T) {
+	n := int64(pager.MAXPAGES)
+	// Fill the pool with pages [0, n) in order, then touch page 0, bring in page n,
+	// touch page 1, and bring in page n+1.
+	expected := map[pager.EvictionPolicy][]int64{
+		// Page 1 is the least recently used; bringing it back evicts page 2, and page n+1 page 3.
+		pager.LRU_EVICTION: {1, 2, 3},
+		// Touching pages doesn't matter; they go in the order they came in.
+		pager.FIFO_EVICTION: {0, 1},
+		// The first sweep clears every reference bit and comes back around to page 0;
+		// touching page 1 then spares it on the second.
+		pager.CLOCK_EVICTION: {0, 2},
+	}
+	for policy, victims := range expected {
+		dbName := getTempBTreeDB(t)
+		defer os.Remove(dbName)
+		p := pager.NewPagerWithPolicy(policy)
+		if err := p.Open(dbName); err != nil {
+			t.Fatal(err)
+		}
+		if p.GetEvictionPolicy() != policy {
+			t.Errorf("Expected eviction policy %v, got %v", policy, p.GetEvictionPolicy())
+		}
+		evicted := make([]int64, 0)
+		p.SetEvictionCallback(func(pagenum int64) {
+			evicted = append(evicted, pagenum)
+		})
+		dirtyPages(t, p, n, 1)
+		for _, pn := range []int64{0, n, 1, n + 1} {
+			page, err := p.GetPage(pn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page.Put()
+		}
+		if fmt.Sprint(evicted) != fmt.Sprint(victims) {
+			t.Errorf("Policy %v: expected pages %v to be evicted, got %v", policy, victims, evicted)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testPagerClockSecondChance(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPagerWithPolicy(pager.CLOCK_EVICTION)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	evicted := make([]int64, 0)
+	p.SetEvictionCallback(func(pagenum int64) {
+		evicted = append(evicted, pagenum)
+	})
+	touch := func(pn int64) {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	// Fill the pool; bringing in one more page sweeps every reference bit clear
+	// and comes back around to evict page 0.
+	n := int64(pager.MAXPAGES)
+	dirtyPages(t, p, n, 1)
+	touch(n)
+	// Page 3, referenced ahead of the hand, survives its pass and goes on the next one,
+	// after the pages brought in since, which the hand also passes once.
+	touch(3)
+	expected := []int64{0, 1, 2}
+	for pn := int64(4); pn < n; pn++ {
+		expected = append(expected, pn)
+	}
+	expected = append(expected, 3)
+	for next := n + 1; len(evicted) < len(expected); next++ {
+		touch(next)
+	}
+	if fmt.Sprint(evicted) != fmt.Sprint(expected) {
+		t.Fatalf("Expected pages %v to be evicted, got %v", expected, evicted)
+	}
+}
+
+func testPagerPrefetch(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Write more pages than the pool holds.
+	n := int64(pager.MAXPAGES) + 8
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	dirtyPages(t, p, n, 3)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Prefetch(-1, 4); err == nil {
+		t.Error("Prefetching from a negative page should fail")
+	}
+	if err := p.Prefetch(0, -4); err == nil {
+		t.Error("Prefetching a negative number of pages should fail")
+	}
+	// Prefetched pages are read in unpinned, so getting them hits.
+	if err := p.Prefetch(2, 5); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range p.Frames() {
+		if frame.List == pager.PINNED_FRAME {
+			t.Errorf("Prefetched page %v is pinned", frame.PageNum)
+		}
+	}
+	for pn := int64(2); pn < 7; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := *page.GetData(); data[0] != 3 || data[1] != byte(pn) {
+			t.Errorf("Prefetched page %v holds %v", pn, data[:2])
+		}
+		page.Put()
+	}
+	if stats := p.Stats(); stats != (pager.PagerStats{Hits: 5, Prefetches: 5}) {
+		t.Fatalf("Expected 5 prefetches, then 5 hits, got %+v", stats)
+	}
+	// Resident pages are skipped, and prefetching stops at the end of the file.
+	if err := p.Prefetch(0, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prefetch(n-2, 8); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Prefetches != 10 {
+		t.Fatalf("Expected 10 prefetches, got %+v", stats)
+	}
+	// Prefetching fills the free frames, then stops without evicting anything.
+	if err := p.Prefetch(0, n); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Prefetches != int64(pager.MAXPAGES) || stats.Evictions != 0 {
+		t.Fatalf("Expected %v prefetches and no evictions, got %+v", pager.MAXPAGES, stats)
+	}
+}
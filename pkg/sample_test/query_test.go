@@ -2,25 +2,50 @@ package test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 	"github.com/csci1270-fall-2023/dbms-projects-handout/pkg/query"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+
+	errgroup "golang.org/x/sync/errgroup"
 )
 
 func TestQueryTA(t *testing.T) {
 	t.Run("TestQuerySimple", testQuerySimple)
 	t.Run("TestFilterInsertAndCheckSmall", testFilterInsertAndCheckSmall)
+	t.Run("TestFilterFalsePositiveRate", testFilterFalsePositiveRate)
+	t.Run("TestMultiJoinChain", testMultiJoinChain)
+	t.Run("TestMultiJoinFanIn", testMultiJoinFanIn)
+	t.Run("TestApproxDistinct", testApproxDistinct)
+	t.Run("TestJoinSlowConsumer", testJoinSlowConsumer)
+	t.Run("TestSortSpill", testSortSpill)
+	t.Run("TestJoinDuplicateValues", testJoinDuplicateValues)
+	t.Run("TestJoinBloomFilter", testJoinBloomFilter)
+	t.Run("TestJoinOuter", testJoinOuter)
+	t.Run("TestNestedLoopJoin", testNestedLoopJoin)
+	t.Run("TestJoinConcurrentBuild", testJoinConcurrentBuild)
+	t.Run("TestJoinBuildHoldsOffVacuum", testJoinBuildHoldsOffVacuum)
+	t.Run("TestJoinQuiet", testJoinQuiet)
+	t.Run("TestJoinEmpty", testJoinEmpty)
+	t.Run("TestJoinSentCount", testJoinSentCount)
 }
 
 // Mod vals by this value to prevent hardcoding tests
 var query_salt int64 = rand.Int63n(1000)
 
-func getTempQueryDB(t *testing.T) string {
+func getTempQueryDB(t testing.TB) string {
 	tmpfile, err := ioutil.TempFile(".", "db-*")
 	if err != nil {
 		t.Error(err)
@@ -136,3 +161,905 @@ func testFilterInsertAndCheckSmall(t *testing.T) {
 		}
 	}
 }
+
+func testFilterFalsePositiveRate(t *testing.T) {
+	// With n = 10k keys in m = 2^17 bits, (1 - e^(-2n/m))^2 is about 2%.
+	n, size, bound := int64(10000), int64(1<<17), 0.04
+	filter := query.CreateFilter(size)
+	for i := int64(0); i < n; i++ {
+		filter.Insert(i * 7919)
+	}
+	for i := int64(0); i < n; i++ {
+		if !filter.Contains(i * 7919) {
+			t.Fatalf("inserted value %d but not found", i*7919)
+		}
+	}
+	falsePositives := 0
+	for i := int64(0); i < n; i++ {
+		if filter.Contains(i*7919 + 1) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / float64(n); rate > bound {
+		t.Errorf("False-positive rate %v exceeds %v", rate, bound)
+	}
+}
+
+// getTempHashIndex opens a hash index holding the given key-value pairs.
+// The returned function closes it and removes its files.
+func getTempHashIndex(t testing.TB, kvs ...int64) (*hash.HashIndex, func()) {
+	dbName := getTempQueryDB(t)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		os.Remove(dbName)
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if err = index.Insert(kvs[i], kvs[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return index, func() {
+		index.Close()
+		os.Remove(dbName)
+		os.Remove(dbName + ".meta")
+	}
+}
+
+func testMultiJoinChain(t *testing.T) {
+	// a.value = b.key, then b.value = c.key.
+	a, cleanupA := getTempHashIndex(t, 1, 10, 2, 20, 3, 30, 4, 10)
+	defer cleanupA()
+	b, cleanupB := getTempHashIndex(t, 10, 100, 20, 200, 40, 100)
+	defer cleanupB()
+	c, cleanupC := getTempHashIndex(t, 100, 7, 300, 8)
+	defer cleanupC()
+	before, _ := filepath.Glob("db-*")
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	specs := []query.JoinSpec{{LeftOnKey: false, RightOnKey: true}, {LeftOnKey: false, RightOnKey: true}}
+	resultsChan, _, group, cleanupCallback, err := query.MultiJoin(ctx, []db.Index{a, b, c}, specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]query.EntryPair, 0)
+	done := make(chan bool)
+	go func() {
+		for pair := range resultsChan {
+			results = append(results, pair)
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	cleanupCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (10, 100) is reached from two entries of a; (40, 100) from none.
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %v", len(results))
+	}
+	for _, pair := range results {
+		if pair.GetLeft().GetKey() != 10 || pair.GetLeft().GetValue() != 100 ||
+			pair.GetRight().GetKey() != 100 || pair.GetRight().GetValue() != 7 {
+			t.Errorf("Unexpected result %v", pair)
+		}
+	}
+	if after, _ := filepath.Glob("db-*"); len(after) != len(before) {
+		t.Errorf("Intermediate indexes were left behind: %v", after)
+	}
+
+	// A cancelled context stops the pipeline and cleans up after itself.
+	cancelCtx()
+	_, _, _, cleanupCallback, err = query.MultiJoin(ctx, []db.Index{a, b, c}, specs)
+	if cleanupCallback != nil {
+		cleanupCallback()
+	}
+	if err == nil {
+		t.Error("Expected an error from a cancelled join")
+	}
+	if after, _ := filepath.Glob("db-*"); len(after) != len(before) {
+		t.Errorf("Intermediate indexes were left behind: %v", after)
+	}
+
+	// So does a final join that fails, without the caller cleaning up.
+	defer func(maxEntries int64) { query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries) }(query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get())
+	query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(0)
+	_, _, _, cleanupCallback, err = query.MultiJoin(context.Background(), []db.Index{a, b, failingIndex{Index: c}}, specs)
+	if err == nil {
+		t.Error("Expected an error from a join reading a failing table")
+	}
+	if cleanupCallback != nil {
+		t.Error("Expected no cleanup callback from a failed join")
+	}
+	if after, _ := filepath.Glob("db-*"); len(after) != len(before) {
+		t.Errorf("Intermediate indexes were left behind: %v", after)
+	}
+}
+
+func testMultiJoinFanIn(t *testing.T) {
+	// a.value = b.key, then b.value = c.key, where (10, 100) is reached from 600 entries of a,
+	// more than a bucket of the intermediate index holds, and (20, 200) from 3.
+	aKvs := make([]int64, 0)
+	for i := int64(0); i < 603; i++ {
+		value := int64(10)
+		if i >= 600 {
+			value = 20
+		}
+		aKvs = append(aKvs, i, value)
+	}
+	a, cleanupA := getTempHashIndex(t, aKvs...)
+	defer cleanupA()
+	b, cleanupB := getTempHashIndex(t, 10, 100, 20, 200, 30, 300)
+	defer cleanupB()
+	c, cleanupC := getTempHashIndex(t, 100, 7, 200, 8)
+	defer cleanupC()
+	before := countTempDBs(t)
+
+	specs := []query.JoinSpec{{LeftOnKey: false, RightOnKey: true}, {LeftOnKey: false, RightOnKey: true}}
+	results := joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+		return query.MultiJoin(ctx, []db.Index{a, b, c}, specs)
+	})
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result]++
+	}
+	if len(results) != 603 || counts["10:100 100:7"] != 600 || counts["20:200 200:8"] != 3 {
+		t.Errorf("Expected 600 of (10, 100) and 3 of (20, 200), got %v", counts)
+	}
+	if countTempDBs(t) != before {
+		t.Error("Intermediate indexes were left behind")
+	}
+}
+
+func testJoinSlowConsumer(t *testing.T) {
+	// Far more bucket pairs than the buffer pool has frames, all with results pending.
+	n := int64(20000)
+	kvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		kvs = append(kvs, i, i)
+	}
+	left, cleanupLeft := getTempHashIndex(t, kvs...)
+	defer cleanupLeft()
+	right, cleanupRight := getTempHashIndex(t, kvs...)
+	defer cleanupRight()
+	if numBuckets := len(left.GetTable().GetBuckets()); numBuckets <= 32 {
+		t.Fatalf("Expected more buckets than buffer pool frames, got %v", numBuckets)
+	}
+	defer func(size int) { query.JOIN_CHANNEL_BUFFER.Set(size) }(query.JOIN_CHANNEL_BUFFER.Get())
+	query.JOIN_CHANNEL_BUFFER.Set(0)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := query.Join(ctx, left, right, true, true)
+	if err != nil {
+		if cleanupCallback != nil {
+			cleanupCallback()
+		}
+		t.Fatal(err)
+	}
+	// Bucket pairs waiting to send keep their copies; there are never more than the slots.
+	maxPairs := int64(query.JOIN_MAX_PINNED_BUCKETS.Get())
+	peakPairs := int64(0)
+	done := make(chan int64)
+	go func() {
+		count := int64(0)
+		for pair := range resultsChan {
+			// Stall at first, so every probe is blocked sending.
+			if count < 10 {
+				time.Sleep(20 * time.Millisecond)
+				if pairs := query.BucketPairsInFlight(); pairs > peakPairs {
+					peakPairs = pairs
+				}
+			}
+			if pair.GetLeft().GetKey() != pair.GetRight().GetKey() {
+				t.Errorf("Unexpected result %v", pair)
+			}
+			count++
+		}
+		done <- count
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	count := <-done
+	cleanupCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("Expected %v results, got %v", n, count)
+	}
+	if peakPairs < 1 || peakPairs > maxPairs {
+		t.Errorf("Expected between 1 and %v bucket pairs held at once, saw %v", maxPairs, peakPairs)
+	}
+}
+
+// withinPercent returns true if estimate is within pct percent of actual.
+func withinPercent(estimate int64, actual int64, pct float64) bool {
+	return math.Abs(float64(estimate-actual)) <= float64(actual)*pct/100
+}
+
+func testApproxDistinct(t *testing.T) {
+	// A few million values with repeats, straight into the sketch.
+	hll := query.CreateHyperLogLog(query.HLL_PRECISION)
+	distinct := int64(1500000)
+	for i := int64(0); i < 2*distinct; i++ {
+		hll.Insert((i % distinct) * 7919)
+	}
+	if estimate := hll.Estimate(); !withinPercent(estimate, distinct, 2) {
+		t.Errorf("Estimated %v distinct values, expected about %v", estimate, distinct)
+	}
+	// Small counts use linear counting and stay accurate too.
+	small := query.CreateHyperLogLog(query.HLL_PRECISION)
+	for i := int64(0); i < 100; i++ {
+		small.Insert(i)
+	}
+	if estimate := small.Estimate(); !withinPercent(estimate, 100, 2) {
+		t.Errorf("Estimated %v distinct values, expected about 100", estimate)
+	}
+
+	// Over an index, on keys and on values.
+	n := int64(20000)
+	kvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		kvs = append(kvs, i, i%5000)
+	}
+	index, cleanup := getTempHashIndex(t, kvs...)
+	defer cleanup()
+	estimate, err := query.ApproxDistinct(index, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !withinPercent(estimate, n, 2) {
+		t.Errorf("Estimated %v distinct keys, expected about %v", estimate, n)
+	}
+	estimate, err = query.ApproxDistinct(index, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !withinPercent(estimate, 5000, 2) {
+		t.Errorf("Estimated %v distinct values, expected about %v", estimate, 5000)
+	}
+}
+
+func testJoinDuplicateValues(t *testing.T) {
+	// Each value repeats 10 times on the left and 5 times on the right.
+	leftKvs := make([]int64, 0, 600)
+	for i := int64(0); i < 300; i++ {
+		leftKvs = append(leftKvs, i, i%30)
+	}
+	rightKvs := make([]int64, 0, 400)
+	for i := int64(0); i < 200; i++ {
+		rightKvs = append(rightKvs, 1000+i, i%40)
+	}
+	left, cleanupLeft := getTempHashIndex(t, leftKvs...)
+	defer cleanupLeft()
+	right, cleanupRight := getTempHashIndex(t, rightKvs...)
+	defer cleanupRight()
+	results, err := getresults(t, left, right, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every left entry pairs with every right entry sharing its value.
+	seen := make(map[[2]int64]bool)
+	for _, pair := range results {
+		l, r := pair.GetLeft(), pair.GetRight()
+		if l.GetValue() != r.GetValue() || l.GetValue() != l.GetKey()%30 || r.GetValue() != (r.GetKey()-1000)%40 {
+			t.Fatalf("Unexpected pair (%v, %v), (%v, %v)", l.GetKey(), l.GetValue(), r.GetKey(), r.GetValue())
+		}
+		if seen[[2]int64{l.GetKey(), r.GetKey()}] {
+			t.Fatalf("Pair of keys %v and %v returned twice", l.GetKey(), r.GetKey())
+		}
+		seen[[2]int64{l.GetKey(), r.GetKey()}] = true
+	}
+	if len(results) != 30*10*5 {
+		t.Errorf("Expected %v pairs, got %v", 30*10*5, len(results))
+	}
+
+	// A low-cardinality column repeats each value more times than a bucket holds, on both sides.
+	lRepeats, rRepeats := hash.BucketSize(1)+20, hash.BucketSize(1)+5
+	lowLeftKvs := make([]int64, 0)
+	for i := int64(0); i < 2*lRepeats; i++ {
+		lowLeftKvs = append(lowLeftKvs, i, i%2)
+	}
+	lowRightKvs := make([]int64, 0)
+	for i := int64(0); i < 2*rRepeats; i++ {
+		lowRightKvs = append(lowRightKvs, 1000+i, i%2)
+	}
+	lowLeft, cleanupLowLeft := getTempHashIndex(t, lowLeftKvs...)
+	defer cleanupLowLeft()
+	lowRight, cleanupLowRight := getTempHashIndex(t, lowRightKvs...)
+	defer cleanupLowRight()
+	results, err = getresults(t, lowLeft, lowRight, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen = make(map[[2]int64]bool)
+	for _, pair := range results {
+		l, r := pair.GetLeft(), pair.GetRight()
+		if l.GetValue() != r.GetValue() || l.GetValue() != l.GetKey()%2 || r.GetValue() != (r.GetKey()-1000)%2 {
+			t.Fatalf("Unexpected pair (%v, %v), (%v, %v)", l.GetKey(), l.GetValue(), r.GetKey(), r.GetValue())
+		}
+		seen[[2]int64{l.GetKey(), r.GetKey()}] = true
+	}
+	if expected := 2 * lRepeats * rRepeats; int64(len(seen)) != expected || int64(len(results)) != expected {
+		t.Errorf("Expected %v distinct pairs, got %v of %v", expected, len(seen), len(results))
+	}
+}
+
+// countTempDBs returns the number of temporary db files in the working directory.
+func countTempDBs(t *testing.T) int {
+	matches, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+// checkSorted checks that sorted holds the entries of kvs in ascending order of key,
+// or of value then key if onKey is false.
+func checkSorted(t *testing.T, sorted db.Index, kvs []int64, onKey bool) {
+	prevKey, prevValue := int64(math.MinInt64), int64(math.MinInt64)
+	n := int64(0)
+	err := db.Scan(sorted, func(entry utils.Entry) error {
+		values := entry.Values()
+		key, value := values[0], values[1]
+		if entry.GetKey() != n {
+			return fmt.Errorf("entry %v has rank %v", n, entry.GetKey())
+		}
+		if onKey && key <= prevKey {
+			return fmt.Errorf("key %v sorted after %v", key, prevKey)
+		}
+		if !onKey && (value < prevValue || (value == prevValue && key <= prevKey)) {
+			return fmt.Errorf("(%v, %v) sorted after (%v, %v)", key, value, prevKey, prevValue)
+		}
+		if kvs[2*key+1] != value {
+			return fmt.Errorf("key %v has value %v, expected %v", key, value, kvs[2*key+1])
+		}
+		prevKey, prevValue = key, value
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(kvs)/2) {
+		t.Fatalf("Expected %v sorted entries, got %v", len(kvs)/2, n)
+	}
+}
+
+func testSortSpill(t *testing.T) {
+	// Keys [0, n) with values running backwards, repeating.
+	n := int64(5000)
+	kvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		kvs = append(kvs, i, (n-i)%700)
+	}
+	index, cleanup := getTempHashIndex(t, kvs...)
+	defer cleanup()
+	before := countTempDBs(t)
+
+	// Small inputs are sorted in memory, without any temporary files.
+	small, smallCleanup := getTempHashIndex(t, kvs[:200]...)
+	defer smallCleanup()
+	before++
+	sorted, sortCleanup, err := query.Sort(small, false, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sorted.GetPager().HasFile() || countTempDBs(t) != before {
+		t.Error("Expected a small sort to stay in memory")
+	}
+	checkSorted(t, sorted, kvs[:200], false)
+	sortCleanup()
+
+	// Large inputs spill to runs, which are gone once merged.
+	sorted, sortCleanup, err = query.Sort(index, false, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sorted.GetPager().HasFile() || countTempDBs(t) != before+1 {
+		t.Error("Expected a large sort to spill to a single merged file")
+	}
+	checkSorted(t, sorted, kvs, false)
+	sortCleanup()
+	if countTempDBs(t) != before {
+		t.Error("Expected cleanup to remove the merged file")
+	}
+
+	// Inputs that fit the buffer but not the buffer pool spill to a single run.
+	sorted, sortCleanup, err = query.Sort(index, true, 100*n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sorted.GetPager().HasFile() {
+		t.Error("Expected a sort too big for the buffer pool to spill")
+	}
+	checkSorted(t, sorted, kvs, true)
+	sortCleanup()
+	if countTempDBs(t) != before {
+		t.Error("Expected cleanup to remove the spilled run")
+	}
+}
+
+func BenchmarkJoinChannelBuffer(b *testing.B) {
+	// Every left entry's value matches a right key.
+	n := int64(1000)
+	leftKvs := make([]int64, 0, 2*n)
+	rightKvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		leftKvs = append(leftKvs, i, i%500)
+		rightKvs = append(rightKvs, i%500, i)
+	}
+	left, cleanupLeft := getTempHashIndex(b, leftKvs...)
+	defer cleanupLeft()
+	right, cleanupRight := getTempHashIndex(b, rightKvs[:1000]...)
+	defer cleanupRight()
+	defer func(size int) { query.JOIN_CHANNEL_BUFFER.Set(size) }(query.JOIN_CHANNEL_BUFFER.Get())
+	for _, size := range []int{0, 64, 1024, 16384} {
+		b.Run(fmt.Sprintf("buffer=%v", size), func(b *testing.B) {
+			query.JOIN_CHANNEL_BUFFER.Set(size)
+			for i := 0; i < b.N; i++ {
+				ctx, cancelCtx := context.WithCancel(context.Background())
+				resultsChan, _, group, cleanupCallback, err := query.Join(ctx, left, right, false, true)
+				if err != nil {
+					b.Fatal(err)
+				}
+				done := make(chan int)
+				go func() {
+					count := 0
+					for range resultsChan {
+						count++
+					}
+					done <- count
+				}()
+				err = group.Wait()
+				close(resultsChan)
+				count := <-done
+				cleanupCallback()
+				cancelCtx()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if int64(count) != n {
+					b.Fatalf("Expected %v results, got %v", n, count)
+				}
+			}
+		})
+	}
+}
+
+func testJoinBloomFilter(t *testing.T) {
+	// Only one key in a hundred has a match, so the filter rules most probes out.
+	n := int64(5000)
+	leftKvs := make([]int64, 0, 2*n)
+	rightKvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		leftKvs = append(leftKvs, i, i)
+		if i%100 == 0 {
+			rightKvs = append(rightKvs, i, -i)
+		} else {
+			rightKvs = append(rightKvs, n+i, -i)
+		}
+	}
+	left, cleanupLeft := getTempHashIndex(t, leftKvs...)
+	defer cleanupLeft()
+	right, cleanupRight := getTempHashIndex(t, rightKvs...)
+	defer cleanupRight()
+	join := func() map[int64]int64 {
+		results, err := getresults(t, left, right, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches := make(map[int64]int64)
+		for _, pair := range results {
+			matches[pair.GetLeft().GetKey()] = pair.GetRight().GetValue()
+		}
+		if len(matches) != len(results) {
+			t.Errorf("Expected %v distinct results, got %v", len(results), len(matches))
+		}
+		return matches
+	}
+	filtered := join()
+	// A 1-bit filter never rules a key out.
+	size := query.DEFAULT_FILTER_SIZE.Get()
+	query.DEFAULT_FILTER_SIZE.Set(1)
+	defer func() { query.DEFAULT_FILTER_SIZE.Set(size) }()
+	unfiltered := join()
+	if len(filtered) != int(n/100) || len(unfiltered) != len(filtered) {
+		t.Fatalf("Expected %v results both ways, got %v and %v", n/100, len(filtered), len(unfiltered))
+	}
+	for key, value := range unfiltered {
+		if filtered[key] != value || value != -key {
+			t.Errorf("Key %v: got %v with the filter and %v without", key, filtered[key], value)
+		}
+	}
+}
+
+// A function starting a join, like query.Join.
+type joinFunc func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error)
+
+// joinResults runs a join and returns its results, rendered and sorted.
+func joinResults(t testing.TB, join joinFunc) []string {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := join(ctx)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]string, 0)
+	done := make(chan bool)
+	go func() {
+		for pair := range resultsChan {
+			side := func(entry utils.Entry) string {
+				if entry == nil {
+					return "nil"
+				}
+				return fmt.Sprintf("%v:%v", entry.GetKey(), entry.GetValue())
+			}
+			results = append(results, side(pair.GetLeft())+" "+side(pair.GetRight()))
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// joinWithType runs a join of the given type and returns its results, rendered and sorted.
+func joinWithType(t *testing.T, left db.Index, right db.Index, joinType query.JoinType) []string {
+	return joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+		return query.JoinWithType(ctx, left, right, false, true, joinType)
+	})
+}
+
+func testJoinOuter(t *testing.T) {
+	// left.value = right.key; 3 and 4 share value 30, which right lacks; right's 40 is unmatched.
+	left, cleanupLeft := getTempHashIndex(t, 1, 10, 2, 20, 3, 30, 4, 30, 5, 10)
+	defer cleanupLeft()
+	right, cleanupRight := getTempHashIndex(t, 10, 100, 20, 200, 40, 400)
+	defer cleanupRight()
+	inner := []string{"1:10 10:100", "2:20 20:200", "5:10 10:100"}
+	unmatchedLeft := []string{"3:30 nil", "4:30 nil"}
+	unmatchedRight := []string{"nil 40:400"}
+	for _, c := range []struct {
+		joinType query.JoinType
+		expected [][]string
+	}{
+		{query.INNER, [][]string{inner}},
+		{query.LEFT_OUTER, [][]string{inner, unmatchedLeft}},
+		{query.RIGHT_OUTER, [][]string{inner, unmatchedRight}},
+		{query.FULL_OUTER, [][]string{inner, unmatchedLeft, unmatchedRight}},
+	} {
+		expected := make([]string, 0)
+		for _, rows := range c.expected {
+			expected = append(expected, rows...)
+		}
+		sort.Strings(expected)
+		if results := joinWithType(t, left, right, c.joinType); fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("Join type %v: expected %v, got %v", c.joinType, expected, results)
+		}
+	}
+
+	// Every entry is reported exactly once, even when buckets are paired more than once.
+	n := int64(2000)
+	kvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		kvs = append(kvs, i, i)
+	}
+	big, cleanupBig := getTempHashIndex(t, kvs...)
+	defer cleanupBig()
+	small, cleanupSmall := getTempHashIndex(t, 0, 0, 7, 7, n+1, n+1)
+	defer cleanupSmall()
+	results := joinWithType(t, big, small, query.FULL_OUTER)
+	if int64(len(results)) != n+1 {
+		t.Fatalf("Expected %v results, got %v", n+1, len(results))
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i] == results[i-1] {
+			t.Errorf("Result %v reported twice", results[i])
+		}
+	}
+	if results = joinWithType(t, small, big, query.FULL_OUTER); int64(len(results)) != n+1 {
+		t.Errorf("Expected %v results, got %v", n+1, len(results))
+	}
+}
+
+// tinyJoinTables opens two small tables sharing some keys and values, with duplicates.
+func tinyJoinTables(t testing.TB) (left db.Index, right db.Index, cleanup func()) {
+	left, cleanupLeft := getTempHashIndex(t, 1, 10, 2, 20, 3, 10, 4, 40, 10, 50)
+	right, cleanupRight := getTempHashIndex(t, 10, 1, 20, 2, 30, 2, 50, 4, 4, 10)
+	return left, right, func() {
+		cleanupLeft()
+		cleanupRight()
+	}
+}
+
+func testNestedLoopJoin(t *testing.T) {
+	left, right, cleanup := tinyJoinTables(t)
+	defer cleanup()
+	for _, onKeys := range [][2]bool{{true, true}, {true, false}, {false, true}, {false, false}} {
+		joinOnLeftKey, joinOnRightKey := onKeys[0], onKeys[1]
+		before := countTempDBs(t)
+		nested := joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+			resultsChan, ctxt, group, cleanupCallback, err := query.Join(ctx, left, right, joinOnLeftKey, joinOnRightKey)
+			if countTempDBs(t) != before {
+				t.Error("Expected tiny tables to be joined without temporary files")
+			}
+			return resultsChan, ctxt, group, cleanupCallback, err
+		})
+		direct := joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+			return query.NestedLoopJoin(ctx, left, right, joinOnLeftKey, joinOnRightKey)
+		})
+		// Force Grace Hash Join.
+		maxEntries := query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get()
+		query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(0)
+		grace := joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+			return query.Join(ctx, left, right, joinOnLeftKey, joinOnRightKey)
+		})
+		query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries)
+		if len(grace) == 0 || fmt.Sprint(nested) != fmt.Sprint(grace) || fmt.Sprint(direct) != fmt.Sprint(grace) {
+			t.Errorf("Join on %v: nested-loop results %v and %v differ from %v", onKeys, nested, direct, grace)
+		}
+	}
+}
+
+func BenchmarkTinyJoin(b *testing.B) {
+	left, right, cleanup := tinyJoinTables(b)
+	defer cleanup()
+	defer func(maxEntries int64) { query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries) }(query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get())
+	for _, c := range []struct {
+		name       string
+		maxEntries int64
+	}{{"grace", 0}, {"nested-loop", query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get()}} {
+		b.Run(c.name, func(b *testing.B) {
+			query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(c.maxEntries)
+			for i := 0; i < b.N; i++ {
+				joinResults(b, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+					return query.Join(ctx, left, right, false, true)
+				})
+			}
+		})
+	}
+}
+
+// failingIndex wraps an index so that its cursors fail after reading limit entries.
+type failingIndex struct {
+	db.Index
+	limit int
+}
+
+func (index failingIndex) TableStart() (utils.Cursor, error) {
+	cursor, err := index.Index.TableStart()
+	if err != nil {
+		return nil, err
+	}
+	return &failingCursor{Cursor: cursor, left: index.limit}, nil
+}
+
+// failingCursor fails to read any entry once it has read its share.
+type failingCursor struct {
+	utils.Cursor
+	left int
+}
+
+func (cursor *failingCursor) GetEntry() (utils.Entry, error) {
+	if cursor.left == 0 {
+		return nil, errors.New("cursor failed")
+	}
+	cursor.left--
+	return cursor.Cursor.GetEntry()
+}
+
+func testJoinConcurrentBuild(t *testing.T) {
+	// Both tables are too large for a nested-loop join, so both hash indices are built.
+	n := int64(1000)
+	kvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		kvs = append(kvs, i, i%100)
+	}
+	table, cleanupTable := getTempHashIndex(t, kvs...)
+	defer cleanupTable()
+	before := countTempDBs(t)
+	// A self-join builds both indices from the same table at once.
+	results := joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+		resultsChan, ctxt, group, cleanupCallback, err := query.Join(ctx, table, table, true, false)
+		if after := countTempDBs(t); err == nil && after != before+2 {
+			t.Errorf("Expected 2 temporary indices, found %v", after-before)
+		}
+		return resultsChan, ctxt, group, cleanupCallback, err
+	})
+	// Keys below 100 each match the 10 entries with that value.
+	if len(results) != 100*10 {
+		t.Errorf("Expected %v results, got %v", 100*10, len(results))
+	}
+	for _, result := range results {
+		var lKey, lValue, rKey, rValue int64
+		fmt.Sscanf(result, "%d:%d %d:%d", &lKey, &lValue, &rKey, &rValue)
+		if lKey != lValue || rValue != lKey || rValue != rKey%100 {
+			t.Fatalf("Unexpected result %v", result)
+		}
+	}
+	if countTempDBs(t) != before {
+		t.Error("Expected cleanup to remove both temporary indices")
+	}
+	// If either build fails, the other's index is removed too. The failing table reads
+	// past the size of a nested-loop join before its cursor fails.
+	failing := failingIndex{Index: table, limit: int(n / 2)}
+	before = countTempDBs(t)
+	for _, tables := range [][2]db.Index{{table, failing}, {failing, table}} {
+		_, _, _, cleanupCallback, err := query.Join(context.Background(), tables[0], tables[1], false, false)
+		if cleanupCallback != nil {
+			cleanupCallback()
+		}
+		if err == nil {
+			t.Error("Expected a join reading a failing table to fail")
+		}
+		if countTempDBs(t) != before {
+			t.Error("Expected a failed build to leave no temporary indices behind")
+		}
+	}
+}
+
+// scanCountingIndex wraps a hash index to count cursors opened outside BeginScan and EndScan,
+// where auto-vacuum could move entries under them.
+type scanCountingIndex struct {
+	*hash.HashIndex
+	scans     *int64 // Scans in progress.
+	unguarded *int64 // Cursors opened while no scan was in progress.
+}
+
+func (index scanCountingIndex) BeginScan() {
+	atomic.AddInt64(index.scans, 1)
+	index.HashIndex.BeginScan()
+}
+
+func (index scanCountingIndex) EndScan() {
+	index.HashIndex.EndScan()
+	atomic.AddInt64(index.scans, -1)
+}
+
+func (index scanCountingIndex) TableStart() (utils.Cursor, error) {
+	if atomic.LoadInt64(index.scans) == 0 {
+		atomic.AddInt64(index.unguarded, 1)
+	}
+	return index.HashIndex.TableStart()
+}
+
+func testJoinBuildHoldsOffVacuum(t *testing.T) {
+	left, right, cleanup := tinyJoinTables(t)
+	defer cleanup()
+	defer func(maxEntries int64) { query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries) }(query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get())
+	query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(0)
+	var scans, unguarded [2]int64
+	wrappedLeft := scanCountingIndex{left.(*hash.HashIndex), &scans[0], &unguarded[0]}
+	wrappedRight := scanCountingIndex{right.(*hash.HashIndex), &scans[1], &unguarded[1]}
+	results := joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+		return query.Join(ctx, wrappedLeft, wrappedRight, false, true)
+	})
+	if len(results) == 0 {
+		t.Fatal("Expected the join to match some entries")
+	}
+	if unguarded != [2]int64{0, 0} {
+		t.Errorf("Expected every scan of the joined tables to hold off auto-vacuum, %v did not", unguarded)
+	}
+}
+
+func testJoinQuiet(t *testing.T) {
+	left, right, cleanup := tinyJoinTables(t)
+	defer cleanup()
+	defer func(maxEntries int64) { query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries) }(query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get())
+	// Neither kind of join writes to stdout.
+	for _, maxEntries := range []int64{0, query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get()} {
+		query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries)
+		out := captureStdout(t, func() {
+			joinResults(t, func(ctx context.Context) (chan query.EntryPair, context.Context, *errgroup.Group, func(), error) {
+				return query.Join(ctx, left, right, false, true)
+			})
+		})
+		if out != "" {
+			t.Errorf("Expected a join to write nothing to stdout, got %q", out)
+		}
+	}
+}
+
+func testJoinEmpty(t *testing.T) {
+	empty, cleanupEmpty := getTempHashIndex(t)
+	defer cleanupEmpty()
+	other, cleanupOther := getTempHashIndex(t)
+	defer cleanupOther()
+	full, cleanupFull := getTempHashIndex(t, 1, 10, 2, 20)
+	defer cleanupFull()
+	defer func(maxEntries int64) { query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries) }(query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get())
+	for _, maxEntries := range []int64{0, query.NESTED_LOOP_JOIN_MAX_ENTRIES.Get()} {
+		query.NESTED_LOOP_JOIN_MAX_ENTRIES.Set(maxEntries)
+		for _, tables := range [][2]db.Index{{empty, full}, {full, empty}, {empty, other}, {empty, empty}} {
+			if results := joinWithType(t, tables[0], tables[1], query.INNER); len(results) != 0 {
+				t.Errorf("Expected no results joining an empty table, got %v", results)
+			}
+		}
+		// Outer joins still report the other table's entries.
+		if results := joinWithType(t, empty, full, query.FULL_OUTER); fmt.Sprint(results) != "[nil 1:10 nil 2:20]" {
+			t.Errorf("Unexpected results %v", results)
+		}
+		if results := joinWithType(t, full, empty, query.LEFT_OUTER); fmt.Sprint(results) != "[1:10 nil 2:20 nil]" {
+			t.Errorf("Unexpected results %v", results)
+		}
+	}
+}
+
+func testJoinSentCount(t *testing.T) {
+	// Every left entry matches 10 right entries, for 10000 results in all.
+	n := int64(1000)
+	leftKvs := make([]int64, 0, 2*n)
+	rightKvs := make([]int64, 0, 2*n)
+	for i := int64(0); i < n; i++ {
+		leftKvs = append(leftKvs, i, i%100)
+		rightKvs = append(rightKvs, i, i%100)
+	}
+	left, cleanupLeft := getTempHashIndex(t, leftKvs...)
+	defer cleanupLeft()
+	right, cleanupRight := getTempHashIndex(t, rightKvs...)
+	defer cleanupRight()
+	for _, buffer := range []int{0, 16} {
+		joinConfig := query.DefaultJoinConfig()
+		joinConfig.ChannelBuffer = buffer
+		ctx, cancelCtx := context.WithCancel(context.Background())
+		defer cancelCtx()
+		resultsChan, _, group, cleanupCallback, sent, err := query.JoinWithConfig(ctx, left, right, false, false, joinConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cap(resultsChan) != buffer {
+			t.Errorf("Expected a buffer of %v, got %v", buffer, cap(resultsChan))
+		}
+		// Cancel partway through; results already sent stay counted, and no others are.
+		received := int64(0)
+		for range resultsChan {
+			received++
+			if received == 500 {
+				cancelCtx()
+				break
+			}
+		}
+		if err = group.Wait(); err == nil {
+			t.Error("Expected the cancelled join to fail")
+		}
+		close(resultsChan)
+		for range resultsChan {
+			received++
+		}
+		cleanupCallback()
+		if sent() != received {
+			t.Errorf("Buffer %v: counted %v results sent, but %v were", buffer, sent(), received)
+		}
+		if received >= 10*n {
+			t.Errorf("Expected cancelling to cut the join short, got %v results", received)
+		}
+	}
+	// A negative buffer is rejected, by both in-memory and hash joins, rather than panicking.
+	tinyLeft, tinyRight, cleanupTiny := tinyJoinTables(t)
+	defer cleanupTiny()
+	joinConfig := query.DefaultJoinConfig()
+	joinConfig.ChannelBuffer = -1
+	for _, tables := range [][2]db.Index{{left, right}, {tinyLeft, tinyRight}} {
+		_, _, _, cleanupCallback, _, err := query.JoinWithConfig(context.Background(), tables[0], tables[1], false, false, joinConfig)
+		if cleanupCallback != nil {
+			cleanupCallback()
+		}
+		if err == nil {
+			t.Error("Expected a negative channel buffer to be rejected")
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	recovery "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/recovery"
+	uuid "github.com/google/uuid"
+)
+
+func TestRecoveryTA(t *testing.T) {
+	t.Run("TestCheckpointOffset", testCheckpointOffset)
+	t.Run("TestRecoverReleasesLocks", testRecoverReleasesLocks)
+	t.Run("TestVerifyWhileRunning", testVerifyWhileRunning)
+	t.Run("TestTailLog", testTailLog)
+	t.Run("TestCrashAfterCommit", testCrashAfterCommit)
+	t.Run("TestCrashBeforeCommit", testCrashBeforeCommit)
+}
+
+// getTempRecoveryManager returns a recovery manager over a fresh database with one btree table.
+// The returned function removes everything it created.
+func getTempRecoveryManager(t *testing.T) (*recovery.RecoveryManager, *db.Database, string, func()) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile, err := ioutil.TempFile(".", "log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+	cleanup := func() {
+		os.RemoveAll(folder)
+		os.RemoveAll(folder + "-recovery")
+		os.Remove(logFile.Name())
+	}
+	d, err := db.Open(folder)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	if err = db.HandleCreateTable(d, "create btree table t", &w); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logFile.Name())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	rm.Table("btree", "t")
+	return rm, d, logFile.Name(), func() {
+		index, _ := d.GetTable("t")
+		index.GetPager().Close()
+		cleanup()
+	}
+}
+
+func testCheckpointOffset(t *testing.T) {
+	rm, _, logName, cleanup := getTempRecoveryManager(t)
+	defer cleanup()
+	first, second := uuid.New(), uuid.New()
+	rm.Start(first)
+	rm.Start(second)
+	rm.Commit(first)
+	offset, numActive, err := rm.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numActive != 1 {
+		t.Errorf("Expected 1 active transaction, got %v", numActive)
+	}
+	// The offset should point at the start of the checkpoint record.
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset <= 0 || offset >= int64(len(contents)) || contents[offset-1] != '\n' {
+		t.Fatalf("Offset %v is not the start of a log record", offset)
+	}
+	record := string(contents[offset:])
+	record = record[:strings.Index(record, "\n")]
+	if !strings.HasSuffix(record, "checkpoint >") || !strings.Contains(record, second.String()) {
+		t.Errorf("Expected a checkpoint record naming %v at offset %v, found %q", second, offset, record)
+	}
+	// A second checkpoint lands after the first.
+	rm.Commit(second)
+	nextOffset, numActive, err := rm.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextOffset <= offset || numActive != 0 {
+		t.Errorf("Expected a later checkpoint with no active transactions, got offset %v with %v", nextOffset, numActive)
+	}
+}
+
+func testRecoverReleasesLocks(t *testing.T) {
+	rm, d, logName, cleanup := getTempRecoveryManager(t)
+	defer cleanup()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	if _, _, err := rm.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// A transaction inserts, then the server crashes before it commits.
+	var w bytes.Buffer
+	clientId := uuid.New()
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", &w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovery.HandleInsert(d, tm, rm, "insert 5 50 into t", clientId); err != nil {
+		t.Fatal(err)
+	}
+	// Recover with fresh transaction and lock managers, as on restart.
+	lm := concurrency.NewLockManager()
+	newTm := concurrency.NewTransactionManager(lm)
+	newRm, err := recovery.NewRecoveryManager(d, newTm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRm.SetDebug(true)
+	if err = newRm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if held := lm.GetHeldResources(); len(held) != 0 {
+		t.Errorf("Expected no locks after recovery, found %v", len(held))
+	}
+	index, _ := d.GetTable("t")
+	if _, err = index.Find(5); err == nil {
+		t.Error("Interrupted insert was not undone")
+	}
+	// A transaction left running is reported.
+	if err = newTm.Begin(uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	if err = newRm.VerifyRecovered(); err == nil {
+		t.Error("Expected VerifyRecovered to report a running transaction")
+	}
+}
+
+func testVerifyWhileRunning(t *testing.T) {
+	_, d, logName, cleanup := getTempRecoveryManager(t)
+	defer cleanup()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Verify repeatedly while clients begin and commit transactions.
+	n := 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			rm.VerifyRecovered()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		clientId := uuid.New()
+		if err = tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err = tm.Commit(clientId); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+	if err = rm.VerifyRecovered(); err == nil {
+		t.Error("Expected VerifyRecovered to report the running transactions")
+	}
+}
+
+func testTailLog(t *testing.T) {
+	rm, _, logName, cleanup := getTempRecoveryManager(t)
+	defer cleanup()
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	records := make(chan string, 16)
+	done := make(chan error)
+	go func() {
+		done <- rm.Tail(ctx, func(log recovery.Log) {
+			records <- recovery.ToString(log)
+		})
+	}()
+	// expectRecord waits for the next record Tail delivers.
+	expectRecord := func(expected string) {
+		select {
+		case record := <-records:
+			if record != expected {
+				t.Errorf("Expected record %q, got %q", expected, record)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for record %q", expected)
+		}
+	}
+	// Give Tail a moment to start at the current end of the log.
+	time.Sleep(100 * time.Millisecond)
+	clientId := uuid.New()
+	rm.Start(clientId)
+	rm.Commit(clientId)
+	expectRecord("< " + clientId.String() + " start >\n")
+	expectRecord("< " + clientId.String() + " commit >\n")
+	// A half-written record is held back until its line is complete.
+	f, err := os.OpenFile(logName, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("< create hash table ")
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case record := <-records:
+		t.Errorf("Partial record delivered as %q", record)
+	default:
+	}
+	f.WriteString("u >\n")
+	expectRecord("< create hash table u >\n")
+	cancelCtx()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// crashAndRecover runs fn against a fresh database holding an empty btree table t, crashing
+// once n more records have been logged, then restarts and recovers the database.
+// The returned function closes the recovered database and removes everything created.
+func crashAndRecover(t *testing.T, n int, fn func(d *db.Database, tm *concurrency.TransactionManager, rm *recovery.RecoveryManager)) (*db.Database, func()) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile, err := ioutil.TempFile(".", "log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+	cleanup := func() {
+		os.RemoveAll(folder)
+		os.RemoveAll(folder + "-recovery")
+		os.Remove(logFile.Name())
+	}
+	d, err := recovery.Prime(folder)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logFile.Name())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if _, _, err = rm.Checkpoint(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	if err = recovery.HandleCreateTable(d, tm, rm, "create btree table t", &w, uuid.New()); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if !recovery.WithCrashAfter(n, func() { fn(d, tm, rm) }) {
+		t.Error("Expected a crash")
+	}
+	// Restart from what made it to disk.
+	d.Close()
+	d, err = recovery.Prime(folder)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	tm = concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err = recovery.NewRecoveryManager(d, tm, logFile.Name())
+	if err != nil {
+		d.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	rm.SetDebug(true)
+	if err = rm.Recover(); err != nil {
+		d.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		cleanup()
+	}
+}
+
+// insertAndCommit inserts key into t in its own transaction, reporting the first error.
+func insertAndCommit(d *db.Database, tm *concurrency.TransactionManager, rm *recovery.RecoveryManager, key int64) error {
+	var w bytes.Buffer
+	clientId := uuid.New()
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", &w, clientId); err != nil {
+		return err
+	}
+	if err := recovery.HandleInsert(d, tm, rm, fmt.Sprintf("insert %v %v into t", key, key*10), clientId); err != nil {
+		return err
+	}
+	return recovery.HandleTransaction(d, tm, rm, "transaction commit", &w, clientId)
+}
+
+func testCrashAfterCommit(t *testing.T) {
+	// Crash right after the first transaction's start, insert and commit records.
+	d, cleanup := crashAndRecover(t, 3, func(d *db.Database, tm *concurrency.TransactionManager, rm *recovery.RecoveryManager) {
+		insertAndCommit(d, tm, rm, 5)
+		insertAndCommit(d, tm, rm, 6)
+	})
+	defer cleanup()
+	index, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(5); err != nil || entry.GetValue() != 50 {
+		t.Error("A committed insert did not survive the crash")
+	}
+	if _, err := index.Find(6); err == nil {
+		t.Error("An insert logged after the crash survived it")
+	}
+}
+
+func testCrashBeforeCommit(t *testing.T) {
+	// Crash after the start and insert records, before the commit record.
+	d, cleanup := crashAndRecover(t, 2, func(d *db.Database, tm *concurrency.TransactionManager, rm *recovery.RecoveryManager) {
+		insertAndCommit(d, tm, rm, 5)
+	})
+	defer cleanup()
+	index, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.Find(5); err == nil {
+		t.Error("An uncommitted insert was not rolled back")
+	}
+}
@@ -0,0 +1,537 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	query "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/query"
+	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	uuid "github.com/google/uuid"
+)
+
+func TestReplTA(t *testing.T) {
+	t.Run("TestReplErrorFormatter", testReplErrorFormatter)
+	t.Run("TestReplNotFoundHandler", testReplNotFoundHandler)
+	t.Run("TestReplRunChanEcho", testReplRunChanEcho)
+	t.Run("TestReplAlias", testReplAlias)
+	t.Run("TestReplSettings", testReplSettings)
+	t.Run("TestReplSettingsConcurrent", testReplSettingsConcurrent)
+	t.Run("TestReplFormat", testReplFormat)
+	t.Run("TestReplAddCommand", testReplAddCommand)
+	t.Run("TestReplCombine", testReplCombine)
+	t.Run("TestReplRun", testReplRun)
+	t.Run("TestReplHistory", testReplHistory)
+	t.Run("TestReplTokenize", testReplTokenize)
+	t.Run("TestReplArity", testReplArity)
+	t.Run("TestReplQuit", testReplQuit)
+}
+
+// runOverPipe feeds the input lines to r.Run over an in-memory connection and returns everything it wrote.
+func runOverPipe(r *repl.REPL, lines ...string) string {
+	server, client := net.Pipe()
+	go func() {
+		r.Run(server, uuid.New(), "> ")
+		server.Close()
+	}()
+	go func() {
+		for _, line := range lines {
+			io.WriteString(client, line+"\n")
+		}
+	}()
+	var sb strings.Builder
+	buf := make([]byte, 1024)
+	for {
+		n, err := client.Read(buf)
+		sb.Write(buf[:n])
+		// Stop once the last command's prompt is back.
+		if err != nil || strings.Count(sb.String(), "> ") > len(lines) {
+			break
+		}
+	}
+	client.Close()
+	return sb.String()
+}
+
+// captureStdout calls fn and returns what it wrote to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	read, write, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = write
+	fn()
+	os.Stdout = stdout
+	write.Close()
+	out, _ := ioutil.ReadAll(read)
+	return string(out)
+}
+
+// runChanCapturingStdout runs r.RunChan on the given payloads and returns what it wrote to stdout.
+func runChanCapturingStdout(t *testing.T, r *repl.REPL, payloads ...string) string {
+	c := make(chan string, len(payloads))
+	for _, payload := range payloads {
+		c <- payload
+	}
+	close(c)
+	return captureStdout(t, func() { r.RunChan(c, uuid.New(), "") })
+}
+
+func testReplErrorFormatter(t *testing.T) {
+	called := false
+	r := repl.NewRepl(repl.WithErrorFormatter(func(err error) string {
+		called = true
+		return "ERR<" + err.Error() + ">\n"
+	}))
+	r.AddCommand("fail", func(payload string, replConfig *repl.REPLConfig) error {
+		return errors.New("boom")
+	}, "Always fails.")
+	out := runOverPipe(r, "fail")
+	if !called || !strings.Contains(out, "ERR<boom>") {
+		t.Errorf("Custom error formatter not used; output was %q", out)
+	}
+	// Without options, errors print as before.
+	plain := repl.NewRepl()
+	plain.AddCommand("fail", func(payload string, replConfig *repl.REPLConfig) error {
+		return errors.New("boom")
+	}, "Always fails.")
+	if out = runOverPipe(plain, "fail"); !strings.Contains(out, "boom\n") {
+		t.Errorf("Default error format changed; output was %q", out)
+	}
+}
+
+func testReplNotFoundHandler(t *testing.T) {
+	r, err := repl.CombineRepls([]*repl.REPL{repl.NewRepl()},
+		repl.WithNotFoundHandler(func(payload string, w io.Writer) {
+			io.WriteString(w, "unknown: "+payload+"\n")
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := runOverPipe(r, "nope 1"); !strings.Contains(out, "unknown: nope 1") {
+		t.Errorf("Custom not-found handler not used; output was %q", out)
+	}
+	if out := runOverPipe(repl.NewRepl(), "nope"); !strings.Contains(out, "command not found") {
+		t.Errorf("Default not-found message changed; output was %q", out)
+	}
+}
+
+func testReplRunChanEcho(t *testing.T) {
+	if out := runChanCapturingStdout(t, repl.NewRepl(), "hello there"); !strings.Contains(out, "hello there") {
+		t.Errorf("RunChan should echo payloads by default; output was %q", out)
+	}
+	if out := runChanCapturingStdout(t, repl.NewRepl(repl.WithoutEcho()), "hello there"); strings.Contains(out, "hello there") {
+		t.Errorf("RunChan echoed despite WithoutEcho; output was %q", out)
+	}
+}
+
+func testReplAlias(t *testing.T) {
+	r := repl.NewRepl()
+	var payloads []string
+	r.AddCommand("transaction", func(payload string, replConfig *repl.REPLConfig) error {
+		payloads = append(payloads, payload)
+		return nil
+	}, "Records its payload.")
+	if err := r.AddAlias("b", "transaction begin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddAlias("t", "transaction"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddAlias("x", "missing"); err == nil {
+		t.Error("An alias for a missing command should be rejected")
+	}
+	if err := r.AddAlias("transaction", "t"); err == nil {
+		t.Error("An alias shadowing a command should be rejected")
+	}
+	runOverPipe(r, "b optimistic", "t commit  now")
+	expected := []string{"transaction begin optimistic", "transaction commit  now"}
+	if len(payloads) != len(expected) {
+		t.Fatalf("Expected payloads %q, got %q", expected, payloads)
+	}
+	for i := range expected {
+		if payloads[i] != expected[i] {
+			t.Errorf("Expected payload %q, got %q", expected[i], payloads[i])
+		}
+	}
+	if help := r.HelpString(); !strings.Contains(help, "b: alias for transaction begin") {
+		t.Errorf("Help should list aliases; got %q", help)
+	}
+	// Aliases survive combining REPLs.
+	combined, err := repl.CombineRepls([]*repl.REPL{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if combined.GetAliases()["b"] != "transaction begin" {
+		t.Error("CombineRepls dropped an alias")
+	}
+}
+
+func testReplSettings(t *testing.T) {
+	defer func(size int) { query.JOIN_CHANNEL_BUFFER.Set(size) }(query.JOIN_CHANNEL_BUFFER.Get())
+	out := runOverPipe(repl.NewRepl(), ".set join_channel_buffer 64", ".show join_channel_buffer",
+		".set join_channel_buffer -1", ".set join_channel_buffer many", ".set no_such_setting 1")
+	if query.JOIN_CHANNEL_BUFFER.Get() != 64 {
+		t.Errorf("Expected the join buffer to be 64, got %v", query.JOIN_CHANNEL_BUFFER.Get())
+	}
+	for _, expected := range []string{
+		"join_channel_buffer = 64\n",
+		"join_channel_buffer must be between",
+		"join_channel_buffer must be an integer",
+		"unknown setting no_such_setting",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in output %q", expected, out)
+		}
+	}
+	// Settings can be changed directly, too.
+	interval := config.NewDurationSetting("test_interval", 10*time.Millisecond, time.Millisecond, time.Second, "A test setting.")
+	if err := config.SetSetting("test_interval", "250ms"); err != nil || interval.Get() != 250*time.Millisecond {
+		t.Errorf("Expected the interval to be 250ms, got %v (%v)", interval.Get(), err)
+	}
+	if err := config.SetSetting("test_interval", "1h"); err == nil || interval.Get() != 250*time.Millisecond {
+		t.Errorf("An out-of-range value should be rejected and leave the setting alone, got %v", interval.Get())
+	}
+	if value, err := config.ShowSetting("test_interval"); err != nil || value != "250ms" {
+		t.Errorf("Expected to show 250ms, got %q (%v)", value, err)
+	}
+}
+
+// One client's .set doesn't race with another client's join reading the setting; run with -race.
+func testReplSettingsConcurrent(t *testing.T) {
+	defer func(size int) { query.JOIN_CHANNEL_BUFFER.Set(size) }(query.JOIN_CHANNEL_BUFFER.Get())
+	query.JOIN_CHANNEL_BUFFER.Set(0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if err := config.SetSetting("join_channel_buffer", fmt.Sprint(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if size := query.DefaultJoinConfig().ChannelBuffer; size < 0 || size >= 1000 {
+			t.Fatalf("Read a join buffer size that was never set: %v", size)
+		}
+	}
+	<-done
+}
+
+// A joined pair as rendered in JSON.
+type jsonPair struct {
+	Left  struct{ Key, Value int64 }
+	Right struct{ Key, Value int64 }
+}
+
+// parseRows parses each line of out with parse, returning the results sorted.
+func parseRows(t *testing.T, out string, parse func(line string) (string, error)) []string {
+	rows := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		row, err := parse(line)
+		if err != nil {
+			t.Fatalf("Couldn't parse %q: %v", line, err)
+		}
+		rows = append(rows, row)
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func testReplFormat(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, line := range []string{"create btree table left", "create btree table right"} {
+		if err = db.HandleCreateTable(d, line, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if err = db.HandleInsert(d, fmt.Sprintf("insert %v %v into left", i, i*2)); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.HandleInsert(d, fmt.Sprintf("insert %v %v into right", i*2, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := repl.CombineRepls([]*repl.REPL{db.DatabaseRepl(d), query.QueryRepl(d)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := runOverPipe(r, "select from left", ".format json", "select from left",
+		"join left val on right key", ".format text", "join left val on right key")
+	// Each command's output ends with the next prompt.
+	outputs := strings.Split(out, "> ")[1:]
+	if len(outputs) < 6 {
+		t.Fatalf("Expected output for 6 commands, got %q", out)
+	}
+	if outputs[1] != "format = json\n" || outputs[4] != "format = text\n" {
+		t.Errorf("Unexpected .format output %q, %q", outputs[1], outputs[4])
+	}
+	// Both formats carry the same entries.
+	parseText := func(line string) (string, error) {
+		var key, value int64
+		_, err := fmt.Sscanf(line, "(%d, %d)", &key, &value)
+		return fmt.Sprint(key, value), err
+	}
+	parseJSON := func(line string) (string, error) {
+		var entry struct{ Key, Value int64 }
+		err := json.Unmarshal([]byte(line), &entry)
+		return fmt.Sprint(entry.Key, entry.Value), err
+	}
+	textRows, jsonRows := parseRows(t, outputs[0], parseText), parseRows(t, outputs[2], parseJSON)
+	if len(textRows) != 50 || strings.Join(textRows, ",") != strings.Join(jsonRows, ",") {
+		t.Errorf("Select results differ between formats:\n%v\n%v", textRows, jsonRows)
+	}
+	// And the same joined pairs.
+	parseTextPair := func(line string) (string, error) {
+		var lk, lv, rk, rv int64
+		_, err := fmt.Sscanf(line, "{(%d, %d), (%d, %d)}", &lk, &lv, &rk, &rv)
+		return fmt.Sprint(lk, lv, rk, rv), err
+	}
+	parseJSONPair := func(line string) (string, error) {
+		var pair jsonPair
+		err := json.Unmarshal([]byte(line), &pair)
+		return fmt.Sprint(pair.Left.Key, pair.Left.Value, pair.Right.Key, pair.Right.Value), err
+	}
+	jsonPairs, textPairs := parseRows(t, outputs[3], parseJSONPair), parseRows(t, outputs[5], parseTextPair)
+	if len(textPairs) != 50 || strings.Join(textPairs, ",") != strings.Join(jsonPairs, ",") {
+		t.Errorf("Join results differ between formats:\n%v\n%v", textPairs, jsonPairs)
+	}
+}
+
+func testReplAddCommand(t *testing.T) {
+	r := repl.NewRepl()
+	var got string
+	r.AddCommand("greet", func(payload string, replConfig *repl.REPLConfig) error {
+		got = payload
+		return nil
+	}, "Greet someone. usage: greet <name>")
+	runChanCapturingStdout(t, r, "greet world")
+	if got != "greet world" {
+		t.Errorf("Expected the action to get %q, got %q", "greet world", got)
+	}
+	if help := r.GetHelp()["greet"]; help != "Greet someone. usage: greet <name>" {
+		t.Errorf("Unexpected help %q", help)
+	}
+	// Triggers starting with a '.' are reserved for meta-commands.
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected AddCommand to reject a meta-command trigger")
+		}
+		if _, exists := r.GetCommands()[".greet"]; exists {
+			t.Error("Rejected trigger was registered")
+		}
+	}()
+	r.AddCommand(".greet", func(payload string, replConfig *repl.REPLConfig) error {
+		return nil
+	}, "Not allowed.")
+}
+
+func testReplCombine(t *testing.T) {
+	noop := func(payload string, replConfig *repl.REPLConfig) error { return nil }
+	a := repl.NewRepl()
+	a.AddCommand("select", noop, "Select from a.")
+	b := repl.NewRepl()
+	b.AddCommand("join", noop, "Join in b.")
+	combined, err := repl.CombineRepls([]*repl.REPL{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(combined.GetCommands()) != 2 {
+		t.Errorf("Expected 2 commands, got %v", len(combined.GetCommands()))
+	}
+	if combined.GetHelp()["select"] != "Select from a." || combined.GetHelp()["join"] != "Join in b." {
+		t.Errorf("Help not carried over: %v", combined.GetHelp())
+	}
+	// Two REPLs defining the same trigger conflict.
+	c := repl.NewRepl()
+	c.AddCommand("select", noop, "Select from c.")
+	if _, err = repl.CombineRepls([]*repl.REPL{a, c}); err == nil || !strings.Contains(err.Error(), "select") {
+		t.Errorf("Expected an error naming select, got %v", err)
+	}
+}
+
+func testReplRun(t *testing.T) {
+	r := repl.NewRepl()
+	r.AddCommand("echo", func(payload string, replConfig *repl.REPLConfig) error {
+		io.WriteString(replConfig.GetWriter(), payload+"\n")
+		return nil
+	}, "Echo the payload.")
+	// Blank lines just reprint the prompt.
+	if out := runOverPipe(r, "", "   ", "echo hi"); out != "> > > echo hi\n> " {
+		t.Errorf("Unexpected output %q", out)
+	}
+	// Closing the connection ends the loop.
+	server, client := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		r.Run(server, uuid.New(), "> ")
+		done <- true
+	}()
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after its connection closed")
+	}
+	server.Close()
+}
+
+func testReplHistory(t *testing.T) {
+	r := repl.NewRepl()
+	r.AddCommand("say", func(payload string, replConfig *repl.REPLConfig) error {
+		io.WriteString(replConfig.GetWriter(), "said "+strings.TrimPrefix(payload, "say ")+"\n")
+		return nil
+	}, "Say something.")
+	// Meta-commands aren't recorded; rerun commands are.
+	out := runOverPipe(r, "say a", ".show history_size", "say b", "nope", ".!2", ".!9", ".!x", ".history")
+	expected := "> said a\n" +
+		"> history_size = 100 (number of commands each session remembers for .history)\n" +
+		"> said b\n" +
+		"> command not found\n" +
+		"> say b\nsaid b\n" +
+		"> no command 9 in history\n" +
+		"> usage: .!<n>\n" +
+		"> 1: say a\n2: say b\n3: nope\n4: say b\n" +
+		"> "
+	if out != expected {
+		t.Errorf("Expected output:\n%q\ngot:\n%q", expected, out)
+	}
+	// Old commands are forgotten, but keep their numbers.
+	if err := config.SetSetting("history_size", "2"); err != nil {
+		t.Fatal(err)
+	}
+	defer config.SetSetting("history_size", "100")
+	out = runOverPipe(r, "say a", "say b", "say c", ".!1", ".history")
+	if !strings.HasSuffix(out, "> no command 1 in history\n> 2: say b\n3: say c\n> ") {
+		t.Errorf("Unexpected output %q", out)
+	}
+	// Resizing mid-session keeps the numbering once the ring has wrapped.
+	if err := config.SetSetting("history_size", "3"); err != nil {
+		t.Fatal(err)
+	}
+	out = runOverPipe(r, "say a", "say b", "say c", "say d", ".history")
+	if !strings.HasSuffix(out, "> 2: say b\n3: say c\n4: say d\n> ") {
+		t.Errorf("Unexpected output %q", out)
+	}
+	out = runOverPipe(r, "say a", "say b", "say c", "say d", ".set history_size 2", "say e", ".!3", ".history")
+	if !strings.HasSuffix(out, "> no command 3 in history\n> 4: say d\n5: say e\n> ") {
+		t.Errorf("Unexpected output %q", out)
+	}
+}
+
+func testReplTokenize(t *testing.T) {
+	cases := []struct {
+		line   string
+		tokens []string
+	}{
+		{"  list_push_head   1 \t 2  ", []string{"list_push_head", "1", "2"}},
+		{`list_push_head "hello world"`, []string{"list_push_head", "hello world"}},
+		{`say "she said \"hi\"" back\ slash`, []string{"say", `she said "hi"`, "back slash"}},
+		{`a"b c"d ""`, []string{"ab cd", ""}},
+		{"", []string{}},
+	}
+	for _, c := range cases {
+		tokens, err := repl.Tokenize(c.line)
+		if err != nil {
+			t.Errorf("%q: %v", c.line, err)
+			continue
+		}
+		if fmt.Sprint(tokens) != fmt.Sprint(c.tokens) || len(tokens) != len(c.tokens) {
+			t.Errorf("%q: expected %q, got %q", c.line, c.tokens, tokens)
+		}
+	}
+	for _, line := range []string{`say "unclosed`, `say trailing\`} {
+		if _, err := repl.Tokenize(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+	// Lines that don't tokenize are rejected before dispatch.
+	r := repl.NewRepl()
+	r.AddCommand("say", func(payload string, replConfig *repl.REPLConfig) error {
+		t.Errorf("Unexpected dispatch of %q", payload)
+		return nil
+	}, "Say something.")
+	if out := runOverPipe(r, `say "hi`); out != "> unbalanced quotes\n> " {
+		t.Errorf("Unexpected output %q", out)
+	}
+}
+
+func testReplArity(t *testing.T) {
+	r := repl.NewRepl()
+	calls := 0
+	count := func(payload string, replConfig *repl.REPLConfig) error {
+		calls++
+		return nil
+	}
+	r.AddCommandN("pair", 1, 2, count, "Take one or two values. usage: pair a [b]")
+	r.AddCommandN("many", 1, -1, count, "Take any number of values. usage: many <value>...")
+	combined, err := repl.CombineRepls([]*repl.REPL{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := runOverPipe(combined, "pair", "pair a", `pair a "b c"`, "pair a b c", "many", "many a b c d")
+	expected := "> wrong number of arguments to pair: Take one or two values. usage: pair a [b]\n" +
+		"> > > wrong number of arguments to pair: Take one or two values. usage: pair a [b]\n" +
+		"> wrong number of arguments to many: Take any number of values. usage: many <value>...\n" +
+		"> > "
+	if out != expected {
+		t.Errorf("Expected output:\n%q\ngot:\n%q", expected, out)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %v", calls)
+	}
+}
+
+func testReplQuit(t *testing.T) {
+	for _, quit := range []string{".quit", ".EXIT"} {
+		r := repl.NewRepl()
+		r.AddCommand("say", func(payload string, replConfig *repl.REPLConfig) error {
+			t.Errorf("Unexpected dispatch of %q after %s", payload, quit)
+			return nil
+		}, "Say something.")
+		server, client := net.Pipe()
+		done := make(chan bool)
+		output := make(chan string, 1)
+		go func() {
+			out, _ := ioutil.ReadAll(client)
+			output <- string(out)
+		}()
+		go func() {
+			r.Run(server, uuid.New(), "> ")
+			server.Close()
+			done <- true
+		}()
+		go io.WriteString(client, quit+"\nsay hi\n")
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run didn't return on %s", quit)
+		}
+		client.Close()
+		if out := <-output; out != "> \n" {
+			t.Errorf("Unexpected output %q", out)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package utils
+
+// DeleteMode determines how an index removes entries.
+type DeleteMode int
+
+const (
+	// Shift later entries over the deleted one right away.
+	PHYSICAL_DELETE DeleteMode = 0
+	// Mark the entry deleted in place and compact later, so that cursors
+	// parked on the same page neither skip nor repeat entries.
+	TOMBSTONE_DELETE DeleteMode = 1
+)
@@ -4,6 +4,7 @@ package utils
 type Entry interface {
 	GetKey() int64
 	GetValue() int64
+	Values() []int64 // All values, the first being GetValue().
 	Marshal() []byte
 }
 
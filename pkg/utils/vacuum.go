@@ -0,0 +1,104 @@
+package utils
+
+import "sync"
+
+// An index with auto-vacuum on checks its fragmentation once every AUTO_VACUUM_INTERVAL
+// deletes, so the cost of measuring it is spread thin.
+var AUTO_VACUUM_INTERVAL int64 = 64
+
+// VacuumTracker decides when an index should compact itself: every AUTO_VACUUM_INTERVAL
+// deletes, but never while a scan is running, since compaction moves entries out from
+// under cursors. A check that falls due during a scan is deferred until the last scan ends,
+// and scans that begin during a check wait for it to finish.
+// The zero value has auto-vacuum off.
+type VacuumTracker struct {
+	mtx         sync.Mutex
+	done        *sync.Cond // Signalled when a check finishes.
+	threshold   float64    // Fragmentation at which to compact; 0 is off.
+	deletes     int64      // Deletes since the last check.
+	activeScans int64      // Scans currently running.
+	deferred    bool       // Whether a check fell due during a scan.
+	checking    bool       // Whether a check is running.
+}
+
+// SetThreshold sets the fragmentation at which to compact; 0 turns auto-vacuum off.
+func (v *VacuumTracker) SetThreshold(threshold float64) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.threshold = threshold
+	v.deletes = 0
+	v.deferred = false
+}
+
+// GetThreshold returns the fragmentation at which to compact, or 0 if auto-vacuum is off.
+func (v *VacuumTracker) GetThreshold() float64 {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.threshold
+}
+
+// NoteDelete records a delete, returning true if fragmentation should be checked now.
+// The caller must call EndCheck once it has checked, and compacted if need be.
+func (v *VacuumTracker) NoteDelete() bool {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if v.threshold <= 0 {
+		return false
+	}
+	v.deletes++
+	if v.deletes < AUTO_VACUUM_INTERVAL {
+		return false
+	}
+	v.deletes = 0
+	return v.startCheck()
+}
+
+// BeginScan holds off compaction until the matching EndScan.
+func (v *VacuumTracker) BeginScan() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for v.checking {
+		v.cond().Wait()
+	}
+	v.activeScans++
+}
+
+// EndScan ends a scan, returning true if fragmentation should be checked now.
+// The caller must call EndCheck once it has checked, and compacted if need be.
+func (v *VacuumTracker) EndScan() bool {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.activeScans--
+	if !v.deferred || v.threshold <= 0 {
+		return false
+	}
+	return v.startCheck()
+}
+
+// EndCheck lets scans start again after a check.
+func (v *VacuumTracker) EndCheck() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.checking = false
+	v.cond().Broadcast()
+}
+
+// startCheck starts a check, or defers it if scans or another check are running.
+// Expects mtx to be locked.
+func (v *VacuumTracker) startCheck() bool {
+	if v.activeScans > 0 || v.checking {
+		v.deferred = true
+		return false
+	}
+	v.deferred = false
+	v.checking = true
+	return true
+}
+
+// cond returns the condition variable scans wait on. Expects mtx to be locked.
+func (v *VacuumTracker) cond() *sync.Cond {
+	if v.done == nil {
+		v.done = sync.NewCond(&v.mtx)
+	}
+	return v.done
+}
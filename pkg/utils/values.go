@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Tables store between 1 and MAX_NUM_VALUES int64 values per entry, fixed when the
+// table is created. The bound keeps a dozen or so entries in each page.
+const MAX_NUM_VALUES int64 = 32
+
+// CheckNumValues returns an error if a table can't store numValues values per entry.
+func CheckNumValues(numValues int64) error {
+	if numValues < 1 || numValues > MAX_NUM_VALUES {
+		return fmt.Errorf("tables store between 1 and %v values per entry, not %v", MAX_NUM_VALUES, numValues)
+	}
+	return nil
+}
+
+// CheckValues returns an error if values can't be written to a table storing
+// numValues values per entry.
+func CheckValues(values []int64, numValues int64) error {
+	if len(values) == 0 {
+		return errors.New("no values given")
+	}
+	if int64(len(values)) > numValues {
+		return fmt.Errorf("table stores %v values per entry, got %v", numValues, len(values))
+	}
+	return nil
+}